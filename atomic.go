@@ -0,0 +1,96 @@
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// stageDest creates a copy of dest next to it that the changes are applied
+// to. Directories are created again, all other entries are linked to the
+// ones in dest. The disk writer replaces modified files instead of writing
+// to them, so the linked files in dest are never changed.
+func stageDest(dest string) (string, error) {
+	staging := filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".staging."+nextSuffix())
+
+	type dir struct {
+		path string
+		stat *Stat
+	}
+	var dirs []dir
+	err := filepath.Walk(dest, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dest, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(staging, rel)
+		if !fi.IsDir() {
+			if err := os.Link(path, target); err != nil {
+				return errors.Wrapf(err, "failed to link %s", path)
+			}
+			return nil
+		}
+		if err := os.Mkdir(target, 0700); err != nil {
+			return errors.Wrapf(err, "failed to create dir %s", target)
+		}
+		stat := &Stat{Path: rel, Mode: uint32(fi.Mode()), ModTime: fi.ModTime().UnixNano()}
+		setUnixOpt(fi, stat, rel, nil)
+		if err := loadXattr(path, stat); err != nil {
+			return err
+		}
+		dirs = append(dirs, dir{path: target, stat: stat})
+		return nil
+	})
+	if err == nil {
+		// parents are updated after their children changed their times
+		for i := len(dirs) - 1; i >= 0; i-- {
+			if err = rewriteMetadata(dirs[i].path, dirs[i].stat, nil); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		os.RemoveAll(staging)
+		return "", errors.Wrapf(err, "failed to stage %s", dest)
+	}
+	return staging, nil
+}
+
+// swapDestRename exchanges the staging directory and the destination with
+// two renames. dest is missing for a moment in between.
+func swapDestRename(staging, dest string) error {
+	old := staging + ".old"
+	if err := os.Rename(dest, old); err != nil {
+		return errors.Wrapf(err, "failed to move %s", dest)
+	}
+	if err := os.Rename(staging, dest); err != nil {
+		os.Rename(old, dest)
+		return errors.Wrapf(err, "failed to move %s to %s", staging, dest)
+	}
+	return errors.Wrapf(os.Rename(old, staging), "failed to move %s", old)
+}
+
+// runAtomic applies the changes to a staging copy of the destination and
+// replaces the destination with it if the transfer succeeds.
+func (rs *ReceiveSession) runAtomic(ctx context.Context) error {
+	staging, err := stageDest(rs.dest)
+	if err != nil {
+		return abortReceive(rs.conns, err)
+	}
+	rs.r.dest = staging
+	if err := rs.r.run(ctx); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+	if err := swapDest(staging, rs.dest); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+	// staging has the previous contents of the destination now
+	return errors.Wrapf(os.RemoveAll(staging), "failed to remove previous %s", rs.dest)
+}
@@ -0,0 +1,17 @@
+package fsutil
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// swapDest exchanges the staging directory and the destination. Readers of
+// dest see either the previous or the new tree.
+func swapDest(staging, dest string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, staging, unix.AT_FDCWD, dest, unix.RENAME_EXCHANGE)
+	if err == unix.EINVAL || err == unix.ENOSYS {
+		// the filesystem or kernel doesn't support exchanging
+		return swapDestRename(staging, dest)
+	}
+	return errors.Wrapf(err, "failed to exchange %s and %s", staging, dest)
+}
@@ -0,0 +1,8 @@
+// +build !linux
+
+package fsutil
+
+// swapDest exchanges the staging directory and the destination.
+func swapDest(staging, dest string) error {
+	return swapDestRename(staging, dest)
+}
@@ -0,0 +1,271 @@
+package fsutil
+
+import (
+	"container/list"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ContentCache records the regular files written by a DiskWriter. When a
+// later change modifies a file whose incoming stat and current state at the
+// destination match its entry, the existing contents are kept and only the
+// metadata is updated instead of requesting the data again. This makes
+// repeated receives cheap on filesystems that can't store modification times
+// with full precision, where unchanged files are otherwise detected as
+// modified.
+type ContentCache interface {
+	// Get returns the entry recorded for the path p.
+	Get(p string) (*ContentCacheEntry, bool)
+	// Set records the entry for p after its contents were written.
+	Set(p string, e *ContentCacheEntry)
+}
+
+// ContentCacheEntry describes the contents of a file at the destination.
+type ContentCacheEntry struct {
+	// Stat is the stat the contents were received with.
+	Stat *Stat
+	// Size and ModTime are the size and modification time in nanoseconds of
+	// the file at the destination after it was written.
+	Size    int64
+	ModTime int64
+	// Digest is the hash of the file passed to NotifyHashed. It is empty if
+	// the file was not hashed.
+	Digest string
+}
+
+// current reports whether a file at the destination described by fi still
+// has the contents recorded in the entry and stat describes the same
+// contents.
+func (e *ContentCacheEntry) current(fi os.FileInfo, stat *Stat) bool {
+	if e.Stat == nil {
+		return false
+	}
+	return e.Stat.Mode == stat.Mode && e.Stat.Size_ == stat.Size_ && e.Stat.ModTime == stat.ModTime &&
+		fi.Size() == e.Size && fi.ModTime().UnixNano() == e.ModTime
+}
+
+// ContentCachePinner is implemented by content caches that evict entries. A
+// DiskWriter pins the entries it uses until Wait returns, so they are not
+// evicted while the transfer is running.
+type ContentCachePinner interface {
+	// Pin keeps the entry for p, also one recorded later, from being evicted
+	// until release is called.
+	Pin(p string) (release func())
+}
+
+// ContentCacheOpt limits the entries kept by a MemContentCache. The limits
+// are applied when entries are recorded or released and by Prune. Pinned
+// entries are never evicted.
+type ContentCacheOpt struct {
+	// MaxSize is the total size of the recorded files above which the least
+	// recently used entries are evicted. Zero means no limit.
+	MaxSize int64
+	// MaxAge evicts the entries that were not used for longer. Zero means no
+	// limit.
+	MaxAge time.Duration
+}
+
+// MemContentCache is a ContentCache keeping its entries in memory. Long
+// running receivers bound it with ContentCacheOpt. The entries used by a
+// DiskWriter are pinned so they are not evicted in between.
+type MemContentCache struct {
+	opt ContentCacheOpt
+	now func() time.Time
+
+	mu sync.Mutex
+	m  map[string]*list.Element
+	// lru holds the *cacheItems with the most recently used one in front
+	lru  *list.List
+	size int64
+	pins map[string]int
+}
+
+type cacheItem struct {
+	p    string
+	e    *ContentCacheEntry
+	used time.Time
+}
+
+// NewContentCache returns an empty MemContentCache.
+func NewContentCache(opt ContentCacheOpt) *MemContentCache {
+	return &MemContentCache{
+		opt:  opt,
+		now:  time.Now,
+		m:    make(map[string]*list.Element),
+		lru:  list.New(),
+		pins: make(map[string]int),
+	}
+}
+
+// Get returns the entry recorded for the path p.
+func (c *MemContentCache) Get(p string) (*ContentCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.m[p]
+	if !ok {
+		return nil, false
+	}
+	item := el.Value.(*cacheItem)
+	now := c.now()
+	if c.expired(item, now) && c.pins[p] == 0 {
+		c.remove(el)
+		return nil, false
+	}
+	item.used = now
+	c.lru.MoveToFront(el)
+	return item.e, true
+}
+
+// Set records the entry for p after its contents were written.
+func (c *MemContentCache) Set(p string, e *ContentCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.m[p]; ok {
+		c.remove(el)
+	}
+	c.m[p] = c.lru.PushFront(&cacheItem{p: p, e: e, used: c.now()})
+	c.size += e.Size
+	c.evict()
+}
+
+// Pin keeps the entry for p, also one recorded later, from being evicted
+// until release is called.
+func (c *MemContentCache) Pin(p string) (release func()) {
+	c.mu.Lock()
+	c.pins[p]++
+	c.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.pins[p]--; c.pins[p] == 0 {
+				delete(c.pins, p)
+			}
+			c.evict()
+		})
+	}
+}
+
+// Prune evicts the entries exceeding the limits and returns their number.
+// Caches with MaxAge should be pruned periodically, as expired entries are
+// otherwise only evicted when other entries are recorded.
+func (c *MemContentCache) Prune() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.evict()
+}
+
+// Len returns the number of entries and their total size.
+func (c *MemContentCache) Len() (int, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.m), c.size
+}
+
+func (c *MemContentCache) expired(item *cacheItem, now time.Time) bool {
+	return c.opt.MaxAge > 0 && now.Sub(item.used) > c.opt.MaxAge
+}
+
+// evict removes the least recently used entries that are expired or exceed
+// the size limit. c.mu needs to be held.
+func (c *MemContentCache) evict() int {
+	now := c.now()
+	n := 0
+	for el := c.lru.Back(); el != nil; {
+		prev := el.Prev()
+		item := el.Value.(*cacheItem)
+		over := c.opt.MaxSize > 0 && c.size > c.opt.MaxSize
+		if !over && !c.expired(item, now) {
+			// the entries in front were used more recently
+			break
+		}
+		if c.pins[item.p] == 0 {
+			c.remove(el)
+			n++
+		}
+		el = prev
+	}
+	return n
+}
+
+func (c *MemContentCache) remove(el *list.Element) {
+	item := c.lru.Remove(el).(*cacheItem)
+	delete(c.m, item.p)
+	c.size -= item.e.Size
+}
+
+// cacheContents records the contents written to the file at dest.
+func (dw *DiskWriter) cacheContents(p, dest string, stat *Stat, digest string) error {
+	fi, err := os.Lstat(dest)
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat %s", dest)
+	}
+	st := *stat
+	dw.pinContents(p)
+	dw.opt.ContentCache.Set(p, &ContentCacheEntry{
+		Stat:    &st,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().UnixNano(),
+		Digest:  digest,
+	})
+	return nil
+}
+
+// keepContents updates the metadata of a file whose contents are current
+// according to the content cache.
+func (dw *DiskWriter) keepContents(kind ChangeKind, p, dest string, stat *Stat, e *ContentCacheEntry) error {
+	if dw.metrics != nil {
+		dw.metrics.FileCached(p, stat.Size_)
+	}
+	if err := rewriteMetadata(dest, stat, dw.opt.Chown); err != nil {
+		return errors.Wrapf(err, "error setting metadata for %s", dest)
+	}
+	if dw.notifyHashed == nil {
+		return dw.cacheContents(p, dest, stat, "")
+	}
+	hw := newHashWriter(&StatInfo{stat}, nil, dw.opt.HashAlgorithm)
+	if e.Digest != "" && e.Stat.Equal(stat) {
+		hw.sum = e.Digest
+	} else {
+		// the digest also covers the metadata, so it is computed again
+		if err := hw.hashPrefix(dest, stat.Size_); err != nil {
+			return err
+		}
+		hw.Close()
+	}
+	if err := dw.cacheContents(p, dest, stat, hw.Hash()); err != nil {
+		return err
+	}
+	return dw.notifyHashed(kind, p, hw, nil)
+}
+
+// pinContents pins the content cache entry for p until Wait returns.
+func (dw *DiskWriter) pinContents(p string) {
+	pinner, ok := dw.opt.ContentCache.(ContentCachePinner)
+	if !ok {
+		return
+	}
+	dw.pinMu.Lock()
+	defer dw.pinMu.Unlock()
+	if _, ok := dw.pins[p]; ok {
+		return
+	}
+	if dw.pins == nil {
+		dw.pins = make(map[string]func())
+	}
+	dw.pins[p] = pinner.Pin(p)
+}
+
+func (dw *DiskWriter) releasePins() {
+	dw.pinMu.Lock()
+	pins := dw.pins
+	dw.pins = nil
+	dw.pinMu.Unlock()
+	for _, release := range pins {
+		release()
+	}
+}
@@ -0,0 +1,84 @@
+package fsutil
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentCacheGC(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := NewContentCache(ContentCacheOpt{MaxSize: 10, MaxAge: time.Minute})
+	c.now = func() time.Time { return now }
+	entry := func(size int64) *ContentCacheEntry {
+		return &ContentCacheEntry{Stat: &Stat{Size_: size}, Size: size}
+	}
+	has := func(p string) bool {
+		_, ok := c.Get(p)
+		return ok
+	}
+
+	c.Set("a", entry(4))
+	c.Set("b", entry(4))
+	// using a makes b the least recently used entry
+	assert.True(t, has("a"))
+	c.Set("c", entry(4))
+	assert.False(t, has("b"))
+	assert.True(t, has("a"))
+	assert.True(t, has("c"))
+	n, size := c.Len()
+	assert.Equal(t, 2, n)
+	assert.Equal(t, int64(8), size)
+
+	// pinned entries are kept over the size limit until they are released
+	release := c.Pin("a")
+	c.Set("d", entry(4))
+	assert.False(t, has("c"))
+	c.Set("e", entry(4))
+	assert.False(t, has("d"))
+	assert.True(t, has("a"))
+	release()
+	c.Set("f", entry(8))
+	assert.False(t, has("a"))
+	assert.False(t, has("e"))
+	n, size = c.Len()
+	assert.Equal(t, 1, n)
+	assert.Equal(t, int64(8), size)
+
+	// expired entries are evicted unless they are pinned
+	release = c.Pin("f")
+	c.Set("g", entry(1))
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, 1, c.Prune())
+	assert.True(t, has("f"))
+	assert.False(t, has("g"))
+	release()
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, 1, c.Prune())
+	n, size = c.Len()
+	assert.Equal(t, 0, n)
+	assert.Equal(t, int64(0), size)
+}
+
+func TestDiskWriterPinsContentCache(t *testing.T) {
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	c := NewContentCache(ContentCacheOpt{MaxSize: 5})
+	dw := NewDiskWriter(dest, DiskWriterOpt{ContentCache: c})
+	for _, p := range []string{"a", "b"} {
+		fi := &readerFileInfo{StatInfo: &StatInfo{&Stat{Path: p, Mode: 0644, Size_: 5}}, r: strings.NewReader("data1")}
+		assert.NoError(t, dw.HandleChange(ChangeKindAdd, p, fi, nil))
+	}
+	// both files are kept while the writer uses them
+	n, _ := c.Len()
+	assert.Equal(t, 2, n)
+	assert.NoError(t, dw.Wait())
+	n, _ = c.Len()
+	assert.Equal(t, 1, n)
+}
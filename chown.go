@@ -0,0 +1,69 @@
+package fsutil
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ChownAction defines how the owner of a created entry is chosen.
+type ChownAction int
+
+const (
+	// ChownPreserve keeps the uid and gid of the received stat.
+	ChownPreserve ChownAction = iota
+	// ChownFixed gives all entries the owner Uid and Gid, for example the
+	// user running a rootless build.
+	ChownFixed
+	// ChownRemap maps the uid and gid of the received stat through UIDMaps
+	// and GIDMaps like a user namespace does. Ids that are not mapped fail
+	// the transfer.
+	ChownRemap
+)
+
+// ChownOpt is the ownership policy of a DiskWriter.
+type ChownOpt struct {
+	Action   ChownAction
+	Uid, Gid int
+	UIDMaps  []IDMap
+	GIDMaps  []IDMap
+}
+
+// IDMap maps the Size ids starting at ContainerID to the ids starting at
+// HostID.
+type IDMap struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// owner returns the uid and gid an entry with stat is created with.
+func (o *ChownOpt) owner(stat *Stat) (int, int, error) {
+	if o == nil {
+		return int(stat.Uid), int(stat.Gid), nil
+	}
+	switch o.Action {
+	case ChownPreserve:
+		return int(stat.Uid), int(stat.Gid), nil
+	case ChownFixed:
+		return o.Uid, o.Gid, nil
+	case ChownRemap:
+		uid, err := mapID(int(stat.Uid), o.UIDMaps)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "failed to remap uid of %s", stat.Path)
+		}
+		gid, err := mapID(int(stat.Gid), o.GIDMaps)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "failed to remap gid of %s", stat.Path)
+		}
+		return uid, gid, nil
+	}
+	return 0, 0, errors.Errorf("invalid chown action %d", o.Action)
+}
+
+func mapID(id int, maps []IDMap) (int, error) {
+	for _, m := range maps {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + id - m.ContainerID, nil
+		}
+	}
+	return 0, errors.Errorf("id %d is not mapped", id)
+}
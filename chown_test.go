@@ -0,0 +1,33 @@
+package fsutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChownOwner(t *testing.T) {
+	stat := &Stat{Path: "foo", Uid: 1000, Gid: 50}
+
+	var opt *ChownOpt
+	uid, gid, err := opt.owner(stat)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1000, 50}, []int{uid, gid})
+
+	opt = &ChownOpt{Action: ChownFixed, Uid: 1, Gid: 2}
+	uid, gid, err = opt.owner(stat)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, []int{uid, gid})
+
+	opt = &ChownOpt{
+		Action:  ChownRemap,
+		UIDMaps: []IDMap{{ContainerID: 0, HostID: 100000, Size: 1000}, {ContainerID: 1000, HostID: 5000, Size: 1}},
+		GIDMaps: []IDMap{{ContainerID: 0, HostID: 200000, Size: 65536}},
+	}
+	uid, gid, err = opt.owner(stat)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{5000, 200050}, []int{uid, gid})
+
+	_, _, err = opt.owner(&Stat{Path: "bar", Uid: 1001})
+	assert.EqualError(t, err, "failed to remap uid of bar: id 1001 is not mapped")
+}
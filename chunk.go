@@ -0,0 +1,276 @@
+package fsutil
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultChunkSize is the size of the chunks if ChunkOpt.Size is not set.
+	DefaultChunkSize = 4 << 20
+	// DefaultChunkConcurrency is the number of chunks of a file requested at
+	// the same time if ChunkOpt.Concurrency is not set.
+	DefaultChunkConcurrency = 4
+)
+
+// ChunkOpt defines how a receiver splits the contents of large files into
+// chunks that are requested separately. Several chunks of a file are in
+// flight at the same time and are written to the file in order once they
+// arrived, so up to Size*Concurrency bytes are buffered per file. Holes of
+// sparse files are transferred as data in chunks. The sender must support
+// chunks.
+type ChunkOpt struct {
+	// Size is the size of the chunks. Files not larger than it are requested
+	// as a whole.
+	Size int64
+	// Concurrency is the number of chunks of a file requested at the same
+	// time.
+	Concurrency int
+	// Retries is the number of times a chunk that arrived incomplete or,
+	// with ReceiveOpt.VerifyChecksums, failed verification is requested
+	// again. Once they are exhausted the file fails, and ReceiveOpt.Retries
+	// applies to it as a whole.
+	Retries int
+}
+
+func (o *ChunkOpt) size() int64 {
+	if o.Size > 0 {
+		return o.Size
+	}
+	return DefaultChunkSize
+}
+
+func (o *ChunkOpt) concurrency() int {
+	if o.Concurrency > 0 {
+		return o.Concurrency
+	}
+	return DefaultChunkConcurrency
+}
+
+// chunk is a part of a file requested separately. The fields other than done
+// and err are only accessed by the receiving loop until done is closed.
+type chunk struct {
+	offset int64
+	length int64
+	buf    []byte
+	// n is the number of bytes received
+	n int64
+	// checksum is the digest the sender sent for the chunk
+	checksum string
+	tries    int
+	done     chan struct{}
+	err      error
+}
+
+func newChunk(offset, length int64) *chunk {
+	return &chunk{
+		offset: offset,
+		length: length,
+		buf:    make([]byte, length),
+		done:   make(chan struct{}),
+	}
+}
+
+func (c *chunk) finish(err error) {
+	c.err = err
+	close(c.done)
+}
+
+// requestChunks fetches the contents of the file at p from offset to size in
+// chunks and writes them to wc in order.
+func (s *peer) requestChunks(p string, id uint32, offset, size int64, wc io.WriteCloser) (retErr error) {
+	opt := s.r.chunks
+	var pending []*chunk
+	defer func() {
+		if retErr != nil {
+			// replies to the other requests need to arrive before the file
+			// can be requested again
+			for _, c := range pending {
+				<-c.done
+			}
+		}
+	}()
+	next := offset
+	for next < size || len(pending) > 0 {
+		for len(pending) < opt.concurrency() && next < size {
+			length := opt.size()
+			if size-next < length {
+				length = size - next
+			}
+			c := newChunk(next, length)
+			if err := s.requestChunk(id, c); err != nil {
+				return err
+			}
+			pending = append(pending, c)
+			next += length
+		}
+
+		c := pending[0]
+		<-c.done
+		err := c.err
+		if err == nil {
+			err = s.checkChunk(p, c)
+		}
+		if err != nil {
+			if !retryChunk(err) || c.tries >= opt.Retries {
+				pending = pending[1:]
+				return err
+			}
+			atomic.AddInt64(&s.r.stats.retries, 1)
+			retry := newChunk(c.offset, c.length)
+			retry.tries = c.tries + 1
+			pending[0] = retry
+			if err := s.requestChunk(id, retry); err != nil {
+				pending = pending[1:]
+				return err
+			}
+			continue
+		}
+		pending = pending[1:]
+		if _, err := wc.Write(c.buf); err != nil {
+			return err
+		}
+	}
+	return wc.Close()
+}
+
+func (s *peer) requestChunk(id uint32, c *chunk) error {
+	s.muPipes.Lock()
+	if s.chunks[id] == nil {
+		s.chunks[id] = make(map[int64]*chunk)
+	}
+	s.chunks[id][c.offset] = c
+	s.muPipes.Unlock()
+	req := &Packet{Type: PACKET_REQ, ID: id, Offset: c.offset, Length: c.length, Compression: s.r.compression, Verify: s.r.verify}
+	if err := s.conn.SendMsg(req); err != nil {
+		s.dropChunk(id, c)
+		return err
+	}
+	return nil
+}
+
+func (s *peer) dropChunk(id uint32, c *chunk) {
+	s.muPipes.Lock()
+	defer s.muPipes.Unlock()
+	if s.chunks[id][c.offset] != c {
+		return
+	}
+	delete(s.chunks[id], c.offset)
+	if len(s.chunks[id]) == 0 {
+		delete(s.chunks, id)
+	}
+}
+
+// checkChunk verifies that a chunk is complete and matches its checksum.
+func (s *peer) checkChunk(p string, c *chunk) error {
+	if c.n != c.length {
+		return errors.WithStack(&incompleteChunkError{path: p, offset: c.offset, length: c.length, n: c.n})
+	}
+	if !s.r.verify {
+		return nil
+	}
+	if c.checksum == "" {
+		return errors.Errorf("sender did not send a checksum for the chunk at %d of %s", c.offset, p)
+	}
+	dgst := sha256.Sum256(c.buf)
+	if actual := "sha256:" + hex.EncodeToString(dgst[:]); actual != c.checksum {
+		return errors.WithStack(&ChecksumError{Path: p, Expected: c.checksum, Actual: actual})
+	}
+	return nil
+}
+
+type incompleteChunkError struct {
+	path   string
+	offset int64
+	length int64
+	n      int64
+}
+
+func (e *incompleteChunkError) Error() string {
+	return fmt.Sprintf("received %d of %d bytes of the chunk at %d of %s", e.n, e.length, e.offset, e.path)
+}
+
+func retryChunk(err error) bool {
+	switch errors.Cause(err).(type) {
+	case *ChecksumError, *incompleteChunkError:
+		return true
+	}
+	return false
+}
+
+// chunkData handles a PACKET_DATA for a chunk. It returns false if the file
+// is not requested in chunks.
+func (s *peer) chunkData(ctx context.Context, p *Packet) (bool, error) {
+	s.muPipes.Lock()
+	chunks, ok := s.chunks[p.ID]
+	var c *chunk
+	end := len(p.Data) == 0 && p.Length > 0
+	for _, ch := range chunks {
+		if end && ch.offset == p.Offset && ch.length == p.Length || !end && p.Offset >= ch.offset && p.Offset < ch.offset+ch.length {
+			c = ch
+			break
+		}
+	}
+	if c != nil && end {
+		delete(chunks, c.offset)
+		if len(chunks) == 0 {
+			delete(s.chunks, p.ID)
+		}
+	}
+	s.muPipes.Unlock()
+	if !ok {
+		return false, nil
+	}
+	if c == nil {
+		return true, errors.Errorf("invalid chunk at %d of file %d", p.Offset, p.ID)
+	}
+	if end {
+		c.checksum = p.Checksum
+		c.finish(nil)
+		return true, nil
+	}
+	if s.r.rateLimit != nil {
+		if err := s.r.rateLimit.WaitBytes(ctx, len(p.Data)); err != nil {
+			return true, err
+		}
+	}
+	dt := p.Data
+	if p.Compression != COMPRESSION_NONE {
+		var err error
+		if dt, err = decompressData(p.Compression, dt); err != nil {
+			return true, err
+		}
+	}
+	pos := p.Offset - c.offset
+	if pos+int64(len(dt)) > c.length {
+		return true, errors.Errorf("data at %d exceeds the chunk at %d of file %d", p.Offset, c.offset, p.ID)
+	}
+	copy(c.buf[pos:], dt)
+	c.n += int64(len(dt))
+	return true, nil
+}
+
+// failChunks ends the chunks requested for a file with err. If id is nil
+// the chunks of all files are failed.
+func (s *peer) failChunks(id *uint32, err error) bool {
+	s.muPipes.Lock()
+	defer s.muPipes.Unlock()
+	failed := false
+	for i, chunks := range s.chunks {
+		if id != nil && *id != i {
+			continue
+		}
+		for _, c := range chunks {
+			c.finish(err)
+		}
+		delete(s.chunks, i)
+		failed = true
+	}
+	return failed
+}
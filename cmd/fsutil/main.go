@@ -0,0 +1,236 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil"
+	"github.com/tonistiigi/fsutil/util"
+	"golang.org/x/net/context"
+)
+
+const usage = `usage: fsutil COMMAND [OPTIONS] ARGS
+
+Commands:
+  walk DIR       list the entries of DIR
+  diff A B       list the changes from directory A to directory B
+  hash DIR       print the tree digest of DIR
+  send DIR       send DIR to a receiver
+  receive DIR    receive into DIR from a sender
+
+send and receive speak over stdin and stdout unless -addr or -listen is set.
+Run fsutil COMMAND -h for the options of a command.
+`
+
+type command func(ctx context.Context, args []string) error
+
+var commands = map[string]command{
+	"walk":    walk,
+	"diff":    diff,
+	"hash":    hash,
+	"send":    send,
+	"receive": receive,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "fsutil: unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	if err := cmd(ctx, os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "fsutil %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// patterns is a flag that can be repeated.
+type patterns []string
+
+func (p *patterns) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patterns) Set(s string) error {
+	*p = append(*p, s)
+	return nil
+}
+
+// parse parses the flags of a command and returns its n arguments.
+func parse(fs *flag.FlagSet, args []string, n int, names string) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != n {
+		return nil, errors.Errorf("expected arguments %s", names)
+	}
+	return fs.Args(), nil
+}
+
+func walkOpt(includes, excludes patterns) *fsutil.WalkOpt {
+	if len(includes) == 0 && len(excludes) == 0 {
+		return nil
+	}
+	return &fsutil.WalkOpt{IncludePatterns: includes, ExcludePatterns: excludes}
+}
+
+func walk(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("walk", flag.ExitOnError)
+	var includes, excludes patterns
+	fs.Var(&includes, "include", "only walk the entries matching `PATTERN`, can be repeated")
+	fs.Var(&excludes, "exclude", "skip the entries matching `PATTERN`, can be repeated")
+	args, err := parse(fs, args, 1, "DIR")
+	if err != nil {
+		return err
+	}
+	return fsutil.Walk(ctx, args[0], walkOpt(includes, excludes), func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		stat := fi.Sys().(*fsutil.Stat)
+		line := fmt.Sprintf("%s %d:%d %10d %s", fi.Mode(), stat.Uid, stat.Gid, fi.Size(), p)
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			line += " -> " + stat.Linkname
+		case stat.Linkname != "":
+			line += " link to " + stat.Linkname
+		}
+		fmt.Println(line)
+		return nil
+	})
+}
+
+func diff(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	args, err := parse(fs, args, 2, "A B")
+	if err != nil {
+		return err
+	}
+	kinds := map[fsutil.ChangeKind]string{
+		fsutil.ChangeKindAdd:    "A",
+		fsutil.ChangeKindModify: "M",
+		fsutil.ChangeKindDelete: "D",
+	}
+	return fsutil.Changes(ctx, args[0], args[1], func(kind fsutil.ChangeKind, p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s %s\n", kinds[kind], p)
+		return nil
+	})
+}
+
+func hash(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("hash", flag.ExitOnError)
+	var includes, excludes patterns
+	fs.Var(&includes, "include", "only hash the entries matching `PATTERN`, can be repeated")
+	fs.Var(&excludes, "exclude", "skip the entries matching `PATTERN`, can be repeated")
+	args, err := parse(fs, args, 1, "DIR")
+	if err != nil {
+		return err
+	}
+	dgst, err := fsutil.TreeDigest(ctx, args[0], walkOpt(includes, excludes))
+	if err != nil {
+		return err
+	}
+	fmt.Println(dgst)
+	return nil
+}
+
+func send(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	addr := fs.String("addr", "", "connect to the receiver at TCP `ADDRESS`")
+	listen := fs.String("listen", "", "wait for the receiver on TCP `ADDRESS`")
+	compress := fs.Bool("compress", false, "allow the receiver to ask for compressed data")
+	var includes, excludes patterns
+	fs.Var(&includes, "include", "only send the entries matching `PATTERN`, can be repeated")
+	fs.Var(&excludes, "exclude", "skip the entries matching `PATTERN`, can be repeated")
+	args, err := parse(fs, args, 1, "DIR")
+	if err != nil {
+		return err
+	}
+	opt := fsutil.SendOpt{WalkOpt: walkOpt(includes, excludes)}
+	if *compress {
+		opt.Compression = &fsutil.CompressionOpt{}
+	}
+	conn, closeConn, err := connect(*addr, *listen)
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+	return fsutil.Send(ctx, conn, args[0], opt)
+}
+
+func receive(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("receive", flag.ExitOnError)
+	addr := fs.String("addr", "", "connect to the sender at TCP `ADDRESS`")
+	listen := fs.String("listen", "", "wait for the sender on TCP `ADDRESS`")
+	create := fs.Bool("create", false, "create the destination if it doesn't exist")
+	compress := fs.Bool("compress", false, "ask for gzip compressed data")
+	verify := fs.Bool("verify", false, "verify the checksums of the received files")
+	args, err := parse(fs, args, 1, "DIR")
+	if err != nil {
+		return err
+	}
+	opt := fsutil.ReceiveOpt{VerifyChecksums: *verify}
+	if *create {
+		opt.CreateDest = &fsutil.CreateDestOpt{}
+	}
+	if *compress {
+		opt.Compression = fsutil.COMPRESSION_GZIP
+	}
+	conn, closeConn, err := connect(*addr, *listen)
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+	return fsutil.Receive(ctx, conn, args[0], opt)
+}
+
+// connect returns the stream to the peer, over TCP if addr or listen is set
+// and over stdin and stdout otherwise.
+func connect(addr, listen string) (fsutil.Stream, func() error, error) {
+	var conn net.Conn
+	switch {
+	case addr != "" && listen != "":
+		return nil, nil, errors.New("only one of -addr and -listen can be set")
+	case addr != "":
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to connect to %s", addr)
+		}
+		conn = c
+	case listen != "":
+		l, err := net.Listen("tcp", listen)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to listen on %s", listen)
+		}
+		c, err := l.Accept()
+		l.Close()
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to accept a connection on %s", listen)
+		}
+		conn = c
+	default:
+		return util.NewProtoStream(os.Stdin, os.Stdout), func() error { return nil }, nil
+	}
+	return util.NewProtoStream(conn, conn), conn.Close, nil
+}
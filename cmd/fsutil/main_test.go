@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonistiigi/fsutil"
+	"github.com/tonistiigi/fsutil/fstest"
+	"golang.org/x/net/context"
+)
+
+// TestMain runs the command instead of the tests when the test binary is
+// started by fsutilCmd.
+func TestMain(m *testing.M) {
+	if os.Getenv("FSUTIL_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// fsutilCmd returns the command running fsutil with args.
+func fsutilCmd(args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "FSUTIL_TEST_MAIN=1")
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// run runs fsutil with args and returns its output.
+func run(t *testing.T, args ...string) string {
+	out, err := fsutilCmd(args...).Output()
+	assert.NoError(t, err, strings.Join(args, " "))
+	return string(out)
+}
+
+func TestCommands(t *testing.T) {
+	a, err := fstest.TmpDir(fstest.ChangeStream([]string{
+		"ADD bar dir",
+		"ADD bar/baz file data1",
+		"ADD foo file data2",
+		"ADD qux symlink foo",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(a)
+
+	b, err := fstest.TmpDir(fstest.ChangeStream([]string{
+		"ADD bar dir",
+		"ADD bar/baz file data1",
+		"ADD foo file data22",
+		"ADD zzz file",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(b)
+
+	// diff compares modification times, so the same entries in both trees
+	// need to have the same ones
+	tm := time.Unix(1500000000, 0)
+	for _, d := range []string{a, b} {
+		err := filepath.Walk(d, func(p string, fi os.FileInfo, err error) error {
+			if err != nil || fi.Mode()&os.ModeSymlink != 0 {
+				return err
+			}
+			return os.Chtimes(p, tm, tm)
+		})
+		assert.NoError(t, err)
+	}
+
+	var paths []string
+	for _, l := range strings.Split(strings.TrimSpace(run(t, "walk", a)), "\n") {
+		fields := strings.Fields(l)
+		if assert.True(t, len(fields) >= 4, l) {
+			paths = append(paths, strings.Join(fields[3:], " "))
+		}
+	}
+	assert.Equal(t, []string{"bar", "bar/baz", "foo", "qux -> foo"}, paths)
+
+	assert.Equal(t, "M foo\nD qux\nA zzz\n", run(t, "diff", a, b))
+
+	dgst, err := fsutil.TreeDigest(context.Background(), a, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, dgst+"\n", run(t, "hash", a))
+	assert.NotEqual(t, dgst+"\n", run(t, "hash", b))
+
+	cmd := fsutilCmd("foo")
+	cmd.Stderr = nil
+	assert.Error(t, cmd.Run())
+}
+
+func TestSendReceive(t *testing.T) {
+	src, err := fstest.TmpDir(fstest.ChangeStream([]string{
+		"ADD bar dir",
+		"ADD bar/baz file data1",
+		"ADD foo file data2",
+		"ADD qux symlink foo",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(src)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	// the sender and the receiver talk over their stdin and stdout
+	r1, w1, err := os.Pipe()
+	assert.NoError(t, err)
+	r2, w2, err := os.Pipe()
+	assert.NoError(t, err)
+	send := fsutilCmd("send", src)
+	send.Stdin, send.Stdout = r2, w1
+	receive := fsutilCmd("receive", "-create", "-compress", "-verify", filepath.Join(dest, "out"))
+	receive.Stdin, receive.Stdout = r1, w2
+
+	assert.NoError(t, send.Start())
+	assert.NoError(t, receive.Start())
+	for _, f := range []*os.File{r1, w1, r2, w2} {
+		f.Close()
+	}
+	assert.NoError(t, receive.Wait())
+	assert.NoError(t, send.Wait())
+
+	assert.Equal(t, run(t, "hash", src), run(t, "hash", filepath.Join(dest, "out")))
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "out/bar/baz"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data1", string(dt))
+}
@@ -17,7 +17,7 @@ func main() {
 
 	s := util.NewProtoStream(os.Stdin, os.Stdout)
 
-	if err := fsutil.Send(context.Background(), s, flag.Args()[0], nil, nil); err != nil {
+	if err := fsutil.Send(context.Background(), s, flag.Args()[0], fsutil.SendOpt{}); err != nil {
 		panic(err)
 	}
 }
@@ -0,0 +1,139 @@
+package fsutil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// DefaultCompressionMinSize is the size below which file data is sent
+// uncompressed if CompressionOpt.MinSize is not set.
+const DefaultCompressionMinSize = 512
+
+// maxDecompressedSize limits the size of a decompressed data packet.
+const maxDecompressedSize = 4 << 20
+
+// CompressionOpt defines how a sender compresses file data. The receiver asks
+// for an encoding with ReceiveOpt.Compression, data is only compressed if the
+// sender allows that encoding.
+type CompressionOpt struct {
+	// Allowed lists the encodings the sender agrees to use. If empty, all
+	// supported encodings are allowed.
+	Allowed []Packet_Compression
+	// MinSize is the size below which data packets are sent uncompressed.
+	MinSize int
+}
+
+func (o *CompressionOpt) allows(c Packet_Compression) bool {
+	if c == COMPRESSION_NONE {
+		return false
+	}
+	if len(o.Allowed) == 0 {
+		_, ok := Packet_Compression_name[int32(c)]
+		return ok
+	}
+	for _, a := range o.Allowed {
+		if a == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *CompressionOpt) minSize() int {
+	if o.MinSize > 0 {
+		return o.MinSize
+	}
+	return DefaultCompressionMinSize
+}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return w
+	},
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedSize))
+	})
+	return zstdErr
+}
+
+// compressData returns dt encoded with c. It returns nil if the encoded data
+// is not smaller than dt.
+func compressData(c Packet_Compression, dt []byte) ([]byte, error) {
+	var out []byte
+	switch c {
+	case COMPRESSION_GZIP:
+		var b bytes.Buffer
+		w := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(w)
+		w.Reset(&b)
+		if _, err := w.Write(dt); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		out = b.Bytes()
+	case COMPRESSION_ZSTD:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		out = zstdEncoder.EncodeAll(dt, nil)
+	default:
+		return nil, errors.Errorf("unsupported compression %s", c)
+	}
+	if len(out) >= len(dt) {
+		return nil, nil
+	}
+	return out, nil
+}
+
+// decompressData returns the data of a packet encoded with c.
+func decompressData(c Packet_Compression, dt []byte) ([]byte, error) {
+	switch c {
+	case COMPRESSION_GZIP:
+		r, err := gzip.NewReader(bytes.NewReader(dt))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decompress data")
+		}
+		out, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decompress data")
+		}
+		if len(out) > maxDecompressedSize {
+			return nil, errors.Errorf("decompressed data larger than %d bytes", maxDecompressedSize)
+		}
+		return out, nil
+	case COMPRESSION_ZSTD:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		out, err := zstdDecoder.DecodeAll(dt, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decompress data")
+		}
+		return out, nil
+	default:
+		return nil, errors.Errorf("unsupported compression %s", c)
+	}
+}
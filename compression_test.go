@@ -0,0 +1,46 @@
+package fsutil
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressData(t *testing.T) {
+	text := bytes.Repeat([]byte("lorem ipsum dolor sit amet "), 1000)
+	random := make([]byte, 4096)
+	_, err := crand.Read(random)
+	assert.NoError(t, err)
+
+	for _, c := range []Packet_Compression{COMPRESSION_GZIP, COMPRESSION_ZSTD} {
+		enc, err := compressData(c, text)
+		assert.NoError(t, err)
+		assert.True(t, len(enc) < len(text))
+		dt, err := decompressData(c, enc)
+		assert.NoError(t, err)
+		assert.Equal(t, text, dt)
+
+		enc, err = compressData(c, random)
+		assert.NoError(t, err)
+		assert.Nil(t, enc)
+	}
+
+	_, err = decompressData(COMPRESSION_GZIP, []byte("invalid"))
+	assert.Error(t, err)
+	_, err = compressData(Packet_Compression(42), text)
+	assert.Error(t, err)
+}
+
+func TestCompressionOptAllows(t *testing.T) {
+	opt := &CompressionOpt{}
+	assert.False(t, opt.allows(COMPRESSION_NONE))
+	assert.True(t, opt.allows(COMPRESSION_GZIP))
+	assert.True(t, opt.allows(COMPRESSION_ZSTD))
+	assert.False(t, opt.allows(Packet_Compression(42)))
+
+	opt = &CompressionOpt{Allowed: []Packet_Compression{COMPRESSION_GZIP}}
+	assert.True(t, opt.allows(COMPRESSION_GZIP))
+	assert.False(t, opt.allows(COMPRESSION_ZSTD))
+}
@@ -0,0 +1,150 @@
+package fsutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+)
+
+// DeletePolicy defines which entries of the destination that were not
+// received from the sender are removed.
+type DeletePolicy int
+
+const (
+	// DeleteUnmatched removes the entries that were not received, except
+	// the ones left out by ReceiveOpt.Filter or DiskWriterOpt.Filter.
+	// Directories removed at the source are removed with everything in
+	// them.
+	DeleteUnmatched DeletePolicy = iota
+	// DeleteKeepExtra never removes entries, so the received tree is
+	// applied on top of the destination.
+	DeleteKeepExtra
+	// DeleteExcluded removes all entries that were not received, including
+	// the ones left out by the filters.
+	DeleteExcluded
+)
+
+// matchOnly uses the selection of a filter without rewriting entries.
+type matchOnly struct {
+	Filter
+}
+
+func (f matchOnly) Map(path string, stat *Stat) error {
+	return nil
+}
+
+// DeleteLimit protects the destination from syncs that would remove a large
+// part of it, for example when an empty source directory is synced by
+// accident. Deletions are held back until the whole diff has been computed and
+// are only applied if they stay within the limits.
+type DeleteLimit struct {
+	// Max is the maximum number of entries that may be removed. Zero means no
+	// limit.
+	Max int
+	// Percent is the maximum share of the destination entries, between 0 and
+	// 100, that may be removed. Zero means no limit.
+	Percent int
+	// Confirm is called when a limit is exceeded. Returning nil allows the
+	// deletions to proceed. If Confirm is not set the sync fails with a
+	// *DeleteLimitError.
+	Confirm func(deletes, total int) error
+}
+
+// DeleteLimitError is returned when a sync would remove more entries than
+// allowed by DeleteLimit.
+type DeleteLimitError struct {
+	Deletes int
+	Total   int
+}
+
+func (e *DeleteLimitError) Error() string {
+	return fmt.Sprintf("sync would delete %d of %d entries in destination", e.Deletes, e.Total)
+}
+
+func (l *DeleteLimit) exceeded(deletes, total int) bool {
+	if l.Max > 0 && deletes > l.Max {
+		return true
+	}
+	if l.Percent > 0 && total > 0 && deletes*100 > l.Percent*total {
+		return true
+	}
+	return false
+}
+
+// deleteGuard sits between the diff and the writer. It counts the entries in
+// the destination and queues deletions until flush is called.
+type deleteGuard struct {
+	limit    *DeleteLimit
+	root     string
+	changeFn ChangeFunc
+	deletes  []string
+	total    int
+}
+
+func (g *deleteGuard) walkerFn(fn walkerFn) walkerFn {
+	return func(ctx context.Context, pathC chan<- *currentPath) error {
+		c := make(chan *currentPath)
+		errCh := make(chan error, 1)
+		go func() {
+			defer close(c)
+			errCh <- fn(ctx, c)
+		}()
+		for p := range c {
+			g.total++
+			select {
+			case pathC <- p:
+			case <-ctx.Done():
+				for range c {
+				}
+				return ctx.Err()
+			}
+		}
+		return <-errCh
+	}
+}
+
+func (g *deleteGuard) HandleChange(kind ChangeKind, p string, fi os.FileInfo, err error) error {
+	if err == nil && kind == ChangeKindDelete {
+		g.deletes = append(g.deletes, p)
+		return nil
+	}
+	return g.changeFn(kind, p, fi, err)
+}
+
+// flush applies the queued deletions if they are within the limits. It must
+// be called after the diff has completed.
+func (g *deleteGuard) flush() error {
+	n := 0
+	for _, p := range g.deletes {
+		n += countEntries(filepath.Join(g.root, p))
+	}
+	if g.limit.exceeded(n, g.total) {
+		if g.limit.Confirm == nil {
+			return &DeleteLimitError{Deletes: n, Total: g.total}
+		}
+		if err := g.limit.Confirm(n, g.total); err != nil {
+			return err
+		}
+	}
+	for _, p := range g.deletes {
+		if err := g.changeFn(ChangeKindDelete, p, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countEntries returns the number of entries at p, including the contents of
+// a directory.
+func countEntries(p string) int {
+	n := 0
+	filepath.Walk(p, func(path string, fi os.FileInfo, err error) error {
+		if err == nil {
+			n++
+		}
+		return nil
+	})
+	return n
+}
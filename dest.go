@@ -0,0 +1,149 @@
+package fsutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CreateDestOpt defines how a missing destination directory is created.
+type CreateDestOpt struct {
+	// Mode is the permission of the created directories. Defaults to 0755.
+	Mode os.FileMode
+	// Chown sets the owner of the created directories to Uid and Gid.
+	Chown    bool
+	Uid, Gid int
+}
+
+// DestNotExistError is returned when the destination directory doesn't exist
+// and creating it was not allowed.
+type DestNotExistError struct {
+	Path string
+}
+
+func (e *DestNotExistError) Error() string {
+	return fmt.Sprintf("destination %s does not exist", e.Path)
+}
+
+// RequireEmptyOpt makes a receive refuse to run if the destination already
+// contains entries.
+type RequireEmptyOpt struct {
+	// Allow lists patterns in filepath.Match syntax of names that may exist
+	// in the destination directory, for example "lost+found".
+	Allow []string
+}
+
+// DestNotEmptyError is returned when the destination is required to be empty
+// but contains entries.
+type DestNotEmptyError struct {
+	Path    string
+	Entries []string
+}
+
+func (e *DestNotEmptyError) Error() string {
+	return fmt.Sprintf("destination %s is not empty: %s", e.Path, strings.Join(e.Entries, ", "))
+}
+
+// DestLockedError is returned when another receive is already applying
+// changes to the destination.
+type DestLockedError struct {
+	Path string
+}
+
+func (e *DestLockedError) Error() string {
+	return fmt.Sprintf("destination %s is locked by another receive", e.Path)
+}
+
+// prepareDest validates the destination before anything is received.
+func prepareDest(dest string, opt ReceiveOpt) error {
+	fi, err := os.Stat(dest)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return errors.Wrapf(err, "failed to stat destination %s", dest)
+		}
+		if opt.CreateDest == nil {
+			return &DestNotExistError{Path: dest}
+		}
+		return createDest(dest, opt.CreateDest)
+	}
+	if !fi.IsDir() {
+		return errors.Errorf("destination %s is not a directory", dest)
+	}
+	if opt.RequireEmpty != nil {
+		return checkEmpty(dest, opt.RequireEmpty)
+	}
+	return nil
+}
+
+func checkEmpty(dest string, opt *RequireEmptyOpt) error {
+	f, err := os.Open(dest)
+	if err != nil {
+		return err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", dest)
+	}
+	var entries []string
+	for _, name := range names {
+		allowed := false
+		for _, pattern := range opt.Allow {
+			if ok, err := filepath.Match(pattern, name); err != nil {
+				return errors.Wrapf(err, "invalid pattern %q", pattern)
+			} else if ok {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			entries = append(entries, name)
+		}
+	}
+	if len(entries) > 0 {
+		sort.Strings(entries)
+		return &DestNotEmptyError{Path: dest, Entries: entries}
+	}
+	return nil
+}
+
+func createDest(dest string, opt *CreateDestOpt) error {
+	mode := opt.Mode
+	if mode == 0 {
+		mode = 0755
+	}
+
+	var missing []string
+	for p := filepath.Clean(dest); ; p = filepath.Dir(p) {
+		if _, err := os.Lstat(p); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return errors.Wrapf(err, "failed to stat %s", p)
+		}
+		missing = append(missing, p)
+		if p == filepath.Dir(p) {
+			break
+		}
+	}
+
+	for i := len(missing) - 1; i >= 0; i-- {
+		p := missing[i]
+		if err := os.Mkdir(p, mode); err != nil {
+			return errors.Wrapf(err, "failed to create %s", p)
+		}
+		// the mode passed to mkdir is subject to umask
+		if err := os.Chmod(p, mode); err != nil {
+			return errors.Wrapf(err, "failed to chmod %s", p)
+		}
+		if opt.Chown {
+			if err := os.Lchown(p, opt.Uid, opt.Gid); err != nil {
+				return errors.Wrapf(err, "failed to chown %s", p)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+// +build !windows
+
+package fsutil
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// lockDest takes an advisory lock on the destination directory. The lock is
+// taken on the directory itself because a marker file inside it would be
+// removed by the sync.
+func lockDest(dest string) (func(), error) {
+	f, err := os.Open(dest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %s for locking", dest)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		if err == unix.EWOULDBLOCK {
+			return nil, &DestLockedError{Path: dest}
+		}
+		return nil, errors.Wrapf(err, "failed to lock %s", dest)
+	}
+	return func() {
+		unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,35 @@
+// +build windows
+
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows"
+)
+
+// lockDest opens a lock file next to the destination directory without
+// sharing it, so a second receive fails to open it. The file is removed when
+// the lock is released. Directories can't be locked with LockFileEx and a
+// file inside the destination would be removed by the sync.
+func lockDest(dest string) (func(), error) {
+	dest = filepath.Clean(dest)
+	p := filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".lock")
+	name, err := windows.UTF16PtrFromString(p)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid lock path %s", p)
+	}
+	h, err := windows.CreateFile(name, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil, windows.CREATE_ALWAYS, windows.FILE_ATTRIBUTE_HIDDEN|windows.FILE_FLAG_DELETE_ON_CLOSE, 0)
+	if err != nil {
+		if err == windows.ERROR_SHARING_VIOLATION {
+			return nil, &DestLockedError{Path: dest}
+		}
+		return nil, errors.Wrapf(err, "failed to lock %s", dest)
+	}
+	f := os.NewFile(uintptr(h), p)
+	return func() {
+		f.Close()
+	}, nil
+}
@@ -8,8 +8,11 @@ import (
 
 type walkerFn func(ctx context.Context, pathC chan<- *currentPath) error
 
-func Changes(ctx context.Context, a, b walkerFn, changeFn ChangeFunc) error {
-	return nil
+// Changes walks the directories a and b and calls changeFn for every path
+// that was added, modified or deleted in b compared to a. Files are compared
+// by type, size, modification time and link target, not by content.
+func Changes(ctx context.Context, a, b string, changeFn ChangeFunc) error {
+	return doubleWalkDiff(ctx, changeFn, GetWalkerFn(a), GetWalkerFn(b))
 }
 
 func GetWalkerFn(root string) walkerFn {
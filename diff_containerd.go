@@ -52,6 +52,9 @@ func doubleWalkDiff(ctx context.Context, changeFn ChangeFunc, a, b walkerFn) (er
 
 		f1, f2 *currentPath
 		rmdir  string
+		// rewritten holds files that were recreated during the diff. Hardlinks
+		// pointing to them need to be recreated as well.
+		rewritten = map[string]struct{}{}
 	)
 	g.Go(func() error {
 		defer close(c1)
@@ -118,6 +121,13 @@ func doubleWalkDiff(ctx context.Context, changeFn ChangeFunc, a, b walkerFn) (er
 				} else if rmdir != "" {
 					rmdir = ""
 				}
+				if same {
+					if s, ok := f2.f.Sys().(*Stat); ok && f2.f.Mode()&os.ModeSymlink == 0 && s.Linkname != "" {
+						if _, ok := rewritten[s.Linkname]; ok {
+							same = false
+						}
+					}
+				}
 				f = f2.f
 				f1 = nil
 				f2 = nil
@@ -125,6 +135,9 @@ func doubleWalkDiff(ctx context.Context, changeFn ChangeFunc, a, b walkerFn) (er
 					continue loop0
 				}
 			}
+			if f != nil && !f.IsDir() {
+				rewritten[p] = struct{}{}
+			}
 			if err := changeFn(k, p, f, nil); err != nil {
 				return err
 			}
@@ -147,7 +160,7 @@ func pathChange(lower, upper *currentPath) (ChangeKind, string) {
 	}
 	// TODO: compare by directory
 
-	switch i := strings.Compare(lower.path, upper.path); {
+	switch i := comparePath(lower.path, upper.path); {
 	case i < 0:
 		// File in lower that is not in upper
 		return ChangeKindDelete, lower.path
@@ -159,6 +172,35 @@ func pathChange(lower, upper *currentPath) (ChangeKind, string) {
 	}
 }
 
+// comparePath compares paths in the order they are returned by a directory
+// walk. A plain string comparison would sort "a.b" before "a/b" although the
+// walk returns the contents of "a" first.
+func comparePath(p1, p2 string) int {
+	for i := 0; i < len(p1) && i < len(p2); i++ {
+		c1, c2 := p1[i], p2[i]
+		if c1 == c2 {
+			continue
+		}
+		if c1 == os.PathSeparator {
+			return -1
+		}
+		if c2 == os.PathSeparator {
+			return 1
+		}
+		if c1 < c2 {
+			return -1
+		}
+		return 1
+	}
+	switch {
+	case len(p1) < len(p2):
+		return -1
+	case len(p1) > len(p2):
+		return 1
+	}
+	return 0
+}
+
 func sameFile(f1, f2 *currentPath) (bool, error) {
 	// if os.SameFile(f1.f, f2.f) {
 	//   return true, nil
@@ -174,8 +216,17 @@ func sameFile(f1, f2 *currentPath) (bool, error) {
 	//   return eq, err
 	// }
 
+	if f1.f.Mode()&os.ModeType != f2.f.Mode()&os.ModeType {
+		return false, nil
+	}
+
 	// If not a directory also check size, modtime, and content
 	if !f1.f.IsDir() {
+		s1, ok1 := f1.f.Sys().(*Stat)
+		s2, ok2 := f2.f.Sys().(*Stat)
+		if ok1 && ok2 && s1.Linkname != s2.Linkname {
+			return false, nil
+		}
 		if f1.f.Size() != f2.f.Size() {
 			return false, nil
 		}
@@ -0,0 +1,66 @@
+package fsutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestChanges(t *testing.T) {
+	a, err := tmpDir(changeStream([]string{
+		"ADD bar dir",
+		"ADD bar/baz file data1",
+		"ADD foo file data2",
+		"ADD foo2 file data3",
+		"ADD gone dir",
+		"ADD gone/file file data4",
+		"ADD link symlink foo",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(a)
+
+	b, err := tmpDir(changeStream([]string{
+		"ADD bar dir",
+		"ADD bar/baz file data1",
+		"ADD bar/new file data5",
+		"ADD foo file data2-changed",
+		"ADD foo2 file data3",
+		"ADD link symlink foo2",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(b)
+
+	// files with identical contents only compare equal with the same mtime
+	tm := time.Unix(1500000000, 0)
+	for _, p := range []string{"bar/baz", "foo", "foo2"} {
+		assert.NoError(t, os.Chtimes(filepath.Join(a, p), tm, tm))
+		assert.NoError(t, os.Chtimes(filepath.Join(b, p), tm, tm))
+	}
+
+	buf := &bytes.Buffer{}
+	err = Changes(context.Background(), a, b, changeLog(buf))
+	assert.NoError(t, err)
+	assert.Equal(t, `ADD bar/new
+CHG foo
+DEL gone
+CHG link
+`, string(buf.Bytes()))
+
+	buf.Reset()
+	err = Changes(context.Background(), a, a, changeLog(buf))
+	assert.NoError(t, err)
+	assert.Equal(t, "", string(buf.Bytes()))
+
+	err = ioutil.WriteFile(filepath.Join(b, "foo2"), []byte("data3"), 0600)
+	assert.NoError(t, err)
+	buf.Reset()
+	err = Changes(context.Background(), a, b, changeLog(buf))
+	assert.NoError(t, err)
+	assert.Contains(t, string(buf.Bytes()), "CHG foo2\n")
+}
@@ -1,5 +1,3 @@
-// +build linux
-
 package fsutil
 
 import (
@@ -10,35 +8,225 @@ import (
 	"path/filepath"
 	"strconv"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
-	"github.com/stevvooe/continuity/sysx"
 	"golang.org/x/net/context"
-	"golang.org/x/sys/unix"
+	"golang.org/x/sync/errgroup"
 )
 
 type writeToFunc func(context.Context, string, io.WriteCloser) error
 
+// fileSkippedError is returned by the data function for files the sender
+// could not read and left out of the transfer.
+type fileSkippedError struct {
+	reason string
+}
+
+func (e *fileSkippedError) Error() string {
+	return "file skipped by sender: " + e.reason
+}
+
+// DiskWriterOpt defines how a DiskWriter creates entries.
+type DiskWriterOpt struct {
+	// Chown defines the owner of the created entries. If nil, the uid and
+	// gid of the received stats are used.
+	Chown *ChownOpt
+	// NotifyHashed is called for every applied change. The file info of
+	// added and modified entries implements Hashed. Receive uses
+	// ReceiveOpt.NotifyHashed instead.
+	NotifyHashed ChangeFunc
+	// Sparse leaves holes in files instead of writing runs of zeros, and has
+	// Receive ask the sender for the holes in the source files so they are
+	// not transferred.
+	Sparse bool
+	// ContentCache records the written files so unchanged contents of
+	// modified files are not requested again. If it implements
+	// ContentCachePinner, the entries used are pinned until Wait returns.
+	ContentCache ContentCache
+	// HashAlgorithm is the hash of the digests passed to NotifyHashed. If
+	// nil, sha256 is used and the digests have no prefix.
+	HashAlgorithm *HashAlgorithm
+	// Filter drops and rewrites the added and modified entries before they
+	// are created, for example to strip setuid bits or change the owner.
+	// Renamed entries are created at their new path, deletions are applied
+	// unchanged. Receive applies it to the received stats before comparing
+	// them to the destination, like ReceiveOpt.Filter.
+	Filter Filter
+	// Epoch is the modification time set on all written entries instead
+	// of the one of the source. It is applied after Filter. Receive doesn't
+	// compare the times of directories, so directories that already exist
+	// in the destination keep their times.
+	Epoch *time.Time
+	// Layer writes the changes as a layer on top of a parent tree, recording
+	// deleted entries as whiteouts. The destination needs to be empty. Not
+	// supported with Watch, Atomic or VolumeSnapshot receives.
+	Layer *LayerOpt
+}
+
+// filter returns the filter applied to the written entries or nil.
+func (opt *DiskWriterOpt) filter() Filter {
+	var filters []Filter
+	if opt.Filter != nil {
+		filters = append(filters, opt.Filter)
+	}
+	if opt.Epoch != nil {
+		filters = append(filters, WithEpoch(*opt.Epoch))
+	}
+	if len(filters) == 0 {
+		return nil
+	}
+	return Chain(filters...)
+}
+
 type DiskWriter struct {
 	asyncDataFunc writeToFunc
 	syncDataFunc  writeToFunc
 	dest          string
-
-	wg           sync.WaitGroup
+	opt           DiskWriterOpt
+	unsupported   *UnsupportedPolicy
+	retries       int
+	stats         *transferStats
+	resume        *ResumeState
+	fileProgress  func(Stat, int64, int64)
+	metrics       Metrics
+	// requested is the size of the file contents requested with
+	// asyncDataFunc
+	requested int64
+
+	// eg runs the asynchronous writes. ctx is cancelled when a change fails
+	// or parent is done.
+	eg           *errgroup.Group
 	mu           sync.RWMutex
 	err          error
+	parent       context.Context
 	ctx          context.Context
 	cancel       func()
 	notifyHashed func(ChangeKind, string, os.FileInfo, error) error
+	skipped      *unsupportedFiles
+
+	filter *statFilter
+	// sources are the original paths of the entries renamed by the filter
+	sources map[string]string
+	// dirTimes are the modification times of the directories whose entries
+	// changed. Adding and removing entries updates the time, so they are set
+	// again once all changes have been applied.
+	dirTimes map[string]int64
+
+	// pins release the content cache entries used by the writer
+	pinMu sync.Mutex
+	pins  map[string]func()
 }
 
-func (dw *DiskWriter) Wait() error {
-	dw.wg.Wait()
+// NewDiskWriter returns a DiskWriter applying changes to dest. The contents
+// of regular files are read from file infos implementing io.Reader, like the
+// ones passed by Untar, other files are created empty.
+func NewDiskWriter(dest string, opt DiskWriterOpt) *DiskWriter {
+	return NewDiskWriterContext(context.Background(), dest, opt)
+}
+
+// NewDiskWriterContext returns a DiskWriter like NewDiskWriter that stops
+// the writes in progress when ctx is cancelled. The files they left
+// incomplete are removed and Wait returns ctx.Err().
+func NewDiskWriterContext(ctx context.Context, dest string, opt DiskWriterOpt) *DiskWriter {
+	dw := &DiskWriter{
+		dest:         dest,
+		opt:          opt,
+		notifyHashed: opt.NotifyHashed,
+	}
+	dw.start(ctx)
+	return dw
+}
+
+// start ties the writes to ctx.
+func (dw *DiskWriter) start(ctx context.Context) {
+	dw.parent = ctx
+	dw.ctx, dw.cancel = context.WithCancel(ctx)
+	dw.eg = &errgroup.Group{}
+}
+
+// stopped returns why the writes were stopped or nil if they were not.
+func (dw *DiskWriter) stopped() error {
+	if dw.ctx.Err() == nil {
+		return nil
+	}
+	if err := dw.parent.Err(); err != nil {
+		return err
+	}
 	dw.mu.RLock()
 	defer dw.mu.RUnlock()
-	return dw.err
+	if dw.err != nil {
+		return dw.err
+	}
+	return dw.ctx.Err()
+}
+
+func (dw *DiskWriter) Wait() error {
+	if dw.eg != nil {
+		// the errors are recorded in dw.err
+		dw.eg.Wait()
+	}
+	dw.releasePins()
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if dw.parent != nil && dw.parent.Err() != nil {
+		return dw.parent.Err()
+	}
+	if dw.err != nil {
+		return dw.err
+	}
+	if err := dw.restoreDirTimes(); err != nil {
+		return err
+	}
+	if dw.skipped != nil {
+		return dw.skipped.err()
+	}
+	return nil
+}
+
+// keepDirTime records the modification time of the directory at p before
+// its entries are changed, unless a time was already recorded for it.
+func (dw *DiskWriter) keepDirTime(p string) error {
+	if p == dw.dest {
+		return nil
+	}
+	dw.mu.Lock()
+	_, ok := dw.dirTimes[p]
+	dw.mu.Unlock()
+	if ok {
+		return nil
+	}
+	fi, err := os.Lstat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "failed to stat %s", p)
+	}
+	dw.setDirTime(p, fi.ModTime().UnixNano())
+	return nil
+}
+
+func (dw *DiskWriter) setDirTime(p string, t int64) {
+	dw.mu.Lock()
+	if dw.dirTimes == nil {
+		dw.dirTimes = make(map[string]int64)
+	}
+	dw.dirTimes[p] = t
+	dw.mu.Unlock()
+}
+
+// restoreDirTimes sets the recorded times of the directories. dw.mu needs to
+// be held.
+func (dw *DiskWriter) restoreDirTimes() error {
+	for p, t := range dw.dirTimes {
+		if err := chtimes(p, t); err != nil && !os.IsNotExist(errors.Cause(err)) {
+			return err
+		}
+	}
+	dw.dirTimes = nil
+	return nil
 }
 
 func (dw *DiskWriter) HandleChange(kind ChangeKind, p string, fi os.FileInfo, err error) (retErr error) {
@@ -47,27 +235,65 @@ func (dw *DiskWriter) HandleChange(kind ChangeKind, p string, fi os.FileInfo, er
 	}
 
 	if dw.ctx == nil {
-		ctx, cancel := context.WithCancel(context.Background())
-		dw.ctx = ctx
-		dw.cancel = cancel
+		dw.start(context.Background())
+	}
+	if err := dw.stopped(); err != nil {
+		return err
+	}
+	if dw.metrics != nil {
+		start := time.Now()
+		defer func() {
+			if retErr == nil {
+				dw.metrics.Phase(PhaseWrite, p, time.Since(start))
+			}
+		}()
 	}
 
 	defer func() {
 		if retErr != nil {
 			dw.mu.Lock()
 			if dw.err == nil {
-				dw.err = err
+				dw.err = retErr
 			}
 			dw.mu.Unlock()
 			dw.cancel()
 		}
 	}()
 
+	if dw.opt.filter() != nil && kind != ChangeKindDelete {
+		var ok bool
+		p, fi, ok, err = dw.filterChange(p, fi)
+		if err != nil || !ok {
+			return err
+		}
+	}
+
 	destPath := filepath.Join(dw.dest, p)
+	if err := dw.keepDirTime(filepath.Dir(destPath)); err != nil {
+		return err
+	}
+
+	opaque := false
+	if dw.opt.Layer != nil {
+		if isWhiteoutName(p) {
+			return errors.WithStack(&ValidationError{Path: p, Reason: "reserved for whiteouts"})
+		}
+		if kind != ChangeKindDelete {
+			removed, err := dw.prepareLayerEntry(p)
+			if err != nil {
+				return err
+			}
+			opaque = removed && fi.IsDir()
+		}
+	}
 
 	if kind == ChangeKindDelete {
-		// todo: no need to validate if diff is trusted but is it always?
-		if err := os.RemoveAll(destPath); err != nil {
+		if dw.opt.Layer != nil {
+			if err := dw.whiteout(p); err != nil {
+				return err
+			}
+		} else if err := os.RemoveAll(destPath); err != nil {
+			// todo: no need to validate if diff is trusted but is it always?
 			return errors.Wrapf(err, "failed to remove: %s", destPath)
 		}
 		if dw.notifyHashed != nil {
@@ -87,7 +313,7 @@ func (dw *DiskWriter) HandleChange(kind ChangeKind, p string, fi os.FileInfo, er
 	oldFi, err := os.Lstat(destPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			if kind != ChangeKindAdd {
+			if kind != ChangeKindAdd && dw.opt.Layer == nil {
 				return errors.Wrapf(err, "invalid addition: %s", destPath)
 			}
 			rename = false
@@ -97,17 +323,36 @@ func (dw *DiskWriter) HandleChange(kind ChangeKind, p string, fi os.FileInfo, er
 	}
 
 	if oldFi != nil && fi.IsDir() && oldFi.IsDir() {
-		if err := rewriteMetadata(destPath, stat); err != nil {
+		if err := rewriteMetadata(destPath, stat, dw.opt.Chown); err != nil {
 			return errors.Wrapf(err, "error setting dir metadata for %s", destPath)
 		}
+		dw.setDirTime(destPath, stat.ModTime)
 		return nil
 	}
 
+	if dw.resume != nil && oldFi != nil && oldFi.Mode().IsRegular() && fi.Mode().IsRegular() && stat.Linkname == "" {
+		if offset, ok := dw.resume.take(p, stat); ok && offset <= oldFi.Size() {
+			return dw.resumeFile(p, destPath, stat, offset)
+		}
+	}
+
+	if dw.opt.ContentCache != nil && kind == ChangeKindModify && oldFi != nil && oldFi.Mode().IsRegular() && fi.Mode().IsRegular() && stat.Linkname == "" {
+		dw.pinContents(p)
+		if e, ok := dw.opt.ContentCache.Get(p); ok && e.current(oldFi, stat) {
+			return dw.keepContents(kind, p, destPath, stat, e)
+		}
+	}
+
 	newPath := destPath
 	if rename {
 		newPath = filepath.Join(filepath.Dir(destPath), ".tmp."+nextSuffix())
 	}
 
+	if dw.unsupported != nil && !isSupportedMode(fi.Mode()) {
+		dw.skip(p, errUnsupportedMode(fi.Mode()))
+		return nil
+	}
+
 	// todo: combine with hardlink validation
 
 	asyncRequestFileData := false
@@ -118,8 +363,12 @@ func (dw *DiskWriter) HandleChange(kind ChangeKind, p string, fi os.FileInfo, er
 		if err := os.Mkdir(newPath, fi.Mode()); err != nil {
 			return errors.Wrapf(err, "failed to create dir %s", newPath)
 		}
-	case fi.Mode()&os.ModeDevice != 0 || fi.Mode()&os.ModeNamedPipe != 0:
+	case fi.Mode()&(os.ModeDevice|os.ModeNamedPipe|os.ModeSocket) != 0:
 		if err := handleTarTypeBlockCharFifo(newPath, stat); err != nil {
+			if dw.unsupported != nil && os.IsPermission(err) {
+				dw.skip(p, err)
+				return nil
+			}
 			return errors.Wrapf(err, "failed to create device %s", newPath)
 		}
 	case fi.Mode()&os.ModeSymlink != 0:
@@ -127,6 +376,12 @@ func (dw *DiskWriter) HandleChange(kind ChangeKind, p string, fi os.FileInfo, er
 			return errors.Wrapf(err, "failed to symlink %s", newPath)
 		}
 	case stat.Linkname != "":
+		if dw.opt.Layer != nil {
+			// the target may be unchanged and only exist in the parent
+			if err := dw.copyUp(stat.Linkname); err != nil {
+				return err
+			}
+		}
 		if err := os.Link(filepath.Join(dw.dest, stat.Linkname), newPath); err != nil {
 			return errors.Wrapf(err, "failed to link %s to %s", newPath, stat.Linkname)
 		}
@@ -135,13 +390,18 @@ func (dw *DiskWriter) HandleChange(kind ChangeKind, p string, fi os.FileInfo, er
 		if err != nil {
 			return errors.Wrapf(err, "failed to create %s", newPath)
 		}
-		if dw.syncDataFunc != nil {
+		syncDataFunc := dw.syncDataFunc
+		if r, ok := fi.(io.Reader); ok && syncDataFunc == nil && dw.asyncDataFunc == nil {
+			// the contents come with the change, for example from Untar
+			syncDataFunc = readerDataFunc(r)
+		}
+		if syncDataFunc != nil {
 			var h io.WriteCloser = file
 			if dw.notifyHashed != nil {
-				hw = newHashWriter(fi, file)
+				hw = newHashWriter(fi, file, dw.opt.HashAlgorithm)
 				h = hw
 			}
-			if err := dw.syncDataFunc(dw.ctx, p, h); err != nil {
+			if err := syncDataFunc(dw.ctx, dw.source(p), h); err != nil {
 				return errors.Wrapf(err, "failed to write %s", newPath)
 			}
 			break
@@ -153,35 +413,144 @@ func (dw *DiskWriter) HandleChange(kind ChangeKind, p string, fi os.FileInfo, er
 		}
 	}
 
-	if err := rewriteMetadata(newPath, stat); err != nil {
+	if err := rewriteMetadata(newPath, stat, dw.opt.Chown); err != nil {
 		return errors.Wrapf(err, "error setting metadata for %s", newPath)
 	}
 
 	if rename {
+		// rename(2) is a no-op if both paths are links to the same file
+		if oldFi.IsDir() != fi.IsDir() || (fi.Mode()&os.ModeSymlink == 0 && stat.Linkname != "") {
+			if err := os.RemoveAll(destPath); err != nil {
+				return errors.Wrapf(err, "failed to remove %s", destPath)
+			}
+		}
 		if err := os.Rename(newPath, destPath); err != nil {
 			return errors.Wrapf(err, "failed to rename %s to %s", newPath, destPath)
 		}
 	}
+	if fi.IsDir() {
+		if opaque {
+			if err := dw.markOpaque(p); err != nil {
+				return err
+			}
+		}
+		dw.setDirTime(destPath, stat.ModTime)
+	}
 
 	if asyncRequestFileData {
-		dw.requestAsyncFileData(p, destPath, stat)
-	} else if dw.notifyHashed != nil {
+		dw.requestAsyncFileData(p, destPath, stat, 0)
+		return nil
+	}
+	if dw.notifyHashed != nil {
 		if hw == nil {
-			hw = newHashWriter(fi, nil)
+			hw = newHashWriter(fi, nil, dw.opt.HashAlgorithm)
 			hw.Close()
 		}
 		if err := dw.notifyHashed(kind, p, hw, nil); err != nil {
 			return err
 		}
 	}
+	if dw.opt.ContentCache != nil && fi.Mode().IsRegular() && stat.Linkname == "" {
+		var digest string
+		if hw != nil {
+			digest = hw.Hash()
+		}
+		if err := dw.cacheContents(p, destPath, stat, digest); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-func (dw *DiskWriter) requestAsyncFileData(p, dest string, stat *Stat) {
-	dw.wg.Add(1)
+// filterChange applies the filter to a copy of the stat of an entry. It
+// returns the path the entry is created at and its new file info.
+func (dw *DiskWriter) filterChange(p string, fi os.FileInfo) (string, os.FileInfo, bool, error) {
+	stat, ok := fi.Sys().(*Stat)
+	if !ok {
+		return "", nil, false, errors.Errorf("%s invalid change without stat information", p)
+	}
+	st := *stat
+	if stat.Xattrs != nil {
+		st.Xattrs = make(map[string][]byte, len(stat.Xattrs))
+		for k, v := range stat.Xattrs {
+			st.Xattrs[k] = v
+		}
+	}
+	if dw.filter == nil {
+		dw.filter = newStatFilter(dw.opt.filter())
+	}
+	ok, err := dw.filter.filter(&st)
+	if err != nil || !ok {
+		return "", nil, false, err
+	}
+	if st.Path != p {
+		dw.mu.Lock()
+		if dw.sources == nil {
+			dw.sources = make(map[string]string)
+		}
+		dw.sources[st.Path] = p
+		dw.mu.Unlock()
+	}
+	var nfi os.FileInfo = &StatInfo{&st}
+	if r, ok := fi.(io.Reader); ok {
+		nfi = &readerStatInfo{StatInfo: &StatInfo{&st}, Reader: r}
+	}
+	return st.Path, nfi, true, nil
+}
+
+// readerStatInfo keeps the contents of a change whose stat was filtered.
+type readerStatInfo struct {
+	*StatInfo
+	io.Reader
+}
+
+// source returns the path the contents of the entry at p are read from.
+func (dw *DiskWriter) source(p string) string {
+	dw.mu.RLock()
+	defer dw.mu.RUnlock()
+	if src, ok := dw.sources[p]; ok {
+		return src
+	}
+	return p
+}
+
+func readerDataFunc(r io.Reader) writeToFunc {
+	return func(ctx context.Context, p string, wc io.WriteCloser) error {
+		if _, err := io.Copy(wc, r); err != nil {
+			wc.Close()
+			return err
+		}
+		return wc.Close()
+	}
+}
+
+func (dw *DiskWriter) skip(p string, err error) {
+	dw.mu.Lock()
+	if dw.skipped == nil {
+		dw.skipped = &unsupportedFiles{policy: dw.unsupported}
+	}
+	dw.skipped.add(p, err)
+	dw.mu.Unlock()
+}
+
+// resumeFile continues writing a file that an earlier transfer left behind
+// incomplete.
+func (dw *DiskWriter) resumeFile(p, dest string, stat *Stat, offset int64) error {
+	if err := os.Truncate(dest, offset); err != nil {
+		return errors.Wrapf(err, "failed to truncate %s", dest)
+	}
+	if err := rewriteMetadata(dest, stat, dw.opt.Chown); err != nil {
+		return errors.Wrapf(err, "error setting metadata for %s", dest)
+	}
+	dw.requestAsyncFileData(p, dest, stat, offset)
+	return nil
+}
+
+func (dw *DiskWriter) requestAsyncFileData(p, dest string, stat *Stat, offset int64) {
+	atomic.AddInt64(&dw.requested, stat.Size_-offset)
 	// todo: limit worker threads
-	go func() (retErr error) {
+	dw.eg.Go(func() (retErr error) {
 		defer func() {
 			if retErr != nil {
 				dw.mu.Lock()
@@ -192,28 +561,109 @@ func (dw *DiskWriter) requestAsyncFileData(p, dest string, stat *Stat) {
 				dw.mu.Unlock()
 			}
 		}()
-		var hw *hashedWriter
-		var h io.WriteCloser = &lazyFileWriter{
-			dest: dest,
-		}
-		if dw.notifyHashed != nil {
-			hw = newHashWriter(&StatInfo{stat}, h)
-			h = hw
+		var digest string
+		for i := 0; ; i++ {
+			n, d, err := dw.fetchFile(p, dest, stat, offset)
+			if _, ok := errors.Cause(err).(*fileSkippedError); ok {
+				return errors.Wrapf(os.Remove(dest), "failed to remove skipped file %s", dest)
+			}
+			if errors.Cause(err) == errResumeRejected && offset > 0 {
+				// the kept part can't be used, the file is fetched again
+				if err := os.Truncate(dest, 0); err != nil {
+					return errors.Wrapf(err, "failed to truncate %s", dest)
+				}
+				atomic.AddInt64(&dw.requested, offset)
+				offset = 0
+				continue
+			}
+			_, corrupt := errors.Cause(err).(*ChecksumError)
+			if !corrupt || i >= dw.retries {
+				if err != nil {
+					if errors.Cause(err) == ErrShutdown {
+						return err
+					}
+					// corrupt contents are not continued
+					if dw.resume != nil && !corrupt {
+						dw.resume.add(p, stat, offset+n)
+					} else if dw.ctx.Err() != nil {
+						// the write was interrupted
+						os.Remove(dest)
+					}
+					return errors.WithStack(&TransferError{Path: p, Offset: offset + n, Err: err})
+				}
+				digest = d
+				break
+			}
+			if err := os.Truncate(dest, 0); err != nil {
+				return errors.Wrapf(err, "failed to truncate %s", dest)
+			}
+			offset = 0
+			if dw.stats != nil {
+				atomic.AddInt64(&dw.stats.retries, 1)
+			}
 		}
-		if err := dw.asyncDataFunc(dw.ctx, p, h); err != nil {
+		// writing to a file drops its security.capability
+		if err := setXattrs(dest, stat); err != nil {
 			return err
 		}
-		if hw != nil {
-			if err := dw.notifyHashed(ChangeKindAdd, p, hw, nil); err != nil {
-				return err
-			}
-		}
 		if err := chtimes(dest, stat.ModTime); err != nil { // TODO: check parent dirs
 			return err
 		}
-		dw.wg.Done()
+		if dw.opt.ContentCache != nil {
+			return dw.cacheContents(p, dest, stat, digest)
+		}
 		return nil
-	}()
+	})
+}
+
+// fetchFile writes the contents of a file from offset on and reports its
+// hash. It returns the number of bytes written and the hash.
+func (dw *DiskWriter) fetchFile(p, dest string, stat *Stat, offset int64) (int64, string, error) {
+	ctx := dw.ctx
+	if offset > 0 {
+		prefix, err := filePrefixDigest(dest, offset)
+		if err != nil {
+			return 0, "", err
+		}
+		ctx = withResume(ctx, offset, prefix)
+	}
+	lfw := &lazyFileWriter{
+		dest:   dest,
+		size:   stat.Size_,
+		ctx:    dw.ctx,
+		offset: offset,
+		sparse: dw.opt.Sparse,
+		timed:  dw.metrics != nil,
+	}
+	if dw.fileProgress != nil {
+		lfw.progress = func(n int64) {
+			dw.fileProgress(*stat, n, stat.Size_)
+		}
+	}
+	var hw *hashedWriter
+	var h io.WriteCloser = lfw
+	if dw.notifyHashed != nil {
+		hw = newHashWriter(&StatInfo{stat}, h, dw.opt.HashAlgorithm)
+		if offset > 0 {
+			if err := hw.hashPrefix(dest, offset); err != nil {
+				return 0, "", err
+			}
+		}
+		h = hw
+	}
+	if err := dw.asyncDataFunc(ctx, dw.source(p), h); err != nil {
+		return lfw.n, "", err
+	}
+	if lfw.timed {
+		dw.metrics.Phase(PhaseWrite, p, lfw.elapsed)
+	}
+	if hw != nil {
+		if err := dw.notifyHashed(ChangeKindAdd, p, hw, nil); err != nil {
+			return lfw.n, "", err
+		}
+		return lfw.n, hw.Hash(), nil
+	}
+	return lfw.n, "", nil
 }
 
 type hashedWriter struct {
@@ -222,21 +672,45 @@ type hashedWriter struct {
 	h   hash.Hash
 	w   io.WriteCloser
 	sum string
+	// prefix is added to the hex digest
+	prefix string
 }
 
-func newHashWriter(fi os.FileInfo, w io.WriteCloser) *hashedWriter {
-	h, _ := NewTarsumHash(fi)
+func newHashWriter(fi os.FileInfo, w io.WriteCloser, alg *HashAlgorithm) *hashedWriter {
+	var h hash.Hash
+	var prefix string
+	if alg != nil {
+		h, _ = NewTarsumHashWithAlgorithm(fi, *alg)
+		prefix = alg.Name + ":"
+	} else {
+		h, _ = NewTarsumHash(fi)
+	}
 	hw := &hashedWriter{
 		FileInfo: fi,
 		Writer:   io.MultiWriter(w, h),
 		h:        h,
 		w:        w,
+		prefix:   prefix,
 	}
 	return hw
 }
 
+// hashPrefix adds the first n bytes already written to the file at p to the
+// hash.
+func (hw *hashedWriter) hashPrefix(p string, n int64) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", p)
+	}
+	defer f.Close()
+	if _, err := io.CopyN(hw.h, f, n); err != nil {
+		return errors.Wrapf(err, "failed to read %s", p)
+	}
+	return nil
+}
+
 func (hw *hashedWriter) Close() error {
-	hw.sum = string(hex.EncodeToString(hw.h.Sum(nil)))
+	hw.sum = hw.prefix + hex.EncodeToString(hw.h.Sum(nil))
 	if hw.w != nil {
 		return hw.w.Close()
 	}
@@ -259,84 +733,88 @@ type Hashed interface {
 
 type lazyFileWriter struct {
 	dest string
-	ctx  context.Context
-	f    *os.File
+	// size is the size of the complete file
+	size   int64
+	ctx    context.Context
+	f      *os.File
+	offset int64
+	n      int64
+	sparse bool
+	// hole is set if the file ends with a hole that was seeked over
+	hole bool
+	// progress is called with the position in the file after every write
+	progress func(int64)
+	// timed sums the time spent writing in elapsed
+	timed   bool
+	elapsed time.Duration
 }
 
 func (lfw *lazyFileWriter) Write(dt []byte) (int, error) {
+	if lfw.ctx != nil {
+		// data functions copying local files don't watch the context
+		if err := lfw.ctx.Err(); err != nil {
+			return 0, err
+		}
+	}
 	if lfw.f == nil {
 		file, err := os.OpenFile(lfw.dest, os.O_WRONLY, 0) //todo: windows
 		if err != nil {
 			return 0, errors.Wrapf(err, "failed to open %s", lfw.dest)
 		}
+		if lfw.offset > 0 {
+			if _, err := file.Seek(lfw.offset, io.SeekStart); err != nil {
+				file.Close()
+				return 0, errors.Wrapf(err, "failed to seek %s", lfw.dest)
+			}
+		}
 		lfw.f = file
 	}
-	return lfw.f.Write(dt)
-}
-
-func (lfw *lazyFileWriter) Close() error {
-	if lfw.f != nil {
-		return lfw.f.Close()
-	}
-	return nil
-}
-
-func rewriteMetadata(p string, stat *Stat) error {
-	for key, value := range stat.Xattrs {
-		sysx.Setxattr(p, key, value, 0)
+	var n int
+	var err error
+	if lfw.timed {
+		start := time.Now()
+		defer func() { lfw.elapsed += time.Since(start) }()
 	}
-
-	if err := os.Lchown(p, int(stat.Uid), int(stat.Gid)); err != nil {
-		return errors.Wrapf(err, "failed to lchown %s", p)
-	}
-
-	if os.FileMode(stat.Mode)&os.ModeSymlink == 0 {
-		if err := os.Chmod(p, os.FileMode(stat.Mode)); err != nil {
-			return errors.Wrapf(err, "failed to chown %s", p)
-		}
+	if lfw.sparse {
+		n, err = lfw.writeSparse(dt)
+	} else {
+		n, err = lfw.f.Write(dt)
 	}
-
-	if err := chtimes(p, stat.ModTime); err != nil {
-		return errors.Wrapf(err, "failed to chtimes %s", p)
+	lfw.n += int64(n)
+	if lfw.progress != nil && n > 0 {
+		lfw.progress(lfw.offset + lfw.n)
 	}
-
-	return nil
+	return n, err
 }
 
-func chtimes(path string, un int64) error {
-	var utimes [2]unix.Timespec
-	utimes[0] = unix.NsecToTimespec(un)
-	utimes[1] = utimes[0]
-
-	if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, utimes[0:], unix.AT_SYMLINK_NOFOLLOW); err != nil {
-		return errors.Wrap(err, "failed call to UtimesNanoAt")
+func (lfw *lazyFileWriter) Close() error {
+	if lfw.f == nil {
+		return nil
 	}
-
-	return nil
+	if lfw.hole {
+		// seeking past the end doesn't extend the file
+		if err := lfw.f.Truncate(lfw.offset + lfw.n); err != nil {
+			lfw.f.Close()
+			return errors.Wrapf(err, "failed to truncate %s", lfw.dest)
+		}
+	}
+	return lfw.f.Close()
 }
 
-// handleTarTypeBlockCharFifo is an OS-specific helper function used by
-// createTarFile to handle the following types of header: Block; Char; Fifo
-func handleTarTypeBlockCharFifo(path string, stat *Stat) error {
-	mode := uint32(stat.Mode & 07777)
-	if os.FileMode(stat.Mode)&os.ModeCharDevice != 0 {
-		mode |= syscall.S_IFCHR
-	} else if os.FileMode(stat.Mode)&os.ModeNamedPipe != 0 {
-		mode |= syscall.S_IFIFO
-	} else {
-		mode |= syscall.S_IFBLK
+// reset drops the data written so far, so the contents can be written again.
+func (lfw *lazyFileWriter) reset() error {
+	if lfw.f != nil {
+		lfw.f.Close()
+		lfw.f = nil
 	}
-
-	if err := syscall.Mknod(path, mode, int(mkdev(stat.Devmajor, stat.Devminor))); err != nil {
-		return err
+	lfw.n = 0
+	lfw.hole = false
+	if err := os.Truncate(lfw.dest, lfw.offset); err != nil {
+		return errors.Wrapf(err, "failed to truncate %s", lfw.dest)
 	}
 	return nil
 }
 
-func mkdev(major int64, minor int64) uint32 {
-	return uint32(((minor & 0xfff00) << 12) | ((major & 0xfff) << 8) | (minor & 0xff))
-}
-
 // Random number state.
 // We generate random temporary file names so that there's a good
 // chance the file doesn't exist yet - keeps the number of tries in
@@ -3,15 +3,19 @@
 package fsutil
 
 import (
+	"archive/tar"
 	"bytes"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
+	"github.com/stevvooe/continuity/sysx"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/context"
 )
@@ -147,6 +151,74 @@ func TestWalkerWriterAsync(t *testing.T) {
 	assert.True(t, duration < 500*time.Millisecond)
 }
 
+func TestUntar(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar dir",
+		"ADD bar/baz file data1",
+		"ADD bar/link file >bar/baz",
+		"ADD foo symlink bar/baz",
+		"ADD foo2 file data2",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	buf := &bytes.Buffer{}
+	err = WriteTar(context.Background(), d, nil, buf)
+	assert.NoError(t, err)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	hashes := map[string]string{}
+	dw := NewDiskWriter(dest, DiskWriterOpt{
+		NotifyHashed: func(kind ChangeKind, p string, fi os.FileInfo, err error) error {
+			hashes[p] = fi.(Hashed).Hash()
+			return nil
+		},
+	})
+	err = Untar(context.Background(), buf, dw.HandleChange)
+	assert.NoError(t, err)
+	assert.NoError(t, dw.Wait())
+
+	b1, b2 := &bytes.Buffer{}, &bytes.Buffer{}
+	assert.NoError(t, Walk(context.Background(), d, nil, bufWalk(b1)))
+	assert.NoError(t, Walk(context.Background(), dest, nil, bufWalk(b2)))
+	assert.Equal(t, b1.String(), b2.String())
+
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "bar/baz"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data1", string(dt))
+	assert.Equal(t, 5, len(hashes))
+	assert.NotEqual(t, hashes["bar/baz"], hashes["foo2"])
+
+	// missing parents are created, the root entry is skipped
+	buf.Reset()
+	tw := tar.NewWriter(buf)
+	for _, name := range []string{"./", "./a/b/c"} {
+		hdr := &tar.Header{Name: name, Mode: 0600, Typeflag: tar.TypeReg}
+		if name == "./" {
+			hdr.Typeflag = tar.TypeDir
+		}
+		assert.NoError(t, tw.WriteHeader(hdr))
+	}
+	assert.NoError(t, tw.Close())
+	var paths []string
+	err = Untar(context.Background(), buf, func(kind ChangeKind, p string, fi os.FileInfo, err error) error {
+		paths = append(paths, p)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "a/b", "a/b/c"}, paths)
+
+	buf.Reset()
+	tw = tar.NewWriter(buf)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "a/../../evil", Mode: 0600, Typeflag: tar.TypeReg}))
+	assert.NoError(t, tw.Close())
+	err = Untar(context.Background(), buf, dw.HandleChange)
+	assert.EqualError(t, err, `invalid path "a/../../evil" in tar archive`)
+}
+
 func readAsAdd(f HandleChangeFn) filepath.WalkFunc {
 	return func(path string, fi os.FileInfo, err error) error {
 		return f(ChangeKindAdd, path, fi, err)
@@ -175,3 +247,223 @@ func newWriteToFunc(baseDir string, delay time.Duration) writeToFunc {
 		return nil
 	}
 }
+
+func TestWriterTransferError(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD foo file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	dw := &DiskWriter{
+		dest: dest,
+		asyncDataFunc: func(ctx context.Context, p string, wc io.WriteCloser) error {
+			if _, err := wc.Write([]byte("dat")); err != nil {
+				return err
+			}
+			wc.Close()
+			return syscall.ENOSPC
+		},
+	}
+	err = Walk(context.Background(), d, nil, readAsAdd(dw.HandleChange))
+	assert.NoError(t, err)
+
+	err = dw.Wait()
+	assert.Error(t, err)
+	assert.Equal(t, syscall.ENOSPC, errors.Cause(err))
+	var terr *TransferError
+	if assert.True(t, errors.As(err, &terr), "%v", err) {
+		assert.Equal(t, "foo", terr.Path)
+		assert.Equal(t, int64(3), terr.Offset)
+	}
+}
+
+func TestWriterFilter(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar dir",
+		"ADD bar/foo file data0",
+		"ADD foo dir",
+		"ADD foo/foo1 file data1",
+		"ADD foo/foo2 file data2",
+		"ADD zz file data3",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+	err = os.Chmod(filepath.Join(d, "foo/foo2"), 0755|os.ModeSetuid)
+	assert.NoError(t, err)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	filter := Chain(MatchFunc(func(p string, stat *Stat) (bool, error) {
+		return p != "bar", nil
+	}), MapFunc(func(p string, stat *Stat) error {
+		if p == "foo" || strings.HasPrefix(p, "foo/") {
+			stat.Path = "qux" + strings.TrimPrefix(p, "foo")
+		}
+		stat.Mode &^= uint32(os.ModeSetuid)
+		return nil
+	}))
+
+	dw := &DiskWriter{
+		dest:          dest,
+		asyncDataFunc: newWriteToFunc(d, 0),
+		opt:           DiskWriterOpt{Filter: filter},
+	}
+
+	err = Walk(context.Background(), d, nil, readAsAdd(dw.HandleChange))
+	assert.NoError(t, err)
+	err = dw.Wait()
+	assert.NoError(t, err)
+
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), dest, nil, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `dir qux
+file qux/foo1
+file qux/foo2
+file zz
+`, string(b.Bytes()))
+
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "qux/foo2"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data2", string(dt))
+
+	fi, err := os.Stat(filepath.Join(dest, "qux/foo2"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), fi.Mode())
+}
+
+func TestWriterLayer(t *testing.T) {
+	parent, err := tmpDir(changeStream([]string{
+		"ADD q file data0",
+		"ADD x dir",
+		"ADD x/y file data1",
+		"ADD z file data2",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(parent)
+
+	changes := changeStream([]string{
+		"DEL q file",
+		"DEL x dir",
+		"ADD x dir",
+		"ADD x/w file",
+		"ADD x2 file >z",
+	})
+
+	write := func(format WhiteoutFormat) string {
+		dest, err := ioutil.TempDir("", "dest")
+		assert.NoError(t, err)
+		dw := &DiskWriter{
+			dest:         dest,
+			syncDataFunc: noOpWriteTo,
+			opt:          DiskWriterOpt{Layer: &LayerOpt{Parent: parent, Whiteouts: format}},
+		}
+		for _, c := range changes {
+			err := dw.HandleChange(c.kind, c.path, c.fi, nil)
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, dw.Wait())
+		return dest
+	}
+
+	dest := write(WhiteoutOCI)
+	defer os.RemoveAll(dest)
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), dest, nil, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `file .wh.q
+dir x
+file x/.wh..wh..opq
+file x/w
+file x2
+file z >x2
+`, string(b.Bytes()))
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "z"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data2", string(dt))
+
+	// the whiteout names can't be written
+	dw := &DiskWriter{dest: dest, opt: DiskWriterOpt{Layer: &LayerOpt{Parent: parent}}}
+	err = dw.HandleChange(ChangeKindAdd, ".wh.foo", changeStream([]string{"ADD .wh.foo file"})[0].fi, nil)
+	var verr *ValidationError
+	assert.True(t, errors.As(err, &verr))
+
+	if os.Getuid() != 0 {
+		t.Skip("overlay whiteouts need privileges")
+	}
+	dest = write(WhiteoutOverlay)
+	defer os.RemoveAll(dest)
+	fi, err := os.Lstat(filepath.Join(dest, "q"))
+	assert.NoError(t, err)
+	assert.True(t, isOverlayWhiteout(fi))
+	fi, err = os.Lstat(filepath.Join(dest, "x"))
+	assert.NoError(t, err)
+	assert.True(t, fi.IsDir())
+	v, err := sysx.LGetxattr(filepath.Join(dest, "x"), overlayOpaqueAttr)
+	assert.NoError(t, err)
+	assert.Equal(t, "y", string(v))
+}
+
+func TestWriterCancel(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+		"ADD foo file data2",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	dw := NewDiskWriterContext(ctx, dest, DiskWriterOpt{})
+	// the data function doesn't watch the context
+	dw.asyncDataFunc = func(_ context.Context, p string, wc io.WriteCloser) error {
+		if p == "foo" {
+			return nil
+		}
+		for i := 0; i < 1000; i++ {
+			if _, err := wc.Write([]byte("d")); err != nil {
+				return err
+			}
+			if i == 0 {
+				close(started)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return wc.Close()
+	}
+	err = Walk(context.Background(), d, nil, func(p string, fi os.FileInfo, err error) error {
+		if p == "foo" {
+			<-started
+			cancel()
+		}
+		return dw.HandleChange(ChangeKindAdd, p, fi, err)
+	})
+	assert.Equal(t, context.Canceled, errors.Cause(err))
+
+	done := make(chan struct{})
+	go func() {
+		err = dw.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("write was not interrupted")
+	}
+	assert.Equal(t, context.Canceled, err)
+
+	// the partial file is removed
+	_, err = os.Lstat(filepath.Join(dest, "bar"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,99 @@
+// +build !windows
+
+package fsutil
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/stevvooe/continuity/sysx"
+	"golang.org/x/sys/unix"
+)
+
+func rewriteMetadata(p string, stat *Stat, chown *ChownOpt) error {
+	uid, gid, err := chown.owner(stat)
+	if err != nil {
+		return err
+	}
+	if err := os.Lchown(p, uid, gid); err != nil {
+		return errors.Wrapf(err, "failed to lchown %s", p)
+	}
+
+	// chown clears security.capability so the xattrs are set after it
+	if err := setXattrs(p, stat); err != nil {
+		return err
+	}
+
+	if os.FileMode(stat.Mode)&os.ModeSymlink == 0 {
+		if err := os.Chmod(p, os.FileMode(stat.Mode)); err != nil {
+			return errors.Wrapf(err, "failed to chown %s", p)
+		}
+	}
+
+	if err := chtimes(p, stat.ModTime); err != nil {
+		return errors.Wrapf(err, "failed to chtimes %s", p)
+	}
+
+	return nil
+}
+
+func setXattrs(p string, stat *Stat) error {
+	for key, value := range stat.Xattrs {
+		if err := sysx.LSetxattr(p, key, value, 0); err != nil {
+			return errors.Wrapf(err, "failed to set xattr %s on %s", key, p)
+		}
+	}
+	return nil
+}
+
+func chtimes(path string, un int64) error {
+	var utimes [2]unix.Timespec
+	utimes[0] = unix.NsecToTimespec(un)
+	utimes[1] = utimes[0]
+
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, utimes[0:], unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return errors.Wrap(err, "failed call to UtimesNanoAt")
+	}
+
+	return nil
+}
+
+// handleTarTypeBlockCharFifo is an OS-specific helper function used by
+// createTarFile to handle the following types of header: Block; Char; Fifo.
+// Unix sockets are created as nodes without a listener as well.
+func handleTarTypeBlockCharFifo(path string, stat *Stat) error {
+	mode := uint32(stat.Mode & 07777)
+	if os.FileMode(stat.Mode)&os.ModeCharDevice != 0 {
+		mode |= syscall.S_IFCHR
+	} else if os.FileMode(stat.Mode)&os.ModeNamedPipe != 0 {
+		mode |= syscall.S_IFIFO
+	} else if os.FileMode(stat.Mode)&os.ModeSocket != 0 {
+		mode |= syscall.S_IFSOCK
+	} else {
+		mode |= syscall.S_IFBLK
+	}
+
+	if err := syscall.Mknod(path, mode, int(mkdev(stat.Devmajor, stat.Devminor))); err != nil {
+		return err
+	}
+	return nil
+}
+
+func mkdev(major int64, minor int64) uint32 {
+	return uint32(((minor & 0xfff00) << 12) | ((major & 0xfff) << 8) | (minor & 0xff))
+}
+
+// isOverlayWhiteout returns true if fi is a character device with the device
+// number 0/0.
+func isOverlayWhiteout(fi os.FileInfo) bool {
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	s, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && s.Rdev == 0
+}
+
+func setOverlayOpaque(p string) error {
+	return errors.Wrapf(sysx.LSetxattr(p, overlayOpaqueAttr, []byte("y"), 0), "failed to set xattr %s on %s", overlayOpaqueAttr, p)
+}
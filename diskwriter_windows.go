@@ -0,0 +1,67 @@
+// +build windows
+
+package fsutil
+
+import (
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// rewriteMetadata applies the mode and modification time of stat. Ownership
+// and xattrs can't be set on windows and are ignored. Only the write bits of
+// the mode are used, marking files without them as read-only.
+func rewriteMetadata(p string, stat *Stat, chown *ChownOpt) error {
+	if os.FileMode(stat.Mode)&os.ModeSymlink != 0 {
+		// chmod and chtimes would follow the link
+		return nil
+	}
+
+	mode := os.FileMode(stat.Mode)
+	if mode.IsRegular() {
+		// contents are written after the metadata is set
+		mode |= 0200
+	}
+	if err := os.Chmod(p, mode); err != nil {
+		return errors.Wrapf(err, "failed to chmod %s", p)
+	}
+
+	if err := chtimes(p, stat.ModTime); err != nil {
+		return errors.Wrapf(err, "failed to chtimes %s", p)
+	}
+
+	return nil
+}
+
+func setXattrs(p string, stat *Stat) error {
+	return nil
+}
+
+func chtimes(path string, un int64) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat %s", path)
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	t := time.Unix(0, un)
+	return os.Chtimes(path, t, t)
+}
+
+// handleTarTypeBlockCharFifo fails with a permission error as device nodes,
+// fifos and sockets can't be created on windows. Receives with an UnsupportedPolicy
+// skip them.
+func handleTarTypeBlockCharFifo(path string, stat *Stat) error {
+	return &os.PathError{Op: "mknod", Path: path, Err: os.ErrPermission}
+}
+
+func isOverlayWhiteout(fi os.FileInfo) bool {
+	return false
+}
+
+// setOverlayOpaque fails as overlayfs is not available on windows.
+func setOverlayOpaque(p string) error {
+	return errors.Errorf("overlay whiteouts are not supported on windows: %s", p)
+}
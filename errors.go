@@ -0,0 +1,51 @@
+package fsutil
+
+import "fmt"
+
+// ValidationError is returned for a change that can't be applied because its
+// path is invalid, for example a path leaving the destination or changes sent
+// out of order by the peer.
+type ValidationError struct {
+	Path   string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid path %s: %s", e.Path, e.Reason)
+}
+
+// ChecksumError is returned when the contents of a received file don't match
+// the digest expected for it.
+type ChecksumError struct {
+	Path     string
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch for %s: expected %s, got %s", e.Path, e.Expected, e.Actual)
+}
+
+// TransferError is returned when the contents of a file could not be read by
+// the sender or written to the destination. Offset is the position in the
+// file the transfer failed at and Err the underlying error, for example a
+// syscall.Errno, which errors.Cause returns. Use errors.As to get the
+// TransferError itself.
+type TransferError struct {
+	Path   string
+	Offset int64
+	Err    error
+}
+
+func (e *TransferError) Error() string {
+	return fmt.Sprintf("failed to transfer %s at offset %d: %v", e.Path, e.Offset, e.Err)
+}
+
+func (e *TransferError) Unwrap() error {
+	return e.Err
+}
+
+// Cause returns the underlying error.
+func (e *TransferError) Cause() error {
+	return e.Err
+}
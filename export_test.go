@@ -0,0 +1,6 @@
+// +build linux
+
+package fsutil
+
+// SyncDirs is syncDirs for the tests in package fsutil_test.
+var SyncDirs = syncDirs
@@ -0,0 +1,188 @@
+// +build linux
+
+// Package filesync registers the fsutil sync protocol as gRPC services so
+// directories can be transferred over buildkit style sessions in both
+// directions.
+package filesync
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// keyDirName is the metadata key selecting the directory requested from a
+// FSSyncProvider.
+const keyDirName = "dir-name"
+
+// Attachable is a service that can be registered on a session's gRPC
+// server.
+type Attachable interface {
+	Register(*grpc.Server)
+}
+
+// SyncedDir is a directory served by a FSSyncProvider.
+type SyncedDir struct {
+	Name string
+	Dir  string
+	Opt  fsutil.SendOpt
+}
+
+// FSSyncProvider serves local directories to the other side of a session,
+// which receives them with FSSync.
+type FSSyncProvider struct {
+	dirs map[string]SyncedDir
+}
+
+// NewFSSyncProvider returns a provider serving dirs by their names.
+func NewFSSyncProvider(dirs []SyncedDir) *FSSyncProvider {
+	p := &FSSyncProvider{dirs: make(map[string]SyncedDir, len(dirs))}
+	for _, d := range dirs {
+		p.dirs[d.Name] = d
+	}
+	return p
+}
+
+func (p *FSSyncProvider) Register(server *grpc.Server) {
+	RegisterFileSyncServer(server, p)
+}
+
+// DiffCopy sends the requested directory.
+func (p *FSSyncProvider) DiffCopy(stream FileSync_DiffCopyServer) error {
+	dir, err := p.requestedDir(stream)
+	if err != nil {
+		return err
+	}
+	return fsutil.Send(stream.Context(), stream, dir.Dir, dir.Opt)
+}
+
+// TarStream sends the requested directory as a tar archive.
+func (p *FSSyncProvider) TarStream(stream FileSync_TarStreamServer) error {
+	dir, err := p.requestedDir(stream)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(&packetWriter{stream: stream}, 32*1<<10)
+	if err := fsutil.WriteTar(stream.Context(), dir.Dir, dir.Opt.WalkOpt, w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return stream.Send(&fsutil.Packet{Type: fsutil.PACKET_FIN})
+}
+
+func (p *FSSyncProvider) requestedDir(stream grpc.ServerStream) (SyncedDir, error) {
+	var name string
+	if md, ok := metadata.FromIncomingContext(stream.Context()); ok {
+		if v := md[keyDirName]; len(v) > 0 {
+			name = v[0]
+		}
+	}
+	dir, ok := p.dirs[name]
+	if !ok {
+		return SyncedDir{}, errors.Errorf("no access allowed to dir %q", name)
+	}
+	return dir, nil
+}
+
+// packetWriter sends the data written to it in PACKET_DATA packets.
+type packetWriter struct {
+	stream FileSync_TarStreamServer
+}
+
+func (w *packetWriter) Write(dt []byte) (int, error) {
+	if err := w.stream.Send(&fsutil.Packet{Type: fsutil.PACKET_DATA, Data: dt}); err != nil {
+		return 0, err
+	}
+	return len(dt), nil
+}
+
+// FSSyncTarget receives the directory copied to it with CopyTo.
+type FSSyncTarget struct {
+	dest string
+	opt  fsutil.ReceiveOpt
+}
+
+// NewFSSyncTarget returns a target receiving into dest.
+func NewFSSyncTarget(dest string, opt fsutil.ReceiveOpt) *FSSyncTarget {
+	return &FSSyncTarget{dest: dest, opt: opt}
+}
+
+func (t *FSSyncTarget) Register(server *grpc.Server) {
+	RegisterFileSendServer(server, t)
+}
+
+// DiffCopy receives the directory sent by the client.
+func (t *FSSyncTarget) DiffCopy(stream FileSend_DiffCopyServer) error {
+	return fsutil.Receive(stream.Context(), stream, t.dest, t.opt)
+}
+
+// FSSync receives the directory name served by the FSSyncProvider on the
+// other end of conn into dest.
+func FSSync(ctx context.Context, conn *grpc.ClientConn, name, dest string, opt fsutil.ReceiveOpt) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ctx = metadata.NewOutgoingContext(ctx, metadata.Pairs(keyDirName, name))
+	stream, err := NewFileSyncClient(conn).DiffCopy(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "failed to request %s", name)
+	}
+	if err := fsutil.Receive(ctx, stream, dest, opt); err != nil {
+		return err
+	}
+	return stream.CloseSend()
+}
+
+// FSSyncTar writes the directory name served by the FSSyncProvider on the
+// other end of conn to w as a tar archive.
+func FSSyncTar(ctx context.Context, conn *grpc.ClientConn, name string, w io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ctx = metadata.NewOutgoingContext(ctx, metadata.Pairs(keyDirName, name))
+	stream, err := NewFileSyncClient(conn).TarStream(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "failed to request %s", name)
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	for {
+		p, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				return errors.Errorf("tar stream of %s ended unexpectedly", name)
+			}
+			return err
+		}
+		switch p.Type {
+		case fsutil.PACKET_DATA:
+			if _, err := w.Write(p.Data); err != nil {
+				return err
+			}
+		case fsutil.PACKET_FIN:
+			return nil
+		default:
+			return errors.Errorf("unexpected packet %s in tar stream", p.Type)
+		}
+	}
+}
+
+// CopyTo sends root to the FSSyncTarget on the other end of conn.
+func CopyTo(ctx context.Context, conn *grpc.ClientConn, root string, opt fsutil.SendOpt) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := NewFileSendClient(conn).DiffCopy(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to start copy")
+	}
+	if err := fsutil.Send(ctx, stream, root, opt); err != nil {
+		return err
+	}
+	return stream.CloseSend()
+}
@@ -0,0 +1,114 @@
+// +build linux
+
+package filesync
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonistiigi/fsutil"
+	"github.com/tonistiigi/fsutil/fstest"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+func TestFileSync(t *testing.T) {
+	src, err := fstest.TmpDir(fstest.ChangeStream([]string{
+		"ADD foo dir",
+		"ADD foo/bar file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(src)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	dest2, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest2)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server := grpc.NewServer()
+	for _, a := range []Attachable{
+		NewFSSyncProvider([]SyncedDir{{Name: "context", Dir: src}}),
+		NewFSSyncTarget(dest2, fsutil.ReceiveOpt{}),
+	} {
+		a.Register(server)
+	}
+	go server.Serve(l)
+	defer server.Stop()
+
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	ctx := context.Background()
+	err = FSSync(ctx, conn, "context", dest, fsutil.ReceiveOpt{})
+	assert.NoError(t, err)
+
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "foo/bar"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data1", string(dt))
+
+	err = FSSync(ctx, conn, "other", dest, fsutil.ReceiveOpt{})
+	assert.Error(t, err)
+
+	err = CopyTo(ctx, conn, src, fsutil.SendOpt{})
+	assert.NoError(t, err)
+
+	dt, err = ioutil.ReadFile(filepath.Join(dest2, "foo/bar"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data1", string(dt))
+}
+
+func TestFileSyncTar(t *testing.T) {
+	src, err := fstest.TmpDir(fstest.ChangeStream([]string{
+		"ADD foo dir",
+		"ADD foo/bar file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(src)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server := grpc.NewServer()
+	NewFSSyncProvider([]SyncedDir{{Name: "context", Dir: src}}).Register(server)
+	go server.Serve(l)
+	defer server.Stop()
+
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	ctx := context.Background()
+	buf := &bytes.Buffer{}
+	err = FSSyncTar(ctx, conn, "context", buf)
+	assert.NoError(t, err)
+
+	tr := tar.NewReader(buf)
+	hdr, err := tr.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "foo/", hdr.Name)
+	hdr, err = tr.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "foo/bar", hdr.Name)
+	dt, err := ioutil.ReadAll(tr)
+	assert.NoError(t, err)
+	assert.Equal(t, "data1", string(dt))
+	_, err = tr.Next()
+	assert.Equal(t, io.EOF, err)
+
+	err = FSSyncTar(ctx, conn, "other", buf)
+	assert.Error(t, err)
+}
@@ -0,0 +1,3 @@
+package filesync
+
+//go:generate protoc -I=. -I=.. -I=../../../.. --gogoslick_out=plugins=grpc:. filesync.proto
@@ -0,0 +1,137 @@
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Filter selects and rewrites the entries of a tree. Filters are used by Walk
+// through WalkOpt, and so by Send, and by Receive for the entries coming from
+// the sender.
+type Filter interface {
+	// Match reports whether the entry at path is kept. Leaving out a
+	// directory leaves out everything under it.
+	Match(path string, stat *Stat) (bool, error)
+	// Map rewrites a kept entry by changing stat in place. Changing
+	// stat.Path renames the entry; the new names need to keep the walk order
+	// of the original ones or the entries are recreated on every transfer.
+	// Hardlinks to a renamed entry need their Linkname renamed as well.
+	Map(path string, stat *Stat) error
+}
+
+// Chain returns a filter that keeps the entries matched by all filters and
+// applies their Map functions in order.
+func Chain(filters ...Filter) Filter {
+	return chain(filters)
+}
+
+type chain []Filter
+
+func (c chain) Match(path string, stat *Stat) (bool, error) {
+	for _, f := range c {
+		if ok, err := f.Match(path, stat); err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (c chain) Map(path string, stat *Stat) error {
+	for _, f := range c {
+		if err := f.Map(path, stat); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MatchFunc is a Filter that only selects entries.
+type MatchFunc func(path string, stat *Stat) (bool, error)
+
+func (f MatchFunc) Match(path string, stat *Stat) (bool, error) {
+	return f(path, stat)
+}
+
+func (f MatchFunc) Map(path string, stat *Stat) error {
+	return nil
+}
+
+// MapFunc is a Filter that keeps all entries and rewrites them.
+type MapFunc func(path string, stat *Stat) error
+
+func (f MapFunc) Match(path string, stat *Stat) (bool, error) {
+	return true, nil
+}
+
+func (f MapFunc) Map(path string, stat *Stat) error {
+	return f(path, stat)
+}
+
+// MaxSize returns a filter leaving out regular files larger than n bytes.
+func MaxSize(n int64) Filter {
+	return MatchFunc(func(path string, stat *Stat) (bool, error) {
+		return !os.FileMode(stat.Mode).IsRegular() || stat.Size_ <= n, nil
+	})
+}
+
+// WithEpoch returns a filter setting the modification time of all entries to
+// t, for example for reproducible outputs. Used in WalkOpt it applies to
+// Send and WriteTar, see DiskWriterOpt.Epoch for writing entries.
+func WithEpoch(t time.Time) Filter {
+	ns := t.UnixNano()
+	return MapFunc(func(path string, stat *Stat) error {
+		stat.ModTime = ns
+		return nil
+	})
+}
+
+// statFilter applies a filter to a stream of stats in walk order.
+type statFilter struct {
+	f       Filter
+	skip    string
+	dropped map[string]struct{}
+}
+
+func newStatFilter(f Filter) *statFilter {
+	return &statFilter{f: f, dropped: map[string]struct{}{}}
+}
+
+// filter returns false if the entry is left out. Hardlinks to files that were
+// left out, also with one of their parent directories, are turned into
+// regular files.
+func (sf *statFilter) filter(st *Stat) (bool, error) {
+	if sf.skip != "" && strings.HasPrefix(st.Path, sf.skip) {
+		return false, nil
+	}
+	sf.skip = ""
+
+	p := st.Path
+	ok, err := sf.f.Match(p, st)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		if os.FileMode(st.Mode).IsDir() {
+			sf.skip = p + string(filepath.Separator)
+		}
+		sf.dropped[p] = struct{}{}
+		return false, nil
+	}
+	if st.Linkname != "" && os.FileMode(st.Mode)&os.ModeSymlink == 0 && sf.isDropped(st.Linkname) {
+		st.Linkname = ""
+	}
+	return true, sf.f.Map(p, st)
+}
+
+// isDropped returns true if the entry at p or one of its parent directories
+// was left out.
+func (sf *statFilter) isDropped(p string) bool {
+	for ; p != "." && p != string(filepath.Separator); p = filepath.Dir(p) {
+		if _, ok := sf.dropped[p]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+// +build windows
+
+package fsutil
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatFilterBackslash(t *testing.T) {
+	f := newStatFilter(MatchFunc(func(p string, st *Stat) (bool, error) {
+		return p != `a` && p != `b\c`, nil
+	}))
+	dir := uint32(os.ModeDir | 0755)
+	for _, tc := range []struct {
+		path string
+		mode uint32
+		ok   bool
+	}{
+		{`a`, dir, false},
+		{`a\b`, dir, false},
+		{`a\b\c`, 0644, false},
+		{`ab`, 0644, true},
+		{`b`, dir, true},
+		{`b\c`, dir, false},
+		{`b\c\d`, 0644, false},
+		{`b\cd`, 0644, true},
+	} {
+		ok, err := f.filter(&Stat{Path: tc.path, Mode: tc.mode})
+		assert.NoError(t, err, tc.path)
+		assert.Equal(t, tc.ok, ok, tc.path)
+	}
+}
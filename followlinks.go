@@ -0,0 +1,116 @@
+package fsutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// followLinks returns patterns with the symlinks along them resolved under
+// root. The links and the paths they point to are added after the patterns.
+// Targets outside of root are resolved as if root was the filesystem root. A
+// link that is reached again while resolving it is not followed further.
+func followLinks(root string, patterns []string) ([]string, error) {
+	r := &linkResolver{root: root, added: make(map[string]struct{})}
+	for _, p := range patterns {
+		r.added[p] = struct{}{}
+	}
+	out := append([]string{}, patterns...)
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "!") {
+			continue
+		}
+		if err := r.resolve(".", splitPath(p), nil); err != nil {
+			return nil, err
+		}
+	}
+	return append(out, r.out...), nil
+}
+
+type linkResolver struct {
+	root  string
+	added map[string]struct{}
+	out   []string
+}
+
+func (r *linkResolver) add(p string) {
+	if _, ok := r.added[p]; ok {
+		return
+	}
+	r.added[p] = struct{}{}
+	r.out = append(r.out, p)
+}
+
+// resolve follows the links in the pattern parts under dir. chain holds the
+// links followed to get to dir.
+func (r *linkResolver) resolve(dir string, parts []string, chain []string) error {
+	for len(parts) > 0 {
+		part := parts[0]
+		if part == "**" {
+			break
+		}
+		if strings.ContainsAny(part, "*?[\\") {
+			fis, err := ioutil.ReadDir(filepath.Join(r.root, dir))
+			if err != nil {
+				if isNotExist(err) {
+					return nil
+				}
+				return errors.Wrapf(err, "failed to read dir %s", dir)
+			}
+			for _, fi := range fis {
+				if ok, _ := filepath.Match(part, fi.Name()); !ok {
+					continue
+				}
+				if err := r.resolve(dir, append([]string{fi.Name()}, parts[1:]...), chain); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		p := filepath.Join(dir, part)
+		fi, err := os.Lstat(filepath.Join(r.root, p))
+		if err != nil {
+			if isNotExist(err) {
+				break
+			}
+			return errors.Wrapf(err, "failed to lstat %s", p)
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			dir = p
+			parts = parts[1:]
+			continue
+		}
+		for _, l := range chain {
+			if l == p {
+				return nil
+			}
+		}
+		link, err := os.Readlink(filepath.Join(r.root, p))
+		if err != nil {
+			return errors.Wrapf(err, "failed to readlink %s", p)
+		}
+		r.add(p)
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(dir, link)
+		}
+		target := append(splitPath(link), parts[1:]...)
+		return r.resolve(".", target, append(chain[:len(chain):len(chain)], p))
+	}
+	if p := filepath.Join(append([]string{dir}, parts...)...); len(chain) > 0 && p != "." {
+		r.add(p)
+	}
+	return nil
+}
+
+// splitPath returns the elements of p cleaned as a path under the root.
+func splitPath(p string) []string {
+	p = filepath.Join(string(filepath.Separator), filepath.FromSlash(p))
+	p = strings.TrimPrefix(p, string(filepath.Separator))
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, string(filepath.Separator))
+}
@@ -0,0 +1,40 @@
+package fsutil
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+)
+
+// FS is a source of files that can be sent with SendFS, for example a
+// directory, an archive or a tree kept in memory.
+type FS interface {
+	// Walk calls fn for every entry in lexical order, parents before their
+	// children. The file infos need to return a *Stat from Sys.
+	Walk(ctx context.Context, fn filepath.WalkFunc) error
+	// Open returns the contents of the regular file at the path passed to
+	// the walk function. Readers that are io.Seeker are seeked to continue
+	// interrupted files.
+	Open(p string) (io.ReadCloser, error)
+}
+
+// NewFS returns the FS of the directory at root with the entries accepted by
+// opt.
+func NewFS(root string, opt *WalkOpt) FS {
+	return &dirFS{root: root, opt: opt}
+}
+
+type dirFS struct {
+	root string
+	opt  *WalkOpt
+}
+
+func (fs *dirFS) Walk(ctx context.Context, fn filepath.WalkFunc) error {
+	return Walk(ctx, fs.root, fs.opt, fn)
+}
+
+func (fs *dirFS) Open(p string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(fs.root, p))
+}
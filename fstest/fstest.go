@@ -0,0 +1,269 @@
+// Package fstest contains helpers for building directory fixtures and
+// asserting on the output of fsutil.Walk.
+//
+// Fixtures are described with a small DSL, one change per line:
+//
+//	ADD foo dir
+//	ADD foo/bar file data
+//	ADD foo/baz file >foo/bar
+//	ADD foo/link symlink ../foo
+//	DEL foo/bar file
+//
+// The first field is the kind of change (ADD, CHG or DEL), followed by the
+// path and the type of the entry. Files take optional data or, if prefixed
+// with '>', the path of the hardlink target. Symlinks require a target.
+package fstest
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil"
+	"golang.org/x/net/context"
+)
+
+// Change is a single parsed fixture entry.
+type Change struct {
+	Kind     fsutil.ChangeKind
+	Path     string
+	FileInfo os.FileInfo
+	Data     string
+}
+
+// ChangeStream parses a list of fixture lines. It panics on invalid input.
+func ChangeStream(dt []string) (changes []*Change) {
+	for _, s := range dt {
+		changes = append(changes, ParseChange(s))
+	}
+	return
+}
+
+// ParseChange parses a single fixture line. It panics on invalid input.
+func ParseChange(str string) *Change {
+	f := strings.Fields(str)
+	errStr := fmt.Sprintf("invalid change %q", str)
+	if len(f) < 3 {
+		panic(errStr)
+	}
+	c := &Change{}
+	switch f[0] {
+	case "ADD":
+		c.Kind = fsutil.ChangeKindAdd
+	case "CHG":
+		c.Kind = fsutil.ChangeKindModify
+	case "DEL":
+		c.Kind = fsutil.ChangeKindDelete
+	default:
+		panic(errStr)
+	}
+	c.Path = f[1]
+	st := &fsutil.Stat{Path: f[1]}
+	switch f[2] {
+	case "file":
+		if len(f) > 3 {
+			if f[3][0] == '>' {
+				st.Linkname = f[3][1:]
+			} else {
+				c.Data = f[3]
+				st.Size_ = int64(len(c.Data))
+			}
+		}
+	case "dir":
+		st.Mode |= uint32(os.ModeDir)
+	case "symlink":
+		if len(f) < 4 {
+			panic(errStr)
+		}
+		st.Mode |= uint32(os.ModeSymlink)
+		st.Linkname = f[3]
+	default:
+		panic(errStr)
+	}
+	c.FileInfo = &fsutil.StatInfo{Stat: st}
+	return c
+}
+
+// TmpDir creates a new temporary directory and applies the additions from
+// inp to it. The caller is responsible for removing the directory.
+func TmpDir(inp []*Change) (dir string, retErr error) {
+	tmpdir, err := ioutil.TempDir("", "fstest")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if retErr != nil {
+			os.RemoveAll(tmpdir)
+		}
+	}()
+	if err := Apply(tmpdir, inp); err != nil {
+		return "", err
+	}
+	return tmpdir, nil
+}
+
+// Apply applies the changes from inp to an existing directory.
+func Apply(dir string, inp []*Change) error {
+	for _, c := range inp {
+		p := filepath.Join(dir, c.Path)
+		if c.Kind == fsutil.ChangeKindDelete {
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+			continue
+		}
+		stat, ok := c.FileInfo.Sys().(*fsutil.Stat)
+		if !ok {
+			return errors.Errorf("invalid change without stat info %s", p)
+		}
+		if c.Kind == fsutil.ChangeKindModify {
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+		}
+		if c.FileInfo.IsDir() {
+			if err := os.Mkdir(p, 0700); err != nil {
+				return err
+			}
+		} else if c.FileInfo.Mode()&os.ModeSymlink != 0 {
+			if err := os.Symlink(stat.Linkname, p); err != nil {
+				return err
+			}
+		} else if len(stat.Linkname) > 0 {
+			if err := os.Link(filepath.Join(dir, stat.Linkname), p); err != nil {
+				return err
+			}
+		} else {
+			if err := ioutil.WriteFile(p, []byte(c.Data), 0600); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// BufWalk returns a walk function writing a line for every entry to buf in
+// the format returned by WalkString.
+func BufWalk(buf *bytes.Buffer) filepath.WalkFunc {
+	return func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		stat, ok := fi.Sys().(*fsutil.Stat)
+		if !ok {
+			return errors.Errorf("invalid fileinfo without stat info %s", path)
+		}
+		t := "file"
+		if fi.IsDir() {
+			t = "dir"
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			t = "symlink:" + stat.Linkname
+		}
+		fmt.Fprintf(buf, "%s %s", t, path)
+		if fi.Mode()&os.ModeSymlink == 0 && stat.Linkname != "" {
+			fmt.Fprintf(buf, " >%s", stat.Linkname)
+		}
+		fmt.Fprintln(buf)
+		return nil
+	}
+}
+
+// WalkString walks root and returns a line for every entry, for example:
+//
+//	dir foo
+//	file foo/bar
+//	file foo/baz >foo/bar
+//	symlink:../foo foo/link
+func WalkString(root string, opt *fsutil.WalkOpt) (string, error) {
+	b := &bytes.Buffer{}
+	if err := fsutil.Walk(context.Background(), root, opt, BufWalk(b)); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Compare returns an error describing the first difference between the
+// directories a and b. Entries are compared by type, permissions, size, link
+// targets and the contents of regular files.
+func Compare(a, b string) error {
+	sa, err := WalkString(a, nil)
+	if err != nil {
+		return err
+	}
+	sb, err := WalkString(b, nil)
+	if err != nil {
+		return err
+	}
+	if sa != sb {
+		return errors.Errorf("walk output differs:\n%s", lineDiff(sa, sb))
+	}
+	return filepath.Walk(a, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(a, p)
+		if err != nil {
+			return err
+		}
+		fi2, err := os.Lstat(filepath.Join(b, rel))
+		if err != nil {
+			return err
+		}
+		if fi.Mode() != fi2.Mode() {
+			return errors.Errorf("mode mismatch for %s: %s %s", rel, fi.Mode(), fi2.Mode())
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		if fi.Size() != fi2.Size() {
+			return errors.Errorf("size mismatch for %s: %d %d", rel, fi.Size(), fi2.Size())
+		}
+		dt1, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		dt2, err := ioutil.ReadFile(filepath.Join(b, rel))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(dt1, dt2) {
+			return errors.Errorf("content mismatch for %s", rel)
+		}
+		return nil
+	})
+}
+
+// lineDiff returns the lines only present in one of the inputs, prefixed
+// with "-" for a and "+" for b.
+func lineDiff(a, b string) string {
+	la := strings.Split(a, "\n")
+	lb := strings.Split(b, "\n")
+	inA := make(map[string]struct{}, len(la))
+	for _, l := range la {
+		inA[l] = struct{}{}
+	}
+	inB := make(map[string]struct{}, len(lb))
+	for _, l := range lb {
+		inB[l] = struct{}{}
+	}
+	var out []string
+	for _, l := range la {
+		if _, ok := inB[l]; !ok {
+			out = append(out, "-"+l)
+		}
+	}
+	for _, l := range lb {
+		if _, ok := inA[l]; !ok {
+			out = append(out, "+"+l)
+		}
+	}
+	if len(out) == 0 {
+		return "entries out of order"
+	}
+	return strings.Join(out, "\n")
+}
@@ -0,0 +1,52 @@
+package fstest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTmpDir(t *testing.T) {
+	d, err := TmpDir(ChangeStream([]string{
+		"ADD bar dir",
+		"ADD bar/foo file data1",
+		"ADD bar/foo2 symlink ../foo",
+		"ADD foo file >bar/foo",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	out, err := WalkString(d, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `dir bar
+file bar/foo
+symlink:../foo bar/foo2
+file foo >bar/foo
+`, out)
+
+	dt, err := ioutil.ReadFile(filepath.Join(d, "foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data1", string(dt))
+
+	err = Apply(d, ChangeStream([]string{
+		"DEL bar/foo2 file",
+		"CHG foo dir",
+	}))
+	assert.NoError(t, err)
+
+	out, err = WalkString(d, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `dir bar
+file bar/foo
+dir foo
+`, out)
+}
+
+func TestParseChangeInvalid(t *testing.T) {
+	assert.Panics(t, func() { ParseChange("ADD foo") })
+	assert.Panics(t, func() { ParseChange("MOV foo file") })
+	assert.Panics(t, func() { ParseChange("ADD foo symlink") })
+}
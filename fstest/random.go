@@ -0,0 +1,209 @@
+package fstest
+
+import (
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/tonistiigi/fsutil"
+)
+
+// RandomTreeOpt controls the trees generated by RandomTree.
+type RandomTreeOpt struct {
+	// MaxDepth is the maximum depth of nested directories.
+	MaxDepth int
+	// MaxEntries is the maximum number of entries in a directory.
+	MaxEntries int
+	// MaxFileSize is the maximum size of a regular file.
+	MaxFileSize int
+}
+
+// DefaultRandomTreeOpt is used by RandomTree for zero values in the options.
+var DefaultRandomTreeOpt = RandomTreeOpt{
+	MaxDepth:    4,
+	MaxEntries:  8,
+	MaxFileSize: 64 * 1024,
+}
+
+// nameChars contains characters sorting before and after the path separator
+// and multi-byte characters to exercise path ordering and encoding.
+var nameChars = []rune("abcxyzABZ019 -._~!+,=@#ÄöЖ日本語😀")
+
+// RandomTree generates a random directory tree of files, directories,
+// symlinks and hardlinks. The changes are returned in walk order and can be
+// passed to TmpDir or Apply.
+func RandomTree(r *rand.Rand, opt RandomTreeOpt) []*Change {
+	g := &generator{r: r, opt: withDefaults(opt)}
+	g.dir("", 0)
+	return g.changes
+}
+
+// Mutate returns a random set of changes for a tree previously generated
+// with RandomTree, including modified contents, changed types, deletions and
+// additions. The returned changes can be passed to Apply.
+func Mutate(r *rand.Rand, tree []*Change, opt RandomTreeOpt) []*Change {
+	g := &generator{r: r, opt: withDefaults(opt), noLinks: true}
+	var out []*Change
+	removed := map[string]struct{}{}
+	linked := map[string]struct{}{}
+	for _, c := range tree {
+		if st, ok := c.FileInfo.Sys().(*fsutil.Stat); ok && !c.FileInfo.IsDir() && c.FileInfo.Mode()&os.ModeSymlink == 0 && st.Linkname != "" {
+			linked[st.Linkname] = struct{}{}
+		}
+	}
+	for _, c := range tree {
+		if isRemoved(c.Path, removed) {
+			continue
+		}
+		if _, ok := linked[c.Path]; ok {
+			continue
+		}
+		switch g.r.Intn(10) {
+		case 0:
+			out = append(out, &Change{Kind: fsutil.ChangeKindDelete, Path: c.Path, FileInfo: c.FileInfo})
+			removed[c.Path] = struct{}{}
+		case 1:
+			if c.FileInfo.IsDir() {
+				out = append(out, g.file(c.Path, fsutil.ChangeKindModify))
+				removed[c.Path] = struct{}{}
+			} else {
+				out = append(out, g.file(c.Path, fsutil.ChangeKindModify))
+			}
+		case 2:
+			if c.FileInfo.IsDir() {
+				g.dir(c.Path, g.opt.MaxDepth-1)
+			}
+		}
+	}
+	for _, c := range g.changes {
+		if c.Kind != fsutil.ChangeKindAdd || isRemoved(path.Dir(c.Path), removed) {
+			continue
+		}
+		if exists(c.Path, tree) {
+			// leave out the new entries under it too, it may not be a directory
+			removed[c.Path] = struct{}{}
+			continue
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func withDefaults(opt RandomTreeOpt) RandomTreeOpt {
+	if opt.MaxDepth == 0 {
+		opt.MaxDepth = DefaultRandomTreeOpt.MaxDepth
+	}
+	if opt.MaxEntries == 0 {
+		opt.MaxEntries = DefaultRandomTreeOpt.MaxEntries
+	}
+	if opt.MaxFileSize == 0 {
+		opt.MaxFileSize = DefaultRandomTreeOpt.MaxFileSize
+	}
+	return opt
+}
+
+func isRemoved(p string, removed map[string]struct{}) bool {
+	for p != "." && p != "/" && p != "" {
+		if _, ok := removed[p]; ok {
+			return true
+		}
+		p = path.Dir(p)
+	}
+	return false
+}
+
+func exists(p string, tree []*Change) bool {
+	for _, c := range tree {
+		if c.Path == p {
+			return true
+		}
+	}
+	return false
+}
+
+type generator struct {
+	r       *rand.Rand
+	opt     RandomTreeOpt
+	changes []*Change
+	files   []string
+	noLinks bool
+}
+
+func (g *generator) dir(p string, depth int) {
+	n := g.r.Intn(g.opt.MaxEntries + 1)
+	names := map[string]struct{}{}
+	for i := 0; i < n; i++ {
+		names[g.name()] = struct{}{}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		fp := path.Join(p, name)
+		switch t := g.r.Intn(10); {
+		case t < 3 && depth < g.opt.MaxDepth:
+			g.changes = append(g.changes, &Change{
+				Kind:     fsutil.ChangeKindAdd,
+				Path:     fp,
+				FileInfo: &fsutil.StatInfo{Stat: &fsutil.Stat{Path: fp, Mode: uint32(os.ModeDir | 0755)}},
+			})
+			g.dir(fp, depth+1)
+		case t < 4:
+			g.changes = append(g.changes, g.symlink(fp))
+		case t < 5 && len(g.files) > 0 && !g.noLinks:
+			target := g.files[g.r.Intn(len(g.files))]
+			g.changes = append(g.changes, &Change{
+				Kind:     fsutil.ChangeKindAdd,
+				Path:     fp,
+				FileInfo: &fsutil.StatInfo{Stat: &fsutil.Stat{Path: fp, Mode: 0644, Linkname: target}},
+			})
+		default:
+			g.changes = append(g.changes, g.file(fp, fsutil.ChangeKindAdd))
+			g.files = append(g.files, fp)
+		}
+	}
+}
+
+func (g *generator) file(p string, kind fsutil.ChangeKind) *Change {
+	size := 0
+	if g.opt.MaxFileSize > 0 {
+		size = g.r.Intn(g.opt.MaxFileSize + 1)
+	}
+	dt := make([]byte, size)
+	g.r.Read(dt)
+	return &Change{
+		Kind:     kind,
+		Path:     p,
+		Data:     string(dt),
+		FileInfo: &fsutil.StatInfo{Stat: &fsutil.Stat{Path: p, Mode: 0644, Size_: int64(size)}},
+	}
+}
+
+func (g *generator) symlink(p string) *Change {
+	target := g.name()
+	if g.r.Intn(2) == 0 {
+		target = "../" + target
+	}
+	return &Change{
+		Kind:     fsutil.ChangeKindAdd,
+		Path:     p,
+		FileInfo: &fsutil.StatInfo{Stat: &fsutil.Stat{Path: p, Mode: uint32(os.ModeSymlink | 0777), Linkname: target}},
+	}
+}
+
+func (g *generator) name() string {
+	for {
+		n := 1 + g.r.Intn(8)
+		rs := make([]rune, n)
+		for i := range rs {
+			rs[i] = nameChars[g.r.Intn(len(nameChars))]
+		}
+		name := string(rs)
+		if name != "." && name != ".." {
+			return name
+		}
+	}
+}
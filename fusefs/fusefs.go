@@ -0,0 +1,181 @@
+// +build linux
+
+// Package fusefs mounts a tree received with fsutil.ReceiveLazy as a
+// read-only FUSE filesystem, so builders can use the entries before the file
+// contents were transferred. The contents of a file are fetched from the
+// sender when it is first opened. Files are always transferred completely,
+// also when only a part of them is read.
+package fusefs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil"
+	"golang.org/x/net/context"
+)
+
+// Mount serves the tree received with fsutil.ReceiveLazy read-only at
+// mountpoint until the filesystem is unmounted or ctx is cancelled. The tree
+// is not closed when Mount returns.
+func Mount(ctx context.Context, t *fsutil.LazyTree, mountpoint string) error {
+	c, err := fuse.Mount(mountpoint, fuse.ReadOnly(), fuse.FSName("fsutil"), fuse.Subtype("fsutil"))
+	if err != nil {
+		return errors.Wrapf(err, "failed to mount %s", mountpoint)
+	}
+	defer c.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			fuse.Unmount(mountpoint)
+		case <-done:
+		}
+	}()
+
+	if err := fs.Serve(c, NewFS(t)); err != nil {
+		return errors.Wrapf(err, "failed to serve %s", mountpoint)
+	}
+	<-c.Ready
+	if c.MountError != nil {
+		return errors.Wrapf(c.MountError, "failed to mount %s", mountpoint)
+	}
+	return ctx.Err()
+}
+
+// FS is a read-only filesystem serving a fsutil.LazyTree. It can be passed to
+// fs.Serve for mounts that need other options than the ones set by Mount.
+type FS struct {
+	t *fsutil.LazyTree
+}
+
+// NewFS returns a FS serving t.
+func NewFS(t *fsutil.LazyTree) *FS {
+	return &FS{t: t}
+}
+
+func (f *FS) Root() (fs.Node, error) {
+	return &node{t: f.t, p: ""}, nil
+}
+
+// node is an entry of the tree at path p.
+type node struct {
+	t *fsutil.LazyTree
+	p string
+}
+
+func (n *node) Attr(ctx context.Context, a *fuse.Attr) error {
+	fi, err := n.t.Stat(n.p)
+	if err != nil {
+		return toErrno(err)
+	}
+	a.Mode = fi.Mode()
+	a.Size = uint64(fi.Size())
+	a.Blocks = (a.Size + 511) / 512
+	a.Mtime = fi.ModTime()
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		a.Nlink = uint32(st.Nlink)
+		a.Uid = st.Uid
+		a.Gid = st.Gid
+		a.Atime = time.Unix(st.Atim.Unix())
+		a.Ctime = time.Unix(st.Ctim.Unix())
+	}
+	return nil
+}
+
+func (n *node) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	p := filepath.Join(n.p, name)
+	if _, err := n.t.Stat(p); err != nil {
+		return nil, toErrno(err)
+	}
+	return &node{t: n.t, p: p}, nil
+}
+
+func (n *node) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	fis, err := n.t.ReadDir(n.p)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	out := make([]fuse.Dirent, 0, len(fis))
+	for _, fi := range fis {
+		out = append(out, fuse.Dirent{Name: fi.Name(), Type: direntType(fi.Mode())})
+	}
+	return out, nil
+}
+
+func (n *node) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	target, err := n.t.Readlink(n.p)
+	if err != nil {
+		return "", toErrno(err)
+	}
+	return target, nil
+}
+
+// Open materializes regular files. Directories are read through the node.
+func (n *node) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if req.Dir {
+		return n, nil
+	}
+	f, err := n.t.Open(ctx, n.p)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	// the contents don't change once they were fetched
+	resp.Flags |= fuse.OpenKeepCache
+	return &handle{f: f}, nil
+}
+
+type handle struct {
+	f *os.File
+}
+
+func (h *handle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	buf := make([]byte, req.Size)
+	n, err := h.f.ReadAt(buf, req.Offset)
+	if err != nil && err != io.EOF {
+		return toErrno(err)
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+func (h *handle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return h.f.Close()
+}
+
+func direntType(m os.FileMode) fuse.DirentType {
+	switch {
+	case m.IsDir():
+		return fuse.DT_Dir
+	case m&os.ModeSymlink != 0:
+		return fuse.DT_Link
+	case m&os.ModeNamedPipe != 0:
+		return fuse.DT_FIFO
+	case m&os.ModeSocket != 0:
+		return fuse.DT_Socket
+	case m&os.ModeCharDevice != 0:
+		return fuse.DT_Char
+	case m&os.ModeDevice != 0:
+		return fuse.DT_Block
+	}
+	return fuse.DT_File
+}
+
+// toErrno returns the errno of failed filesystem calls so the kernel reports
+// them instead of EIO.
+func toErrno(err error) error {
+	if pe, ok := errors.Cause(err).(*os.PathError); ok {
+		if errno, ok := pe.Err.(syscall.Errno); ok {
+			return fuse.Errno(errno)
+		}
+	}
+	return err
+}
@@ -0,0 +1,153 @@
+// +build linux
+
+package fusefs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/tonistiigi/fsutil"
+	"github.com/tonistiigi/fsutil/fstest"
+	"github.com/tonistiigi/fsutil/util"
+	"golang.org/x/net/context"
+)
+
+// receiveLazy receives src lazily into a temporary directory.
+func receiveLazy(t *testing.T, src string) (*fsutil.LazyTree, func()) {
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	s1 := util.NewProtoStream(r1, w2)
+	s2 := util.NewProtoStream(r2, w1)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- fsutil.Send(context.Background(), s1, src, fsutil.SendOpt{})
+	}()
+	tree, err := fsutil.ReceiveLazy(context.Background(), s2, dest, fsutil.ReceiveOpt{})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return tree, func() {
+		assert.NoError(t, tree.Close())
+		assert.NoError(t, <-sendErr)
+		os.RemoveAll(dest)
+	}
+}
+
+func TestFS(t *testing.T) {
+	src, err := fstest.TmpDir(fstest.ChangeStream([]string{
+		"ADD bar dir",
+		"ADD bar/baz file data1",
+		"ADD foo symlink bar/baz",
+		"ADD qux file data22",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(src)
+
+	tree, done := receiveLazy(t, src)
+	defer done()
+
+	ctx := context.Background()
+	root, err := NewFS(tree).Root()
+	assert.NoError(t, err)
+
+	dirents, err := root.(fs.HandleReadDirAller).ReadDirAll(ctx)
+	assert.NoError(t, err)
+	var names []string
+	for _, d := range dirents {
+		names = append(names, d.Name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"bar", "foo", "qux"}, names)
+
+	lookup := func(n fs.Node, name string) fs.Node {
+		c, err := n.(fs.NodeStringLookuper).Lookup(ctx, name)
+		assert.NoError(t, err)
+		return c
+	}
+
+	// the size of a file is known before its contents are fetched
+	qux := lookup(root, "qux")
+	var a fuse.Attr
+	assert.NoError(t, qux.Attr(ctx, &a))
+	assert.Equal(t, uint64(6), a.Size)
+	assert.True(t, a.Mode.IsRegular())
+	assert.Contains(t, tree.Pending(), "qux")
+
+	h, err := qux.(fs.NodeOpener).Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+	assert.NoError(t, err)
+	resp := &fuse.ReadResponse{}
+	assert.NoError(t, h.(fs.HandleReader).Read(ctx, &fuse.ReadRequest{Offset: 2, Size: 10}, resp))
+	assert.Equal(t, "ta22", string(resp.Data))
+	assert.NoError(t, h.(fs.HandleReleaser).Release(ctx, &fuse.ReleaseRequest{}))
+	assert.NotContains(t, tree.Pending(), "qux")
+
+	foo := lookup(root, "foo")
+	target, err := foo.(fs.NodeReadlinker).Readlink(ctx, &fuse.ReadlinkRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, "bar/baz", target)
+
+	baz := lookup(lookup(root, "bar"), "baz")
+	assert.NoError(t, baz.Attr(ctx, &a))
+	assert.Equal(t, uint64(5), a.Size)
+
+	_, err = root.(fs.NodeStringLookuper).Lookup(ctx, "missing")
+	assert.Equal(t, fuse.ENOENT, err)
+}
+
+func TestMount(t *testing.T) {
+	if _, err := exec.LookPath("fusermount"); err != nil {
+		t.Skip("fusermount is not available")
+	}
+	src, err := fstest.TmpDir(fstest.ChangeStream([]string{
+		"ADD bar dir",
+		"ADD bar/baz file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(src)
+
+	tree, done := receiveLazy(t, src)
+	defer done()
+
+	mnt, err := ioutil.TempDir("", "mnt")
+	assert.NoError(t, err)
+	defer os.RemoveAll(mnt)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mountErr := make(chan error, 1)
+	go func() {
+		mountErr <- Mount(ctx, tree, mnt)
+	}()
+
+	// the mount is read by another process, opening files of the mount from
+	// the serving process can deadlock in the poller
+	var dt []byte
+	for i := 0; i < 100; i++ {
+		if dt, err = exec.Command("cat", filepath.Join(mnt, "bar/baz")).Output(); err == nil {
+			break
+		}
+		select {
+		case err := <-mountErr:
+			t.Skipf("mount failed: %v", err)
+		default:
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+	assert.Equal(t, "data1", string(dt))
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-mountErr)
+}
@@ -0,0 +1,111 @@
+package fsutil
+
+import (
+	"sync"
+)
+
+// ProtocolVersion is the version of the protocol implemented by this
+// package. Both sides of a transfer advertise it in a handshake before the
+// stats are sent. Peers that predate the handshake have version 0.
+const ProtocolVersion = 1
+
+// Capabilities advertised in the handshake. Peers with version 0 are assumed
+// to support none of them.
+const (
+	// CapCompression is advertised by senders allowing compression and by
+	// receivers decoding compressed data.
+	CapCompression = "compression"
+	// CapXattrs is advertised by senders reading and receivers writing
+	// extended attributes. Windows peers don't.
+	CapXattrs = "xattrs"
+	// CapResume is advertised by peers continuing files from an offset after
+	// checking the digest of the part the receiver kept. Receivers transfer
+	// files from senders without it again from the start.
+	CapResume = "resume"
+	// CapSparse is advertised by senders sending holes and by receivers
+	// writing them.
+	CapSparse = "sparse"
+	// CapVerify is advertised by peers checking the checksums of the file
+	// contents. Receivers with VerifyChecksums fail the transfer with
+	// senders without it.
+	CapVerify = "verify"
+	// CapChunks is advertised by peers transferring files in chunks.
+	// Receivers request files from senders without it as a whole.
+	CapChunks = "chunks"
+)
+
+// PeerInfo is the protocol version and the capabilities the other side of a
+// transfer advertised in the handshake.
+type PeerInfo struct {
+	Version      uint32
+	Capabilities []string
+}
+
+// Has returns true if the peer advertised capability.
+func (pi PeerInfo) Has(capability string) bool {
+	for _, c := range pi.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// handshake advertises the capabilities of one side of a connection and
+// records the ones of the peer.
+type handshake struct {
+	caps     []string
+	fn       func(PeerInfo) error
+	sendOnce sync.Once
+
+	mu   sync.Mutex
+	peer *PeerInfo
+}
+
+func newHandshake(caps []string, fn func(PeerInfo) error) *handshake {
+	return &handshake{caps: caps, fn: fn}
+}
+
+// send sends the handshake packet the first time it is called.
+func (h *handshake) send(conn Stream) error {
+	var err error
+	h.sendOnce.Do(func() {
+		err = conn.SendMsg(&Packet{Type: PACKET_HELLO, Version: ProtocolVersion, Capabilities: h.caps})
+	})
+	return err
+}
+
+// recv is called with every packet received from the peer. It returns true
+// if p was a handshake packet that needs no further handling. The first
+// other packet that can't come before the handshake marks the peer as
+// predating it.
+func (h *handshake) recv(p *Packet) (bool, error) {
+	hello := p.Type == PACKET_HELLO
+	h.mu.Lock()
+	if h.peer != nil || !hello && (p.Type == PACKET_DIGEST || p.Type == PACKET_ERR) {
+		// only the first handshake is used
+		h.mu.Unlock()
+		return hello, nil
+	}
+	h.peer = &PeerInfo{}
+	if hello {
+		h.peer.Version = p.Version
+		h.peer.Capabilities = p.Capabilities
+	}
+	info := *h.peer
+	h.mu.Unlock()
+	if h.fn != nil {
+		if err := h.fn(info); err != nil {
+			return hello, err
+		}
+	}
+	return hello, nil
+}
+
+// has returns true if the peer advertised capability. It is false until the
+// handshake was received.
+func (h *handshake) has(capability string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.peer != nil && h.peer.Has(capability)
+}
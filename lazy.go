@@ -0,0 +1,286 @@
+package fsutil
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// LazyTree is a destination received with ReceiveLazy. All entries are
+// created with their final metadata but regular files are left empty until
+// their contents are requested with Open or Materialize. The connection to
+// the sender stays open until Close is called.
+type LazyTree struct {
+	r      *receiver
+	dest   string
+	ready  chan struct{}
+	done   chan struct{}
+	err    error
+	cancel func()
+
+	mu      sync.Mutex
+	pending map[string]*lazyFile
+}
+
+type lazyFile struct {
+	wc io.WriteCloser
+	// size is the size of the file at the sender
+	size int64
+	// fetching is set while the contents are fetched
+	fetching *lazyFetch
+}
+
+type lazyFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// ReceiveLazy receives the metadata of the sender's tree into dest and
+// returns once all entries have been created. File contents are fetched when
+// they are first accessed through the returned LazyTree. The session ends
+// when ctx is cancelled, so ctx needs to stay valid until Close is called.
+// NotifyHashed is not supported in this mode.
+func ReceiveLazy(ctx context.Context, conn Stream, dest string, opt ReceiveOpt) (*LazyTree, error) {
+	if opt.NotifyHashed != nil {
+		return nil, errors.New("NotifyHashed is not supported with lazy receive")
+	}
+	if opt.Atomic {
+		return nil, errors.New("Atomic is not supported with lazy receive")
+	}
+	if err := prepareDest(dest, opt); err != nil {
+		return nil, abortReceive([]Stream{conn}, err)
+	}
+	unlock, err := lockDest(dest)
+	if err != nil {
+		return nil, abortReceive([]Stream{conn}, err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+
+	t := &LazyTree{
+		r:       newReceiver([]Stream{conn}, dest, opt),
+		dest:    dest,
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+		cancel:  cancel,
+		pending: make(map[string]*lazyFile),
+	}
+	t.r.lazy = t
+
+	// the destination stays locked until the session ends
+	go func() {
+		t.err = t.r.run(ctx)
+		unlock()
+		close(t.done)
+	}()
+
+	select {
+	case <-t.ready:
+		return t, nil
+	case <-t.done:
+		cancel()
+		return nil, t.err
+	}
+}
+
+// register is used as the data function of the disk writer. It only records
+// the file so its contents can be requested later.
+func (t *LazyTree) register(ctx context.Context, p string, wc io.WriteCloser) error {
+	f := &lazyFile{wc: wc, size: -1}
+	if w, ok := wc.(*lazyFileWriter); ok {
+		f.size = w.size
+	}
+	t.mu.Lock()
+	t.pending[p] = f
+	t.mu.Unlock()
+	return nil
+}
+
+// Pending returns the paths of the files whose contents have not been
+// fetched yet.
+func (t *LazyTree) Pending() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]string, 0, len(t.pending))
+	for p, f := range t.pending {
+		if f.fetching == nil {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// Materialize fetches the contents of the file at p from the sender. Paths
+// that were already materialized or don't need any data are ignored. Files
+// that failed to be fetched are fetched again by the next call.
+func (t *LazyTree) Materialize(ctx context.Context, p string) error {
+	p, dest, err := t.path(p)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	f, ok := t.pending[p]
+	if !ok {
+		t.mu.Unlock()
+		return nil
+	}
+	if c := f.fetching; c != nil {
+		t.mu.Unlock()
+		select {
+		case <-c.done:
+			return c.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	c := &lazyFetch{done: make(chan struct{})}
+	f.fetching = c
+	t.mu.Unlock()
+
+	c.err = t.fetch(ctx, p, dest, f.wc)
+
+	t.mu.Lock()
+	if c.err == nil {
+		delete(t.pending, p)
+	} else {
+		f.fetching = nil
+	}
+	t.mu.Unlock()
+	close(c.done)
+	return c.err
+}
+
+func (t *LazyTree) fetch(ctx context.Context, p, dest string, wc io.WriteCloser) error {
+	select {
+	case <-t.done:
+		if t.err != nil {
+			return t.err
+		}
+		return errors.Errorf("session closed before %s was fetched", p)
+	default:
+	}
+	fi, err := os.Lstat(dest)
+	if err != nil {
+		return err
+	}
+	if err := t.r.asyncDataFunc(ctx, p, wc); err != nil {
+		// the partial contents are dropped so the file can be fetched again
+		if w, ok := wc.(*lazyFileWriter); ok {
+			if err := w.reset(); err != nil {
+				return err
+			}
+			if err := os.Chtimes(dest, fi.ModTime(), fi.ModTime()); err != nil {
+				return err
+			}
+		}
+		return errors.Wrapf(err, "failed to fetch %s", p)
+	}
+	return os.Chtimes(dest, fi.ModTime(), fi.ModTime())
+}
+
+// Open materializes the file at p and opens it for reading.
+func (t *LazyTree) Open(ctx context.Context, p string) (*os.File, error) {
+	if err := t.Materialize(ctx, p); err != nil {
+		return nil, err
+	}
+	_, dest, err := t.path(p)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(dest)
+}
+
+// Stat returns the file info of the entry at p. Files that were not
+// materialized report the size of their contents at the sender.
+func (t *LazyTree) Stat(p string) (os.FileInfo, error) {
+	p, dest, err := t.path(p)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Lstat(dest)
+	if err != nil {
+		return nil, err
+	}
+	return t.pendingInfo(p, fi), nil
+}
+
+// ReadDir returns the file infos of the entries of the directory at p sorted
+// by name, with the sizes reported by Stat.
+func (t *LazyTree) ReadDir(p string) ([]os.FileInfo, error) {
+	p, dest, err := t.path(p)
+	if err != nil {
+		return nil, err
+	}
+	fis, err := ioutil.ReadDir(dest)
+	if err != nil {
+		return nil, err
+	}
+	for i, fi := range fis {
+		fis[i] = t.pendingInfo(filepath.Join(p, fi.Name()), fi)
+	}
+	return fis, nil
+}
+
+// Readlink returns the target of the symlink at p.
+func (t *LazyTree) Readlink(p string) (string, error) {
+	_, dest, err := t.path(p)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(dest)
+}
+
+// path cleans p and returns it with the path of the entry in the
+// destination. Paths outside of the tree are rejected.
+func (t *LazyTree) path(p string) (string, string, error) {
+	p = filepath.Clean(p)
+	if p != "." {
+		if reason := checkPath(p); reason != "" {
+			return "", "", errors.WithStack(&ValidationError{Path: p, Reason: reason})
+		}
+	}
+	return p, filepath.Join(t.dest, p), nil
+}
+
+func (t *LazyTree) pendingInfo(p string, fi os.FileInfo) os.FileInfo {
+	t.mu.Lock()
+	f, ok := t.pending[p]
+	t.mu.Unlock()
+	if !ok || f.size < 0 || !fi.Mode().IsRegular() {
+		return fi
+	}
+	return &pendingFileInfo{FileInfo: fi, size: f.size}
+}
+
+// pendingFileInfo is the file info of a file whose contents were not
+// fetched yet.
+type pendingFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi *pendingFileInfo) Size() int64 {
+	return fi.size
+}
+
+// Close ends the session with the sender. Files that were not materialized
+// stay empty.
+func (t *LazyTree) Close() error {
+	defer t.cancel()
+	select {
+	case <-t.done:
+		return t.err
+	default:
+	}
+	for _, s := range t.r.peers {
+		if err := s.conn.SendMsg(&Packet{Type: PACKET_FIN}); err != nil {
+			return err
+		}
+	}
+	<-t.done
+	return t.err
+}
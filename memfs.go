@@ -0,0 +1,248 @@
+package fsutil
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// MemFS is a tree of entries kept in memory. Its HandleChange applies changes
+// like a DiskWriter does, for example the entries read by Untar, and it is an
+// FS so the tree can be sent with SendFS. The contents of regular files are
+// read from file infos implementing io.Reader, other files are stored empty.
+type MemFS struct {
+	mu   sync.RWMutex
+	root *memNode
+}
+
+type memNode struct {
+	stat *Stat
+	data []byte
+	// children are the entries of a directory by name
+	children map[string]*memNode
+}
+
+// NewMemFS returns an empty MemFS.
+func NewMemFS() *MemFS {
+	return &MemFS{root: &memNode{children: make(map[string]*memNode)}}
+}
+
+func (m *MemFS) HandleChange(kind ChangeKind, p string, fi os.FileInfo, err error) error {
+	if err != nil {
+		return err
+	}
+	if reason := checkPath(p); reason != "" {
+		return errors.WithStack(&ValidationError{Path: p, Reason: reason})
+	}
+	if kind == ChangeKindDelete {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if dir, err := m.lookupDir(filepath.Dir(p)); err == nil {
+			delete(dir.children, filepath.Base(p))
+		}
+		return nil
+	}
+
+	stat, ok := fi.Sys().(*Stat)
+	if !ok {
+		return errors.Errorf("%s invalid change without stat information", p)
+	}
+	st := *stat
+	st.Path = p
+	n := &memNode{stat: &st}
+	switch {
+	case fi.IsDir():
+		n.children = make(map[string]*memNode)
+	case fi.Mode().IsRegular() && st.Linkname == "":
+		if r, ok := fi.(io.Reader); ok {
+			// read before locking, the reader may be slow
+			dt, err := ioutil.ReadAll(r)
+			if err != nil {
+				return errors.Wrapf(err, "failed to read %s", p)
+			}
+			n.data = dt
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir, err := m.lookupDir(filepath.Dir(p))
+	if err != nil {
+		return errors.Wrapf(err, "invalid addition: %s", p)
+	}
+	name := filepath.Base(p)
+	old, exists := dir.children[name]
+	if !exists && kind != ChangeKindAdd {
+		return errors.Errorf("invalid modification: %s does not exist", p)
+	}
+	if st.Linkname != "" && !isSymlink(&st) {
+		if checkPath(st.Linkname) != "" {
+			return errors.Errorf("invalid hardlink %s to %s", p, st.Linkname)
+		}
+		target, err := m.lookup(st.Linkname)
+		if err != nil || !os.FileMode(target.stat.Mode).IsRegular() {
+			return errors.Errorf("invalid hardlink %s to %s", p, st.Linkname)
+		}
+		n.data = target.data
+	}
+	if exists && old.children != nil && n.children != nil {
+		n.children = old.children
+	}
+	dir.children[name] = n
+	return nil
+}
+
+// lookup returns the entry at p. m.mu needs to be held.
+func (m *MemFS) lookup(p string) (*memNode, error) {
+	n := m.root
+	for _, name := range splitPath(p) {
+		if n.children == nil {
+			return nil, &os.PathError{Op: "lookup", Path: p, Err: errors.New("not a directory")}
+		}
+		c, ok := n.children[name]
+		if !ok {
+			return nil, &os.PathError{Op: "lookup", Path: p, Err: os.ErrNotExist}
+		}
+		n = c
+	}
+	return n, nil
+}
+
+// lookupDir returns the directory at p. m.mu needs to be held.
+func (m *MemFS) lookupDir(p string) (*memNode, error) {
+	n, err := m.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if n.children == nil {
+		return nil, &os.PathError{Op: "lookup", Path: p, Err: errors.New("not a directory")}
+	}
+	return n, nil
+}
+
+// Stat returns the stat of the entry at p. Errors for missing entries
+// satisfy os.IsNotExist.
+func (m *MemFS) Stat(p string) (*Stat, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n, err := m.lookup(filepath.Clean(p))
+	if err != nil {
+		return nil, err
+	}
+	if n.stat == nil {
+		return nil, errors.New("the root has no stat")
+	}
+	st := *n.stat
+	return &st, nil
+}
+
+// ReadFile returns the contents of the regular file at p. Hardlinks return
+// the contents of their target.
+func (m *MemFS) ReadFile(p string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n, err := m.lookup(filepath.Clean(p))
+	if err != nil {
+		return nil, err
+	}
+	if n.stat == nil || !os.FileMode(n.stat.Mode).IsRegular() {
+		return nil, errors.Errorf("%s is not a regular file", p)
+	}
+	return append([]byte(nil), n.data...), nil
+}
+
+// ReadDir returns the stats of the entries of the directory at p sorted by
+// name. An empty path or "." is the root.
+func (m *MemFS) ReadDir(p string) ([]*Stat, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n, err := m.lookupDir(filepath.Clean(p))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*Stat, 0, len(n.children))
+	for _, name := range sortedNames(n) {
+		st := *n.children[name].stat
+		out = append(out, &st)
+	}
+	return out, nil
+}
+
+func sortedNames(n *memNode) []string {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Walk calls fn for every entry in walk order. The tree must not be changed
+// during the walk.
+func (m *MemFS) Walk(ctx context.Context, fn filepath.WalkFunc) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.walk(ctx, m.root, func(n *memNode) error {
+		st := *n.stat
+		return fn(st.Path, &StatInfo{&st}, nil)
+	})
+}
+
+func (m *MemFS) walk(ctx context.Context, dir *memNode, fn func(*memNode) error) error {
+	for _, name := range sortedNames(dir) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		n := dir.children[name]
+		if err := fn(n); err != nil {
+			return err
+		}
+		if n.children != nil {
+			if err := m.walk(ctx, n, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Open returns the contents of the regular file at p.
+func (m *MemFS) Open(p string) (io.ReadCloser, error) {
+	dt, err := m.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(dt)), nil
+}
+
+// Replay calls fn with a ChangeKindAdd change for every entry in walk order,
+// so the tree can be written with a DiskWriter or added to another MemFS.
+// For regular files the file info also implements io.Reader returning the
+// contents, like the ones passed by Untar.
+func (m *MemFS) Replay(ctx context.Context, fn HandleChangeFn) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.walk(ctx, m.root, func(n *memNode) error {
+		st := *n.stat
+		var fi os.FileInfo = &StatInfo{&st}
+		if os.FileMode(st.Mode).IsRegular() && st.Linkname == "" {
+			fi = &readerFileInfo{StatInfo: &StatInfo{&st}, r: bytes.NewReader(n.data)}
+		}
+		return fn(ChangeKindAdd, st.Path, fi, nil)
+	})
+}
+
+// WriteTar writes the tree to w as a tar archive like the package level
+// WriteTar does for a directory.
+func (m *MemFS) WriteTar(ctx context.Context, w io.Writer) error {
+	return writeTar(ctx, m, w)
+}
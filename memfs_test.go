@@ -0,0 +1,105 @@
+package fsutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestMemFS(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar dir",
+		"ADD bar/baz file data1",
+		"ADD bar/link file >bar/baz",
+		"ADD foo symlink bar/baz",
+		"ADD qux file data2",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	buf := &bytes.Buffer{}
+	err = WriteTar(context.Background(), d, nil, buf)
+	assert.NoError(t, err)
+
+	m := NewMemFS()
+	err = Untar(context.Background(), buf, m.HandleChange)
+	assert.NoError(t, err)
+
+	dt, err := m.ReadFile("bar/baz")
+	assert.NoError(t, err)
+	assert.Equal(t, "data1", string(dt))
+	dt, err = m.ReadFile("bar/link")
+	assert.NoError(t, err)
+	assert.Equal(t, "data1", string(dt))
+
+	stats, err := m.ReadDir("")
+	assert.NoError(t, err)
+	var names []string
+	for _, st := range stats {
+		names = append(names, st.Path)
+	}
+	assert.Equal(t, []string{"bar", "foo", "qux"}, names)
+
+	st, err := m.Stat("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "bar/baz", st.Linkname)
+
+	// a modified directory keeps its entries
+	err = m.HandleChange(ChangeKindModify, "bar", &StatInfo{&Stat{Path: "bar", Mode: uint32(os.ModeDir | 0700)}}, nil)
+	assert.NoError(t, err)
+	err = m.HandleChange(ChangeKindDelete, "qux", nil, nil)
+	assert.NoError(t, err)
+	_, err = m.Stat("qux")
+	assert.True(t, os.IsNotExist(err))
+
+	err = m.HandleChange(ChangeKindAdd, "missing/file", &StatInfo{&Stat{Path: "missing/file", Mode: 0600}}, nil)
+	assert.Error(t, err)
+	err = m.HandleChange(ChangeKindModify, "qux", &StatInfo{&Stat{Path: "qux", Mode: 0600}}, nil)
+	assert.Error(t, err)
+
+	b := &bytes.Buffer{}
+	err = m.Walk(context.Background(), bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `dir bar
+file bar/baz
+file bar/link >bar/baz
+symlink:bar/baz foo
+`, b.String())
+
+	// replay into a directory
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+	dw := NewDiskWriter(dest, DiskWriterOpt{})
+	err = m.Replay(context.Background(), dw.HandleChange)
+	assert.NoError(t, err)
+	assert.NoError(t, dw.Wait())
+
+	b = &bytes.Buffer{}
+	err = Walk(context.Background(), dest, nil, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `dir bar
+file bar/baz
+file bar/link >bar/baz
+symlink:bar/baz foo
+`, b.String())
+	dt, err = ioutil.ReadFile(filepath.Join(dest, "bar/link"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data1", string(dt))
+
+	// and through a tar archive into another MemFS
+	buf.Reset()
+	err = m.WriteTar(context.Background(), buf)
+	assert.NoError(t, err)
+	m2 := NewMemFS()
+	err = Untar(context.Background(), buf, m2.HandleChange)
+	assert.NoError(t, err)
+	dt, err = m2.ReadFile("bar/baz")
+	assert.NoError(t, err)
+	assert.Equal(t, "data1", string(dt))
+}
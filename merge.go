@@ -0,0 +1,163 @@
+package fsutil
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// MergePolicy defines which stream wins when multiple senders passed to
+// ReceiveMerge provide the same path. Directories present in multiple streams
+// are always merged, the policy only picks their metadata.
+type MergePolicy int
+
+const (
+	// MergeLastWins makes entries of later streams replace the ones of earlier
+	// streams.
+	MergeLastWins MergePolicy = iota
+	// MergeFirstWins keeps the entry of the first stream providing a path.
+	MergeFirstWins
+	// MergeError fails the transfer if a path that is not a directory in all
+	// streams is provided by more than one of them.
+	MergeError
+)
+
+// MergeConflictError is returned by ReceiveMerge for conflicting paths when
+// MergeError is used.
+type MergeConflictError struct {
+	Path string
+}
+
+func (e *MergeConflictError) Error() string {
+	return fmt.Sprintf("conflicting path %s in merged sources", e.Path)
+}
+
+type mergeSource struct {
+	s    *peer
+	head *currentPath
+	// skip is set when a directory from this source was replaced by a file
+	// from another source. The contents of the directory are ignored.
+	skip    string
+	dropped map[string]struct{}
+}
+
+func (m *mergeSource) next(ctx context.Context) error {
+	for {
+		select {
+		case p, ok := <-m.s.walkChan:
+			if !ok {
+				m.head = nil
+				return nil
+			}
+			if m.skip != "" && strings.HasPrefix(p.path, m.skip) {
+				m.drop(p.path)
+				continue
+			}
+			m.skip = ""
+			m.head = p
+			return nil
+		case <-m.s.r.shutdown:
+			return ErrShutdown
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// drop marks a path of this source as not being part of the merged tree.
+func (m *mergeSource) drop(p string) {
+	m.s.mu.Lock()
+	delete(m.s.files, p)
+	m.s.mu.Unlock()
+	m.dropped[p] = struct{}{}
+}
+
+func (mp MergePolicy) pick(srcs []*mergeSource) (*mergeSource, error) {
+	if len(srcs) == 1 {
+		return srcs[0], nil
+	}
+	switch mp {
+	case MergeFirstWins:
+		return srcs[0], nil
+	case MergeError:
+		for _, src := range srcs {
+			if !src.head.f.IsDir() {
+				return nil, &MergeConflictError{Path: src.head.path}
+			}
+		}
+	}
+	return srcs[len(srcs)-1], nil
+}
+
+// mergeStat merges the stat streams of all peers into a single stream in
+// walk order.
+func (r *receiver) mergeStat(ctx context.Context, pathC chan<- *currentPath) error {
+	srcs := make([]*mergeSource, len(r.peers))
+	for i, s := range r.peers {
+		srcs[i] = &mergeSource{s: s, dropped: map[string]struct{}{}}
+		if err := srcs[i].next(ctx); err != nil {
+			return err
+		}
+	}
+
+	for {
+		var cands []*mergeSource
+		for _, src := range srcs {
+			if src.head == nil {
+				continue
+			}
+			if len(cands) > 0 {
+				c := comparePath(src.head.path, cands[0].head.path)
+				if c > 0 {
+					continue
+				}
+				if c < 0 {
+					cands = cands[:0]
+				}
+			}
+			cands = append(cands, src)
+		}
+		if len(cands) == 0 {
+			return nil
+		}
+
+		winner, err := r.merge.pick(cands)
+		if err != nil {
+			return err
+		}
+		p := winner.head
+		for _, src := range cands {
+			if src == winner {
+				continue
+			}
+			src.drop(p.path)
+			if src.head.f.IsDir() && !p.f.IsDir() {
+				src.skip = p.path + string(os.PathSeparator)
+			}
+		}
+
+		// a hardlink to a file that was replaced by another source is
+		// transferred as a regular file
+		if stat, ok := p.f.Sys().(*Stat); ok && p.f.Mode()&os.ModeSymlink == 0 && stat.Linkname != "" {
+			if _, ok := winner.dropped[stat.Linkname]; ok {
+				st := *stat
+				st.Linkname = ""
+				p = &currentPath{path: p.path, f: &StatInfo{&st}}
+			}
+		}
+
+		select {
+		case pathC <- p:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		for _, src := range cands {
+			if err := src.next(ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package fsutil
+
+import (
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ReceiveMetadata receives the stats sent by a sender using
+// SendOpt.MetadataOnly without transferring any file contents. The returned
+// snapshot has the content digests computed by the sender, so its
+// TreeDigest matches the one of the source and its Walk can feed a Tarsum.
+func ReceiveMetadata(ctx context.Context, conn Stream) (*Snapshot, error) {
+	s := &Snapshot{Created: time.Now()}
+	ch := make(chan error, 1)
+	go func() {
+		ch <- receiveMetadata(conn, s)
+	}()
+	select {
+	case err := <-ch:
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case <-ctx.Done():
+		conn.SendMsg(&Packet{Type: PACKET_ERR, Data: []byte(ctx.Err().Error())})
+		return nil, ctx.Err()
+	}
+}
+
+func receiveMetadata(conn Stream, s *Snapshot) error {
+	// no file contents are transferred, so none of the capabilities apply
+	hs := newHandshake(nil, nil)
+	if err := hs.send(conn); err != nil {
+		return errors.Wrap(err, "failed to send handshake")
+	}
+	done := false
+	for {
+		var p Packet
+		if err := conn.RecvMsg(&p); err != nil {
+			if err == io.EOF && done {
+				return nil
+			}
+			return err
+		}
+		hello, err := hs.recv(&p)
+		if err != nil {
+			return err
+		}
+		if hello {
+			continue
+		}
+		switch p.Type {
+		case PACKET_ERR:
+			return errors.Errorf("error from sender: %s", p.Data)
+		case PACKET_STAT:
+			if p.Stat == nil {
+				done = true
+				if err := conn.SendMsg(&Packet{Type: PACKET_FIN}); err != nil {
+					return err
+				}
+				continue
+			}
+			if p.Checksum == "" {
+				err := errors.Errorf("sender did not send a digest for %s, it needs to use metadata only mode", p.Stat.Path)
+				conn.SendMsg(&Packet{Type: PACKET_ERR, Data: []byte(err.Error())})
+				return err
+			}
+			p.Stat.Path = filepath.FromSlash(p.Stat.Path)
+			if p.Stat.Linkname != "" && !isSymlink(p.Stat) {
+				p.Stat.Linkname = filepath.FromSlash(p.Stat.Linkname)
+			}
+			s.Entries = append(s.Entries, &SnapshotEntry{Stat: p.Stat, Digest: p.Checksum})
+		case PACKET_FIN:
+			return nil
+		}
+	}
+}
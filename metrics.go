@@ -0,0 +1,92 @@
+package fsutil
+
+import "time"
+
+// Phase is a step of a transfer reported to Metrics.
+type Phase int
+
+const (
+	// PhaseWalk is the walk of the source by the sender, including sending
+	// the stats, and the comparison of the received stats with the
+	// destination by the receiver. It is reported once per transfer.
+	PhaseWalk Phase = iota
+	// PhaseStatSend is the sending of the stat of an entry.
+	PhaseStatSend
+	// PhaseTransfer is the transfer of the contents of a file, from reading
+	// it to sending the last data packet on the sender and from requesting
+	// it to receiving the last data packet on the receiver.
+	PhaseTransfer
+	// PhaseWrite is the creation of an entry at the destination. The
+	// contents of files are written while they are transferred and are
+	// reported separately with the time spent writing them.
+	PhaseWrite
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseWalk:
+		return "walk"
+	case PhaseStatSend:
+		return "stat send"
+	case PhaseTransfer:
+		return "transfer"
+	case PhaseWrite:
+		return "write"
+	}
+	return "unknown"
+}
+
+// Metrics receives measurements of a transfer, for example to export them
+// to a monitoring or tracing system. The methods are called concurrently
+// and shouldn't block.
+type Metrics interface {
+	// Phase is called when a phase ended for the entry at path with the
+	// time it took. path is empty for PhaseWalk.
+	Phase(phase Phase, path string, d time.Duration)
+	// PacketSent is called for every packet sent with its type and size.
+	PacketSent(typ Packet_PacketType, size int)
+	// PacketReceived is called for every packet received with its type and
+	// size.
+	PacketReceived(typ Packet_PacketType, size int)
+	// FileCached is called on the receiver for a file whose contents were
+	// not requested because the content cache had them.
+	FileCached(path string, size int64)
+}
+
+// metricsStream reports the packets going through a stream.
+type metricsStream struct {
+	Stream
+	metrics Metrics
+}
+
+// withMetrics returns conn reporting its packets to m, or conn if m is nil.
+func withMetrics(conn Stream, m Metrics) Stream {
+	if m == nil {
+		return conn
+	}
+	return &metricsStream{Stream: conn, metrics: m}
+}
+
+func (ms *metricsStream) SendMsg(m interface{}) error {
+	p, ok := m.(*Packet)
+	if !ok {
+		return ms.Stream.SendMsg(m)
+	}
+	// the data may be reused once it was sent
+	typ, size := p.Type, p.Size()
+	if err := ms.Stream.SendMsg(m); err != nil {
+		return err
+	}
+	ms.metrics.PacketSent(typ, size)
+	return nil
+}
+
+func (ms *metricsStream) RecvMsg(m interface{}) error {
+	if err := ms.Stream.RecvMsg(m); err != nil {
+		return err
+	}
+	if p, ok := m.(*Packet); ok {
+		ms.metrics.PacketReceived(p.Type, p.Size())
+	}
+	return nil
+}
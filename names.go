@@ -0,0 +1,205 @@
+package fsutil
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// NameAction defines what happens to an entry with an invalid name.
+type NameAction int
+
+const (
+	// NameReject fails the transfer with an *InvalidNameError.
+	NameReject NameAction = iota
+	// NameSkip leaves the entry, and everything under it, out of the
+	// destination.
+	NameSkip
+	// NameEncode percent-encodes the offending bytes of the name, for
+	// example "NUL" is created as "NU%4C" and "a\xff" as "a%FF".
+	NameEncode
+)
+
+// NamePolicy defines how received entries with names that are not valid UTF-8
+// are handled. With Windows set, names that can't be created on Windows are
+// treated the same way: reserved device names like CON or NUL, names ending
+// with a dot or a space and names containing reserved characters.
+//
+// Encoded names may sort differently from the original ones, so such entries
+// are recreated on every transfer. An encoded name is not checked against the
+// other entries of its directory.
+type NamePolicy struct {
+	Action  NameAction
+	Windows bool
+	// Warn is called for every skipped or encoded entry.
+	Warn func(path string, err error)
+}
+
+// InvalidNameError is returned when an entry with an invalid name was
+// received and the policy did not allow handling it.
+type InvalidNameError struct {
+	Path string
+	Err  error
+}
+
+func (e *InvalidNameError) Error() string {
+	return fmt.Sprintf("invalid name %q: %v", e.Path, e.Err)
+}
+
+var windowsReservedNames = map[string]struct{}{
+	"CON": {}, "PRN": {}, "AUX": {}, "NUL": {},
+	"COM1": {}, "COM2": {}, "COM3": {}, "COM4": {}, "COM5": {}, "COM6": {}, "COM7": {}, "COM8": {}, "COM9": {},
+	"LPT1": {}, "LPT2": {}, "LPT3": {}, "LPT4": {}, "LPT5": {}, "LPT6": {}, "LPT7": {}, "LPT8": {}, "LPT9": {},
+}
+
+const windowsReservedChars = `<>:"\|?*`
+
+// checkName returns an error describing why a single path component is
+// invalid.
+func checkName(name string, windows bool) error {
+	if !utf8.ValidString(name) {
+		return errors.New("not valid UTF-8")
+	}
+	if !windows {
+		return nil
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] < 0x20 || strings.IndexByte(windowsReservedChars, name[i]) >= 0 {
+			return errors.Errorf("reserved character %q on Windows", name[i])
+		}
+	}
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return errors.New("ends with a dot or a space")
+	}
+	if _, ok := windowsReservedNames[reservedBase(name)]; ok {
+		return errors.New("reserved device name on Windows")
+	}
+	return nil
+}
+
+// reservedBase returns the part of a name Windows matches against device
+// names. "con.txt" and "CON " both refer to the console.
+func reservedBase(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+	return strings.ToUpper(strings.TrimRight(name, " "))
+}
+
+// encodeName percent-encodes the parts of a name that make it invalid.
+func encodeName(name string, windows bool) string {
+	var b bytes.Buffer
+	for i := 0; i < len(name); {
+		r, size := utf8.DecodeRuneInString(name[i:])
+		c := name[i]
+		switch {
+		case r == utf8.RuneError && size == 1, c == '%':
+			fmt.Fprintf(&b, "%%%02X", c)
+		case windows && (c < 0x20 || strings.IndexByte(windowsReservedChars, c) >= 0):
+			fmt.Fprintf(&b, "%%%02X", c)
+		default:
+			b.WriteString(name[i : i+size])
+		}
+		i += size
+	}
+	out := b.String()
+	if !windows {
+		return out
+	}
+
+	trimmed := strings.TrimRight(out, ". ")
+	suffix := out[len(trimmed):]
+	out = trimmed
+	if base := reservedBase(out); base != "" {
+		if _, ok := windowsReservedNames[base]; ok {
+			// encoding the last character of the device name is enough
+			n := len(base) - 1
+			out = out[:n] + fmt.Sprintf("%%%02X", out[n]) + out[n+1:]
+		}
+	}
+	for i := 0; i < len(suffix); i++ {
+		out += fmt.Sprintf("%%%02X", suffix[i])
+	}
+	return out
+}
+
+// nameFilter is the Filter applying a NamePolicy.
+type nameFilter struct {
+	policy *NamePolicy
+}
+
+// Match checks the path of an entry and the link target of a hardlink.
+func (f *nameFilter) Match(p string, st *Stat) (bool, error) {
+	if _, err := f.rewrite(p); err != nil {
+		return f.handle(p, err)
+	}
+	if st.Linkname != "" && !isSymlink(st) {
+		if _, err := f.rewrite(st.Linkname); err != nil {
+			return f.handle(p, err)
+		}
+	}
+	return true, nil
+}
+
+// Map encodes the names of a matched entry.
+func (f *nameFilter) Map(p string, st *Stat) error {
+	np, err := f.rewrite(p)
+	if err != nil {
+		return err
+	}
+	if st.Linkname != "" && !isSymlink(st) {
+		if st.Linkname, err = f.rewrite(st.Linkname); err != nil {
+			return err
+		}
+	}
+	if np != p {
+		if f.policy.Warn != nil {
+			f.policy.Warn(p, errors.Errorf("created as %s", np))
+		}
+		st.Path = np
+	}
+	return nil
+}
+
+func (f *nameFilter) handle(p string, err error) (bool, error) {
+	if f.policy.Action == NameReject {
+		return false, &InvalidNameError{Path: p, Err: err}
+	}
+	if f.policy.Warn != nil {
+		f.policy.Warn(p, err)
+	}
+	return false, nil
+}
+
+// rewrite returns the path with invalid components encoded. It returns an
+// error if a component is invalid and the policy doesn't encode names. The
+// path uses the separator of the platform.
+func (f *nameFilter) rewrite(p string) (string, error) {
+	sep := string(filepath.Separator)
+	parts := strings.Split(p, sep)
+	changed := false
+	for i, part := range parts {
+		err := checkName(part, f.policy.Windows)
+		if err == nil {
+			continue
+		}
+		if f.policy.Action != NameEncode {
+			return "", err
+		}
+		parts[i] = encodeName(part, f.policy.Windows)
+		changed = true
+	}
+	if !changed {
+		return p, nil
+	}
+	return strings.Join(parts, sep), nil
+}
+
+func isSymlink(st *Stat) bool {
+	return st.Mode&uint32(os.ModeSymlink) != 0
+}
@@ -0,0 +1,36 @@
+package fsutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckName(t *testing.T) {
+	assert.NoError(t, checkName("foo.txt", false))
+	assert.NoError(t, checkName("NUL", false))
+	assert.Error(t, checkName("a\xff", false))
+
+	assert.NoError(t, checkName("foo.txt", true))
+	assert.NoError(t, checkName("console", true))
+	assert.Error(t, checkName("NUL", true))
+	assert.Error(t, checkName("con.txt", true))
+	assert.Error(t, checkName("com1 ", true))
+	assert.Error(t, checkName("foo.", true))
+	assert.Error(t, checkName("a:b", true))
+}
+
+func TestEncodeName(t *testing.T) {
+	assert.Equal(t, "a%FF", encodeName("a\xff", false))
+	assert.Equal(t, "100%25%FF", encodeName("100%\xff", false))
+	assert.Equal(t, "a:b", encodeName("a:b", false))
+
+	assert.Equal(t, "NU%4C", encodeName("NUL", true))
+	assert.Equal(t, "co%6E.txt", encodeName("con.txt", true))
+	assert.Equal(t, "foo%2E%20", encodeName("foo. ", true))
+	assert.Equal(t, "a%3Ab", encodeName("a:b", true))
+
+	for _, name := range []string{"a\xff", "NUL", "con.txt", "foo. ", "a:b", "LPT1.", "x%\x01"} {
+		assert.NoError(t, checkName(encodeName(name, true), true), name)
+	}
+}
@@ -0,0 +1,30 @@
+// +build windows
+
+package fsutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNameFilterBackslash(t *testing.T) {
+	f := &nameFilter{policy: &NamePolicy{Action: NameEncode, Windows: true}}
+	for _, tc := range []struct {
+		path     string
+		expected string
+	}{
+		{`a\b`, `a\b`},
+		{`a\NUL`, `a\NU%4C`},
+		{`con.txt\a`, `co%6E.txt\a`},
+		{`a\b:c\d.`, `a\b%3Ac\d%2E`},
+	} {
+		p, err := f.rewrite(tc.path)
+		assert.NoError(t, err, tc.path)
+		assert.Equal(t, tc.expected, p, tc.path)
+	}
+
+	f.policy.Action = NameReject
+	_, err := f.rewrite(`a\NUL\b`)
+	assert.Error(t, err)
+}
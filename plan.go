@@ -0,0 +1,101 @@
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// PlannedChange is a change a dry run of Receive would apply to the
+// destination.
+type PlannedChange struct {
+	Kind ChangeKind
+	Path string
+	// Stat is the received stat of added and modified entries. It is nil for
+	// deletions.
+	Stat *Stat
+	// Size is the size of the file contents that would be requested from the
+	// sender for added and modified entries, and the size of the files that
+	// would be removed for deletions.
+	Size int64
+}
+
+// ReceivePlan lists the changes a receive would apply to the destination.
+type ReceivePlan struct {
+	Changes  []PlannedChange
+	Added    int
+	Modified int
+	Deleted  int
+	// Size is the total size of the file contents that would be transferred.
+	Size int64
+}
+
+// PlanReceive receives from conn as a dry run and returns the changes that
+// Receive would apply to dest. The sender only sends the stats of the
+// source.
+func PlanReceive(ctx context.Context, conn Stream, dest string, opt ReceiveOpt) (*ReceivePlan, error) {
+	plan := &ReceivePlan{}
+	opt.DryRun = plan.add
+	if err := Receive(ctx, conn, dest, opt); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+func (pl *ReceivePlan) add(c PlannedChange) error {
+	pl.Changes = append(pl.Changes, c)
+	switch c.Kind {
+	case ChangeKindAdd:
+		pl.Added++
+		pl.Size += c.Size
+	case ChangeKindModify:
+		pl.Modified++
+		pl.Size += c.Size
+	case ChangeKindDelete:
+		pl.Deleted++
+	}
+	return nil
+}
+
+// planChange returns the planned change for a change of the diff against
+// the tree at root.
+func planChange(root string, kind ChangeKind, p string, fi os.FileInfo) (PlannedChange, error) {
+	c := PlannedChange{Kind: kind, Path: p}
+	if kind == ChangeKindDelete {
+		size, err := treeSize(filepath.Join(root, p))
+		if err != nil {
+			return c, err
+		}
+		c.Size = size
+		return c, nil
+	}
+	stat, ok := fi.Sys().(*Stat)
+	if !ok {
+		return c, errors.Errorf("%s invalid change without stat information", p)
+	}
+	c.Stat = stat
+	if fi.Mode().IsRegular() && stat.Linkname == "" {
+		c.Size = stat.Size_
+	}
+	return c, nil
+}
+
+// treeSize returns the size of the regular files at p and below it.
+func treeSize(p string) (int64, error) {
+	var size int64
+	err := filepath.Walk(p, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, errors.Wrapf(err, "failed to walk %s", p)
+}
@@ -0,0 +1,69 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const barWidth = 30
+
+// Bar renders transfer progress on a terminal line. If the total size is
+// known it is drawn as a bar, otherwise only the transferred size and the
+// rate are shown.
+type Bar struct {
+	w   io.Writer
+	mu  sync.Mutex
+	est *Estimator
+	throttle
+}
+
+// NewBar returns a Bar writing to w.
+func NewBar(w io.Writer) *Bar {
+	return &Bar{w: w, est: NewEstimator(DefaultWindow), throttle: throttle{interval: DefaultInterval}}
+}
+
+// SetTotal sets the expected total size of the data phase of the transfer.
+// See Estimator for details.
+func (b *Bar) SetTotal(total int64) {
+	b.est.SetTotal(total)
+}
+
+// Estimator returns the estimator used for computing the rate and ETA.
+func (b *Bar) Estimator() *Estimator {
+	return b.est
+}
+
+// Update is a progress callback that can be passed to Send or Receive.
+func (b *Bar) Update(current int, last bool) {
+	b.est.Update(current, last)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.ready(time.Now(), last) {
+		return
+	}
+
+	transferred, total := b.est.Transferred(), b.est.Total()
+	rate := int64(b.est.Rate())
+
+	var line string
+	if total > 0 {
+		ratio := float64(transferred) / float64(total)
+		if ratio > 1 {
+			ratio = 1
+		}
+		filled := int(ratio * barWidth)
+		line = fmt.Sprintf("[%s%s] %3.0f%% %s/%s %s/s", strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled), ratio*100, humanSize(transferred), humanSize(total), humanSize(rate))
+		if eta, ok := b.est.ETA(); ok && !last {
+			line += " ETA " + eta.Truncate(time.Second).String()
+		}
+	} else {
+		line = fmt.Sprintf("%s %s/s", humanSize(transferred), humanSize(rate))
+	}
+	fmt.Fprintf(b.w, "\r\x1b[K%s", line)
+	if last {
+		fmt.Fprintln(b.w)
+	}
+}
@@ -0,0 +1,126 @@
+package progress
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultWindow is the period over which the rate is averaged.
+const DefaultWindow = 5 * time.Second
+
+type sample struct {
+	t time.Time
+	n int64
+}
+
+// Estimator computes a rolling transfer rate and the remaining time from the
+// values passed to its progress callback.
+//
+// Transfers start with a phase where only file metadata is exchanged and the
+// size of the data to follow is not known. Calling SetTotal marks the end of
+// that phase: bytes counted before it are excluded from the progress of the
+// data phase and the rate window is restarted, so the metadata burst doesn't
+// skew the estimate.
+type Estimator struct {
+	mu      sync.Mutex
+	window  time.Duration
+	samples []sample
+	base    int64
+	current int64
+	total   int64
+	done    bool
+	now     func() time.Time
+}
+
+// NewEstimator returns an Estimator averaging the rate over window.
+func NewEstimator(window time.Duration) *Estimator {
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	return &Estimator{window: window, now: time.Now}
+}
+
+// Update is a progress callback that can be passed to Send or Receive.
+func (e *Estimator) Update(current int, last bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.current = int64(current)
+	e.done = last
+	s := sample{t: e.now(), n: e.current}
+	// keep samples at least window/32 apart so the slice stays small
+	if l := len(e.samples); l > 1 && s.t.Sub(e.samples[l-2].t) < e.window/32 {
+		e.samples[l-1] = s
+	} else {
+		e.samples = append(e.samples, s)
+	}
+	i := 0
+	for i < len(e.samples)-2 && s.t.Sub(e.samples[i+1].t) >= e.window {
+		i++
+	}
+	e.samples = e.samples[i:]
+}
+
+// SetTotal sets the size of the data phase and marks its start.
+func (e *Estimator) SetTotal(total int64) {
+	e.mu.Lock()
+	e.total = total
+	e.base = e.current
+	e.samples = []sample{{t: e.now(), n: e.current}}
+	e.mu.Unlock()
+}
+
+// Total returns the total set with SetTotal.
+func (e *Estimator) Total() int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.total
+}
+
+// Transferred returns the bytes transferred in the current phase.
+func (e *Estimator) Transferred() int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.current - e.base
+}
+
+// Rate returns the average throughput in bytes per second over the window.
+func (e *Estimator) Rate() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.rate()
+}
+
+func (e *Estimator) rate() float64 {
+	if len(e.samples) < 2 {
+		return 0
+	}
+	first, last := e.samples[0], e.samples[len(e.samples)-1]
+	d := last.t.Sub(first.t).Seconds()
+	if d <= 0 {
+		return 0
+	}
+	return float64(last.n-first.n) / d
+}
+
+// ETA returns the estimated remaining time. The second return value is false
+// if no estimate can be made yet, because the total is unknown or nothing has
+// been transferred since it was set.
+func (e *Estimator) ETA() (time.Duration, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.done {
+		return 0, true
+	}
+	if e.total <= 0 {
+		return 0, false
+	}
+	remaining := e.total - (e.current - e.base)
+	if remaining <= 0 {
+		return 0, true
+	}
+	rate := e.rate()
+	if rate <= 0 {
+		return 0, false
+	}
+	return time.Duration(float64(remaining) / rate * float64(time.Second)), true
+}
@@ -0,0 +1,63 @@
+package progress
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Event is a single progress record written by JSONWriter.
+type Event struct {
+	Time time.Time `json:"time"`
+	// Current is the number of bytes transferred in the current phase.
+	Current int64 `json:"current"`
+	Total   int64 `json:"total,omitempty"`
+	// Rate is the average throughput in bytes per second.
+	Rate float64 `json:"rate,omitempty"`
+	// ETA is the estimated remaining time in seconds.
+	ETA  float64 `json:"eta,omitempty"`
+	Done bool    `json:"done,omitempty"`
+}
+
+// JSONWriter writes progress updates as a stream of newline separated JSON
+// objects for consumption by other programs.
+type JSONWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	est *Estimator
+	throttle
+}
+
+// NewJSONWriter returns a JSONWriter writing to w.
+func NewJSONWriter(w io.Writer) *JSONWriter {
+	return &JSONWriter{enc: json.NewEncoder(w), est: NewEstimator(DefaultWindow), throttle: throttle{interval: DefaultInterval}}
+}
+
+// SetTotal sets the expected total size of the data phase reported in the
+// events. See Estimator for details.
+func (j *JSONWriter) SetTotal(total int64) {
+	j.est.SetTotal(total)
+}
+
+// Update is a progress callback that can be passed to Send or Receive.
+func (j *JSONWriter) Update(current int, last bool) {
+	j.est.Update(current, last)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	if !j.ready(now, last) {
+		return
+	}
+	ev := Event{
+		Time:    now.UTC(),
+		Current: j.est.Transferred(),
+		Total:   j.est.Total(),
+		Rate:    j.est.Rate(),
+		Done:    last,
+	}
+	if eta, ok := j.est.ETA(); ok {
+		ev.ETA = eta.Seconds()
+	}
+	j.enc.Encode(ev)
+}
@@ -0,0 +1,39 @@
+// Package progress contains ready-made consumers for the progress callbacks
+// of fsutil.Send and fsutil.Receive.
+package progress
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultInterval is the minimum time between two outputs of a progress
+// writer. The final update is always written.
+const DefaultInterval = 100 * time.Millisecond
+
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// throttle reports whether an update at now should be written.
+type throttle struct {
+	interval time.Duration
+	last     time.Time
+}
+
+func (t *throttle) ready(now time.Time, final bool) bool {
+	if !final && !t.last.IsZero() && now.Sub(t.last) < t.interval {
+		return false
+	}
+	t.last = now
+	return true
+}
@@ -0,0 +1,89 @@
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	j := NewJSONWriter(buf)
+	j.Update(5, false)
+	j.SetTotal(100)
+	j.Update(15, false) // throttled
+	j.Update(105, true)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+
+	var ev Event
+	err := json.Unmarshal([]byte(lines[0]), &ev)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), ev.Current)
+	assert.Equal(t, int64(0), ev.Total)
+	assert.False(t, ev.Done)
+
+	err = json.Unmarshal([]byte(lines[1]), &ev)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), ev.Current)
+	assert.True(t, ev.Done)
+}
+
+func TestBar(t *testing.T) {
+	buf := &bytes.Buffer{}
+	b := NewBar(buf)
+	b.SetTotal(2048)
+	b.Update(1024, true)
+	assert.Contains(t, buf.String(), "[===============               ]  50% 1.0 KiB/2.0 KiB")
+	assert.True(t, strings.HasSuffix(buf.String(), "\n"))
+}
+
+func TestEstimator(t *testing.T) {
+	now := time.Unix(0, 0)
+	e := NewEstimator(10 * time.Second)
+	e.now = func() time.Time { return now }
+
+	// metadata phase
+	e.Update(500, false)
+	now = now.Add(time.Second)
+	e.Update(1000, false)
+	_, ok := e.ETA()
+	assert.False(t, ok)
+
+	e.SetTotal(1000)
+	_, ok = e.ETA()
+	assert.False(t, ok)
+
+	for i := 1; i <= 4; i++ {
+		now = now.Add(time.Second)
+		e.Update(1000+i*100, false)
+	}
+	assert.Equal(t, int64(400), e.Transferred())
+	assert.Equal(t, 100.0, e.Rate())
+	eta, ok := e.ETA()
+	assert.True(t, ok)
+	assert.Equal(t, 6*time.Second, eta)
+
+	// old samples leave the window
+	for i := 5; i <= 20; i++ {
+		now = now.Add(time.Second)
+		e.Update(1400+(i-4)*10, false)
+	}
+	assert.Equal(t, 10.0, e.Rate())
+
+	e.Update(2000, true)
+	eta, ok = e.ETA()
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), eta)
+}
+
+func TestHumanSize(t *testing.T) {
+	assert.Equal(t, "512 B", humanSize(512))
+	assert.Equal(t, "1.5 KiB", humanSize(1536))
+	assert.Equal(t, "3.0 MiB", humanSize(3<<20))
+}
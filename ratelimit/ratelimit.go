@@ -0,0 +1,124 @@
+// Package ratelimit implements bandwidth and operation budgets for
+// fsutil.Send and fsutil.Receive. A server hosting many concurrent transfers creates one
+// Limiter holding the aggregate budget and derives a limiter per session
+// from it, so a single large transfer can't starve the others.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Limits defines the budgets of a limiter. Zero values mean no limit.
+type Limits struct {
+	// BytesPerSec limits the amount of file data received.
+	BytesPerSec int64
+	// OpsPerSec limits the number of filesystem changes applied.
+	OpsPerSec int64
+}
+
+// Limiter throttles a transfer. It satisfies fsutil.RateLimiter.
+type Limiter struct {
+	bytes  *bucket
+	ops    *bucket
+	parent *Limiter
+}
+
+// New returns a limiter enforcing limits.
+func New(limits Limits) *Limiter {
+	return &Limiter{
+		bytes: newBucket(limits.BytesPerSec, time.Now),
+		ops:   newBucket(limits.OpsPerSec, time.Now),
+	}
+}
+
+// Session returns a limiter for a single transfer. Its usage counts against
+// both its own limits and the limits of l.
+func (l *Limiter) Session(limits Limits) *Limiter {
+	s := New(limits)
+	s.parent = l
+	return s
+}
+
+// WaitBytes blocks until n bytes of data may be processed.
+func (l *Limiter) WaitBytes(ctx context.Context, n int) error {
+	return l.wait(ctx, func(l *Limiter) *bucket { return l.bytes }, n)
+}
+
+// WaitOps blocks until n filesystem operations may be performed.
+func (l *Limiter) WaitOps(ctx context.Context, n int) error {
+	return l.wait(ctx, func(l *Limiter) *bucket { return l.ops }, n)
+}
+
+func (l *Limiter) wait(ctx context.Context, get func(*Limiter) *bucket, n int) error {
+	var reserved []*bucket
+	var d time.Duration
+	for ll := l; ll != nil; ll = ll.parent {
+		b := get(ll)
+		if b == nil {
+			continue
+		}
+		if bd := b.reserve(float64(n)); bd > d {
+			d = bd
+		}
+		reserved = append(reserved, b)
+	}
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		for _, b := range reserved {
+			b.cancel(float64(n))
+		}
+		return ctx.Err()
+	}
+}
+
+// bucket is a token bucket holding up to one second worth of tokens.
+// Reservations larger than the available tokens are allowed and put the
+// bucket into debt that later callers wait for.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func newBucket(rate int64, now func() time.Time) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &bucket{rate: float64(rate), tokens: float64(rate), last: now(), now: now}
+}
+
+// reserve takes n tokens and returns how long the caller needs to wait
+// before using them.
+func (b *bucket) reserve(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *bucket) cancel(n float64) {
+	b.mu.Lock()
+	b.tokens += n
+	b.mu.Unlock()
+}
@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newBucket(100, func() time.Time { return now })
+
+	assert.Equal(t, time.Duration(0), b.reserve(60))
+	assert.Equal(t, time.Duration(0), b.reserve(40))
+	assert.Equal(t, 500*time.Millisecond, b.reserve(50))
+
+	now = now.Add(time.Second)
+	assert.Equal(t, time.Duration(0), b.reserve(50))
+
+	// idle time doesn't accumulate more than a second of tokens
+	now = now.Add(time.Minute)
+	assert.Equal(t, time.Second, b.reserve(200))
+
+	b.cancel(200)
+	assert.Equal(t, time.Duration(0), b.reserve(100))
+
+	assert.Nil(t, newBucket(0, time.Now))
+}
+
+func TestSessionLimiter(t *testing.T) {
+	l := New(Limits{BytesPerSec: 1000})
+	s1 := l.Session(Limits{OpsPerSec: 10})
+	s2 := l.Session(Limits{})
+
+	ctx := context.Background()
+	assert.NoError(t, s1.WaitBytes(ctx, 600))
+	assert.NoError(t, s1.WaitOps(ctx, 10))
+
+	// the aggregate budget is used up by the other session
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s2.WaitBytes(ctx, 800))
+	assert.Equal(t, context.DeadlineExceeded, s1.WaitOps(ctx, 5))
+
+	// cancelled reservations are returned
+	assert.NoError(t, s2.WaitBytes(context.Background(), 350))
+}
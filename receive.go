@@ -1,151 +1,845 @@
-// +build linux
-
 package fsutil
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
 	"io"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 	"golang.org/x/sync/errgroup"
 )
 
-func Receive(ctx context.Context, conn Stream, dest string, notifyHashed ChangeFunc) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+type ReceiveOpt struct {
+	NotifyHashed ChangeFunc
+	// Unsupported defines how incoming entries that can't be created at the
+	// destination are handled. If nil, such entries fail the transfer.
+	Unsupported *UnsupportedPolicy
+	// ProgressCb is called with the total size of the packets received so
+	// far. The last call has the second argument set to true.
+	ProgressCb func(int, bool)
+	// FileProgressCb is called while file contents are written with the stat
+	// of the file, the number of its bytes written so far and its size. Once
+	// all stats have been compared to the destination it is also called with
+	// an empty Stat and the total size of the contents requested from the
+	// sender.
+	FileProgressCb func(stat Stat, transferred, total int64)
+	// DeleteLimit aborts the transfer before removing anything from the
+	// destination if too many entries would be deleted. It has no effect
+	// with DeleteKeepExtra.
+	DeleteLimit *DeleteLimit
+	// Merge defines how paths provided by multiple streams are resolved in
+	// ReceiveMerge.
+	Merge MergePolicy
+	// RateLimit throttles the file data received and the changes applied to
+	// the destination. See the ratelimit package for an implementation.
+	RateLimit RateLimiter
+	// VolumeSnapshot takes a filesystem snapshot of the destination before
+	// applying changes. If the transfer fails the destination is rolled back.
+	VolumeSnapshot VolumeSnapshotter
+	// TreeDigest is the digest of the destination as returned by TreeDigest.
+	// If the sender announces the same digest for the source the transfer
+	// finishes immediately. Only used with a single sender.
+	TreeDigest string
+	// CreateDest allows creating the destination directory and its missing
+	// parents. If nil a missing destination fails with *DestNotExistError.
+	CreateDest *CreateDestOpt
+	// Retries is the number of times the contents of a file are requested
+	// again when they fail verification. NotifyHashed can return a
+	// *ChecksumError to have a file requested again.
+	Retries int
+	// Names defines how entries with names that are invalid at the
+	// destination are handled. If nil, names are not checked.
+	Names *NamePolicy
+	// Filter selects and rewrites the entries received from the sender. It
+	// runs after the Names policy. Entries at the destination that it leaves
+	// out are kept unless Delete is DeleteExcluded.
+	Filter Filter
+	// Delete defines which entries not received from the sender are
+	// removed from the destination.
+	Delete DeletePolicy
+	// RequireEmpty fails the transfer with *DestNotEmptyError if the
+	// destination already has entries.
+	RequireEmpty *RequireEmptyOpt
+	// Resume records the files left incomplete when the transfer fails and
+	// continues them in later transfers using the same state. Files whose
+	// kept part differs from the source, and all files of senders without
+	// CapResume, are transferred again. Not used for lazy receives.
+	Resume *ResumeState
+	// Compression is the encoding file data is asked for in. Senders that
+	// don't allow it send the data uncompressed.
+	Compression Packet_Compression
+	// VerifyChecksums has the sender send the sha256 digest of every file
+	// it sends and fails the file with a *ChecksumError if the contents
+	// written don't match it. Retries applies to these errors as well. The
+	// sender must support checksums.
+	VerifyChecksums bool
+	// DiskWriterOpt defines how entries are created at the destination.
+	DiskWriterOpt *DiskWriterOpt
+	// Watch keeps applying the changes sent by a sender using SendOpt.Watch
+	// after the initial transfer. Not used for lazy receives.
+	Watch *ReceiveWatchOpt
+	// Atomic applies the changes to a copy of the destination created next
+	// to it and replaces the destination with the copy once the transfer
+	// succeeded, so the destination is never seen partially updated. The
+	// copy links the unchanged files, which needs hardlink support from the
+	// filesystem. Resume and ContentCache are not used. Not supported with
+	// Watch, VolumeSnapshot or lazy receives.
+	Atomic bool
+	// DisableValidation accepts the stats from the senders without checking
+	// them. By default paths that are not clean, absolute or leave the
+	// destination, stats out of walk order and entries under a symlink at
+	// the destination fail the transfer with a *ValidationError. Only
+	// disable it for trusted senders.
+	DisableValidation bool
+	// DryRun compares the received stats with the destination without
+	// changing it. The changes that would be applied are passed to DryRun
+	// in walk order instead and no file contents are requested. Atomic and
+	// VolumeSnapshot are not used, Watch is not supported. See PlanReceive.
+	DryRun func(PlannedChange) error
+	// Metrics receives the timings, packet counts and content cache hits of
+	// the transfer.
+	Metrics Metrics
+	// Chunks requests the contents of large files in chunks. Not used for
+	// resumed files. If nil, files are requested as a whole.
+	Chunks *ChunkOpt
+	// Handshake is called with the protocol version and capabilities of
+	// every sender once they are known. Returning an error ends the
+	// transfer, for example to reject senders that are too old.
+	Handshake func(PeerInfo) error
+}
+
+// RateLimiter limits the resources used by a transfer. The methods block until
+// n bytes of data or n filesystem operations may be processed.
+type RateLimiter interface {
+	WaitBytes(ctx context.Context, n int) error
+	WaitOps(ctx context.Context, n int) error
+}
+
+func Receive(ctx context.Context, conn Stream, dest string, opt ReceiveOpt) error {
+	return ReceiveMerge(ctx, []Stream{conn}, dest, opt)
+}
+
+// ReceiveStream receives into dest like Receive and delivers the changes
+// applied to the destination. Files are delivered once their contents have
+// been written. The error of the stream is the error of the transfer.
+func ReceiveStream(ctx context.Context, conn Stream, dest string, opt ReceiveOpt) *ChangeStream {
+	return newChangeStream(ctx, dest, func(ctx context.Context, changeFn ChangeFunc) error {
+		notify := opt.NotifyHashed
+		opt.NotifyHashed = func(kind ChangeKind, p string, fi os.FileInfo, err error) error {
+			if notify != nil {
+				if err := notify(kind, p, fi, err); err != nil {
+					return err
+				}
+			}
+			return changeFn(kind, p, fi, err)
+		}
+		return Receive(ctx, conn, dest, opt)
+	})
+}
+
+// ReceiveMerge receives from multiple senders into a single destination. The
+// source trees are merged and the conflicts between them are resolved
+// according to opt.Merge. The destination ends up containing the merged tree
+// only.
+func ReceiveMerge(ctx context.Context, conns []Stream, dest string, opt ReceiveOpt) error {
+	return NewReceiveSession(conns, dest, opt).Run(ctx)
+}
+
+// abortReceive reports an error that happened before the transfer started to
+// the senders.
+func abortReceive(conns []Stream, err error) error {
+	for _, conn := range conns {
+		conn.SendMsg(&Packet{Type: PACKET_ERR, Data: []byte(err.Error())})
+	}
+	return err
+}
 
+func newReceiver(conns []Stream, dest string, opt ReceiveOpt) *receiver {
 	r := &receiver{
-		conn:         &syncStream{Stream: conn},
-		dest:         dest,
-		files:        make(map[string]uint32),
-		pipes:        make(map[uint32]*io.PipeWriter),
-		walkChan:     make(chan *currentPath, 128),
-		notifyHashed: notifyHashed,
+		dest:           dest,
+		notifyHashed:   opt.NotifyHashed,
+		unsupported:    opt.Unsupported,
+		progressCb:     opt.ProgressCb,
+		fileProgressCb: opt.FileProgressCb,
+		deleteLimit:    opt.DeleteLimit,
+		merge:          opt.Merge,
+		rateLimit:      opt.RateLimit,
+		retries:        opt.Retries,
+		resume:         opt.Resume,
+		compression:    opt.Compression,
+		verify:         opt.VerifyChecksums,
+		atomic:         opt.Atomic,
+		validate:       !opt.DisableValidation,
+		deletePolicy:   opt.Delete,
+		diskWriterOpt:  opt.DiskWriterOpt,
+		dryRun:         opt.DryRun,
+		metrics:        opt.Metrics,
+		chunks:         opt.Chunks,
+		stats:          newTransferStats(),
+		shutdown:       make(chan struct{}),
+		abort:          make(chan struct{}),
+	}
+	if opt.Delete == DeleteUnmatched {
+		var filters []Filter
+		if opt.Filter != nil {
+			filters = append(filters, matchOnly{opt.Filter})
+		}
+		if opt.DiskWriterOpt != nil && opt.DiskWriterOpt.filter() != nil {
+			filters = append(filters, matchOnly{opt.DiskWriterOpt.filter()})
+		}
+		if len(filters) > 0 {
+			r.protect = Chain(filters...)
+		}
+	}
+	if opt.TreeDigest != "" && len(conns) == 1 {
+		r.treeDigest = opt.TreeDigest
+		r.digestChecked = make(chan bool, 1)
 	}
-	return r.run(ctx)
+	for _, conn := range conns {
+		s := &peer{
+			r:         r,
+			conn:      &syncStream{Stream: withMetrics(conn, opt.Metrics)},
+			files:     make(map[string]uint32),
+			pipes:     make(map[uint32]*io.PipeWriter),
+			chunks:    make(map[uint32]map[int64]*chunk),
+			sizes:     make(map[uint32]int64),
+			written:   make(map[uint32]int64),
+			checksums: make(map[uint32]string),
+			walkChan:  make(chan *currentPath, 128),
+			hs:        newHandshake(receiverCapabilities(), r.handshakeFn(opt.Handshake)),
+		}
+		if r.validate {
+			s.validator = &Validator{}
+		}
+		var filters []Filter
+		if opt.Names != nil {
+			filters = append(filters, &nameFilter{policy: opt.Names})
+		}
+		if opt.Filter != nil {
+			filters = append(filters, opt.Filter)
+		}
+		if opt.DiskWriterOpt != nil && opt.DiskWriterOpt.filter() != nil {
+			filters = append(filters, opt.DiskWriterOpt.filter())
+		}
+		if len(filters) > 0 {
+			s.filter = newStatFilter(Chain(filters...))
+		}
+		r.peers = append(r.peers, s)
+	}
+	return r
 }
 
 type receiver struct {
-	dest         string
-	conn         Stream
-	files        map[string]uint32
-	pipes        map[uint32]*io.PipeWriter
-	mu           sync.RWMutex
-	muPipes      sync.RWMutex
-	walkChan     chan *currentPath
-	notifyHashed ChangeFunc
+	dest          string
+	peers         []*peer
+	notifyHashed  ChangeFunc
+	unsupported   *UnsupportedPolicy
+	deleteLimit   *DeleteLimit
+	merge         MergePolicy
+	rateLimit     RateLimiter
+	retries       int
+	resume        *ResumeState
+	compression   Packet_Compression
+	verify        bool
+	atomic        bool
+	validate      bool
+	deletePolicy  DeletePolicy
+	diskWriterOpt *DiskWriterOpt
+	dryRun        func(PlannedChange) error
+	metrics       Metrics
+	chunks        *ChunkOpt
+	lazy          *LazyTree
+
+	treeDigest    string
+	digestChecked chan bool
+	// watchPaths limits the comparison to the paths changed at a watching
+	// sender
+	watchPaths []string
+	// protect selects the entries of the destination that are compared
+	// with the received ones, the others are kept
+	protect Filter
+
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+	abort        chan struct{}
+	abortOnce    sync.Once
+	changes      int64
+	stats        *transferStats
+	abortedMu    sync.Mutex
+	abortedFiles []string
+
+	progressCb      func(int, bool)
+	progressCurrent int
+	progressMu      sync.Mutex
+	fileProgressCb  func(Stat, int64, int64)
+}
+
+// peer is the state of a single sender connection.
+type peer struct {
+	r        *receiver
+	conn     Stream
+	files    map[string]uint32
+	pipes    map[uint32]*io.PipeWriter
+	mu       sync.RWMutex
+	muPipes  sync.RWMutex
+	walkChan chan *currentPath
+	filter   *statFilter
+	// checksums are the digests the sender sent for the files, removed
+	// once they are checked
+	checksums map[uint32]string
+	// validator checks the stats received, nil if validation is disabled
+	validator *Validator
+	// chunks are the chunks requested, by file id and offset
+	chunks map[uint32]map[int64]*chunk
+	// sizes are the sizes of the files by id
+	sizes map[uint32]int64
+	// written are the positions in the files requested through pipes,
+	// bounding the holes the sender may send
+	written map[uint32]int64
+	hs      *handshake
+}
+
+// receiverCapabilities returns the capabilities a receiver advertises.
+func receiverCapabilities() []string {
+	caps := []string{CapCompression, CapResume, CapSparse, CapVerify, CapChunks}
+	if xattrsSupported {
+		caps = append(caps, CapXattrs)
+	}
+	return caps
+}
+
+// handshakeFn returns the function checking the handshake of a sender.
+func (r *receiver) handshakeFn(fn func(PeerInfo) error) func(PeerInfo) error {
+	return func(pi PeerInfo) error {
+		if r.verify && !pi.Has(CapVerify) {
+			return errors.Errorf("sender with protocol version %d does not support verifying checksums", pi.Version)
+		}
+		if fn != nil {
+			return fn(pi)
+		}
+		return nil
+	}
 }
 
 func (r *receiver) readStat(ctx context.Context, pathC chan<- *currentPath) error {
+	if len(r.peers) > 1 {
+		return r.mergeStat(ctx, pathC)
+	}
 	for {
 		select {
-		case p, ok := <-r.walkChan:
+		case p, ok := <-r.peers[0].walkChan:
 			if !ok {
 				return nil
 			}
-			pathC <- p
+			select {
+			case pathC <- p:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case <-r.shutdown:
+			return ErrShutdown
 		case <-ctx.Done():
 			return ctx.Err()
 		}
 	}
-	return nil
+}
+
+func (r *receiver) updateProgress(size int, last bool) {
+	r.stats.addBytes(size)
+	if r.progressCb != nil {
+		r.progressMu.Lock()
+		r.progressCurrent += size
+		r.progressCb(r.progressCurrent, last)
+		r.progressMu.Unlock()
+	}
+}
+
+func (r *receiver) updateFileProgress(stat Stat, transferred, total int64) {
+	r.progressMu.Lock()
+	r.fileProgressCb(stat, transferred, total)
+	r.progressMu.Unlock()
 }
 
 func (r *receiver) run(ctx context.Context) error {
+	for _, s := range r.peers {
+		if err := s.hs.send(s.conn); err != nil {
+			return errors.Wrap(err, "failed to send handshake")
+		}
+	}
 	g, ctx := errgroup.WithContext(ctx)
+	defer r.updateProgress(0, true)
+
+	asyncDataFunc := r.asyncDataFunc
+	if r.lazy != nil {
+		asyncDataFunc = r.lazy.register
+	}
 
 	dw := DiskWriter{
-		asyncDataFunc: r.asyncDataFunc,
+		asyncDataFunc: asyncDataFunc,
 		dest:          r.dest,
 		notifyHashed:  r.notifyHashed,
+		unsupported:   r.unsupported,
+		retries:       r.retries,
+		stats:         r.stats,
+		metrics:       r.metrics,
+	}
+	if r.lazy == nil {
+		// lazy files are written by Materialize after the transfer
+		dw.start(ctx)
+	}
+	if r.diskWriterOpt != nil {
+		dw.opt = *r.diskWriterOpt
+		// the filter already ran on the received stats
+		dw.opt.Filter = nil
+		dw.opt.Epoch = nil
+	}
+	if r.lazy == nil && !r.atomic {
+		dw.resume = r.resume
+	}
+	if r.atomic {
+		// files in the staging copy are linked to the destination
+		dw.opt.ContentCache = nil
+	}
+	if r.fileProgressCb != nil {
+		dw.fileProgress = r.updateFileProgress
 	}
 
-	walkDone := make(chan struct{})
+	var checker *destChecker
+	if r.validate {
+		checker = newDestChecker(dw.dest)
+	}
 
-	g.Go(func() error {
-		err := doubleWalkDiff(ctx, dw.HandleChange, GetWalkerFn(r.dest), r.readStat)
-		close(walkDone)
-		return err
-	})
+	changeFn := func(kind ChangeKind, p string, fi os.FileInfo, err error) error {
+		if err == nil {
+			select {
+			case <-r.shutdown:
+				return ErrShutdown
+			default:
+			}
+			if r.rateLimit != nil && r.dryRun == nil {
+				if err := r.rateLimit.WaitOps(ctx, 1); err != nil {
+					return err
+				}
+			}
+			if checker != nil {
+				if err := checker.HandleChange(kind, p, fi, nil); err != nil {
+					return err
+				}
+			}
+			if r.dryRun != nil {
+				c, err := planChange(r.compareRoot(), kind, p, fi)
+				if err != nil {
+					return err
+				}
+				if err := r.dryRun(c); err != nil {
+					return err
+				}
+				atomic.AddInt64(&r.changes, 1)
+				return nil
+			}
+		}
+		if err := dw.HandleChange(kind, p, fi, err); err != nil {
+			return err
+		}
+		atomic.AddInt64(&r.changes, 1)
+		return nil
+	}
+	if r.deletePolicy == DeleteKeepExtra {
+		applyFn := changeFn
+		changeFn = func(kind ChangeKind, p string, fi os.FileInfo, err error) error {
+			if err == nil && kind == ChangeKindDelete {
+				return nil
+			}
+			return applyFn(kind, p, fi, err)
+		}
+	}
 
-	g.Go(func() error {
-		var i uint32 = 0
-
-		var p Packet
-		for {
-			p = Packet{Data: p.Data[:0]}
-			if err := r.conn.RecvMsg(&p); err == nil {
-				switch p.Type {
-				case PACKET_STAT:
-					if p.Stat == nil {
-						close(r.walkChan)
-						<-walkDone
-						go func() {
-							dw.Wait()
-							r.conn.SendMsg(&Packet{Type: PACKET_FIN})
-						}()
-						break
-					}
-					if os.FileMode(p.Stat.Mode)&(os.ModeDir|os.ModeSymlink|os.ModeNamedPipe|os.ModeDevice) == 0 {
-						r.mu.Lock()
-						r.files[p.Stat.Path] = i
-						r.mu.Unlock()
-					}
-					i++
-					r.walkChan <- &currentPath{path: p.Stat.Path, f: &StatInfo{p.Stat}}
-				case PACKET_DATA:
-					r.muPipes.Lock()
-					pw, ok := r.pipes[p.ID]
-					if !ok {
-						r.muPipes.Unlock()
-						return errors.Errorf("invalid file request %s", p.ID)
-					}
-					r.muPipes.Unlock()
-					if len(p.Data) == 0 {
-						if err := pw.Close(); err != nil {
-							return err
-						}
-					} else {
-						if _, err := pw.Write(p.Data); err != nil {
-							return err
-						}
+	g.Go(func() (retErr error) {
+		defer func() {
+			if retErr != nil && retErr != ErrShutdown {
+				for _, s := range r.peers {
+					s.conn.SendMsg(&Packet{Type: PACKET_ERR, Data: []byte(retErr.Error())})
+				}
+			}
+		}()
+		if r.digestChecked != nil {
+			select {
+			case unchanged := <-r.digestChecked:
+				if unchanged {
+					if r.lazy != nil {
+						close(r.lazy.ready)
+						return nil
 					}
-				case PACKET_FIN:
-					return nil
+					return r.peers[0].conn.SendMsg(&Packet{Type: PACKET_FIN})
 				}
-			} else if err != nil {
-				logrus.Error(err)
+			case <-ctx.Done():
+				return ctx.Err()
 			}
 		}
+		var err error
+		start := time.Now()
+		// DeleteKeepExtra removes nothing, so there is nothing to guard
+		if r.deleteLimit == nil || r.deletePolicy == DeleteKeepExtra {
+			err = doubleWalkDiff(ctx, changeFn, r.destWalkerFn(), r.readStat)
+		} else {
+			dg := &deleteGuard{limit: r.deleteLimit, root: r.compareRoot(), changeFn: changeFn}
+			err = doubleWalkDiff(ctx, dg.HandleChange, dg.walkerFn(r.destWalkerFn()), r.readStat)
+			if err == nil {
+				err = dg.flush()
+			}
+		}
+		if r.metrics != nil && err == nil {
+			r.metrics.Phase(PhaseWalk, "", time.Since(start))
+		}
+		if errors.Cause(err) == ErrShutdown {
+			return r.drain(&dw)
+		}
+		if err != nil {
+			return err
+		}
+		if r.fileProgressCb != nil {
+			r.updateFileProgress(Stat{}, 0, atomic.LoadInt64(&dw.requested))
+		}
+		if err := dw.Wait(); err != nil {
+			if errors.Cause(err) == ErrShutdown {
+				return r.drain(&dw)
+			}
+			return err
+		}
+		if r.lazy != nil {
+			// the connections stay open for fetching file contents
+			close(r.lazy.ready)
+			return nil
+		}
+		for _, s := range r.peers {
+			if err := s.conn.SendMsg(&Packet{Type: PACKET_FIN}); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
+
+	// the files still being written won't get any more data once the
+	// transfer failed
+	go func() {
+		<-ctx.Done()
+		r.closePipes(ctx.Err())
+	}()
+
+	// RecvMsg can't be interrupted so the loops are not tracked by the group.
+	// They return once the streams are closed by the caller.
+	for _, s := range r.peers {
+		s := s
+		recvErr := make(chan error, 1)
+		go func() {
+			recvErr <- s.recv(ctx)
+		}()
+		g.Go(func() error {
+			select {
+			case err := <-recvErr:
+				return err
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}
+
 	return g.Wait()
 }
 
+func (s *peer) recv(ctx context.Context) error {
+	var i uint32 = 0
+	checkDigest := s.r.digestChecked != nil
+	unchanged := false
+
+	var p Packet
+	for {
+		p = Packet{Data: p.Data[:0]}
+		if err := s.conn.RecvMsg(&p); err != nil {
+			return err
+		}
+		s.r.updateProgress(p.Size(), false)
+		hello, err := s.hs.recv(&p)
+		if err != nil {
+			return err
+		}
+		if hello {
+			continue
+		}
+		if checkDigest {
+			// a sender announcing a digest sends it as the first packet
+			checkDigest = false
+			unchanged = p.Type == PACKET_DIGEST && string(p.Data) == s.r.treeDigest
+			s.r.digestChecked <- unchanged
+		}
+		if unchanged && p.Type != PACKET_ERR && p.Type != PACKET_FIN {
+			// stats sent before the sender noticed the end of the session
+			continue
+		}
+		switch p.Type {
+		case PACKET_ERR:
+			return errors.Errorf("error from sender: %s", p.Data)
+		case PACKET_STAT:
+			if p.Stat == nil {
+				close(s.walkChan)
+				continue
+			}
+			p.Stat.Path = filepath.FromSlash(p.Stat.Path)
+			if p.Stat.Linkname != "" && !isSymlink(p.Stat) {
+				p.Stat.Linkname = filepath.FromSlash(p.Stat.Linkname)
+			}
+			if s.validator != nil {
+				if err := s.validator.HandleChange(ChangeKindAdd, p.Stat.Path, &StatInfo{p.Stat}, nil); err != nil {
+					return err
+				}
+			}
+			if s.filter != nil {
+				ok, err := s.filter.filter(p.Stat)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					i++
+					continue
+				}
+			}
+			if os.FileMode(p.Stat.Mode)&(os.ModeDir|os.ModeSymlink|os.ModeNamedPipe|os.ModeDevice|os.ModeSocket) == 0 {
+				s.mu.Lock()
+				s.files[p.Stat.Path] = i
+				s.sizes[i] = p.Stat.Size_
+				s.mu.Unlock()
+			}
+			i++
+			select {
+			case s.walkChan <- &currentPath{path: p.Stat.Path, f: &StatInfo{p.Stat}}:
+			case <-s.r.shutdown:
+				// no new files are accepted but data for the requested ones
+				// still needs to be read
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case PACKET_DATA:
+			if ok, err := s.chunkData(ctx, &p); ok {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			s.muPipes.Lock()
+			pw, ok := s.pipes[p.ID]
+			if !ok {
+				s.muPipes.Unlock()
+				if s.r.aborted() {
+					continue
+				}
+				return errors.Errorf("invalid file request %d", p.ID)
+			}
+			s.muPipes.Unlock()
+			if s.r.rateLimit != nil {
+				if err := s.r.rateLimit.WaitBytes(ctx, len(p.Data)); err != nil {
+					return err
+				}
+			}
+			dt := p.Data
+			if p.Compression != COMPRESSION_NONE {
+				var err error
+				if dt, err = decompressData(p.Compression, dt); err != nil {
+					pw.CloseWithError(err)
+					return err
+				}
+			}
+			var err error
+			if len(dt) == 0 {
+				if p.Checksum != "" {
+					s.muPipes.Lock()
+					s.checksums[p.ID] = p.Checksum
+					s.muPipes.Unlock()
+				}
+				err = pw.Close()
+			} else {
+				s.muPipes.Lock()
+				s.written[p.ID] += int64(len(dt))
+				s.muPipes.Unlock()
+				_, err = pw.Write(dt)
+			}
+			if err != nil && !s.r.aborted() {
+				return err
+			}
+		case PACKET_HOLE:
+			s.mu.RLock()
+			size := s.sizes[p.ID]
+			s.mu.RUnlock()
+			s.muPipes.Lock()
+			pw, ok := s.pipes[p.ID]
+			written := s.written[p.ID]
+			valid := p.Offset >= 0 && p.Offset <= size-written
+			if valid {
+				s.written[p.ID] += p.Offset
+			}
+			s.muPipes.Unlock()
+			if !ok {
+				if s.r.aborted() {
+					continue
+				}
+				return errors.Errorf("invalid file request %d", p.ID)
+			}
+			if !valid {
+				err := errors.Errorf("invalid hole size %d at offset %d of file with size %d", p.Offset, written, size)
+				pw.CloseWithError(err)
+				return err
+			}
+			if err := writeZeros(pw, p.Offset); err != nil && !s.r.aborted() {
+				return err
+			}
+		case PACKET_SKIP:
+			if s.failChunks(&p.ID, &fileSkippedError{reason: string(p.Data)}) {
+				continue
+			}
+			s.muPipes.Lock()
+			pw, ok := s.pipes[p.ID]
+			s.muPipes.Unlock()
+			if !ok {
+				if s.r.aborted() {
+					continue
+				}
+				return errors.Errorf("invalid file request %d", p.ID)
+			}
+			pw.CloseWithError(&fileSkippedError{reason: string(p.Data)})
+		case PACKET_RESUME:
+			// the sender can't continue the file at the offset asked for
+			s.muPipes.Lock()
+			pw, ok := s.pipes[p.ID]
+			s.muPipes.Unlock()
+			if !ok {
+				if s.r.aborted() {
+					continue
+				}
+				return errors.Errorf("invalid file request %d", p.ID)
+			}
+			pw.CloseWithError(errResumeRejected)
+		case PACKET_FIN:
+			return nil
+		}
+	}
+}
+
 func (r *receiver) asyncDataFunc(ctx context.Context, p string, wc io.WriteCloser) error {
-	r.mu.Lock()
-	id, ok := r.files[p]
-	if !ok {
-		r.mu.Unlock()
-		return errors.Errorf("invalid file request %s", p)
+	start := time.Now()
+	if err := r.fetchFile(ctx, p, wc); err != nil {
+		if !r.aborted() {
+			return err
+		}
+		// the partial file is removed so no truncated contents are left behind
+		os.Remove(filepath.Join(r.dest, p))
+		r.abortedMu.Lock()
+		r.abortedFiles = append(r.abortedFiles, p)
+		r.abortedMu.Unlock()
+		return ErrShutdown
+	}
+	atomic.AddInt64(&r.stats.files, 1)
+	if r.metrics != nil {
+		r.metrics.Phase(PhaseTransfer, p, time.Since(start))
 	}
-	delete(r.files, p)
-	r.mu.Unlock()
+	return nil
+}
 
+func (r *receiver) fetchFile(ctx context.Context, p string, wc io.WriteCloser) error {
+	for _, s := range r.peers {
+		// the id is kept so the file can be requested again
+		s.mu.RLock()
+		id, ok := s.files[p]
+		s.mu.RUnlock()
+		if ok {
+			atomic.AddInt64(&r.stats.pending, 1)
+			defer atomic.AddInt64(&r.stats.pending, -1)
+			offset, prefix := resumeFrom(ctx)
+			return s.requestFile(p, id, offset, prefix, wc)
+		}
+	}
+	return errors.Errorf("invalid file request %s", p)
+}
+
+// closePipes interrupts the file transfers in progress with err.
+func (r *receiver) closePipes(err error) {
+	for _, s := range r.peers {
+		s.muPipes.Lock()
+		for id, pw := range s.pipes {
+			pw.CloseWithError(err)
+			delete(s.pipes, id)
+		}
+		s.muPipes.Unlock()
+		s.failChunks(nil, err)
+	}
+}
+
+// requestFile asks for the contents of the file at p starting at offset.
+// prefix is the digest of the part before offset the sender needs to match.
+func (s *peer) requestFile(p string, id uint32, offset int64, prefix string, wc io.WriteCloser) error {
+	if offset > 0 && !s.hs.has(CapResume) {
+		return errResumeRejected
+	}
+	if s.r.chunks != nil && offset == 0 && s.hs.has(CapChunks) {
+		s.mu.RLock()
+		size := s.sizes[id]
+		s.mu.RUnlock()
+		if size > s.r.chunks.size() {
+			return s.requestChunks(p, id, offset, size, wc)
+		}
+	}
 	pr, pw := io.Pipe()
-	r.muPipes.Lock()
-	r.pipes[id] = pw
-	r.muPipes.Unlock()
-	if err := r.conn.SendMsg(&Packet{Type: PACKET_REQ, ID: id}); err != nil {
+	s.muPipes.Lock()
+	s.pipes[id] = pw
+	s.written[id] = offset
+	s.muPipes.Unlock()
+	req := &Packet{Type: PACKET_REQ, ID: id, Compression: s.r.compression}
+	if s.r.diskWriterOpt != nil && s.r.diskWriterOpt.Sparse {
+		req.Sparse = true
+	}
+	if s.r.verify {
+		req.Verify = true
+	}
+	if offset > 0 {
+		req.Type = PACKET_RESUME
+		req.Offset = offset
+		req.Data = []byte(prefix)
+	}
+	if err := s.conn.SendMsg(req); err != nil {
 		return err
 	}
 
+	var w io.Writer = wc
+	var h hash.Hash
+	if s.r.verify {
+		h = sha256.New()
+		w = io.MultiWriter(wc, h)
+	}
 	buf := bufPool.Get().([]byte)
 	defer bufPool.Put(buf)
-	if _, err := io.CopyBuffer(wc, pr, buf); err != nil {
+	if _, err := io.CopyBuffer(w, pr, buf); err != nil {
+		return err
+	}
+	if err := wc.Close(); err != nil {
 		return err
 	}
-	return wc.Close()
+	if h == nil {
+		return nil
+	}
+	s.muPipes.Lock()
+	expected, ok := s.checksums[id]
+	delete(s.checksums, id)
+	s.muPipes.Unlock()
+	if !ok {
+		return errors.Errorf("sender did not send a checksum for %s", p)
+	}
+	if actual := "sha256:" + hex.EncodeToString(h.Sum(nil)); actual != expected {
+		return errors.WithStack(&ChecksumError{Path: p, Expected: expected, Actual: actual})
+	}
+	return nil
 }
@@ -4,14 +4,26 @@ package fsutil
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"io/ioutil"
+	mrand "math/rand"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/docker/docker/builder"
 	"github.com/pkg/errors"
+	"github.com/stevvooe/continuity/sysx"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/context"
 )
@@ -37,26 +49,9 @@ func TestCopySimple(t *testing.T) {
 	assert.NoError(t, err)
 	defer os.RemoveAll(dest)
 
-	s1, s2 := sockPairProto()
-
 	ts := NewTarsum("")
-
-	var err1 error
-	var err2 error
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go func() {
-		err1 = Send(context.Background(), s1, d, nil, nil)
-		wg.Done()
-	}()
-	go func() {
-		err2 = Receive(context.Background(), s2, dest, ts.HandleChange)
-		wg.Done()
-	}()
-
-	wg.Wait()
-	assert.NoError(t, err1)
-	assert.NoError(t, err2)
+	err = syncDirs(d, dest, SendOpt{}, ReceiveOpt{NotifyHashed: ts.HandleChange})
+	assert.NoError(t, err)
 
 	b := &bytes.Buffer{}
 	err = Walk(context.Background(), dest, nil, bufWalk(b))
@@ -102,19 +97,8 @@ symlink:../../ zzz/bb/cc/dd
 	err = os.RemoveAll(filepath.Join(d, "foo2"))
 	assert.NoError(t, err)
 
-	wg.Add(2)
-	go func() {
-		err1 = Send(context.Background(), s1, d, nil, nil)
-		wg.Done()
-	}()
-	go func() {
-		err2 = Receive(context.Background(), s2, dest, ts.HandleChange)
-		wg.Done()
-	}()
-
-	wg.Wait()
-	assert.NoError(t, err1)
-	assert.NoError(t, err2)
+	err = syncDirs(d, dest, SendOpt{}, ReceiveOpt{NotifyHashed: ts.HandleChange})
+	assert.NoError(t, err)
 
 	b = &bytes.Buffer{}
 	err = Walk(context.Background(), dest, nil, bufWalk(b))
@@ -155,76 +139,2753 @@ file zzz/bb/cc/foo
 	assert.Equal(t, c.c, 1)
 }
 
-func sockPair() (Stream, Stream) {
-	c1 := make(chan *Packet, 32)
-	c2 := make(chan *Packet, 32)
-	return &fakeConn{c1, c2}, &fakeConn{c2, c1}
-}
+func TestCopyUnsupported(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD foo file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
 
-func sockPairProto() (Stream, Stream) {
-	c1 := make(chan []byte, 32)
-	c2 := make(chan []byte, 32)
-	return &fakeConnProto{c1, c2}, &fakeConnProto{c2, c1}
+	l, err := net.Listen("unix", filepath.Join(d, "sock"))
+	assert.NoError(t, err)
+	defer l.Close()
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	s1, s2 := sockPairProto()
+	err1, err2 := sendReceive(s1, s2, d, dest, SendOpt{
+		WalkOpt: &WalkOpt{
+			Unsupported: &UnsupportedPolicy{},
+		},
+	}, ReceiveOpt{})
+	assert.Error(t, err1)
+	_, ok := errors.Cause(err1).(*UnsupportedError)
+	assert.True(t, ok)
+	assert.Error(t, err2)
+	assert.Contains(t, err2.Error(), "sock")
 }
 
-type fakeConn struct {
-	recvChan chan *Packet
-	sendChan chan *Packet
+func TestCopyDevices(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD foo file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	assert.NoError(t, syscall.Mkfifo(filepath.Join(d, "fifo"), 0600))
+	l, err := net.Listen("unix", filepath.Join(d, "sock"))
+	assert.NoError(t, err)
+	defer l.Close()
+	// creating device nodes needs privileges
+	devices := os.Getuid() == 0
+	if devices {
+		assert.NoError(t, syscall.Mknod(filepath.Join(d, "null"), syscall.S_IFCHR|0666, int(mkdev(1, 3))))
+	}
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	ts := NewTarsum(dest)
+	err = syncDirs(d, dest, SendOpt{}, ReceiveOpt{NotifyHashed: ts.HandleChange})
+	assert.NoError(t, err)
+
+	fi, err := os.Lstat(filepath.Join(dest, "fifo"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.ModeNamedPipe, fi.Mode()&os.ModeType)
+	fi, err = os.Lstat(filepath.Join(dest, "sock"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.ModeSocket, fi.Mode()&os.ModeType)
+	if devices {
+		fi, err = os.Lstat(filepath.Join(dest, "null"))
+		assert.NoError(t, err)
+		assert.Equal(t, os.ModeDevice|os.ModeCharDevice, fi.Mode()&os.ModeType)
+		assert.Equal(t, uint64(mkdev(1, 3)), uint64(fi.Sys().(*syscall.Stat_t).Rdev))
+	}
+
+	dgst, err := ts.Sum()
+	assert.NoError(t, err)
+	expected, err := TreeDigest(context.Background(), d, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, dgst)
 }
 
-func (fc *fakeConn) RecvMsg(m interface{}) error {
-	p, ok := m.(*Packet)
-	if !ok {
-		return errors.Errorf("invalid msg: %#v", m)
+func TestCopyDeleteLimit(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD foo file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dest, err := tmpDir(changeStream([]string{
+		"ADD bar file data2",
+		"ADD baz dir",
+		"ADD baz/a file data3",
+		"ADD foo file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	copyWithLimit := func(limit *DeleteLimit) (error, error) {
+		s1, s2 := sockPairProto()
+		return sendReceive(s1, s2, d, dest, SendOpt{}, ReceiveOpt{DeleteLimit: limit})
 	}
-	p2 := <-fc.recvChan
-	*p = *p2
-	return nil
+
+	err1, err2 := copyWithLimit(&DeleteLimit{Max: 2})
+	assert.Error(t, err1)
+	assert.Error(t, err2)
+	dle, ok := errors.Cause(err2).(*DeleteLimitError)
+	assert.True(t, ok)
+	assert.Equal(t, 3, dle.Deletes)
+	assert.Equal(t, 4, dle.Total)
+
+	_, err = os.Stat(filepath.Join(dest, "baz/a"))
+	assert.NoError(t, err)
+
+	err1, err2 = copyWithLimit(&DeleteLimit{Percent: 50})
+	assert.Error(t, err1)
+	assert.Error(t, err2)
+
+	var confirmed bool
+	err1, err2 = copyWithLimit(&DeleteLimit{Max: 2, Confirm: func(deletes, total int) error {
+		confirmed = true
+		return nil
+	}})
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+	assert.True(t, confirmed)
+
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), dest, nil, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, "file foo\n", string(b.Bytes()))
 }
 
-func (fc *fakeConn) SendMsg(m interface{}) error {
-	p, ok := m.(*Packet)
-	if !ok {
-		return errors.Errorf("invalid msg: %#v", m)
+func TestReceiveMerge(t *testing.T) {
+	d1, err := tmpDir(changeStream([]string{
+		"ADD dir dir",
+		"ADD dir/a file data1",
+		"ADD foo file data2",
+		"ADD h file data3",
+		"ADD x file data4",
+		"ADD z file >h",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d1)
+
+	d2, err := tmpDir(changeStream([]string{
+		"ADD dir dir",
+		"ADD dir/b file data5",
+		"ADD foo file data6",
+		"ADD h file data7",
+		"ADD x dir",
+		"ADD x/y file data8",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d2)
+
+	merge := func(policy MergePolicy) (string, error) {
+		dest, err := ioutil.TempDir("", "dest")
+		if err != nil {
+			return "", err
+		}
+		s1, r1 := sockPairProto()
+		s2, r2 := sockPairProto()
+
+		var errs [3]error
+		var wg sync.WaitGroup
+		wg.Add(3)
+		go func() {
+			errs[0] = Send(context.Background(), s1, d1, SendOpt{})
+			wg.Done()
+		}()
+		go func() {
+			errs[1] = Send(context.Background(), s2, d2, SendOpt{})
+			wg.Done()
+		}()
+		go func() {
+			errs[2] = ReceiveMerge(context.Background(), []Stream{r1, r2}, dest, ReceiveOpt{Merge: policy})
+			wg.Done()
+		}()
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				return dest, err
+			}
+		}
+		return dest, nil
 	}
-	p2 := *p
-	p2.Data = append([]byte{}, p2.Data...)
-	fc.sendChan <- &p2
-	return nil
+
+	dest, err := merge(MergeLastWins)
+	defer os.RemoveAll(dest)
+	assert.NoError(t, err)
+
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), dest, nil, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `dir dir
+file dir/a
+file dir/b
+file foo
+file h
+dir x
+file x/y
+file z
+`, string(b.Bytes()))
+
+	for p, data := range map[string]string{"foo": "data6", "h": "data7", "x/y": "data8", "z": "data3"} {
+		dt, err := ioutil.ReadFile(filepath.Join(dest, p))
+		assert.NoError(t, err)
+		assert.Equal(t, data, string(dt))
+	}
+
+	dest, err = merge(MergeFirstWins)
+	defer os.RemoveAll(dest)
+	assert.NoError(t, err)
+
+	b = &bytes.Buffer{}
+	err = Walk(context.Background(), dest, nil, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `dir dir
+file dir/a
+file dir/b
+file foo
+file h
+file x
+file z >h
+`, string(b.Bytes()))
+
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data2", string(dt))
+
+	dest, err = merge(MergeError)
+	defer os.RemoveAll(dest)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "conflicting path foo")
 }
 
-type fakeConnProto struct {
-	recvChan chan []byte
-	sendChan chan []byte
+func TestCopyRateLimit(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data12",
+		"ADD foo dir",
+		"ADD foo/baz file data345",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	rl := &countingLimiter{}
+	err = syncDirs(d, dest, SendOpt{}, ReceiveOpt{RateLimit: rl})
+	assert.NoError(t, err)
+
+	assert.Equal(t, 13, rl.bytes)
+	assert.Equal(t, 3, rl.ops)
 }
 
-func (fc *fakeConnProto) RecvMsg(m interface{}) error {
-	p, ok := m.(*Packet)
-	if !ok {
-		return errors.Errorf("invalid msg: %#v", m)
+func TestSendRateLimit(t *testing.T) {
+	changes := []string{"ADD foo dir"}
+	for i := 0; i < 8; i++ {
+		changes = append(changes, fmt.Sprintf("ADD foo/f%d file data%d", i, i))
 	}
-	dt := <-fc.recvChan
-	return p.Unmarshal(dt)
+	d, err := tmpDir(changeStream(changes))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	rl := &concurrencyLimiter{}
+	err = syncDirs(d, dest, SendOpt{RateLimit: rl, MaxConcurrentFiles: 1}, ReceiveOpt{})
+	assert.NoError(t, err)
+
+	assert.Equal(t, 40, rl.bytes)
+	assert.Equal(t, 1, rl.max)
+
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "foo/f7"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data7", string(dt))
 }
 
-func (fc *fakeConnProto) SendMsg(m interface{}) error {
-	p, ok := m.(*Packet)
-	if !ok {
-		return errors.Errorf("invalid msg: %#v", m)
-	}
-	dt, err := p.Marshal()
-	if err != nil {
-		return err
+// concurrencyLimiter records the number of callers waiting at the same time.
+type concurrencyLimiter struct {
+	countingLimiter
+	current int
+	max     int
+}
+
+func (l *concurrencyLimiter) WaitBytes(ctx context.Context, n int) error {
+	l.mu.Lock()
+	l.bytes += n
+	l.current++
+	if l.current > l.max {
+		l.max = l.current
 	}
-	fc.sendChan <- dt
+	l.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	l.mu.Lock()
+	l.current--
+	l.mu.Unlock()
 	return nil
 }
 
-type counter struct {
-	c int
+type countingLimiter struct {
+	mu    sync.Mutex
+	bytes int
+	ops   int
 }
 
-func (c *counter) inc(p string, fi builder.FileInfo, err error) error {
-	c.c++
-	return err
+func (l *countingLimiter) WaitBytes(ctx context.Context, n int) error {
+	l.mu.Lock()
+	l.bytes += n
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *countingLimiter) WaitOps(ctx context.Context, n int) error {
+	l.mu.Lock()
+	l.ops += n
+	l.mu.Unlock()
+	return nil
+}
+
+func TestReceiveLazy(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+		"ADD foo dir",
+		"ADD foo/baz file data2",
+		"ADD foo/link symlink ../bar",
+		"ADD zzz file data3",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	s1, s2 := sockPairProto()
+
+	var err1 error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		err1 = Send(context.Background(), s1, d, SendOpt{ReadErrors: &ReadErrorPolicy{Action: ReadErrorSkip}})
+		wg.Done()
+	}()
+
+	lt, err := ReceiveLazy(context.Background(), s2, dest, ReceiveOpt{})
+	assert.NoError(t, err)
+
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), dest, nil, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `file bar
+dir foo
+file foo/baz
+symlink:../bar foo/link
+file zzz
+`, string(b.Bytes()))
+
+	pending := lt.Pending()
+	sort.Strings(pending)
+	assert.Equal(t, []string{"bar", "foo/baz", "zzz"}, pending)
+
+	fi, err := os.Stat(filepath.Join(dest, "foo/baz"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), fi.Size())
+
+	f, err := lt.Open(context.Background(), "foo/baz")
+	assert.NoError(t, err)
+	dt, err := ioutil.ReadAll(f)
+	f.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "data2", string(dt))
+	pending = lt.Pending()
+	sort.Strings(pending)
+	assert.Equal(t, []string{"bar", "zzz"}, pending)
+
+	// paths outside of the tree are rejected
+	assert.Error(t, lt.Materialize(context.Background(), "../bar"))
+	_, err = lt.Stat(filepath.Join(dest, "bar"))
+	assert.Error(t, err)
+
+	// a file that failed to be fetched stays pending and is fetched again
+	assert.NoError(t, os.Rename(filepath.Join(d, "zzz"), filepath.Join(d, "zzz2")))
+	assert.Error(t, lt.Materialize(context.Background(), "zzz"))
+	pending = lt.Pending()
+	sort.Strings(pending)
+	assert.Equal(t, []string{"bar", "zzz"}, pending)
+	assert.NoError(t, os.Rename(filepath.Join(d, "zzz2"), filepath.Join(d, "zzz")))
+	assert.NoError(t, lt.Materialize(context.Background(), "zzz"))
+	assert.Equal(t, []string{"bar"}, lt.Pending())
+	dt, err = ioutil.ReadFile(filepath.Join(dest, "zzz"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data3", string(dt))
+
+	err = lt.Close()
+	assert.NoError(t, err)
+	wg.Wait()
+	assert.NoError(t, err1)
+
+	dt, err = ioutil.ReadFile(filepath.Join(dest, "bar"))
+	assert.NoError(t, err)
+	assert.Equal(t, "", string(dt))
+}
+
+func TestCopyTreeDigest(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+		"ADD foo dir",
+		"ADD foo/baz file data2",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	copyWithDigest := func(src, dst string) error {
+		return syncDirs(d, dest, SendOpt{TreeDigest: src}, ReceiveOpt{TreeDigest: dst})
+	}
+
+	dgst, err := TreeDigest(context.Background(), d, nil)
+	assert.NoError(t, err)
+	emptyDgst, err := TreeDigest(context.Background(), dest, nil)
+	assert.NoError(t, err)
+	assert.NotEqual(t, dgst, emptyDgst)
+
+	err = copyWithDigest(dgst, emptyDgst)
+	assert.NoError(t, err)
+
+	destDgst, err := TreeDigest(context.Background(), dest, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, dgst, destDgst)
+
+	// matching digests skip the comparison so the new file isn't sent
+	err = ioutil.WriteFile(filepath.Join(d, "foo/new"), []byte("data3"), 0600)
+	assert.NoError(t, err)
+
+	err = copyWithDigest(dgst, dgst)
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dest, "foo/new"))
+	assert.True(t, os.IsNotExist(err))
+
+	err = copyWithDigest("", dgst)
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dest, "foo/new"))
+	assert.NoError(t, err)
+}
+
+func TestReceiveCreateDest(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD foo file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	tmp, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	dest := filepath.Join(tmp, "a/b")
+
+	receive := func(opt ReceiveOpt) (error, error) {
+		s1, s2 := sockPairProto()
+		return sendReceive(s1, s2, d, dest, SendOpt{}, opt)
+	}
+
+	err1, err2 := receive(ReceiveOpt{})
+	assert.Error(t, err1)
+	assert.Error(t, err2)
+	_, ok := errors.Cause(err2).(*DestNotExistError)
+	assert.True(t, ok)
+
+	err1, err2 = receive(ReceiveOpt{CreateDest: &CreateDestOpt{Mode: 0710}})
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+
+	for _, p := range []string{"a", "a/b"} {
+		fi, err := os.Stat(filepath.Join(tmp, p))
+		assert.NoError(t, err)
+		assert.Equal(t, os.ModeDir|0710, fi.Mode())
+	}
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data1", string(dt))
+}
+
+func TestReceiveRequireEmpty(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD foo file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dest, err := tmpDir(changeStream([]string{
+		"ADD bar file data2",
+		"ADD lost+found dir",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	receive := func(opt ReceiveOpt) (error, error) {
+		s1, s2 := sockPairProto()
+		return sendReceive(s1, s2, d, dest, SendOpt{}, opt)
+	}
+
+	opt := ReceiveOpt{RequireEmpty: &RequireEmptyOpt{Allow: []string{"lost+found"}}}
+	err1, err2 := receive(opt)
+	assert.Error(t, err1)
+	assert.Error(t, err2)
+	dne, ok := errors.Cause(err2).(*DestNotEmptyError)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"bar"}, dne.Entries)
+
+	_, err = os.Stat(filepath.Join(dest, "bar"))
+	assert.NoError(t, err)
+
+	err = os.Remove(filepath.Join(dest, "bar"))
+	assert.NoError(t, err)
+
+	err1, err2 = receive(opt)
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data1", string(dt))
+}
+
+func TestReceiveLocked(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD foo file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	s1, s2 := sockPairProto()
+	var err1 error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		err1 = Send(context.Background(), s1, d, SendOpt{})
+		wg.Done()
+	}()
+	lt, err := ReceiveLazy(context.Background(), s2, dest, ReceiveOpt{})
+	assert.NoError(t, err)
+
+	s3, s4 := sockPairProto()
+	var err3 error
+	wg.Add(1)
+	go func() {
+		err3 = Send(context.Background(), s3, d, SendOpt{})
+		wg.Done()
+	}()
+	err = Receive(context.Background(), s4, dest, ReceiveOpt{})
+	assert.Error(t, err)
+	_, ok := errors.Cause(err).(*DestLockedError)
+	assert.True(t, ok)
+
+	assert.NoError(t, lt.Close())
+	wg.Wait()
+	assert.NoError(t, err1)
+	assert.Error(t, err3)
+
+	err = syncDirs(d, dest, SendOpt{}, ReceiveOpt{})
+	assert.NoError(t, err)
+}
+
+func TestReceiveNames(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD NUL file data1",
+		"ADD a\xff dir",
+		"ADD a\xff/x file data2",
+		"ADD ok file data3",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	receive := func(opt ReceiveOpt) (string, error) {
+		dest, err := ioutil.TempDir("", "dest")
+		assert.NoError(t, err)
+
+		s1, s2 := sockPairProto()
+		_, err = sendReceive(s1, s2, d, dest, SendOpt{}, opt)
+
+		b := &bytes.Buffer{}
+		assert.NoError(t, Walk(context.Background(), dest, nil, bufWalk(b)))
+		os.RemoveAll(dest)
+		return string(b.Bytes()), err
+	}
+
+	out, err := receive(ReceiveOpt{})
+	assert.NoError(t, err)
+	assert.Equal(t, "file NUL\ndir a\xff\nfile a\xff/x\nfile ok\n", out)
+
+	_, err = receive(ReceiveOpt{Names: &NamePolicy{}})
+	assert.Error(t, err)
+	ne, ok := errors.Cause(err).(*InvalidNameError)
+	assert.True(t, ok)
+	assert.Equal(t, "a\xff", ne.Path)
+
+	var warned []string
+	warn := func(p string, err error) {
+		warned = append(warned, p)
+	}
+	out, err = receive(ReceiveOpt{Names: &NamePolicy{Action: NameSkip, Windows: true, Warn: warn}})
+	assert.NoError(t, err)
+	assert.Equal(t, "file ok\n", out)
+	assert.Equal(t, []string{"NUL", "a\xff"}, warned)
+
+	warned = nil
+	out, err = receive(ReceiveOpt{Names: &NamePolicy{Action: NameEncode, Windows: true, Warn: warn}})
+	assert.NoError(t, err)
+	assert.Equal(t, "file NU%4C\ndir a%FF\nfile a%FF/x\nfile ok\n", out)
+	assert.Equal(t, []string{"NUL", "a\xff", "a\xff/x"}, warned)
+}
+
+func TestCopyRetry(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+		"ADD foo file data2",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	receive := func(retries, failures int) (map[string]int, error) {
+		dest, err := ioutil.TempDir("", "dest")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dest)
+
+		var mu sync.Mutex
+		calls := map[string]int{}
+		notify := func(kind ChangeKind, p string, fi os.FileInfo, err error) error {
+			mu.Lock()
+			defer mu.Unlock()
+			calls[p]++
+			if p == "foo" && calls[p] <= failures {
+				return &ChecksumError{Path: p, Expected: "sha256:x", Actual: "sha256:y"}
+			}
+			return nil
+		}
+
+		s1, s2 := sockPairProto()
+		err1, err := sendReceive(s1, s2, d, dest, SendOpt{}, ReceiveOpt{NotifyHashed: notify, Retries: retries})
+		if err == nil {
+			assert.NoError(t, err1)
+			dt, err := ioutil.ReadFile(filepath.Join(dest, "foo"))
+			assert.NoError(t, err)
+			assert.Equal(t, "data2", string(dt))
+		}
+		return calls, err
+	}
+
+	calls, err := receive(2, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"bar": 1, "foo": 3}, calls)
+
+	calls, err = receive(1, 2)
+	assert.Error(t, err)
+	_, ok := errors.Cause(err).(*ChecksumError)
+	assert.True(t, ok)
+	assert.Equal(t, 2, calls["foo"])
+}
+
+func TestCopyVerifyChecksums(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+		"ADD foo file data2",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	receive := func(retries, corrupt int) error {
+		dest, err := ioutil.TempDir("", "dest")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dest)
+
+		s1, s2 := sockPairProto()
+		conn := &corruptConn{Stream: s2, path: "foo", n: corrupt}
+		err1, err := sendReceive(s1, conn, d, dest, SendOpt{}, ReceiveOpt{VerifyChecksums: true, Retries: retries})
+		if err == nil {
+			assert.NoError(t, err1)
+			dt, err := ioutil.ReadFile(filepath.Join(dest, "foo"))
+			assert.NoError(t, err)
+			assert.Equal(t, "data2", string(dt))
+		}
+		return err
+	}
+
+	assert.NoError(t, receive(0, 0))
+	assert.NoError(t, receive(1, 1))
+
+	err = receive(0, 1)
+	assert.Error(t, err)
+	cerr, ok := errors.Cause(err).(*ChecksumError)
+	if assert.True(t, ok) {
+		assert.Equal(t, "foo", cerr.Path)
+		assert.Equal(t, "sha256:"+fmt.Sprintf("%x", sha256.Sum256([]byte("data2"))), cerr.Expected)
+	}
+}
+
+// corruptConn changes the first byte of the data received for the file at
+// path the first n times it is sent.
+type corruptConn struct {
+	Stream
+	path string
+	n    int
+	id   uint32
+	ids  uint32
+}
+
+func (c *corruptConn) RecvMsg(m interface{}) error {
+	if err := c.Stream.RecvMsg(m); err != nil {
+		return err
+	}
+	p := m.(*Packet)
+	switch p.Type {
+	case PACKET_STAT:
+		if p.Stat != nil {
+			if p.Stat.Path == c.path {
+				c.id = c.ids
+			}
+			c.ids++
+		}
+	case PACKET_DATA:
+		if p.ID == c.id && len(p.Data) > 0 && c.n > 0 {
+			c.n--
+			p.Data[0] ^= 0xff
+		}
+	}
+	return nil
+}
+
+func TestTransferStats(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+		"ADD foo file data2",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	failed := false
+	notify := func(kind ChangeKind, p string, fi os.FileInfo, err error) error {
+		if p == "foo" && !failed {
+			failed = true
+			return &ChecksumError{Path: p, Expected: "sha256:x", Actual: "sha256:y"}
+		}
+		return nil
+	}
+
+	s1, s2 := sockPairProto()
+	ss := NewSendSession(s1, d, SendOpt{})
+	rs := NewReceiveSession([]Stream{s2}, dest, ReceiveOpt{NotifyHashed: notify, Retries: 1})
+	var err1 error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		err1 = ss.Run(context.Background())
+		wg.Done()
+	}()
+	err = rs.Run(context.Background())
+	wg.Wait()
+	assert.NoError(t, err)
+	assert.NoError(t, err1)
+
+	for _, st := range []TransferStats{ss.Stats(), rs.Stats()} {
+		assert.True(t, st.Bytes > 0)
+		assert.Equal(t, int64(3), st.Files)
+		assert.Equal(t, int64(0), st.FilesPending)
+		assert.Equal(t, int64(1), st.Retries)
+		assert.False(t, st.Started.IsZero())
+	}
+}
+
+func TestSendReadErrors(t *testing.T) {
+	transfer := func(opt SendOpt) (string, error, error) {
+		d, err := tmpDir(changeStream([]string{
+			"ADD bar file data1",
+			"ADD foo file data2",
+		}))
+		assert.NoError(t, err)
+		defer os.RemoveAll(d)
+
+		dest, err := ioutil.TempDir("", "dest")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dest)
+
+		s1, s2 := sockPairProto()
+		// foo disappears after its stat was sent
+		conn := &removeOnRequestConn{Stream: s1, path: filepath.Join(d, "foo")}
+		err1, err2 := sendReceive(conn, s2, d, dest, opt, ReceiveOpt{})
+
+		b := &bytes.Buffer{}
+		assert.NoError(t, Walk(context.Background(), dest, nil, bufWalk(b)))
+		return string(b.Bytes()), err1, err2
+	}
+
+	_, err1, err2 := transfer(SendOpt{})
+	assert.Error(t, err1)
+	assert.True(t, os.IsNotExist(errors.Cause(err1)))
+	assert.Error(t, err2)
+
+	var warned []string
+	warn := func(p string, err error) {
+		warned = append(warned, p)
+	}
+	out, err1, err2 := transfer(SendOpt{ReadErrors: &ReadErrorPolicy{Action: ReadErrorSkip, Warn: warn}})
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+	assert.Equal(t, "file bar\n", out)
+	assert.Equal(t, []string{"foo"}, warned)
+
+	out, err1, err2 = transfer(SendOpt{ReadErrors: &ReadErrorPolicy{Action: ReadErrorStale}})
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+	assert.Equal(t, "file bar\nfile foo\n", out)
+}
+
+func TestTimeoutReader(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	r := &timeoutReader{r: pr, timeout: 50 * time.Millisecond, deadline: time.Now().Add(50 * time.Millisecond)}
+
+	go pw.Write([]byte("abc"))
+	buf := make([]byte, 10)
+	n, err := r.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", string(buf[:n]))
+
+	_, err = r.Read(buf)
+	assert.EqualError(t, err, "read timed out after 50ms")
+}
+
+type removeOnRequestConn struct {
+	Stream
+	path string
+}
+
+func (c *removeOnRequestConn) RecvMsg(m interface{}) error {
+	if err := c.Stream.RecvMsg(m); err != nil {
+		return err
+	}
+	if m.(*Packet).Type == PACKET_REQ {
+		os.Remove(c.path)
+	}
+	return nil
+}
+
+func TestReceiveStream(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+		"ADD foo dir",
+		"ADD foo/baz file data2",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dest, err := tmpDir(changeStream([]string{
+		"ADD old file",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	s1, s2 := sockPairProto()
+	var err1 error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		err1 = Send(context.Background(), s1, d, SendOpt{})
+		wg.Done()
+	}()
+
+	s := ReceiveStream(context.Background(), s2, dest, ReceiveOpt{})
+	changes := map[string]ChangeKind{}
+	for c := range s.C {
+		changes[c.Path] = c.Kind
+		if c.Path == "foo/baz" {
+			r, err := c.Open()
+			assert.NoError(t, err)
+			dt, err := ioutil.ReadAll(r)
+			r.Close()
+			assert.NoError(t, err)
+			assert.Equal(t, "data2", string(dt))
+		}
+	}
+	assert.NoError(t, s.Err())
+	wg.Wait()
+	assert.NoError(t, err1)
+
+	assert.Equal(t, map[string]ChangeKind{
+		"bar":     ChangeKindAdd,
+		"foo":     ChangeKindAdd,
+		"foo/baz": ChangeKindAdd,
+		"old":     ChangeKindDelete,
+	}, changes)
+}
+
+func TestCopyXattrs(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar dir",
+		"ADD bar/baz file data1",
+		"ADD foo file data2",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	// cap_net_bind_service in the effective and permitted sets
+	capability := []byte{1, 0, 0, 2, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	xattrs := map[string]map[string][]byte{
+		"bar":     {"user.a": []byte("1")},
+		"bar/baz": {"user.b": []byte("2"), "user.c": []byte("3")},
+		"foo":     {"security.capability": capability},
+	}
+	for p, m := range xattrs {
+		for k, v := range m {
+			if err := sysx.LSetxattr(filepath.Join(d, p), k, v, 0); err != nil {
+				t.Skipf("xattrs not supported: %v", err)
+			}
+		}
+	}
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	err = syncDirs(d, dest, SendOpt{}, ReceiveOpt{})
+	assert.NoError(t, err)
+
+	for p, m := range xattrs {
+		for k, v := range m {
+			dt, err := sysx.LGetxattr(filepath.Join(dest, p), k)
+			assert.NoError(t, err)
+			assert.Equal(t, v, dt, "%s %s", p, k)
+		}
+	}
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data2", string(dt))
+}
+
+func TestReceiveResume(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar dir",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	data := make([]byte, 300*1024)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	err = ioutil.WriteFile(filepath.Join(d, "foo"), data, 0600)
+	assert.NoError(t, err)
+
+	transfer := func(dest string, sconn, rconn func(Stream) Stream, opt ReceiveOpt) (map[string]string, error) {
+		hashes := map[string]string{}
+		var mu sync.Mutex
+		opt.NotifyHashed = func(kind ChangeKind, p string, fi os.FileInfo, err error) error {
+			mu.Lock()
+			hashes[p] = fi.(hashed).Hash()
+			mu.Unlock()
+			return nil
+		}
+		s1, s2 := sockPairProto()
+		_, err := sendReceive(sconn(s1), rconn(s2), d, dest, SendOpt{}, opt)
+		return hashes, err
+	}
+	direct := func(s Stream) Stream { return s }
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	state := &ResumeState{}
+	_, err = transfer(dest, direct, func(s Stream) Stream {
+		return &dropConn{Stream: s, packets: 2}
+	}, ReceiveOpt{Resume: state})
+	assert.Error(t, err)
+
+	offset, ok := state.Files()["foo"]
+	assert.True(t, ok)
+	assert.True(t, offset > 0 && offset < int64(len(data)))
+
+	rec := &recordConn{}
+	hashes, err := transfer(dest, func(s Stream) Stream {
+		rec.Stream = s
+		return rec
+	}, direct, ReceiveOpt{Resume: state})
+	assert.NoError(t, err)
+	assert.Equal(t, []Packet_PacketType{PACKET_RESUME}, rec.requests)
+	assert.Equal(t, int64(len(data))-offset, rec.data)
+	assert.Equal(t, 0, len(state.Files()))
+
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, data, dt)
+
+	dest2, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest2)
+
+	expected, err := transfer(dest2, direct, direct, ReceiveOpt{})
+	assert.NoError(t, err)
+	assert.Equal(t, expected["foo"], hashes["foo"])
+
+	// a kept part that differs from the source is transferred again
+	dest3, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest3)
+
+	state = &ResumeState{}
+	_, err = transfer(dest3, direct, func(s Stream) Stream {
+		return &dropConn{Stream: s, packets: 2}
+	}, ReceiveOpt{Resume: state})
+	assert.Error(t, err)
+	f, err := os.OpenFile(filepath.Join(dest3, "foo"), os.O_WRONLY, 0)
+	assert.NoError(t, err)
+	_, err = f.WriteAt([]byte{data[0] + 1}, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	rec = &recordConn{}
+	hashes, err = transfer(dest3, func(s Stream) Stream {
+		rec.Stream = s
+		return rec
+	}, direct, ReceiveOpt{Resume: state})
+	assert.NoError(t, err)
+	assert.Equal(t, []Packet_PacketType{PACKET_RESUME, PACKET_REQ}, rec.requests)
+	assert.Equal(t, int64(len(data)), rec.data)
+	dt, err = ioutil.ReadFile(filepath.Join(dest3, "foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, data, dt)
+	assert.Equal(t, expected["foo"], hashes["foo"])
+}
+
+func TestFileProgress(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+		"ADD baz dir",
+		"ADD baz/link symlink ../bar",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+	err = ioutil.WriteFile(filepath.Join(d, "foo"), make([]byte, 100*1024), 0600)
+	assert.NoError(t, err)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	type progress struct {
+		totals []int64
+		files  map[string]int64
+	}
+	record := func(pr *progress) func(Stat, int64, int64) {
+		pr.files = map[string]int64{}
+		return func(st Stat, transferred, total int64) {
+			if st.Path == "" {
+				pr.totals = append(pr.totals, total)
+				return
+			}
+			assert.Equal(t, st.Size_, total)
+			assert.True(t, transferred > pr.files[st.Path])
+			pr.files[st.Path] = transferred
+		}
+	}
+	var sent, received progress
+
+	err = syncDirs(d, dest, SendOpt{FileProgressCb: record(&sent)}, ReceiveOpt{FileProgressCb: record(&received)})
+	assert.NoError(t, err)
+
+	for _, pr := range []progress{sent, received} {
+		assert.Equal(t, []int64{5 + 100*1024}, pr.totals)
+		assert.Equal(t, map[string]int64{"bar": 5, "foo": 100 * 1024}, pr.files)
+	}
+}
+
+func TestCopyCompression(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+	data := bytes.Repeat([]byte("lorem ipsum dolor sit amet "), 10000)
+	err = ioutil.WriteFile(filepath.Join(d, "foo"), data, 0600)
+	assert.NoError(t, err)
+
+	transfer := func(sopt *CompressionOpt, c Packet_Compression) int64 {
+		dest, err := ioutil.TempDir("", "dest")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dest)
+
+		s1, s2 := sockPairProto()
+		rec := &recordConn{Stream: s1}
+		err1, err := sendReceive(rec, s2, d, dest, SendOpt{Compression: sopt}, ReceiveOpt{Compression: c})
+		assert.NoError(t, err)
+		assert.NoError(t, err1)
+
+		dt, err := ioutil.ReadFile(filepath.Join(dest, "foo"))
+		assert.NoError(t, err)
+		assert.Equal(t, data, dt)
+		dt, err = ioutil.ReadFile(filepath.Join(dest, "bar"))
+		assert.NoError(t, err)
+		assert.Equal(t, "data1", string(dt))
+		return rec.data
+	}
+
+	size := int64(len(data) + 5)
+	assert.Equal(t, size, transfer(nil, COMPRESSION_GZIP))
+	assert.Equal(t, size, transfer(&CompressionOpt{}, COMPRESSION_NONE))
+	assert.True(t, transfer(&CompressionOpt{}, COMPRESSION_GZIP) < size/10)
+	assert.True(t, transfer(&CompressionOpt{}, COMPRESSION_ZSTD) < size/10)
+	assert.Equal(t, size, transfer(&CompressionOpt{Allowed: []Packet_Compression{COMPRESSION_GZIP}}, COMPRESSION_ZSTD))
+}
+
+func TestReceiveHardlinks(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD a file data1",
+		"ADD dir dir",
+		"ADD dir/b file >a",
+		"ADD dir/c file >a",
+		"ADD single file data2",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), d, nil, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `file a
+dir dir
+file dir/b >a
+file dir/c >a
+file single
+`, string(b.Bytes()))
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	s1, s2 := sockPairProto()
+	rec := &recordConn{Stream: s1}
+	err1, err := sendReceive(rec, s2, d, dest, SendOpt{}, ReceiveOpt{})
+	assert.NoError(t, err)
+	assert.NoError(t, err1)
+	assert.Equal(t, int64(10), rec.data)
+
+	fi1, err := os.Stat(filepath.Join(dest, "a"))
+	assert.NoError(t, err)
+	for _, p := range []string{"dir/b", "dir/c"} {
+		fi2, err := os.Stat(filepath.Join(dest, p))
+		assert.NoError(t, err)
+		assert.True(t, os.SameFile(fi1, fi2), p)
+	}
+	assert.Equal(t, uint64(3), fi1.Sys().(*syscall.Stat_t).Nlink)
+}
+
+func TestReceiveSparse(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	const size = 4 << 20
+	f, err := os.Create(filepath.Join(d, "foo"))
+	assert.NoError(t, err)
+	_, err = f.WriteAt([]byte("start"), 0)
+	assert.NoError(t, err)
+	_, err = f.WriteAt([]byte("middle"), 2<<20)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Truncate(size))
+	assert.NoError(t, f.Close())
+
+	fi, err := os.Stat(filepath.Join(d, "foo"))
+	assert.NoError(t, err)
+	if fi.Sys().(*syscall.Stat_t).Blocks*512 >= size {
+		t.Skip("filesystem doesn't support sparse files")
+	}
+	expected, err := ioutil.ReadFile(filepath.Join(d, "foo"))
+	assert.NoError(t, err)
+
+	transfer := func(opt *DiskWriterOpt) (int64, int64) {
+		dest, err := ioutil.TempDir("", "dest")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dest)
+
+		s1, s2 := sockPairProto()
+		rec := &recordConn{Stream: s1}
+		err1, err := sendReceive(rec, s2, d, dest, SendOpt{}, ReceiveOpt{DiskWriterOpt: opt})
+		assert.NoError(t, err)
+		assert.NoError(t, err1)
+
+		dt, err := ioutil.ReadFile(filepath.Join(dest, "foo"))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, dt)
+		dt, err = ioutil.ReadFile(filepath.Join(dest, "bar"))
+		assert.NoError(t, err)
+		assert.Equal(t, "data1", string(dt))
+
+		fi, err := os.Stat(filepath.Join(dest, "foo"))
+		assert.NoError(t, err)
+		return rec.data, fi.Sys().(*syscall.Stat_t).Blocks * 512
+	}
+
+	data, disk := transfer(nil)
+	assert.Equal(t, int64(size+5), data)
+	assert.True(t, disk >= size)
+
+	data, disk = transfer(&DiskWriterOpt{Sparse: true})
+	assert.True(t, data < 1<<20, "sent %d bytes", data)
+	assert.True(t, disk < 1<<20, "wrote %d bytes", disk)
+}
+
+func TestReceiveHoleSize(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD foo file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	receive := func(size int64) error {
+		dest, err := ioutil.TempDir("", "dest")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dest)
+
+		s1, s2 := sockPairProto()
+		err1, err := sendReceive(&holeConn{Stream: s1, size: size}, s2, d, dest, SendOpt{}, ReceiveOpt{})
+		if err != nil {
+			assert.Error(t, err1)
+			return err
+		}
+		assert.NoError(t, err1)
+		dt, err := ioutil.ReadFile(filepath.Join(dest, "foo"))
+		assert.NoError(t, err)
+		assert.Equal(t, make([]byte, size), dt)
+		return nil
+	}
+
+	assert.NoError(t, receive(5))
+	// holes can't extend the file past its size
+	for _, size := range []int64{6, 1 << 40, -1} {
+		err := receive(size)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "invalid hole size")
+		}
+	}
+}
+
+// holeConn replaces the file data sent with a hole of size.
+type holeConn struct {
+	Stream
+	size int64
+}
+
+func (c *holeConn) SendMsg(m interface{}) error {
+	if p := m.(*Packet); p.Type == PACKET_DATA && len(p.Data) > 0 {
+		return c.Stream.SendMsg(&Packet{Type: PACKET_HOLE, ID: p.ID, Offset: c.size})
+	}
+	return c.Stream.SendMsg(m)
+}
+
+func TestReceiveContentCache(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+		"ADD foo file data2",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	cache := NewContentCache(ContentCacheOpt{})
+	transfer := func() ([]Packet_PacketType, map[string]string) {
+		s1, s2 := sockPairProto()
+		rec := &recordConn{Stream: s1}
+		var mu sync.Mutex
+		hashes := map[string]string{}
+		err1, err := sendReceive(rec, s2, d, dest, SendOpt{}, ReceiveOpt{
+			DiskWriterOpt: &DiskWriterOpt{ContentCache: cache},
+			NotifyHashed: func(kind ChangeKind, p string, fi os.FileInfo, err error) error {
+				mu.Lock()
+				hashes[p] = fi.(Hashed).Hash()
+				mu.Unlock()
+				return nil
+			},
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, err1)
+		return rec.requests, hashes
+	}
+
+	requests, hashes := transfer()
+	assert.Equal(t, 2, len(requests))
+	e, ok := cache.Get("foo")
+	assert.True(t, ok)
+	assert.Equal(t, hashes["foo"], e.Digest)
+
+	// pretend the filesystem truncated the modification time of foo
+	tm := time.Unix(e.ModTime/1e9, 0)
+	assert.NoError(t, os.Chtimes(filepath.Join(dest, "foo"), tm, tm))
+	e.ModTime = tm.UnixNano()
+	cache.Set("foo", e)
+
+	requests, hashes2 := transfer()
+	assert.Equal(t, 0, len(requests))
+	assert.Equal(t, hashes["foo"], hashes2["foo"])
+
+	fi, err := os.Stat(filepath.Join(d, "foo"))
+	assert.NoError(t, err)
+	fi2, err := os.Stat(filepath.Join(dest, "foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, fi.ModTime().UnixNano(), fi2.ModTime().UnixNano())
+
+	// contents changed at the destination are requested again
+	tm = tm.Add(time.Second)
+	assert.NoError(t, os.Chtimes(filepath.Join(dest, "foo"), tm, tm))
+	requests, _ = transfer()
+	assert.Equal(t, 1, len(requests))
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data2", string(dt))
+}
+
+func TestReceiveHashAlgorithm(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar dir",
+		"ADD bar/foo file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	sha512Alg := HashAlgorithm{Name: "sha512", New: sha512.New}
+
+	transfer := func(ts *Tarsum, alg *HashAlgorithm) error {
+		dest, err := ioutil.TempDir("", "dest")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dest)
+
+		return syncDirs(d, dest, SendOpt{}, ReceiveOpt{
+			NotifyHashed:  ts.HandleChange,
+			DiskWriterOpt: &DiskWriterOpt{HashAlgorithm: alg},
+		})
+	}
+
+	ts := NewTarsumWithHash("", sha512Alg)
+	err = transfer(ts, ts.Algorithm())
+	assert.NoError(t, err)
+
+	_, fi, err := ts.Stat("bar/foo")
+	assert.NoError(t, err)
+	h, err := NewTarsumHashWithAlgorithm(fi, sha512Alg)
+	assert.NoError(t, err)
+	_, err = h.Write([]byte("data1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "sha512:"+hex.EncodeToString(h.Sum(nil)), fi.(Hashed).Hash())
+
+	err = transfer(NewTarsumWithHash("", sha512Alg), nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "was not made with sha512")
+}
+
+func TestReceiveWatch(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+		"ADD foo dir",
+		"ADD foo/abc file data2",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	synced := make(chan []string, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s1, s2 := sockPairProto()
+	var err1 error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		err1 = Send(ctx, s1, d, SendOpt{Watch: &SendWatchOpt{Latency: 10 * time.Millisecond}})
+		wg.Done()
+	}()
+	var err2 error
+	wg.Add(1)
+	go func() {
+		err2 = Receive(context.Background(), s2, dest, ReceiveOpt{Watch: &ReceiveWatchOpt{
+			Synced: func(paths []string) {
+				synced <- paths
+			},
+		}})
+		wg.Done()
+	}()
+
+	waitSynced := func() []string {
+		select {
+		case paths := <-synced:
+			return paths
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for sync")
+		}
+		return nil
+	}
+
+	assert.Nil(t, waitSynced())
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "foo/abc"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data2", string(dt))
+
+	err = ioutil.WriteFile(filepath.Join(d, "bar"), []byte("data3"), 0600)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bar"}, waitSynced())
+	dt, err = ioutil.ReadFile(filepath.Join(dest, "bar"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data3", string(dt))
+
+	err = os.MkdirAll(filepath.Join(d, "foo/sub"), 0700)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(d, "foo/sub/new"), []byte("data4"), 0600)
+	assert.NoError(t, err)
+	err = os.Remove(filepath.Join(d, "foo/abc"))
+	assert.NoError(t, err)
+	for {
+		paths := waitSynced()
+		if _, err := os.Stat(filepath.Join(dest, "foo/sub/new")); err == nil {
+			if _, err := os.Stat(filepath.Join(dest, "foo/abc")); os.IsNotExist(err) {
+				break
+			}
+		}
+		assert.NotEmpty(t, paths)
+	}
+
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), dest, nil, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `file bar
+dir foo
+dir foo/sub
+file foo/sub/new
+`, string(b.Bytes()))
+
+	cancel()
+	wg.Wait()
+	assert.Equal(t, context.Canceled, errors.Cause(err1))
+	assert.NoError(t, err2)
+}
+
+func TestReceiveMetadata(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+		"ADD foo dir",
+		"ADD foo/baz file data2",
+		"ADD foo/link symlink ../bar",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	s1, s2 := sockPairProto()
+	rec := &recordConn{Stream: s1}
+	var receiver *PeerInfo
+	var err1 error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		err1 = Send(context.Background(), rec, d, SendOpt{MetadataOnly: true, Handshake: func(pi PeerInfo) error {
+			receiver = &pi
+			return nil
+		}})
+		wg.Done()
+	}()
+	s, err := ReceiveMetadata(context.Background(), s2)
+	wg.Wait()
+	assert.NoError(t, err)
+	assert.NoError(t, err1)
+	assert.Equal(t, int64(0), rec.data)
+	assert.Equal(t, 0, len(rec.requests))
+	assert.Equal(t, PeerInfo{Version: ProtocolVersion}, *receiver)
+
+	b := &bytes.Buffer{}
+	err = s.Walk(context.Background(), bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `file bar
+dir foo
+file foo/baz
+symlink:../bar foo/link
+`, string(b.Bytes()))
+
+	dgst, err := TreeDigest(context.Background(), d, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, dgst, s.TreeDigest())
+
+	// senders that predate the handshake are still supported
+	s1, s2 = sockPairProto()
+	wg.Add(1)
+	go func() {
+		err1 = Send(context.Background(), &legacyConn{Stream: s1}, d, SendOpt{MetadataOnly: true})
+		wg.Done()
+	}()
+	s, err = ReceiveMetadata(context.Background(), s2)
+	wg.Wait()
+	assert.NoError(t, err)
+	assert.NoError(t, err1)
+	assert.Equal(t, dgst, s.TreeDigest())
+
+	// a sender sending contents can't be used for metadata
+	s1, s2 = sockPairProto()
+	wg.Add(1)
+	go func() {
+		err1 = Send(context.Background(), s1, d, SendOpt{})
+		wg.Done()
+	}()
+	_, err = ReceiveMetadata(context.Background(), s2)
+	wg.Wait()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "metadata only")
+	assert.Error(t, err1)
+}
+
+func TestSendFS(t *testing.T) {
+	fs := mapFS{
+		"bar":     "data1",
+		"foo/":    "",
+		"foo/baz": "data22",
+	}
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	s1, s2 := sockPairProto()
+	var err1 error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		err1 = SendFS(context.Background(), s1, fs, SendOpt{})
+		wg.Done()
+	}()
+	err = Receive(context.Background(), s2, dest, ReceiveOpt{})
+	wg.Wait()
+	assert.NoError(t, err)
+	assert.NoError(t, err1)
+
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), dest, nil, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `file bar
+dir foo
+file foo/baz
+`, string(b.Bytes()))
+
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "foo/baz"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data22", string(dt))
+}
+
+// mapFS is an FS of files kept in memory. Keys ending with a slash are
+// directories.
+type mapFS map[string]string
+
+func (m mapFS) Walk(ctx context.Context, fn filepath.WalkFunc) error {
+	var paths []string
+	for p := range m {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		stat := &Stat{Path: strings.TrimSuffix(p, "/"), Mode: 0644, ModTime: time.Now().UnixNano()}
+		if strings.HasSuffix(p, "/") {
+			stat.Mode = uint32(os.ModeDir | 0755)
+		} else {
+			stat.Size_ = int64(len(m[p]))
+		}
+		if err := fn(stat.Path, &StatInfo{stat}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m mapFS) Open(p string) (io.ReadCloser, error) {
+	dt, ok := m[p]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(strings.NewReader(dt)), nil
+}
+
+func TestReceiveAtomic(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+		"ADD foo dir",
+		"ADD foo/baz file data2",
+		"ADD keep file same",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	parent, err := ioutil.TempDir("", "parent")
+	assert.NoError(t, err)
+	defer os.RemoveAll(parent)
+	dest := filepath.Join(parent, "dest")
+	err = os.Mkdir(dest, 0755)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(dest, "bar"), []byte("old"), 0600)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(dest, "removed"), []byte("old"), 0600)
+	assert.NoError(t, err)
+
+	// keep is unchanged so it is linked into the staging copy
+	fi, err := os.Lstat(filepath.Join(d, "keep"))
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(dest, "keep"), []byte("same"), fi.Mode())
+	assert.NoError(t, err)
+	err = os.Chtimes(filepath.Join(dest, "keep"), fi.ModTime(), fi.ModTime())
+	assert.NoError(t, err)
+	keep, err := os.Stat(filepath.Join(dest, "keep"))
+	assert.NoError(t, err)
+
+	receive := func(corrupt int) error {
+		s1, s2 := sockPairProto()
+		conn := &corruptConn{Stream: s2, path: "foo/baz", n: corrupt}
+		_, err := sendReceive(s1, conn, d, dest, SendOpt{}, ReceiveOpt{Atomic: true, VerifyChecksums: true})
+		return err
+	}
+
+	err = receive(1)
+	assert.Error(t, err)
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), dest, nil, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, "file bar\nfile keep\nfile removed\n", string(b.Bytes()))
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "bar"))
+	assert.NoError(t, err)
+	assert.Equal(t, "old", string(dt))
+
+	err = receive(0)
+	assert.NoError(t, err)
+	b = &bytes.Buffer{}
+	err = Walk(context.Background(), dest, nil, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, "file bar\ndir foo\nfile foo/baz\nfile keep\n", string(b.Bytes()))
+	dt, err = ioutil.ReadFile(filepath.Join(dest, "bar"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data1", string(dt))
+
+	fi, err = os.Stat(filepath.Join(dest, "keep"))
+	assert.NoError(t, err)
+	assert.True(t, os.SameFile(keep, fi))
+
+	// the staging copies are removed
+	names, err := ioutil.ReadDir(parent)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(names))
+}
+
+func TestReceiveModTimes(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+		"ADD foo dir",
+		"ADD foo/baz file data2",
+		"ADD foo/sub dir",
+		"ADD foo/sub/x file data3",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+	for i, p := range []string{"foo/sub", "foo"} {
+		tm := time.Unix(1400000000+int64(i), 123456789)
+		err = os.Chtimes(filepath.Join(d, p), tm, tm)
+		assert.NoError(t, err)
+	}
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	receive := func(opt *DiskWriterOpt) int64 {
+		s1, s2 := sockPairProto()
+		rec := &recordConn{Stream: s1}
+		err1, err := sendReceive(rec, s2, d, dest, SendOpt{}, ReceiveOpt{DiskWriterOpt: opt})
+		assert.NoError(t, err)
+		assert.NoError(t, err1)
+		return rec.data
+	}
+
+	// directories keep their times after entries were written into them
+	receive(nil)
+	for _, p := range []string{"bar", "foo", "foo/baz", "foo/sub", "foo/sub/x"} {
+		fi1, err := os.Lstat(filepath.Join(d, p))
+		assert.NoError(t, err)
+		fi2, err := os.Lstat(filepath.Join(dest, p))
+		assert.NoError(t, err)
+		assert.Equal(t, fi1.ModTime().UnixNano(), fi2.ModTime().UnixNano(), p)
+	}
+
+	// directories are not compared, so the times are set in a new
+	// destination
+	err = os.RemoveAll(dest)
+	assert.NoError(t, err)
+	err = os.Mkdir(dest, 0700)
+	assert.NoError(t, err)
+
+	epoch := time.Unix(1500000000, 0)
+	for i := 0; i < 2; i++ {
+		n := receive(&DiskWriterOpt{Epoch: &epoch})
+		if i == 1 {
+			// nothing is transferred again once the times were set
+			assert.Equal(t, int64(0), n)
+		}
+		for _, p := range []string{"bar", "foo", "foo/baz", "foo/sub", "foo/sub/x"} {
+			fi, err := os.Lstat(filepath.Join(dest, p))
+			assert.NoError(t, err)
+			assert.True(t, epoch.Equal(fi.ModTime()), p)
+		}
+	}
+}
+
+func TestReceiveChown(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root")
+	}
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+		"ADD foo dir",
+		"ADD foo/link symlink ../bar",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+	for _, p := range []string{"bar", "foo", "foo/link"} {
+		assert.NoError(t, os.Lchown(filepath.Join(d, p), 10, 20))
+	}
+
+	receive := func(chown *ChownOpt) (string, error) {
+		dest, err := ioutil.TempDir("", "dest")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dest)
+
+		s1, s2 := sockPairProto()
+		_, err = sendReceive(s1, s2, d, dest, SendOpt{}, ReceiveOpt{DiskWriterOpt: &DiskWriterOpt{Chown: chown}})
+		if err != nil {
+			return "", err
+		}
+
+		var owners []string
+		for _, p := range []string{"bar", "foo", "foo/link"} {
+			fi, err := os.Lstat(filepath.Join(dest, p))
+			assert.NoError(t, err)
+			st := fi.Sys().(*syscall.Stat_t)
+			owners = append(owners, fmt.Sprintf("%s:%d:%d", p, st.Uid, st.Gid))
+		}
+		return strings.Join(owners, " "), nil
+	}
+
+	owners, err := receive(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "bar:10:20 foo:10:20 foo/link:10:20", owners)
+
+	owners, err = receive(&ChownOpt{Action: ChownFixed, Uid: 1, Gid: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, "bar:1:2 foo:1:2 foo/link:1:2", owners)
+
+	owners, err = receive(&ChownOpt{
+		Action:  ChownRemap,
+		UIDMaps: []IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		GIDMaps: []IDMap{{ContainerID: 20, HostID: 300, Size: 1}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "bar:100010:300 foo:100010:300 foo/link:100010:300", owners)
+
+	_, err = receive(&ChownOpt{Action: ChownRemap})
+	assert.Error(t, err)
+}
+
+func TestCopyFilter(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+		"ADD foo dir",
+		"ADD foo/baz file d2",
+		"ADD z file d3",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	rename := MapFunc(func(p string, st *Stat) error {
+		if p == "z" {
+			st.Path = "zz"
+		}
+		return nil
+	})
+
+	err = syncDirs(d, dest, SendOpt{WalkOpt: &WalkOpt{Filter: rename}}, ReceiveOpt{Filter: MaxSize(3)})
+	assert.NoError(t, err)
+
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), dest, nil, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `dir foo
+file foo/baz
+file zz
+`, string(b.Bytes()))
+
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "zz"))
+	assert.NoError(t, err)
+	assert.Equal(t, "d3", string(dt))
+}
+
+func TestReceiveFilterHardlink(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD a dir",
+		"ADD a/x file data1",
+		"ADD b file >a/x",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	filter := MatchFunc(func(p string, st *Stat) (bool, error) {
+		return p != "a", nil
+	})
+
+	err = syncDirs(d, dest, SendOpt{}, ReceiveOpt{Filter: filter})
+	assert.NoError(t, err)
+
+	// the hardlink to the file in the dropped directory is a regular file
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), dest, nil, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, "file b\n", string(b.Bytes()))
+
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "b"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data1", string(dt))
+}
+
+func TestReceiveDeletePolicy(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD a file d1",
+		"ADD large file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	receive := func(policy DeletePolicy, limit *DeleteLimit) string {
+		dest, err := tmpDir(changeStream([]string{
+			"ADD dir dir",
+			"ADD dir/x file d2",
+			"ADD extra file d3",
+			"ADD old file data2",
+		}))
+		assert.NoError(t, err)
+		defer os.RemoveAll(dest)
+
+		err = syncDirs(d, dest, SendOpt{}, ReceiveOpt{Filter: MaxSize(3), Delete: policy, DeleteLimit: limit})
+		assert.NoError(t, err)
+
+		b := &bytes.Buffer{}
+		err = Walk(context.Background(), dest, nil, bufWalk(b))
+		assert.NoError(t, err)
+		return string(b.Bytes())
+	}
+
+	assert.Equal(t, "file a\nfile old\n", receive(DeleteUnmatched, nil))
+	assert.Equal(t, "file a\ndir dir\nfile dir/x\nfile extra\nfile old\n", receive(DeleteKeepExtra, nil))
+	assert.Equal(t, "file a\n", receive(DeleteExcluded, nil))
+	// the deletions suppressed by DeleteKeepExtra don't count for the limit
+	assert.Equal(t, "file a\ndir dir\nfile dir/x\nfile extra\nfile old\n", receive(DeleteKeepExtra, &DeleteLimit{Max: 1}))
+}
+
+func TestReceiveValidation(t *testing.T) {
+	file := func(p string) *Stat {
+		return &Stat{Path: p, Mode: 0644, Size_: 4}
+	}
+	dir := func(p string) *Stat {
+		return &Stat{Path: p, Mode: uint32(os.ModeDir | 0755)}
+	}
+	symlink := func(p, target string) *Stat {
+		return &Stat{Path: p, Mode: uint32(os.ModeSymlink | 0777), Linkname: target}
+	}
+	hardlink := func(p, target string) *Stat {
+		return &Stat{Path: p, Mode: 0644, Linkname: target}
+	}
+
+	tcases := []struct {
+		name  string
+		stats []*Stat
+		path  string
+	}{
+		{"parent", []*Stat{file("../evil")}, "../evil"},
+		{"absolute", []*Stat{file("/evil")}, "/evil"},
+		{"unclean", []*Stat{dir("a"), file("a/../../evil")}, "a/../../evil"},
+		{"dot", []*Stat{dir(".")}, "."},
+		{"order", []*Stat{file("b"), file("a")}, "a"},
+		{"duplicate", []*Stat{file("a"), file("a")}, "a"},
+		{"nodir", []*Stat{file("a/b")}, "a/b"},
+		{"symlinkdir", []*Stat{symlink("a", ".."), file("a/evil")}, "a/evil"},
+		{"hardlink", []*Stat{hardlink("a", "../outside")}, "a"},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := ioutil.TempDir("", "validate")
+			assert.NoError(t, err)
+			defer os.RemoveAll(d)
+			dest := filepath.Join(d, "dest")
+			assert.NoError(t, os.Mkdir(dest, 0700))
+
+			err = receiveRawStats(t, tc.stats, dest, ReceiveOpt{})
+			verr, ok := errors.Cause(err).(*ValidationError)
+			if assert.True(t, ok, "%v", err) {
+				assert.Equal(t, tc.path, verr.Path)
+			}
+			fis, err := ioutil.ReadDir(d)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, len(fis))
+		})
+	}
+
+	// the validation can be disabled for trusted senders
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+	err = receiveRawStats(t, []*Stat{file("b"), file("a")}, dest, ReceiveOpt{DisableValidation: true})
+	_, ok := errors.Cause(err).(*ValidationError)
+	assert.False(t, ok, "%v", err)
+}
+
+func TestReceiveValidationRandom(t *testing.T) {
+	seed := time.Now().UnixNano()
+	t.Logf("seed %d", seed)
+	r := mrand.New(mrand.NewSource(seed))
+
+	d, err := ioutil.TempDir("", "validate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	names := []string{"a", "b", "..", ".", "", d}
+	randPath := func() string {
+		parts := make([]string, r.Intn(3)+1)
+		for i := range parts {
+			parts[i] = names[r.Intn(len(names))]
+		}
+		return strings.Join(parts, "/")
+	}
+
+	for i := 0; i < 200; i++ {
+		var stats []*Stat
+		for j := r.Intn(12); j >= 0; j-- {
+			st := &Stat{Path: randPath()}
+			switch r.Intn(4) {
+			case 0:
+				st.Mode = uint32(os.ModeDir | 0755)
+			case 1:
+				st.Mode = 0644
+				st.Size_ = 4
+			case 2:
+				st.Mode = uint32(os.ModeSymlink | 0777)
+				st.Linkname = randPath()
+			case 3:
+				st.Mode = 0644
+				st.Linkname = randPath()
+			}
+			stats = append(stats, st)
+		}
+		if r.Intn(2) == 0 {
+			sort.Slice(stats, func(i, j int) bool {
+				return stats[i].Path < stats[j].Path
+			})
+		}
+
+		dest := filepath.Join(d, "dest")
+		assert.NoError(t, os.Mkdir(dest, 0700))
+		receiveRawStats(t, stats, dest, ReceiveOpt{})
+		fis, err := ioutil.ReadDir(d)
+		assert.NoError(t, err)
+		if !assert.Equal(t, 1, len(fis)) {
+			for _, st := range stats {
+				t.Logf("%s %s %s", os.FileMode(st.Mode), st.Path, st.Linkname)
+			}
+			break
+		}
+		assert.NoError(t, os.RemoveAll(dest))
+	}
+}
+
+// receiveRawStats receives from a sender sending stats as they are and
+// answering every file request with "data".
+func receiveRawStats(t *testing.T, stats []*Stat, dest string, opt ReceiveOpt) error {
+	s1, s2 := sockPairProto()
+	go func() {
+		for _, st := range stats {
+			s1.SendMsg(&Packet{Type: PACKET_STAT, Stat: st})
+		}
+		s1.SendMsg(&Packet{Type: PACKET_STAT})
+		for {
+			var p Packet
+			if err := s1.RecvMsg(&p); err != nil {
+				return
+			}
+			switch p.Type {
+			case PACKET_REQ:
+				s1.SendMsg(&Packet{Type: PACKET_DATA, ID: p.ID, Data: []byte("data")})
+				s1.SendMsg(&Packet{Type: PACKET_DATA, ID: p.ID})
+			case PACKET_FIN:
+				s1.SendMsg(&Packet{Type: PACKET_FIN})
+				return
+			case PACKET_ERR:
+				return
+			}
+		}
+	}()
+
+	ch := make(chan error, 1)
+	go func() {
+		ch <- Receive(context.Background(), s2, dest, opt)
+	}()
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("receive did not finish")
+		return nil
+	}
+}
+
+func TestReceiveShutdown(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD a file data1",
+		"ADD b file data2",
+		"ADD c file data3",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	s1, s2 := sockPairProto()
+	var err1 error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		err1 = Send(context.Background(), s1, d, SendOpt{})
+		wg.Done()
+	}()
+
+	l := &shutdownLimiter{after: 2, called: make(chan struct{})}
+	rs := NewReceiveSession([]Stream{s2}, dest, ReceiveOpt{RateLimit: l})
+	l.shutdown = rs.r.shutdown
+
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- rs.Run(context.Background())
+	}()
+
+	<-l.called
+	report, err := rs.Shutdown(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, ErrShutdown, <-runErr)
+	assert.Equal(t, &ShutdownReport{Changes: 2, Files: 2}, report)
+	wg.Wait()
+	assert.NoError(t, err1)
+
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), dest, nil, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `file a
+file b
+`, string(b.Bytes()))
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "b"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data2", string(dt))
+}
+
+func TestReceiveShutdownAbort(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD a file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	s1, s2 := sockPairProto()
+	var err1 error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		err1 = Send(context.Background(), s1, d, SendOpt{})
+		wg.Done()
+	}()
+
+	// the contents never arrive so the write stays in flight
+	conn := &dropDataConn{Stream: s2, requested: make(chan struct{})}
+	rs := NewReceiveSession([]Stream{conn}, dest, ReceiveOpt{})
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- rs.Run(context.Background())
+	}()
+
+	<-conn.requested
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	report, err := rs.Shutdown(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, ErrShutdown, <-runErr)
+	assert.Equal(t, &ShutdownReport{Changes: 1, Files: 0, Aborted: []string{"a"}}, report)
+	wg.Wait()
+	assert.NoError(t, err1)
+
+	_, err = os.Lstat(filepath.Join(dest, "a"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestReceiveCancel(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD a file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	s1, s2 := sockPairProto()
+	var err1 error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		err1 = Send(context.Background(), s1, d, SendOpt{})
+		wg.Done()
+	}()
+
+	// the contents never arrive so the transfer is cancelled in the middle
+	conn := &dropDataConn{Stream: s2, requested: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- Receive(ctx, conn, dest, ReceiveOpt{})
+	}()
+
+	<-conn.requested
+	cancel()
+	select {
+	case err := <-runErr:
+		assert.Equal(t, context.Canceled, errors.Cause(err))
+	case <-time.After(2 * time.Second):
+		t.Fatal("receive did not return after it was cancelled")
+	}
+	wg.Wait()
+	assert.Error(t, err1)
+}
+
+// shutdownLimiter blocks the operation after the first ones until the
+// receive is shut down.
+type shutdownLimiter struct {
+	after    int
+	ops      int
+	called   chan struct{}
+	shutdown <-chan struct{}
+}
+
+func (l *shutdownLimiter) WaitBytes(ctx context.Context, n int) error {
+	return nil
+}
+
+func (l *shutdownLimiter) WaitOps(ctx context.Context, n int) error {
+	l.ops += n
+	if l.ops == l.after {
+		close(l.called)
+		<-l.shutdown
+	}
+	return nil
+}
+
+type dropDataConn struct {
+	Stream
+	once      sync.Once
+	requested chan struct{}
+}
+
+func (c *dropDataConn) RecvMsg(m interface{}) error {
+	for {
+		if err := c.Stream.RecvMsg(m); err != nil {
+			return err
+		}
+		if m.(*Packet).Type != PACKET_DATA {
+			return nil
+		}
+	}
+}
+
+func (c *dropDataConn) SendMsg(m interface{}) error {
+	if err := c.Stream.SendMsg(m); err != nil {
+		return err
+	}
+	if m.(*Packet).Type == PACKET_REQ {
+		c.once.Do(func() {
+			close(c.requested)
+		})
+	}
+	return nil
+}
+
+// dropConn fails after receiving a number of data packets.
+type dropConn struct {
+	Stream
+	packets int
+}
+
+func (c *dropConn) RecvMsg(m interface{}) error {
+	if c.packets == 0 {
+		return errors.New("connection lost")
+	}
+	if err := c.Stream.RecvMsg(m); err != nil {
+		return err
+	}
+	if p := m.(*Packet); p.Type == PACKET_DATA && len(p.Data) > 0 {
+		c.packets--
+	}
+	return nil
+}
+
+// recordConn records the file requests and the size of the file data sent.
+type recordConn struct {
+	Stream
+	requests []Packet_PacketType
+	data     int64
+}
+
+func (c *recordConn) RecvMsg(m interface{}) error {
+	if err := c.Stream.RecvMsg(m); err != nil {
+		return err
+	}
+	if p := m.(*Packet); p.Type == PACKET_REQ || p.Type == PACKET_RESUME {
+		c.requests = append(c.requests, p.Type)
+	}
+	return nil
+}
+
+func (c *recordConn) SendMsg(m interface{}) error {
+	if p := m.(*Packet); p.Type == PACKET_DATA {
+		c.data += int64(len(p.Data))
+	}
+	return c.Stream.SendMsg(m)
+}
+
+// syncDirs sends src to dest over a new connection and returns the error of
+// the receiver, or else the one of the sender.
+func syncDirs(src, dest string, sopt SendOpt, ropt ReceiveOpt) error {
+	s1, s2 := sockPairProto()
+	err1, err2 := sendReceive(s1, s2, src, dest, sopt, ropt)
+	if err2 != nil {
+		return err2
+	}
+	return err1
+}
+
+// sendReceive sends src from sconn to dest at rconn and returns the errors of
+// the sender and the receiver.
+func sendReceive(sconn, rconn Stream, src, dest string, sopt SendOpt, ropt ReceiveOpt) (error, error) {
+	var err1 error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		err1 = Send(context.Background(), sconn, src, sopt)
+		wg.Done()
+	}()
+	err2 := Receive(context.Background(), rconn, dest, ropt)
+	wg.Wait()
+	return err1, err2
+}
+
+func sockPair() (Stream, Stream) {
+	c1 := make(chan *Packet, 32)
+	c2 := make(chan *Packet, 32)
+	return &fakeConn{c1, c2}, &fakeConn{c2, c1}
+}
+
+func sockPairProto() (Stream, Stream) {
+	c1 := make(chan []byte, 32)
+	c2 := make(chan []byte, 32)
+	return &fakeConnProto{c1, c2}, &fakeConnProto{c2, c1}
+}
+
+type fakeConn struct {
+	recvChan chan *Packet
+	sendChan chan *Packet
+}
+
+func (fc *fakeConn) RecvMsg(m interface{}) error {
+	p, ok := m.(*Packet)
+	if !ok {
+		return errors.Errorf("invalid msg: %#v", m)
+	}
+	p2 := <-fc.recvChan
+	*p = *p2
+	return nil
+}
+
+func (fc *fakeConn) SendMsg(m interface{}) error {
+	p, ok := m.(*Packet)
+	if !ok {
+		return errors.Errorf("invalid msg: %#v", m)
+	}
+	p2 := *p
+	p2.Data = append([]byte{}, p2.Data...)
+	fc.sendChan <- &p2
+	return nil
+}
+
+type fakeConnProto struct {
+	recvChan chan []byte
+	sendChan chan []byte
+}
+
+func (fc *fakeConnProto) RecvMsg(m interface{}) error {
+	p, ok := m.(*Packet)
+	if !ok {
+		return errors.Errorf("invalid msg: %#v", m)
+	}
+	dt := <-fc.recvChan
+	return p.Unmarshal(dt)
+}
+
+func (fc *fakeConnProto) SendMsg(m interface{}) error {
+	p, ok := m.(*Packet)
+	if !ok {
+		return errors.Errorf("invalid msg: %#v", m)
+	}
+	dt, err := p.Marshal()
+	if err != nil {
+		return err
+	}
+	fc.sendChan <- dt
+	return nil
+}
+
+type counter struct {
+	c int
+}
+
+func (c *counter) inc(p string, fi builder.FileInfo, err error) error {
+	c.c++
+	return err
+}
+
+func TestReceiveLayer(t *testing.T) {
+	parent, err := tmpDir(changeStream([]string{
+		"ADD a dir",
+		"ADD a/b file data1",
+		"ADD a/c file data2",
+		"ADD d dir",
+		"ADD d/e file data3",
+		"ADD f file data4",
+		"ADD g dir",
+		"ADD g/h file data5",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(parent)
+
+	d, err := tmpDir(changeStream([]string{
+		"ADD a dir",
+		"ADD a/b file data66",
+		"ADD a/c file data2",
+		"ADD a/c2 file >a/c",
+		"ADD d dir",
+		"ADD g file data7",
+		"ADD i file data8",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	// unchanged files need the same times
+	tm := time.Unix(1500000000, 0)
+	assert.NoError(t, os.Chtimes(filepath.Join(parent, "a/c"), tm, tm))
+	assert.NoError(t, os.Chtimes(filepath.Join(d, "a/c"), tm, tm))
+	assert.NoError(t, os.Chmod(filepath.Join(parent, "d"), 0750))
+	assert.NoError(t, os.Chmod(filepath.Join(d, "d"), 0750))
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	err = syncDirs(d, dest, SendOpt{}, ReceiveOpt{
+		DiskWriterOpt: &DiskWriterOpt{Layer: &LayerOpt{Parent: parent}},
+	})
+	assert.NoError(t, err)
+
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), dest, nil, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `file .wh.f
+dir a
+file a/b
+file a/c
+file a/c2 >a/c
+dir d
+file d/.wh.e
+file g
+file i
+`, string(b.Bytes()))
+
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "a/c"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data2", string(dt))
+	// directories only in the parent are created with its metadata
+	fi1, err := os.Lstat(filepath.Join(parent, "d"))
+	assert.NoError(t, err)
+	fi2, err := os.Lstat(filepath.Join(dest, "d"))
+	assert.NoError(t, err)
+	assert.Equal(t, fi1.Mode(), fi2.Mode())
+	assert.Equal(t, fi1.ModTime(), fi2.ModTime())
+}
+
+func TestReceiveDryRun(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar dir",
+		"ADD bar/foo file data1",
+		"ADD bar/foo2 file >bar/foo",
+		"ADD baz file data22",
+		"ADD foo symlink bar",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dest, err := tmpDir(changeStream([]string{
+		"ADD baz file data3",
+		"ADD qux dir",
+		"ADD qux/a file data4",
+		"ADD qux/b file data55",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	before := &bytes.Buffer{}
+	assert.NoError(t, Walk(context.Background(), dest, nil, bufWalk(before)))
+
+	s1, s2 := sockPairProto()
+
+	var err1 error
+	var err2 error
+	var plan *ReceivePlan
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		err1 = Send(context.Background(), s1, d, SendOpt{})
+		wg.Done()
+	}()
+	go func() {
+		plan, err2 = PlanReceive(context.Background(), s2, dest, ReceiveOpt{})
+		wg.Done()
+	}()
+	wg.Wait()
+	assert.NoError(t, err1)
+	if !assert.NoError(t, err2) {
+		return
+	}
+
+	kinds := map[ChangeKind]string{ChangeKindAdd: "ADD", ChangeKindModify: "CHG", ChangeKindDelete: "DEL"}
+	var out []string
+	for _, c := range plan.Changes {
+		out = append(out, fmt.Sprintf("%s %s %d", kinds[c.Kind], c.Path, c.Size))
+	}
+	assert.Equal(t, []string{
+		"ADD bar 0",
+		"ADD bar/foo 5",
+		"ADD bar/foo2 0",
+		"CHG baz 6",
+		"ADD foo 0",
+		"DEL qux 11",
+	}, out)
+	assert.Equal(t, 4, plan.Added)
+	assert.Equal(t, 1, plan.Modified)
+	assert.Equal(t, 1, plan.Deleted)
+	assert.Equal(t, int64(11), plan.Size)
+
+	// the destination is unchanged
+	after := &bytes.Buffer{}
+	assert.NoError(t, Walk(context.Background(), dest, nil, bufWalk(after)))
+	assert.Equal(t, before.String(), after.String())
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "baz"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data3", string(dt))
+}
+
+type recordMetrics struct {
+	mu       sync.Mutex
+	phases   map[Phase][]string
+	sent     map[Packet_PacketType]int
+	received map[Packet_PacketType]int
+	bytes    int
+	cached   []string
+}
+
+func newRecordMetrics() *recordMetrics {
+	return &recordMetrics{
+		phases:   map[Phase][]string{},
+		sent:     map[Packet_PacketType]int{},
+		received: map[Packet_PacketType]int{},
+	}
+}
+
+func (m *recordMetrics) Phase(phase Phase, path string, d time.Duration) {
+	m.mu.Lock()
+	m.phases[phase] = append(m.phases[phase], path)
+	m.mu.Unlock()
+}
+
+func (m *recordMetrics) PacketSent(typ Packet_PacketType, size int) {
+	m.mu.Lock()
+	m.sent[typ]++
+	m.bytes += size
+	m.mu.Unlock()
+}
+
+func (m *recordMetrics) PacketReceived(typ Packet_PacketType, size int) {
+	m.mu.Lock()
+	m.received[typ]++
+	m.bytes -= size
+	m.mu.Unlock()
+}
+
+func (m *recordMetrics) FileCached(path string, size int64) {
+	m.mu.Lock()
+	m.cached = append(m.cached, path)
+	m.mu.Unlock()
+}
+
+func TestReceiveMetrics(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar dir",
+		"ADD bar/foo file data1",
+		"ADD foo file data2",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	cache := NewContentCache(ContentCacheOpt{})
+	transfer := func() (*recordMetrics, *recordMetrics) {
+		sm, rm := newRecordMetrics(), newRecordMetrics()
+		err := syncDirs(d, dest, SendOpt{Metrics: sm}, ReceiveOpt{
+			DiskWriterOpt: &DiskWriterOpt{ContentCache: cache},
+			Metrics:       rm,
+		})
+		assert.NoError(t, err)
+		return sm, rm
+	}
+
+	sm, rm := transfer()
+	assert.Equal(t, []string{""}, sm.phases[PhaseWalk])
+	assert.Equal(t, []string{"bar", "bar/foo", "foo"}, sm.phases[PhaseStatSend])
+	assert.Equal(t, []string{""}, rm.phases[PhaseWalk])
+	for _, m := range []*recordMetrics{sm, rm} {
+		transferred := append([]string{}, m.phases[PhaseTransfer]...)
+		sort.Strings(transferred)
+		assert.Equal(t, []string{"bar/foo", "foo"}, transferred)
+	}
+	written := append([]string{}, rm.phases[PhaseWrite]...)
+	sort.Strings(written)
+	// the files are reported when created and after their contents were
+	// written
+	assert.Equal(t, []string{"bar", "bar/foo", "bar/foo", "foo", "foo"}, written)
+
+	// every packet sent was received
+	assert.Equal(t, sm.sent, rm.received)
+	assert.Equal(t, rm.sent, sm.received)
+	assert.Equal(t, 0, sm.bytes+rm.bytes)
+	assert.Equal(t, 4, sm.sent[PACKET_STAT])
+	assert.Equal(t, 2, rm.sent[PACKET_REQ])
+
+	// pretend the filesystem truncated the modification time of foo
+	e, ok := cache.Get("foo")
+	assert.True(t, ok)
+	tm := time.Unix(e.ModTime/1e9, 0)
+	assert.NoError(t, os.Chtimes(filepath.Join(dest, "foo"), tm, tm))
+	e.ModTime = tm.UnixNano()
+	cache.Set("foo", e)
+
+	_, rm = transfer()
+	assert.Equal(t, []string{"foo"}, rm.cached)
+	assert.Equal(t, 0, rm.sent[PACKET_REQ])
+}
+
+func TestReceiveChunks(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	// the second half compresses
+	big := make([]byte, 100000)
+	_, err = mrand.New(mrand.NewSource(1)).Read(big[:50000])
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(d, "foo"), big, 0600))
+
+	receive := func(opt ReceiveOpt, corrupt int) ([]Packet_PacketType, error) {
+		dest, err := ioutil.TempDir("", "dest")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dest)
+
+		s1, s2 := sockPairProto()
+		rec := &recordConn{Stream: s1}
+		conn := &corruptConn{Stream: s2, path: "foo", n: corrupt}
+		err1, err := sendReceive(rec, conn, d, dest, SendOpt{Compression: &CompressionOpt{}}, opt)
+		if err == nil {
+			assert.NoError(t, err1)
+			dt, err := ioutil.ReadFile(filepath.Join(dest, "foo"))
+			assert.NoError(t, err)
+			assert.Equal(t, big, dt)
+			dt, err = ioutil.ReadFile(filepath.Join(dest, "bar"))
+			assert.NoError(t, err)
+			assert.Equal(t, "data1", string(dt))
+		}
+		return rec.requests, err
+	}
+
+	// 7 chunks of foo and bar
+	requests, err := receive(ReceiveOpt{Chunks: &ChunkOpt{Size: 16384, Concurrency: 3}, Compression: COMPRESSION_GZIP}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, len(requests))
+
+	// only the corrupt chunk is requested again
+	opt := ReceiveOpt{Chunks: &ChunkOpt{Size: 16384, Retries: 1}, VerifyChecksums: true}
+	requests, err = receive(opt, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 9, len(requests))
+
+	opt.Chunks.Retries = 0
+	_, err = receive(opt, 1)
+	assert.Error(t, err)
+	_, ok := errors.Cause(err).(*ChecksumError)
+	assert.True(t, ok)
+}
+
+func TestReceiveHandshake(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+		"ADD foo file 0123456789",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	receive := func(legacy bool, opt ReceiveOpt) (*PeerInfo, *PeerInfo, []Packet_PacketType, error) {
+		dest, err := ioutil.TempDir("", "dest")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dest)
+
+		s1, s2 := sockPairProto()
+		if legacy {
+			s1 = &legacyConn{Stream: s1}
+		}
+		rec := &recordConn{Stream: s1}
+		var sender, receiver *PeerInfo
+		sopt := SendOpt{Handshake: func(pi PeerInfo) error {
+			receiver = &pi
+			return nil
+		}}
+		handshake := opt.Handshake
+		opt.Handshake = func(pi PeerInfo) error {
+			sender = &pi
+			if handshake != nil {
+				return handshake(pi)
+			}
+			return nil
+		}
+		err1, err := sendReceive(rec, s2, d, dest, sopt, opt)
+		if err == nil {
+			assert.NoError(t, err1)
+			dt, err := ioutil.ReadFile(filepath.Join(dest, "foo"))
+			assert.NoError(t, err)
+			assert.Equal(t, "0123456789", string(dt))
+		}
+		return sender, receiver, rec.requests, err
+	}
+
+	sender, receiver, requests, err := receive(false, ReceiveOpt{Chunks: &ChunkOpt{Size: 4}})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(ProtocolVersion), sender.Version)
+	assert.True(t, sender.Has(CapChunks))
+	assert.False(t, sender.Has(CapCompression))
+	assert.Equal(t, uint32(ProtocolVersion), receiver.Version)
+	assert.True(t, receiver.Has(CapCompression))
+	// 3 chunks of foo and 2 of bar
+	assert.Equal(t, 5, len(requests))
+
+	// files are not requested in chunks from older senders
+	sender, receiver, requests, err = receive(true, ReceiveOpt{Chunks: &ChunkOpt{Size: 4}})
+	assert.NoError(t, err)
+	assert.Equal(t, PeerInfo{}, *sender)
+	assert.Equal(t, PeerInfo{}, *receiver)
+	assert.Equal(t, 2, len(requests))
+
+	_, _, _, err = receive(true, ReceiveOpt{VerifyChecksums: true})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "does not support verifying checksums")
+
+	_, _, _, err = receive(false, ReceiveOpt{Handshake: func(pi PeerInfo) error {
+		return errors.Errorf("protocol version %d not supported", pi.Version)
+	}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not supported")
+}
+
+// legacyConn is the connection of a sender that predates the handshake.
+type legacyConn struct {
+	Stream
+}
+
+func (c *legacyConn) SendMsg(m interface{}) error {
+	if p := m.(*Packet); p.Type == PACKET_HELLO {
+		return nil
+	}
+	return c.Stream.SendMsg(m)
+}
+
+func (c *legacyConn) RecvMsg(m interface{}) error {
+	for {
+		if err := c.Stream.RecvMsg(m); err != nil {
+			return err
+		}
+		if p := m.(*Packet); p.Type != PACKET_HELLO {
+			return nil
+		}
+	}
 }
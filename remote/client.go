@@ -0,0 +1,43 @@
+// +build linux
+
+package remote
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil"
+	"github.com/tonistiigi/fsutil/util"
+	"golang.org/x/net/context"
+)
+
+// Client receives the directory served by a Server.
+type Client struct {
+	Network string
+	Address string
+	// Handshake is called after the connection has been established and can
+	// be used to present credentials expected by the server's Auth function.
+	Handshake func(net.Conn) error
+	Opt       fsutil.ReceiveOpt
+}
+
+// Receive connects to the server and syncs its contents to dest.
+func (c *Client) Receive(ctx context.Context, dest string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return errors.Wrapf(err, "failed to dial %s", c.Address)
+	}
+	defer conn.Close()
+	return c.ReceiveConn(ctx, conn, dest)
+}
+
+// ReceiveConn runs a single receive session on an established connection.
+func (c *Client) ReceiveConn(ctx context.Context, conn net.Conn, dest string) error {
+	if c.Handshake != nil {
+		if err := c.Handshake(conn); err != nil {
+			return errors.Wrap(err, "handshake failed")
+		}
+	}
+	return fsutil.Receive(ctx, util.NewProtoStream(conn, conn), dest, c.Opt)
+}
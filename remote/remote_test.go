@@ -0,0 +1,140 @@
+// +build linux
+
+package remote
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/tonistiigi/fsutil/fstest"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+)
+
+func TestServerClient(t *testing.T) {
+	src, err := fstest.TmpDir(fstest.ChangeStream([]string{
+		"ADD foo dir",
+		"ADD foo/bar file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(src)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	s := &Server{
+		Root: src,
+		Auth: func(conn net.Conn) error {
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				return err
+			}
+			if line != "secret\n" {
+				return errors.Errorf("invalid token")
+			}
+			return nil
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Serve(ctx, l)
+
+	c := &Client{
+		Network: "tcp",
+		Address: l.Addr().String(),
+		Handshake: func(conn net.Conn) error {
+			_, err := conn.Write([]byte("secret\n"))
+			return err
+		},
+	}
+	err = c.Receive(ctx, dest)
+	assert.NoError(t, err)
+
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "foo/bar"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data1", string(dt))
+
+	c.Handshake = func(conn net.Conn) error {
+		_, err := conn.Write([]byte("invalid\n"))
+		return err
+	}
+	err = c.Receive(ctx, dest)
+	assert.Error(t, err)
+}
+
+func TestListenAndSync(t *testing.T) {
+	src, err := fstest.TmpDir(fstest.ChangeStream([]string{
+		"ADD foo file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(src)
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sock := filepath.Join(src, "..", filepath.Base(src)+".sock")
+	defer os.Remove(sock)
+
+	// a socket left by a process that exited is replaced
+	l, err := net.Listen("unix", sock)
+	assert.NoError(t, err)
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	var pid int32
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ListenAndSync(ctx, sock, src, nil, func(cred *unix.Ucred) error {
+			pid = cred.Pid
+			return SameUser(cred)
+		})
+	}()
+
+	c := &Client{
+		Network: "unix",
+		Address: sock,
+	}
+	for i := 0; i < 100; i++ {
+		if err = c.Receive(ctx, dest); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+	assert.Equal(t, int32(os.Getpid()), pid)
+
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data1", string(dt))
+
+	// the socket is removed when the server stops
+	cancel()
+	assert.NoError(t, <-errCh)
+	_, err = os.Lstat(sock)
+	assert.True(t, os.IsNotExist(err))
+
+	// other files are not replaced
+	err = ioutil.WriteFile(sock, []byte("data2"), 0600)
+	assert.NoError(t, err)
+	err = ListenAndSync(context.Background(), sock, src, nil, nil)
+	assert.Error(t, err)
+	dt, err = ioutil.ReadFile(sock)
+	assert.NoError(t, err)
+	assert.Equal(t, "data2", string(dt))
+}
@@ -0,0 +1,62 @@
+// +build linux
+
+package remote
+
+import (
+	"net"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil"
+	"github.com/tonistiigi/fsutil/util"
+	"golang.org/x/net/context"
+)
+
+// Server serves the contents of a directory to every client connecting to
+// a listener.
+type Server struct {
+	Root string
+	Opt  fsutil.SendOpt
+	// Auth is called for every accepted connection before any data is sent.
+	// Returning an error closes the connection.
+	Auth func(net.Conn) error
+}
+
+// Serve accepts connections on l until ctx is cancelled or the listener
+// fails. The listener is closed when Serve returns.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+			}
+			return errors.Wrap(err, "failed to accept connection")
+		}
+		go func() {
+			if err := s.ServeConn(ctx, conn); err != nil {
+				logrus.Errorf("failed to serve %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn runs a single send session on conn and closes it afterwards.
+func (s *Server) ServeConn(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+	if s.Auth != nil {
+		if err := s.Auth(conn); err != nil {
+			return errors.Wrap(err, "unauthorized")
+		}
+	}
+	return fsutil.Send(ctx, util.NewProtoStream(conn, conn), s.Root, s.Opt)
+}
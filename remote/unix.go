@@ -0,0 +1,99 @@
+// +build linux
+
+package remote
+
+import (
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+)
+
+// ListenAndSync listens on the unix socket at socketPath and serves root to
+// local clients until ctx is cancelled. checkCred is called with the
+// credentials of every connecting process. If it is nil, only processes
+// running as root or as the same user as the current process are accepted.
+func ListenAndSync(ctx context.Context, socketPath, root string, opt *fsutil.WalkOpt, checkCred func(*unix.Ucred) error) error {
+	if checkCred == nil {
+		checkCred = SameUser
+	}
+	if err := removeStaleSocket(socketPath); err != nil {
+		return err
+	}
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %s", socketPath)
+	}
+	defer os.Remove(socketPath)
+	s := &Server{
+		Root: root,
+		Opt:  fsutil.SendOpt{WalkOpt: opt},
+		Auth: func(conn net.Conn) error {
+			cred, err := PeerCred(conn)
+			if err != nil {
+				return err
+			}
+			return checkCred(cred)
+		},
+	}
+	return s.Serve(ctx, l)
+}
+
+// removeStaleSocket removes a socket left at p by a process that is not
+// listening anymore. Other files are not replaced.
+func removeStaleSocket(p string) error {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "failed to stat %s", p)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return errors.Errorf("%s exists and is not a socket", p)
+	}
+	if conn, err := net.Dial("unix", p); err == nil {
+		conn.Close()
+		return errors.Errorf("%s is in use", p)
+	}
+	if err := os.Remove(p); err != nil {
+		return errors.Wrapf(err, "failed to remove stale socket %s", p)
+	}
+	return nil
+}
+
+// SameUser accepts processes running as root or as the same user as the
+// current process.
+func SameUser(cred *unix.Ucred) error {
+	if cred.Uid != 0 && int(cred.Uid) != os.Getuid() {
+		return errors.Errorf("uid %d not allowed", cred.Uid)
+	}
+	return nil
+}
+
+// PeerCred returns the credentials of the process on the other side of a
+// unix socket connection.
+func PeerCred(conn net.Conn) (*unix.Ucred, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errors.Errorf("invalid connection type %T", conn)
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	if err := rc.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, errors.Wrap(credErr, "failed to get peer credentials")
+	}
+	return cred, nil
+}
@@ -0,0 +1,119 @@
+package fsutil
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ResumeState records the files a receive was writing when it failed, so a
+// later receive into the same destination can continue them where they were
+// interrupted instead of transferring them again. The same state is passed to
+// every attempt. A file is continued only if its stat from the sender has not
+// changed in between and the sender has the same contents up to the offset.
+// The zero value is ready to use.
+type ResumeState struct {
+	mu    sync.Mutex
+	files map[string]resumeFile
+}
+
+type resumeFile struct {
+	mode    uint32
+	size    int64
+	modTime int64
+	offset  int64
+}
+
+// Files returns the paths of the files that can be continued and the number of
+// bytes already written for each.
+func (s *ResumeState) Files() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := make(map[string]int64, len(s.files))
+	for p, f := range s.files {
+		m[p] = f.offset
+	}
+	return m
+}
+
+func (s *ResumeState) add(p string, st *Stat, offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files == nil {
+		s.files = make(map[string]resumeFile)
+	}
+	s.files[p] = resumeFile{mode: st.Mode, size: st.Size_, modTime: st.ModTime, offset: offset}
+}
+
+// take removes the record for p and returns the offset to continue from if
+// st matches the stat the file was started with.
+func (s *ResumeState) take(p string, st *Stat) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[p]
+	if !ok {
+		return 0, false
+	}
+	delete(s.files, p)
+	if f.mode != st.Mode || f.size != st.Size_ || f.modTime != st.ModTime {
+		return 0, false
+	}
+	return f.offset, true
+}
+
+// errResumeRejected is returned when a file can't be continued because the
+// part written before differs from the source or the sender can't continue
+// files. The file is then transferred again from the start.
+var errResumeRejected = errors.New("file can't be continued")
+
+type resumeKey struct{}
+
+type resumeInfo struct {
+	offset int64
+	// prefix is the digest of the first offset bytes of the file
+	prefix string
+}
+
+// withResume returns a context asking for the file contents starting at
+// offset. prefix is the digest of the part of the file already written.
+func withResume(ctx context.Context, offset int64, prefix string) context.Context {
+	return context.WithValue(ctx, resumeKey{}, resumeInfo{offset: offset, prefix: prefix})
+}
+
+func resumeFrom(ctx context.Context) (int64, string) {
+	ri, _ := ctx.Value(resumeKey{}).(resumeInfo)
+	return ri.offset, ri.prefix
+}
+
+// prefixDigest returns the sha256 digest of the first n bytes read from r.
+// It fails with errResumeRejected if r is shorter.
+func prefixDigest(r io.Reader, n int64) (string, error) {
+	h := sha256.New()
+	copied, err := io.Copy(h, io.LimitReader(r, n))
+	if err != nil {
+		return "", err
+	}
+	if copied != n {
+		return "", errResumeRejected
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// filePrefixDigest returns the digest of the first n bytes of the file at p.
+func filePrefixDigest(p string, n int64) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	dgst, err := prefixDigest(f, n)
+	if err != nil && err != errResumeRejected {
+		return "", errors.Wrapf(err, "failed to read %s", p)
+	}
+	return dgst, err
+}
@@ -0,0 +1,48 @@
+// +build linux
+
+package fsutil_test
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil"
+	"github.com/tonistiigi/fsutil/fstest"
+)
+
+func TestRoundTripRandom(t *testing.T) {
+	seed := time.Now().UnixNano()
+	t.Logf("seed %d", seed)
+	r := rand.New(rand.NewSource(seed))
+
+	for i := 0; i < 20; i++ {
+		tree := fstest.RandomTree(r, fstest.RandomTreeOpt{})
+		src, err := fstest.TmpDir(tree)
+		require.NoError(t, err)
+
+		dest, err := ioutil.TempDir("", "dest")
+		require.NoError(t, err)
+
+		err = fsutil.SyncDirs(src, dest, fsutil.SendOpt{}, fsutil.ReceiveOpt{})
+		require.NoError(t, err)
+		assert.NoError(t, fstest.Compare(src, dest))
+
+		err = fstest.Apply(src, fstest.Mutate(r, tree, fstest.RandomTreeOpt{}))
+		require.NoError(t, err)
+
+		err = fsutil.SyncDirs(src, dest, fsutil.SendOpt{}, fsutil.ReceiveOpt{})
+		require.NoError(t, err)
+		assert.NoError(t, fstest.Compare(src, dest))
+
+		os.RemoveAll(src)
+		os.RemoveAll(dest)
+		if t.Failed() {
+			break
+		}
+	}
+}
@@ -1,15 +1,20 @@
-// +build linux
-
 package fsutil
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
 )
 
 var bufPool = sync.Pool{
@@ -23,89 +28,507 @@ type Stream interface {
 	SendMsg(m interface{}) error
 }
 
-func Send(ctx context.Context, conn Stream, root string, opt *WalkOpt, progressCb func(int, bool)) error {
+type SendOpt struct {
+	// WalkOpt selects the files that are sent.
+	WalkOpt *WalkOpt
+	// ProgressCb is called with the total size of the packets sent so far.
+	// The last call has the second argument set to true.
+	ProgressCb func(int, bool)
+	// FileProgressCb is called while file contents are sent with the stat of
+	// the file, the number of its bytes sent so far and its size. Once all
+	// stats have been sent it is also called with an empty Stat and the total
+	// size of the files the receiver may request.
+	FileProgressCb func(stat Stat, transferred, total int64)
+	// TreeDigest is the digest of the source tree as returned by TreeDigest,
+	// usually from a cache. If the receiver was given the same digest for the
+	// destination the transfer finishes without comparing any files.
+	TreeDigest string
+	// ReadErrors defines what happens when a file can't be read after its
+	// stat was sent. If nil, such errors fail the transfer.
+	ReadErrors *ReadErrorPolicy
+	// Compression allows compressing file data for receivers asking for it.
+	// If nil, data is sent uncompressed.
+	Compression *CompressionOpt
+	// Watch keeps sending the changes to the source after the initial
+	// transfer until ctx is canceled. Only supported on linux.
+	Watch *SendWatchOpt
+	// RateLimit throttles the file data sent. Only WaitBytes is used. See
+	// the ratelimit package for an implementation.
+	RateLimit RateLimiter
+	// MaxConcurrentFiles limits the number of files read at the same time.
+	// Zero means DefaultMaxConcurrentFiles.
+	MaxConcurrentFiles int
+	// MetadataOnly sends the stats together with the content digests of the
+	// files and never their contents. The receiver needs to use
+	// ReceiveMetadata.
+	MetadataOnly bool
+	// Metrics receives the timings and packet counts of the transfer.
+	Metrics Metrics
+	// Handshake is called with the protocol version and capabilities of the
+	// receiver once they are known. Returning an error ends the transfer,
+	// for example to reject receivers that are too old.
+	Handshake func(PeerInfo) error
+}
+
+// DefaultMaxConcurrentFiles is the number of files a sender reads at the
+// same time by default.
+const DefaultMaxConcurrentFiles = 16
+
+// ReadErrorAction defines how a file that can't be read is sent.
+type ReadErrorAction int
+
+const (
+	// ReadErrorFail fails the transfer.
+	ReadErrorFail ReadErrorAction = iota
+	// ReadErrorSkip makes the receiver remove the file from the destination.
+	// Receivers that predate this action never finish the file.
+	ReadErrorSkip
+	// ReadErrorStale keeps the file at the destination with the stat that
+	// was already sent and the contents that could be read, possibly none.
+	ReadErrorStale
+)
+
+// ReadErrorPolicy defines how files that become unreadable or disappear
+// during a transfer are handled, for example editor temporary files.
+type ReadErrorPolicy struct {
+	Action ReadErrorAction
+	// Timeout limits the time spent reading a single file. Files that take
+	// longer are handled as read errors.
+	Timeout time.Duration
+	// Warn is called for every file that was skipped or sent stale.
+	Warn func(path string, err error)
+}
+
+func Send(ctx context.Context, conn Stream, root string, opt SendOpt) error {
+	return NewSendSession(conn, root, opt).Run(ctx)
+}
+
+// SendFS sends the entries of fs over conn. opt.WalkOpt is not used, the
+// entries are the ones walked by fs. Watch is not supported.
+func SendFS(ctx context.Context, conn Stream, fs FS, opt SendOpt) error {
+	if opt.Watch != nil {
+		return errors.New("watching is only supported for directories")
+	}
+	ss := &SendSession{
+		s:   newSender(&syncStream{Stream: withMetrics(conn, opt.Metrics)}, fs, opt, newTransferStats()),
+		opt: opt,
+	}
+	return ss.Run(ctx)
+}
+
+// SendSession is a send whose progress can be watched while it is running.
+type SendSession struct {
+	s    *sender
+	root string
+	opt  SendOpt
+}
+
+// NewSendSession returns a session sending root over conn. The transfer
+// starts when Run is called.
+func NewSendSession(conn Stream, root string, opt SendOpt) *SendSession {
+	return &SendSession{
+		s:    newSender(&syncStream{Stream: withMetrics(conn, opt.Metrics)}, NewFS(root, opt.WalkOpt), opt, newTransferStats()),
+		root: root,
+		opt:  opt,
+	}
+}
+
+func newSender(conn Stream, fs FS, opt SendOpt, stats *transferStats) *sender {
+	maxFiles := opt.MaxConcurrentFiles
+	if maxFiles <= 0 {
+		maxFiles = DefaultMaxConcurrentFiles
+	}
+	return &sender{
+		conn:           conn,
+		fs:             fs,
+		files:          make(map[uint32]string),
+		requested:      make(map[uint32]struct{}),
+		fileStats:      make(map[uint32]*Stat),
+		progressCb:     opt.ProgressCb,
+		fileProgressCb: opt.FileProgressCb,
+		treeDigest:     opt.TreeDigest,
+		readErrors:     opt.ReadErrors,
+		compression:    opt.Compression,
+		rateLimit:      opt.RateLimit,
+		metadataOnly:   opt.MetadataOnly,
+		metrics:        opt.Metrics,
+		hs:             newHandshake(senderCapabilities(opt), opt.Handshake),
+		fileSem:        make(chan struct{}, maxFiles),
+		stats:          stats,
+	}
+}
+
+// Run performs the transfer. With SendOpt.Watch it keeps running until ctx
+// is canceled and then returns ctx.Err().
+func (ss *SendSession) Run(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-
-	s := &sender{
-		ctx:        ctx,
-		cancel:     cancel,
-		conn:       &syncStream{Stream: conn},
-		root:       root,
-		opt:        opt,
-		files:      make(map[uint32]string),
-		progressCb: progressCb,
+	ss.s.ctx = ctx
+	ss.s.cancel = cancel
+	if ss.opt.Watch != nil {
+		return ss.runWatch(ctx)
 	}
-	return s.run()
+	return ss.s.run()
+}
+
+// Stats returns the counters of the transfer.
+func (ss *SendSession) Stats() TransferStats {
+	return ss.s.stats.snapshot()
 }
 
 type sender struct {
 	ctx             context.Context
 	conn            Stream
 	cancel          func()
-	opt             *WalkOpt
-	root            string
+	fs              FS
 	files           map[uint32]string
+	requested       map[uint32]struct{}
 	mu              sync.RWMutex
 	progressCb      func(int, bool)
 	progressCurrent int
+	progressMu      sync.Mutex
+	fileProgressCb  func(Stat, int64, int64)
+	fileStats       map[uint32]*Stat
+	treeDigest      string
+	readErrors      *ReadErrorPolicy
+	compression     *CompressionOpt
+	rateLimit       RateLimiter
+	metadataOnly    bool
+	metrics         Metrics
+	hs              *handshake
+	// fileSem limits the number of files read at the same time
+	fileSem chan struct{}
+	stats   *transferStats
+
+	// fileErr is the first error that failed sending a file.
+	fileErr   error
+	fileErrMu sync.Mutex
+
+	// finished is set when the receiver ended the session before all stats
+	// were sent because it already had the same tree.
+	finished   bool
+	stopWalk   func()
+	finishedMu sync.Mutex
+}
+
+// senderCapabilities returns the capabilities a sender with opt advertises.
+func senderCapabilities(opt SendOpt) []string {
+	caps := []string{CapResume, CapVerify, CapChunks}
+	if opt.Compression != nil {
+		caps = append(caps, CapCompression)
+	}
+	if holesSupported {
+		caps = append(caps, CapSparse)
+	}
+	if xattrsSupported {
+		caps = append(caps, CapXattrs)
+	}
+	return caps
 }
 
 func (s *sender) run() error {
-	go s.send()
+	g, ctx := errgroup.WithContext(s.ctx)
 	defer s.updateProgress(0, true)
+
+	g.Go(func() error {
+		err := s.send()
+		if err != nil {
+			s.conn.SendMsg(&Packet{Type: PACKET_ERR, Data: []byte(err.Error())})
+		}
+		return err
+	})
+
+	// RecvMsg can't be interrupted so the loop is not tracked by the group.
+	// It returns once the stream is closed by the caller.
+	recvErr := make(chan error, 1)
+	go func() {
+		recvErr <- s.recv()
+	}()
+	g.Go(func() error {
+		select {
+		case err := <-recvErr:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+
+	err := g.Wait()
+	s.fileErrMu.Lock()
+	defer s.fileErrMu.Unlock()
+	if s.fileErr != nil {
+		return s.fileErr
+	}
+	return err
+}
+
+// fail ends the session after a file couldn't be sent.
+func (s *sender) fail(err error) {
+	s.fileErrMu.Lock()
+	first := s.fileErr == nil
+	if first {
+		s.fileErr = err
+	}
+	s.fileErrMu.Unlock()
+	if first {
+		s.conn.SendMsg(&Packet{Type: PACKET_ERR, Data: []byte(err.Error())})
+		s.cancel()
+	}
+}
+
+func (s *sender) recv() error {
 	for {
 		var p Packet
-		if err := s.conn.RecvMsg(&p); err == nil {
-			switch p.Type {
-			case PACKET_REQ:
-				if err := s.queue(p.ID); err != nil {
-					return err
-				}
-			case PACKET_FIN:
-				return s.conn.SendMsg(&Packet{Type: PACKET_FIN})
+		if err := s.conn.RecvMsg(&p); err != nil {
+			return err
+		}
+		hello, err := s.hs.recv(&p)
+		if err != nil {
+			return err
+		}
+		if hello {
+			continue
+		}
+		switch p.Type {
+		case PACKET_ERR:
+			return errors.Errorf("error from receiver: %s", p.Data)
+		case PACKET_REQ, PACKET_RESUME:
+			if s.metadataOnly {
+				return errors.New("file contents are not sent in metadata only mode")
+			}
+			if err := s.queue(p); err != nil {
+				return err
 			}
+		case PACKET_FIN:
+			s.finishedMu.Lock()
+			s.finished = true
+			if s.stopWalk != nil {
+				s.stopWalk()
+			}
+			s.finishedMu.Unlock()
+			return s.conn.SendMsg(&Packet{Type: PACKET_FIN})
 		}
 	}
 }
 
 func (s *sender) updateProgress(size int, last bool) {
+	s.stats.addBytes(size)
 	if s.progressCb != nil {
+		s.progressMu.Lock()
 		s.progressCurrent += size
 		s.progressCb(s.progressCurrent, last)
+		s.progressMu.Unlock()
 	}
 }
 
-func (s *sender) queue(id uint32) error {
-	// TODO: add worker threads
+func (s *sender) updateFileProgress(stat Stat, transferred, total int64) {
+	s.progressMu.Lock()
+	s.fileProgressCb(stat, transferred, total)
+	s.progressMu.Unlock()
+}
+
+func (s *sender) queue(req Packet) error {
+	id := req.ID
 	// TODO: use something faster than map
+	// files stay in the map because the receiver may request them again if
+	// their contents fail verification
 	s.mu.Lock()
 	p, ok := s.files[id]
+	_, retry := s.requested[id]
+	s.requested[id] = struct{}{}
+	s.mu.Unlock()
 	if !ok {
-		s.mu.Unlock()
 		return errors.Errorf("invalid file id %d", id)
 	}
-	delete(s.files, id)
-	s.mu.Unlock()
-	go s.sendFile(id, p)
+	// chunks of a file are requested separately
+	if retry && req.Length == 0 {
+		atomic.AddInt64(&s.stats.retries, 1)
+	}
+	atomic.AddInt64(&s.stats.pending, 1)
+	go func() {
+		defer atomic.AddInt64(&s.stats.pending, -1)
+		select {
+		case s.fileSem <- struct{}{}:
+		case <-s.ctx.Done():
+			return
+		}
+		defer func() { <-s.fileSem }()
+		start := time.Now()
+		if err := s.sendFile(p, req); err != nil {
+			s.fail(err)
+			return
+		}
+		if s.metrics != nil {
+			s.metrics.Phase(PhaseTransfer, p, time.Since(start))
+		}
+		if req.Length == 0 || req.Offset == 0 {
+			atomic.AddInt64(&s.stats.files, 1)
+		}
+	}()
 	return nil
 }
 
-func (s *sender) sendFile(id uint32, p string) error {
-	f, err := os.Open(filepath.Join(s.root, p))
-	if err == nil {
-		buf := bufPool.Get().([]byte)
-		defer bufPool.Put(buf)
-		if _, err := io.CopyBuffer(&fileSender{sender: s, id: id}, f, buf); err != nil {
-			return err // TODO: handle error
+// sendFile sends the contents of a file as asked for by req, starting at its
+// offset and compressed if that is allowed. If req has a length only that
+// chunk of the file is sent. A PACKET_RESUME is only continued if the first
+// offset bytes of the file have the digest in its data.
+func (s *sender) sendFile(p string, req Packet) error {
+	id := req.ID
+	if req.Type == PACKET_RESUME && len(req.Data) > 0 {
+		ok, err := s.matchPrefix(p, req.Offset, string(req.Data))
+		if err != nil {
+			return errors.WithStack(&TransferError{Path: p, Err: err})
+		}
+		if !ok {
+			return s.conn.SendMsg(&Packet{ID: id, Type: PACKET_RESUME})
 		}
 	}
-	return s.conn.SendMsg(&Packet{ID: id, Type: PACKET_DATA})
+	fs := &fileSender{sender: s, id: id, sent: req.Offset, chunked: req.Length > 0}
+	if s.compression != nil && s.compression.allows(req.Compression) {
+		fs.compression = req.Compression
+	}
+	if req.Verify {
+		fs.checksum = sha256.New()
+	}
+	if s.fileProgressCb != nil && !fs.chunked {
+		s.mu.RLock()
+		fs.stat = s.fileStats[id]
+		s.mu.RUnlock()
+	}
+	err := s.copyFile(p, req.Offset, req.Length, req.Sparse && !fs.chunked, fs)
+	if fs.err != nil {
+		return fs.err
+	}
+	if err != nil {
+		if s.readErrors == nil || s.readErrors.Action == ReadErrorFail {
+			return errors.WithStack(&TransferError{Path: p, Offset: fs.sent, Err: err})
+		}
+		if s.readErrors.Warn != nil {
+			s.readErrors.Warn(p, err)
+		}
+		if s.readErrors.Action == ReadErrorSkip {
+			return s.conn.SendMsg(&Packet{ID: id, Type: PACKET_SKIP, Data: []byte(err.Error())})
+		}
+	}
+	fin := &Packet{ID: id, Type: PACKET_DATA}
+	if fs.chunked {
+		fin.Offset = req.Offset
+		fin.Length = req.Length
+	}
+	if fs.checksum != nil {
+		fin.Checksum = "sha256:" + hex.EncodeToString(fs.checksum.Sum(nil))
+	}
+	return s.conn.SendMsg(fin)
+}
+
+// matchPrefix returns true if the first n bytes of the file at p have the
+// digest dgst.
+func (s *sender) matchPrefix(p string, n int64, dgst string) (bool, error) {
+	rc, err := s.fs.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+	actual, err := prefixDigest(rc, n)
+	if err == errResumeRejected {
+		return false, nil
+	}
+	return actual == dgst, err
+}
+
+func (s *sender) copyFile(p string, offset, length int64, sparse bool, fs *fileSender) error {
+	rc, err := s.fs.Open(p)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if offset > 0 {
+		if sk, ok := rc.(io.Seeker); ok {
+			_, err = sk.Seek(offset, io.SeekStart)
+		} else {
+			_, err = io.CopyN(ioutil.Discard, rc, offset)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var r io.Reader = rc
+	if s.readErrors != nil && s.readErrors.Timeout > 0 {
+		r = &timeoutReader{r: rc, timeout: s.readErrors.Timeout, deadline: time.Now().Add(s.readErrors.Timeout)}
+	}
+	if length > 0 {
+		r = io.LimitReader(r, length)
+	}
+	buf := bufPool.Get().([]byte)
+	defer bufPool.Put(buf)
+	// holes can only be found in files on disk
+	if f, ok := rc.(*os.File); ok && sparse {
+		return copySparse(fs, f, r, offset, buf)
+	}
+	_, err = io.CopyBuffer(fs, r, buf)
+	return err
+}
+
+// timeoutReader fails reads that don't finish before the deadline. A read
+// that timed out keeps running in the background, so the reader can't be
+// used anymore afterwards.
+type timeoutReader struct {
+	r        io.Reader
+	timeout  time.Duration
+	deadline time.Time
+	buf      []byte
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+func (t *timeoutReader) Read(p []byte) (int, error) {
+	d := t.deadline.Sub(time.Now())
+	if d <= 0 {
+		return 0, errors.Errorf("read timed out after %s", t.timeout)
+	}
+	if len(t.buf) < len(p) {
+		t.buf = make([]byte, len(p))
+	}
+	buf := t.buf[:len(p)]
+	ch := make(chan readResult, 1)
+	go func() {
+		n, err := t.r.Read(buf)
+		ch <- readResult{n, err}
+	}()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case res := <-ch:
+		return copy(p, buf[:res.n]), res.err
+	case <-timer.C:
+		return 0, errors.Errorf("read timed out after %s", t.timeout)
+	}
 }
 
 func (s *sender) send() error {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	s.finishedMu.Lock()
+	s.stopWalk = cancel
+	s.finishedMu.Unlock()
+
+	if s.treeDigest != "" {
+		if err := s.conn.SendMsg(&Packet{Type: PACKET_DIGEST, Data: []byte(s.treeDigest)}); err != nil {
+			return errors.Wrap(err, "failed to send tree digest")
+		}
+	}
+	if err := s.hs.send(s.conn); err != nil {
+		return errors.Wrap(err, "failed to send handshake")
+	}
+
 	var i uint32 = 0
-	err := Walk(s.ctx, s.root, s.opt, func(path string, fi os.FileInfo, err error) error {
+	var total int64
+	start := time.Now()
+	err := s.fs.Walk(ctx, func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -117,22 +540,75 @@ func (s *sender) send() error {
 			Type: PACKET_STAT,
 			Stat: stat,
 		}
+		if s.metadataOnly {
+			dgst, err := hashContents(fi, func() (io.ReadCloser, error) {
+				return s.fs.Open(path)
+			})
+			if err != nil {
+				return err
+			}
+			p.Checksum = dgst
+		}
+		// paths are sent with forward slashes on every platform
+		stat.Path = filepath.ToSlash(stat.Path)
+		if stat.Linkname != "" && !isSymlink(stat) {
+			stat.Linkname = filepath.ToSlash(stat.Linkname)
+		}
 		s.mu.Lock()
-		s.files[i] = stat.Path
+		// files are read from their path under root, the stat may have
+		// been renamed by a filter
+		s.files[i] = path
+		if s.fileProgressCb != nil {
+			s.fileStats[i] = stat
+			if fi.Mode().IsRegular() && stat.Linkname == "" {
+				total += stat.Size_
+			}
+		}
 		i++
 		s.mu.Unlock()
 		s.updateProgress(p.Size(), false)
-		return errors.Wrapf(s.conn.SendMsg(p), "failed to send stat %s", path)
+		if s.metrics == nil {
+			return errors.Wrapf(s.conn.SendMsg(p), "failed to send stat %s", path)
+		}
+		sendStart := time.Now()
+		if err := s.conn.SendMsg(p); err != nil {
+			return errors.Wrapf(err, "failed to send stat %s", path)
+		}
+		s.metrics.Phase(PhaseStatSend, path, time.Since(sendStart))
+		return nil
 	})
+	if s.metrics != nil {
+		s.metrics.Phase(PhaseWalk, "", time.Since(start))
+	}
+	s.finishedMu.Lock()
+	finished := s.finished
+	s.finishedMu.Unlock()
+	if finished {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
+	if s.fileProgressCb != nil {
+		s.updateFileProgress(Stat{}, 0, total)
+	}
 	return errors.Wrapf(s.conn.SendMsg(&Packet{Type: PACKET_STAT}), "failed to send last stat")
 }
 
 type fileSender struct {
 	sender *sender
 	id     uint32
+	// err is set if sending the data failed as opposed to reading it
+	err error
+	// stat is only set for reporting file progress
+	stat        *Stat
+	sent        int64
+	compression Packet_Compression
+	// checksum hashes the contents sent if the receiver asked for it
+	checksum hash.Hash
+	// chunked is set when a chunk of the file is sent. The data packets
+	// have the position of their data in the file set.
+	chunked bool
 }
 
 func (fs *fileSender) Write(dt []byte) (int, error) {
@@ -140,13 +616,59 @@ func (fs *fileSender) Write(dt []byte) (int, error) {
 		return 0, nil
 	}
 	p := &Packet{Type: PACKET_DATA, ID: fs.id, Data: dt}
+	if fs.chunked {
+		p.Offset = fs.sent
+	}
+	if fs.compression != COMPRESSION_NONE && len(dt) >= fs.sender.compression.minSize() {
+		enc, err := compressData(fs.compression, dt)
+		if err != nil {
+			fs.err = err
+			return 0, err
+		}
+		if enc != nil {
+			p.Data = enc
+			p.Compression = fs.compression
+		}
+	}
+	if fs.sender.rateLimit != nil {
+		if err := fs.sender.rateLimit.WaitBytes(fs.sender.ctx, len(p.Data)); err != nil {
+			fs.err = err
+			return 0, err
+		}
+	}
 	if err := fs.sender.conn.SendMsg(p); err != nil {
+		fs.err = err
 		return 0, err
 	}
 	fs.sender.updateProgress(p.Size(), false)
+	if fs.checksum != nil {
+		fs.checksum.Write(dt)
+	}
+	fs.sent += int64(len(dt))
+	if fs.stat != nil {
+		fs.sender.updateFileProgress(*fs.stat, fs.sent, fs.stat.Size_)
+	}
 	return len(dt), nil
 }
 
+// hole sends a run of n zero bytes that isn't backed by data on disk.
+func (fs *fileSender) hole(n int64) error {
+	p := &Packet{Type: PACKET_HOLE, ID: fs.id, Offset: n}
+	if err := fs.sender.conn.SendMsg(p); err != nil {
+		fs.err = err
+		return err
+	}
+	fs.sender.updateProgress(p.Size(), false)
+	if fs.checksum != nil {
+		writeZeros(fs.checksum, n)
+	}
+	fs.sent += n
+	if fs.stat != nil {
+		fs.sender.updateFileProgress(*fs.stat, fs.sent, fs.stat.Size_)
+	}
+	return nil
+}
+
 type syncStream struct {
 	Stream
 	mu sync.Mutex
@@ -0,0 +1,213 @@
+package fsutil
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ErrShutdown is returned by a receive that was stopped with Shutdown before
+// the transfer completed.
+var ErrShutdown = errors.New("receive was shut down")
+
+// ShutdownReport describes what a receive completed before it was shut down.
+type ShutdownReport struct {
+	// Changes is the number of changes that were applied to the destination.
+	Changes int
+	// Files is the number of files whose contents were fully written.
+	Files int
+	// Aborted lists the files whose writes were interrupted because the
+	// shutdown deadline passed. They have been removed from the destination.
+	Aborted []string
+}
+
+// ReceiveSession is a receive that can be stopped gracefully while it is
+// running.
+type ReceiveSession struct {
+	conns []Stream
+	dest  string
+	opt   ReceiveOpt
+	r     *receiver
+
+	mu      sync.Mutex
+	started bool
+	done    chan struct{}
+	err     error
+}
+
+// NewReceiveSession returns a session receiving from conns into dest. The
+// transfer starts when Run is called.
+func NewReceiveSession(conns []Stream, dest string, opt ReceiveOpt) *ReceiveSession {
+	return &ReceiveSession{
+		conns: conns,
+		dest:  dest,
+		opt:   opt,
+		r:     newReceiver(conns, dest, opt),
+		done:  make(chan struct{}),
+	}
+}
+
+// Run performs the transfer. It returns ErrShutdown if the session was shut
+// down before all changes were applied.
+func (rs *ReceiveSession) Run(ctx context.Context) error {
+	rs.mu.Lock()
+	if rs.started {
+		rs.mu.Unlock()
+		return errors.New("receive session already started")
+	}
+	rs.started = true
+	rs.mu.Unlock()
+	defer close(rs.done)
+
+	select {
+	case <-rs.r.shutdown:
+		rs.err = abortReceive(rs.conns, ErrShutdown)
+	default:
+		rs.err = rs.run(ctx)
+	}
+	return rs.err
+}
+
+func (rs *ReceiveSession) run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if len(rs.conns) == 0 {
+		return errors.New("no streams to receive from")
+	}
+	if rs.opt.Watch != nil && len(rs.conns) > 1 {
+		return abortReceive(rs.conns, errors.New("watching supports a single sender only"))
+	}
+	if rs.opt.Atomic && (rs.opt.Watch != nil || rs.opt.VolumeSnapshot != nil) {
+		return abortReceive(rs.conns, errors.New("atomic receive is not supported with watch or volume snapshots"))
+	}
+	if rs.opt.DryRun != nil && rs.opt.Watch != nil {
+		return abortReceive(rs.conns, errors.New("dry runs are not supported with watch"))
+	}
+	if rs.opt.DiskWriterOpt != nil && rs.opt.DiskWriterOpt.Layer != nil && (rs.opt.Atomic || rs.opt.Watch != nil || rs.opt.VolumeSnapshot != nil) {
+		return abortReceive(rs.conns, errors.New("receiving a layer is not supported with atomic, watch or volume snapshots"))
+	}
+	if err := prepareDest(rs.dest, rs.opt); err != nil {
+		return abortReceive(rs.conns, err)
+	}
+	unlock, err := lockDest(rs.dest)
+	if err != nil {
+		return abortReceive(rs.conns, err)
+	}
+	defer unlock()
+	if err := rs.runInitial(ctx); err != nil {
+		return err
+	}
+	if rs.opt.Watch != nil {
+		return rs.watch(ctx)
+	}
+	return nil
+}
+
+// runInitial performs the transfer of the whole tree.
+func (rs *ReceiveSession) runInitial(ctx context.Context) error {
+	if rs.opt.DryRun != nil {
+		// nothing is written
+		return rs.r.run(ctx)
+	}
+	if rs.opt.Atomic {
+		return rs.runAtomic(ctx)
+	}
+	if rs.opt.VolumeSnapshot == nil {
+		return rs.r.run(ctx)
+	}
+
+	snap, err := rs.opt.VolumeSnapshot.Snapshot(rs.dest)
+	if err != nil {
+		return abortReceive(rs.conns, errors.Wrapf(err, "failed to snapshot %s", rs.dest))
+	}
+	if err := rs.r.run(ctx); err != nil {
+		if err2 := snap.Rollback(); err2 != nil {
+			return errors.Wrapf(err, "rollback failed: %v", err2)
+		}
+		return err
+	}
+	return snap.Release()
+}
+
+// Stats returns the counters of the transfer.
+func (rs *ReceiveSession) Stats() TransferStats {
+	return rs.r.stats.snapshot()
+}
+
+// Shutdown stops the session from accepting new files and waits for the
+// writes already in flight to finish. If ctx is done first, the remaining
+// writes are aborted, their partial files are removed and ctx.Err() is
+// returned together with the report. Shutdown can be called before Run, in
+// which case the transfer never starts.
+func (rs *ReceiveSession) Shutdown(ctx context.Context) (*ShutdownReport, error) {
+	rs.r.shutdownOnce.Do(func() {
+		close(rs.r.shutdown)
+	})
+
+	rs.mu.Lock()
+	started := rs.started
+	rs.mu.Unlock()
+	if !started {
+		return rs.r.report(), nil
+	}
+
+	var err error
+	select {
+	case <-rs.done:
+	case <-ctx.Done():
+		rs.r.abortWrites()
+		<-rs.done
+		err = ctx.Err()
+	}
+	if err == nil && rs.err != ErrShutdown {
+		err = rs.err
+	}
+	return rs.r.report(), err
+}
+
+// drain waits for the writes that were in flight when the receive was shut
+// down and ends the session with the senders.
+func (r *receiver) drain(dw *DiskWriter) error {
+	if err := dw.Wait(); err != nil && errors.Cause(err) != ErrShutdown {
+		return err
+	}
+	for _, s := range r.peers {
+		if err := s.conn.SendMsg(&Packet{Type: PACKET_FIN}); err != nil {
+			return err
+		}
+	}
+	return ErrShutdown
+}
+
+// abortWrites interrupts all file transfers in progress.
+func (r *receiver) abortWrites() {
+	r.abortOnce.Do(func() {
+		close(r.abort)
+		r.closePipes(ErrShutdown)
+	})
+}
+
+func (r *receiver) aborted() bool {
+	select {
+	case <-r.abort:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *receiver) report() *ShutdownReport {
+	r.abortedMu.Lock()
+	aborted := append([]string(nil), r.abortedFiles...)
+	r.abortedMu.Unlock()
+	sort.Strings(aborted)
+	return &ShutdownReport{
+		Changes: int(atomic.LoadInt64(&r.changes)),
+		Files:   int(atomic.LoadInt64(&r.stats.files)),
+		Aborted: aborted,
+	}
+}
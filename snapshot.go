@@ -0,0 +1,431 @@
+package fsutil
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// SnapshotExt is the file extension used for snapshots saved with Save.
+const SnapshotExt = ".fssnap"
+
+const snapshotMagic = "fsutil-snapshot-v1\n"
+
+// Snapshot is a record of the metadata of a directory tree together with the
+// content hashes of its files. Snapshots can be stored in a compact file and
+// later used as the base for computing changes of the tree.
+type Snapshot struct {
+	Created time.Time
+	Root    string
+	Entries []*SnapshotEntry
+}
+
+// SnapshotEntry is a single file of a snapshot. Entries are stored in walk
+// order.
+type SnapshotEntry struct {
+	*Stat
+	// Digest is the hex encoded tarsum hash of the entry, the same value
+	// that is reported to the NotifyHashed callback of a receiver.
+	Digest string
+}
+
+// SnapshotInfo describes a stored snapshot.
+type SnapshotInfo struct {
+	Path    string
+	Created time.Time
+	Root    string
+	Entries int
+	// Size is the total size of the regular files in the snapshot.
+	Size int64
+}
+
+// TakeSnapshot walks root and records all entries accepted by opt.
+func TakeSnapshot(ctx context.Context, root string, opt *WalkOpt) (*Snapshot, error) {
+	s := &Snapshot{Created: time.Now(), Root: root}
+	err := Walk(ctx, root, opt, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		stat, ok := fi.Sys().(*Stat)
+		if !ok {
+			return errors.Errorf("invalid fileinfo without stat info: %s", p)
+		}
+		dgst, err := hashFile(filepath.Join(root, p), fi)
+		if err != nil {
+			return err
+		}
+		s.Entries = append(s.Entries, &SnapshotEntry{Stat: stat, Digest: dgst})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func hashFile(p string, fi os.FileInfo) (string, error) {
+	return hashContents(fi, func() (io.ReadCloser, error) {
+		return os.Open(p)
+	})
+}
+
+// hashContents returns the digest of an entry. The contents of regular files
+// are read from the reader returned by open.
+func hashContents(fi os.FileInfo, open func() (io.ReadCloser, error)) (string, error) {
+	return hashContentsWithAlgorithm(fi, SHA256, open)
+}
+
+func hashContentsWithAlgorithm(fi os.FileInfo, alg HashAlgorithm, open func() (io.ReadCloser, error)) (string, error) {
+	h, err := NewTarsumHashWithAlgorithm(fi, alg)
+	if err != nil {
+		return "", err
+	}
+	stat := fi.Sys().(*Stat)
+	if fi.Mode().IsRegular() && stat.Linkname == "" {
+		f, err := open()
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		if _, err := io.Copy(h, f); err != nil {
+			return "", errors.Wrapf(err, "failed to hash %s", stat.Path)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// TreeDigest returns a digest of all entries in the snapshot. Two trees with
+// the same digest have the same files, metadata and contents, ignoring
+// modification times.
+func (s *Snapshot) TreeDigest() string {
+	h := sha256.New()
+	for _, e := range s.Entries {
+		fmt.Fprintf(h, "%s\x00%s\n", e.Path, e.Digest)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// TreeDigest computes the digest of the directory at root. Computing it
+// requires hashing all files, so callers that want to skip unchanged
+// transfers should store it together with the tree.
+func TreeDigest(ctx context.Context, root string, opt *WalkOpt) (string, error) {
+	s, err := TakeSnapshot(ctx, root, opt)
+	if err != nil {
+		return "", err
+	}
+	return s.TreeDigest(), nil
+}
+
+// Info returns the summary of the snapshot.
+func (s *Snapshot) Info() SnapshotInfo {
+	si := SnapshotInfo{Created: s.Created, Root: s.Root, Entries: len(s.Entries)}
+	for _, e := range s.Entries {
+		if os.FileMode(e.Mode).IsRegular() && e.Linkname == "" {
+			si.Size += e.Size_
+		}
+	}
+	return si
+}
+
+// Walk calls fn for every entry of the snapshot. The passed FileInfo
+// implements Hashed.
+func (s *Snapshot) Walk(ctx context.Context, fn func(string, os.FileInfo, error) error) error {
+	for _, e := range s.Entries {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if err := fn(e.Path, &snapshotFileInfo{StatInfo: &StatInfo{e.Stat}, digest: e.Digest}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Changes calls changeFn for the differences between the snapshot and the
+// current state of the directory at root.
+func (s *Snapshot) Changes(ctx context.Context, root string, opt *WalkOpt, changeFn ChangeFunc) error {
+	return doubleWalkDiff(ctx, changeFn, s.walkerFn(), walkerFnWithOpt(root, opt))
+}
+
+func (s *Snapshot) walkerFn() walkerFn {
+	return func(ctx context.Context, pathC chan<- *currentPath) error {
+		return s.Walk(ctx, func(p string, fi os.FileInfo, err error) error {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case pathC <- &currentPath{path: p, f: fi}:
+				return nil
+			}
+		})
+	}
+}
+
+func walkerFnWithOpt(root string, opt *WalkOpt) walkerFn {
+	return func(ctx context.Context, pathC chan<- *currentPath) error {
+		return Walk(ctx, root, opt, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case pathC <- &currentPath{path: p, f: fi}:
+				return nil
+			}
+		})
+	}
+}
+
+type snapshotFileInfo struct {
+	*StatInfo
+	digest string
+}
+
+func (fi *snapshotFileInfo) Hash() string {
+	return fi.digest
+}
+
+func (fi *snapshotFileInfo) SetHash(s string) {
+	fi.digest = s
+}
+
+// WriteTo writes the snapshot to w in its compressed binary form.
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	gw := gzip.NewWriter(cw)
+	bw := bufio.NewWriter(gw)
+
+	if _, err := bw.WriteString(snapshotMagic); err != nil {
+		return cw.n, err
+	}
+	writeVarint(bw, s.Created.UnixNano())
+	writeBytes(bw, []byte(s.Root))
+	writeVarint(bw, int64(len(s.Entries)))
+	for _, e := range s.Entries {
+		dt, err := e.Stat.Marshal()
+		if err != nil {
+			return cw.n, err
+		}
+		writeBytes(bw, dt)
+		dgst, err := hex.DecodeString(e.Digest)
+		if err != nil {
+			return cw.n, errors.Wrapf(err, "invalid digest for %s", e.Path)
+		}
+		writeBytes(bw, dgst)
+	}
+	if err := bw.Flush(); err != nil {
+		return cw.n, err
+	}
+	if err := gw.Close(); err != nil {
+		return cw.n, err
+	}
+	return cw.n, nil
+}
+
+// Save stores the snapshot in file. The file is replaced atomically.
+func (s *Snapshot) Save(file string) error {
+	f, err := ioutil.TempFile(filepath.Dir(file), ".tmp-snapshot")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := s.WriteTo(f); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "failed to write snapshot %s", file)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
+
+// ReadSnapshot reads a snapshot written with WriteTo.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid snapshot")
+	}
+	br := bufio.NewReader(gr)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != snapshotMagic {
+		return nil, errors.New("invalid snapshot header")
+	}
+
+	s := &Snapshot{}
+	created, err := binary.ReadVarint(br)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid snapshot")
+	}
+	s.Created = time.Unix(0, created)
+	root, err := readBytes(br)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid snapshot")
+	}
+	s.Root = string(root)
+	n, err := binary.ReadVarint(br)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid snapshot")
+	}
+	for i := int64(0); i < n; i++ {
+		dt, err := readBytes(br)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid snapshot entry")
+		}
+		stat := &Stat{}
+		if err := stat.Unmarshal(dt); err != nil {
+			return nil, errors.Wrap(err, "invalid snapshot entry")
+		}
+		dgst, err := readBytes(br)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid snapshot entry")
+		}
+		s.Entries = append(s.Entries, &SnapshotEntry{Stat: stat, Digest: hex.EncodeToString(dgst)})
+	}
+	return s, nil
+}
+
+// LoadSnapshot reads a snapshot stored with Save.
+func LoadSnapshot(file string) (*Snapshot, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s, err := ReadSnapshot(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", file)
+	}
+	return s, nil
+}
+
+// ListSnapshots returns the snapshots stored in dir, oldest first.
+func ListSnapshots(dir string) ([]SnapshotInfo, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []SnapshotInfo
+	for _, fi := range fis {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), SnapshotExt) {
+			continue
+		}
+		p := filepath.Join(dir, fi.Name())
+		s, err := LoadSnapshot(p)
+		if err != nil {
+			return nil, err
+		}
+		si := s.Info()
+		si.Path = p
+		out = append(out, si)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Created.Before(out[j].Created)
+	})
+	return out, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(dt []byte) (int, error) {
+	n, err := cw.w.Write(dt)
+	cw.n += int64(n)
+	return n, err
+}
+
+// errors of these are reported by the final Flush of the bufio.Writer
+func writeVarint(w *bufio.Writer, v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutVarint(buf[:], v)])
+}
+
+func writeBytes(w *bufio.Writer, dt []byte) {
+	writeVarint(w, int64(len(dt)))
+	w.Write(dt)
+}
+
+func readBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n > 1<<20 {
+		return nil, errors.Errorf("invalid record length %d", n)
+	}
+	dt := make([]byte, n)
+	if _, err := io.ReadFull(r, dt); err != nil {
+		return nil, err
+	}
+	return dt, nil
+}
+
+// Drift lists the differences between a snapshot and a directory found by
+// Verify.
+type Drift struct {
+	// Changed are paths whose metadata or contents differ from the snapshot.
+	Changed []string
+	// Missing are paths of the snapshot that don't exist anymore.
+	Missing []string
+	// Extra are paths that are not part of the snapshot.
+	Extra []string
+}
+
+// Clean returns true if no differences were found.
+func (d *Drift) Clean() bool {
+	return len(d.Changed) == 0 && len(d.Missing) == 0 && len(d.Extra) == 0
+}
+
+// Verify compares the directory at root with the snapshot. Unlike Changes it
+// hashes the contents of every file, so modifications that preserved the size
+// and modification time are detected as well. Modification times themselves
+// are not compared.
+func (s *Snapshot) Verify(ctx context.Context, root string, opt *WalkOpt) (*Drift, error) {
+	d := &Drift{}
+	i := 0
+	err := Walk(ctx, root, opt, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		for i < len(s.Entries) && comparePath(s.Entries[i].Path, p) < 0 {
+			d.Missing = append(d.Missing, s.Entries[i].Path)
+			i++
+		}
+		if i == len(s.Entries) || s.Entries[i].Path != p {
+			d.Extra = append(d.Extra, p)
+			return nil
+		}
+		dgst, err := hashFile(filepath.Join(root, p), fi)
+		if err != nil {
+			return err
+		}
+		if dgst != s.Entries[i].Digest {
+			d.Changed = append(d.Changed, p)
+		}
+		i++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for ; i < len(s.Entries); i++ {
+		d.Missing = append(d.Missing, s.Entries[i].Path)
+	}
+	return d, nil
+}
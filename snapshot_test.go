@@ -0,0 +1,145 @@
+package fsutil
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestSnapshot(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+		"ADD foo dir",
+		"ADD foo/baz file data2",
+		"ADD foo/link symlink ../bar",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	s, err := TakeSnapshot(context.Background(), d, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(s.Entries))
+	assert.Equal(t, "foo/baz", s.Entries[2].Path)
+	assert.Equal(t, 64, len(s.Entries[2].Digest))
+
+	buf := &bytes.Buffer{}
+	n, err := s.WriteTo(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+
+	s2, err := ReadSnapshot(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, s.Created.UnixNano(), s2.Created.UnixNano())
+	assert.Equal(t, s.Root, s2.Root)
+	assert.Equal(t, len(s.Entries), len(s2.Entries))
+	for i := range s.Entries {
+		assert.Equal(t, s.Entries[i].Digest, s2.Entries[i].Digest)
+		assert.True(t, s.Entries[i].Stat.Equal(s2.Entries[i].Stat))
+	}
+
+	b := &bytes.Buffer{}
+	err = s2.Walk(context.Background(), bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `file bar
+dir foo
+file foo/baz
+symlink:../bar foo/link
+`, string(b.Bytes()))
+
+	snapdir, err := ioutil.TempDir("", "snapshots")
+	assert.NoError(t, err)
+	defer os.RemoveAll(snapdir)
+
+	err = s.Save(filepath.Join(snapdir, "a"+SnapshotExt))
+	assert.NoError(t, err)
+
+	err = ioutil.WriteFile(filepath.Join(d, "foo/baz"), []byte("data3"), 0600)
+	assert.NoError(t, err)
+	err = os.Remove(filepath.Join(d, "bar"))
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(d, "foo/new"), []byte("data4"), 0600)
+	assert.NoError(t, err)
+
+	s3, err := TakeSnapshot(context.Background(), d, nil)
+	assert.NoError(t, err)
+	err = s3.Save(filepath.Join(snapdir, "b"+SnapshotExt))
+	assert.NoError(t, err)
+
+	infos, err := ListSnapshots(snapdir)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(infos))
+	assert.Equal(t, filepath.Join(snapdir, "a"+SnapshotExt), infos[0].Path)
+	assert.Equal(t, 4, infos[0].Entries)
+	assert.Equal(t, int64(10), infos[0].Size)
+	assert.Equal(t, int64(10), infos[1].Size)
+
+	s4, err := LoadSnapshot(infos[0].Path)
+	assert.NoError(t, err)
+
+	b = &bytes.Buffer{}
+	err = s4.Changes(context.Background(), d, nil, changeLog(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `DEL bar
+CHG foo/baz
+ADD foo/new
+`, string(b.Bytes()))
+}
+
+func changeLog(b *bytes.Buffer) ChangeFunc {
+	return func(kind ChangeKind, p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		k := map[ChangeKind]string{ChangeKindAdd: "ADD", ChangeKindModify: "CHG", ChangeKindDelete: "DEL"}[kind]
+		fmt.Fprintf(b, "%s %s\n", k, p)
+		return nil
+	}
+}
+
+func TestSnapshotVerify(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+		"ADD foo dir",
+		"ADD foo/baz file data2",
+		"ADD foo/link symlink ../bar",
+		"ADD zzz dir",
+		"ADD zzz/a file data3",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	s, err := TakeSnapshot(context.Background(), d, nil)
+	assert.NoError(t, err)
+
+	drift, err := s.Verify(context.Background(), d, nil)
+	assert.NoError(t, err)
+	assert.True(t, drift.Clean())
+
+	// same size and modification time
+	fi, err := os.Stat(filepath.Join(d, "foo/baz"))
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(d, "foo/baz"), []byte("data9"), 0600)
+	assert.NoError(t, err)
+	err = os.Chtimes(filepath.Join(d, "foo/baz"), fi.ModTime(), fi.ModTime())
+	assert.NoError(t, err)
+
+	err = os.Chmod(filepath.Join(d, "bar"), 0700)
+	assert.NoError(t, err)
+	err = os.RemoveAll(filepath.Join(d, "zzz"))
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(d, "foo/new"), []byte("data4"), 0600)
+	assert.NoError(t, err)
+
+	drift, err = s.Verify(context.Background(), d, nil)
+	assert.NoError(t, err)
+	assert.False(t, drift.Clean())
+	assert.Equal(t, []string{"bar", "foo/baz"}, drift.Changed)
+	assert.Equal(t, []string{"zzz", "zzz/a"}, drift.Missing)
+	assert.Equal(t, []string{"foo/new"}, drift.Extra)
+}
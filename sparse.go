@@ -0,0 +1,76 @@
+package fsutil
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// sparseBlockSize is the size of the runs of zeros that are left as holes
+// when writing sparse files.
+const sparseBlockSize = 4096
+
+var zeroBuf = make([]byte, 32*1<<10)
+
+// writeZeros writes n zero bytes to w.
+func writeZeros(w io.Writer, n int64) error {
+	for n > 0 {
+		b := zeroBuf
+		if n < int64(len(b)) {
+			b = b[:n]
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		n -= int64(len(b))
+	}
+	return nil
+}
+
+// zeroPrefix returns the length of the blocks of zeros at the start of dt. A
+// shorter block at the end of dt is included if it only has zeros as well.
+func zeroPrefix(dt []byte) int {
+	var n int
+	for n < len(dt) {
+		end := n + sparseBlockSize
+		if end > len(dt) {
+			end = len(dt)
+		}
+		if !bytes.Equal(dt[n:end], zeroBuf[:end-n]) {
+			break
+		}
+		n = end
+	}
+	return n
+}
+
+// writeSparse writes dt to the file, seeking over the blocks of zeros
+// instead of writing them.
+func (lfw *lazyFileWriter) writeSparse(dt []byte) (int, error) {
+	var written int
+	for written < len(dt) {
+		if n := zeroPrefix(dt[written:]); n > 0 {
+			if _, err := lfw.f.Seek(int64(n), io.SeekCurrent); err != nil {
+				return written, errors.Wrapf(err, "failed to seek %s", lfw.dest)
+			}
+			lfw.hole = true
+			written += n
+			continue
+		}
+		end := written + sparseBlockSize
+		for end < len(dt) && zeroPrefix(dt[end:]) == 0 {
+			end += sparseBlockSize
+		}
+		if end > len(dt) {
+			end = len(dt)
+		}
+		n, err := lfw.f.Write(dt[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		lfw.hole = false
+	}
+	return written, nil
+}
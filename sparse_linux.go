@@ -0,0 +1,67 @@
+package fsutil
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// holesSupported is true if copySparse sends holes.
+const holesSupported = true
+
+// copySparse sends the file f from offset on, sending the holes in it with
+// fs.hole instead of reading them. r reads from f. Filesystems that can't
+// report holes fall back to sending all of the data.
+func copySparse(fs *fileSender, f *os.File, r io.Reader, offset int64, buf []byte) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	fd := int(f.Fd())
+	for pos := offset; pos < size; {
+		data, err := unix.Seek(fd, pos, unix.SEEK_DATA)
+		if err != nil {
+			if err == unix.ENXIO {
+				// no data after pos
+				return fs.hole(size - pos)
+			}
+			if err == unix.EINVAL && pos == offset {
+				_, err = io.CopyBuffer(fs, r, buf)
+				return err
+			}
+			return err
+		}
+		if data > size {
+			data = size
+		}
+		if data > pos {
+			if err := fs.hole(data - pos); err != nil {
+				return err
+			}
+			pos = data
+			continue
+		}
+		end, err := unix.Seek(fd, pos, unix.SEEK_HOLE)
+		if err != nil {
+			return err
+		}
+		if end > size {
+			end = size
+		}
+		if _, err := f.Seek(pos, io.SeekStart); err != nil {
+			return err
+		}
+		n, err := io.CopyBuffer(fs, io.LimitReader(r, end-pos), buf)
+		if err != nil {
+			return err
+		}
+		if n < end-pos {
+			// the file was truncated while it was sent
+			return nil
+		}
+		pos = end
+	}
+	return nil
+}
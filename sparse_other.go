@@ -0,0 +1,18 @@
+// +build !linux
+
+package fsutil
+
+import (
+	"io"
+	"os"
+)
+
+// holesSupported is true if copySparse sends holes.
+const holesSupported = false
+
+// copySparse sends the file from r. Holes are only detected on linux, so all
+// of the data is sent.
+func copySparse(fs *fileSender, f *os.File, r io.Reader, offset int64, buf []byte) error {
+	_, err := io.CopyBuffer(fs, r, buf)
+	return err
+}
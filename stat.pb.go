@@ -1,31 +1,19 @@
-// Code generated by protoc-gen-gogo.
+// Code generated by protoc-gen-gogo. DO NOT EDIT.
 // source: stat.proto
-// DO NOT EDIT!
 
-/*
-	Package fsutil is a generated protocol buffer package.
-
-	It is generated from these files:
-		stat.proto
-		wire.proto
-
-	It has these top-level messages:
-		Stat
-		Packet
-*/
 package fsutil
 
-import proto "github.com/gogo/protobuf/proto"
-import fmt "fmt"
-import math "math"
-
-import bytes "bytes"
-
-import strings "strings"
-import reflect "reflect"
-import github_com_gogo_protobuf_sortkeys "github.com/gogo/protobuf/sortkeys"
-
-import io "io"
+import (
+	bytes "bytes"
+	fmt "fmt"
+	proto "github.com/gogo/protobuf/proto"
+	github_com_gogo_protobuf_sortkeys "github.com/gogo/protobuf/sortkeys"
+	io "io"
+	math "math"
+	math_bits "math/bits"
+	reflect "reflect"
+	strings "strings"
+)
 
 // Reference imports to suppress errors if they are not otherwise used.
 var _ = proto.Marshal
@@ -36,25 +24,52 @@ var _ = math.Inf
 // is compatible with the proto package it is being compiled against.
 // A compilation error at this line likely means your copy of the
 // proto package needs to be updated.
-const _ = proto.GoGoProtoPackageIsVersion2 // please upgrade the proto package
+const _ = proto.GoGoProtoPackageIsVersion3 // please upgrade the proto package
 
 type Stat struct {
-	Path    string `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"`
-	Mode    uint32 `protobuf:"varint,2,opt,name=mode,proto3" json:"mode,omitempty"`
-	Uid     uint32 `protobuf:"varint,3,opt,name=uid,proto3" json:"uid,omitempty"`
-	Gid     uint32 `protobuf:"varint,4,opt,name=gid,proto3" json:"gid,omitempty"`
-	Size_   int64  `protobuf:"varint,5,opt,name=size,proto3" json:"size,omitempty"`
-	ModTime int64  `protobuf:"varint,6,opt,name=modTime,proto3" json:"modTime,omitempty"`
-	// int32 typeflag = 7;
+	Path     string            `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"`
+	Mode     uint32            `protobuf:"varint,2,opt,name=mode,proto3" json:"mode,omitempty"`
+	Uid      uint32            `protobuf:"varint,3,opt,name=uid,proto3" json:"uid,omitempty"`
+	Gid      uint32            `protobuf:"varint,4,opt,name=gid,proto3" json:"gid,omitempty"`
+	Size_    int64             `protobuf:"varint,5,opt,name=size,proto3" json:"size,omitempty"`
+	ModTime  int64             `protobuf:"varint,6,opt,name=modTime,proto3" json:"modTime,omitempty"`
 	Linkname string            `protobuf:"bytes,7,opt,name=linkname,proto3" json:"linkname,omitempty"`
 	Devmajor int64             `protobuf:"varint,8,opt,name=devmajor,proto3" json:"devmajor,omitempty"`
 	Devminor int64             `protobuf:"varint,9,opt,name=devminor,proto3" json:"devminor,omitempty"`
-	Xattrs   map[string][]byte `protobuf:"bytes,10,rep,name=xattrs" json:"xattrs,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Xattrs   map[string][]byte `protobuf:"bytes,10,rep,name=xattrs,proto3" json:"xattrs,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
 }
 
-func (m *Stat) Reset()                    { *m = Stat{} }
-func (*Stat) ProtoMessage()               {}
-func (*Stat) Descriptor() ([]byte, []int) { return fileDescriptorStat, []int{0} }
+func (m *Stat) Reset()      { *m = Stat{} }
+func (*Stat) ProtoMessage() {}
+func (*Stat) Descriptor() ([]byte, []int) {
+	return fileDescriptor_01fabdc1b78bd68b, []int{0}
+}
+func (m *Stat) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *Stat) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_Stat.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *Stat) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Stat.Merge(m, src)
+}
+func (m *Stat) XXX_Size() int {
+	return m.Size()
+}
+func (m *Stat) XXX_DiscardUnknown() {
+	xxx_messageInfo_Stat.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Stat proto.InternalMessageInfo
 
 func (m *Stat) GetPath() string {
 	if m != nil {
@@ -128,13 +143,38 @@ func (m *Stat) GetXattrs() map[string][]byte {
 
 func init() {
 	proto.RegisterType((*Stat)(nil), "fsutil.Stat")
+	proto.RegisterMapType((map[string][]byte)(nil), "fsutil.Stat.XattrsEntry")
+}
+
+func init() { proto.RegisterFile("stat.proto", fileDescriptor_01fabdc1b78bd68b) }
+
+var fileDescriptor_01fabdc1b78bd68b = []byte{
+	// 306 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x4c, 0x91, 0xb1, 0x4e, 0xf3, 0x30,
+	0x14, 0x85, 0x73, 0x9b, 0x36, 0x6d, 0xdd, 0xff, 0x97, 0x90, 0xc5, 0x70, 0xd5, 0xe1, 0x2a, 0x62,
+	0xca, 0x14, 0x21, 0x60, 0x00, 0x46, 0x24, 0x5e, 0x20, 0x30, 0xb0, 0x1a, 0x25, 0x14, 0xd3, 0x26,
+	0xae, 0x12, 0xb7, 0xa2, 0x4c, 0x3c, 0x02, 0x8f, 0xc1, 0x6b, 0xb0, 0x31, 0x76, 0xec, 0x48, 0x9d,
+	0x85, 0xb1, 0x8f, 0x80, 0xec, 0xb4, 0x85, 0xed, 0x9c, 0xef, 0xf8, 0xca, 0x3a, 0xf7, 0x32, 0x56,
+	0x69, 0xa1, 0xe3, 0x69, 0xa9, 0xb4, 0xe2, 0xc1, 0x43, 0x35, 0xd3, 0x72, 0x72, 0xf4, 0xd1, 0x62,
+	0xed, 0x1b, 0x2d, 0x34, 0xe7, 0xac, 0x3d, 0x15, 0xfa, 0x11, 0x21, 0x84, 0xa8, 0x9f, 0x38, 0x6d,
+	0x59, 0xae, 0xd2, 0x0c, 0x5b, 0x21, 0x44, 0xff, 0x13, 0xa7, 0xf9, 0x01, 0xf3, 0x67, 0x32, 0x45,
+	0xdf, 0x21, 0x2b, 0x2d, 0x19, 0xc9, 0x14, 0xdb, 0x0d, 0x19, 0xc9, 0xd4, 0xce, 0x55, 0xf2, 0x25,
+	0xc3, 0x4e, 0x08, 0x91, 0x9f, 0x38, 0xcd, 0x91, 0x75, 0x73, 0x95, 0xde, 0xca, 0x3c, 0xc3, 0xc0,
+	0xe1, 0x9d, 0xe5, 0x43, 0xd6, 0x9b, 0xc8, 0x62, 0x5c, 0x88, 0x3c, 0xc3, 0xae, 0xfb, 0x7d, 0xef,
+	0x6d, 0x96, 0x66, 0xf3, 0x5c, 0x3c, 0xa9, 0x12, 0x7b, 0x6e, 0x6c, 0xef, 0x77, 0x99, 0x2c, 0x54,
+	0x89, 0xfd, 0xdf, 0xcc, 0x7a, 0x7e, 0xcc, 0x82, 0x67, 0xa1, 0x75, 0x59, 0x21, 0x0b, 0xfd, 0x68,
+	0x70, 0x82, 0x71, 0xd3, 0x37, 0xb6, 0x5d, 0xe3, 0x3b, 0x17, 0x5d, 0x17, 0xba, 0x5c, 0x24, 0xdb,
+	0x77, 0xc3, 0x0b, 0x36, 0xf8, 0x83, 0x6d, 0xa9, 0x71, 0xb6, 0xd8, 0x6e, 0xc3, 0x4a, 0x7e, 0xc8,
+	0x3a, 0x73, 0x31, 0x99, 0x35, 0xdb, 0xf8, 0x97, 0x34, 0xe6, 0xb2, 0x75, 0x0e, 0x57, 0x67, 0xcb,
+	0x35, 0x79, 0xab, 0x35, 0x79, 0x9b, 0x35, 0xc1, 0xab, 0x21, 0x78, 0x37, 0x04, 0x9f, 0x86, 0x60,
+	0x69, 0x08, 0xbe, 0x0c, 0xc1, 0xb7, 0x21, 0x6f, 0x63, 0x08, 0xde, 0x6a, 0xf2, 0x96, 0x35, 0x79,
+	0xab, 0x9a, 0xbc, 0xfb, 0xc0, 0x1d, 0xe2, 0xf4, 0x67, 0x00, 0xbc, 0x6a, 0x0c, 0x82, 0x96, 0x01,
+	0x00, 0x00,
 }
+
 func (this *Stat) Equal(that interface{}) bool {
 	if that == nil {
-		if this == nil {
-			return true
-		}
-		return false
+		return this == nil
 	}
 
 	that1, ok := that.(*Stat)
@@ -147,10 +187,7 @@ func (this *Stat) Equal(that interface{}) bool {
 		}
 	}
 	if that1 == nil {
-		if this == nil {
-			return true
-		}
-		return false
+		return this == nil
 	} else if this == nil {
 		return false
 	}
@@ -233,7 +270,7 @@ func valueToGoStringStat(v interface{}, typ string) string {
 func (m *Stat) Marshal() (dAtA []byte, err error) {
 	size := m.Size()
 	dAtA = make([]byte, size)
-	n, err := m.MarshalTo(dAtA)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
 	if err != nil {
 		return nil, err
 	}
@@ -241,111 +278,103 @@ func (m *Stat) Marshal() (dAtA []byte, err error) {
 }
 
 func (m *Stat) MarshalTo(dAtA []byte) (int, error) {
-	var i int
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *Stat) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
 	_ = i
 	var l int
 	_ = l
-	if len(m.Path) > 0 {
-		dAtA[i] = 0xa
-		i++
-		i = encodeVarintStat(dAtA, i, uint64(len(m.Path)))
-		i += copy(dAtA[i:], m.Path)
-	}
-	if m.Mode != 0 {
-		dAtA[i] = 0x10
-		i++
-		i = encodeVarintStat(dAtA, i, uint64(m.Mode))
+	if len(m.Xattrs) > 0 {
+		for k := range m.Xattrs {
+			v := m.Xattrs[k]
+			baseI := i
+			if len(v) > 0 {
+				i -= len(v)
+				copy(dAtA[i:], v)
+				i = encodeVarintStat(dAtA, i, uint64(len(v)))
+				i--
+				dAtA[i] = 0x12
+			}
+			i -= len(k)
+			copy(dAtA[i:], k)
+			i = encodeVarintStat(dAtA, i, uint64(len(k)))
+			i--
+			dAtA[i] = 0xa
+			i = encodeVarintStat(dAtA, i, uint64(baseI-i))
+			i--
+			dAtA[i] = 0x52
+		}
 	}
-	if m.Uid != 0 {
-		dAtA[i] = 0x18
-		i++
-		i = encodeVarintStat(dAtA, i, uint64(m.Uid))
+	if m.Devminor != 0 {
+		i = encodeVarintStat(dAtA, i, uint64(m.Devminor))
+		i--
+		dAtA[i] = 0x48
 	}
-	if m.Gid != 0 {
-		dAtA[i] = 0x20
-		i++
-		i = encodeVarintStat(dAtA, i, uint64(m.Gid))
+	if m.Devmajor != 0 {
+		i = encodeVarintStat(dAtA, i, uint64(m.Devmajor))
+		i--
+		dAtA[i] = 0x40
 	}
-	if m.Size_ != 0 {
-		dAtA[i] = 0x28
-		i++
-		i = encodeVarintStat(dAtA, i, uint64(m.Size_))
+	if len(m.Linkname) > 0 {
+		i -= len(m.Linkname)
+		copy(dAtA[i:], m.Linkname)
+		i = encodeVarintStat(dAtA, i, uint64(len(m.Linkname)))
+		i--
+		dAtA[i] = 0x3a
 	}
 	if m.ModTime != 0 {
-		dAtA[i] = 0x30
-		i++
 		i = encodeVarintStat(dAtA, i, uint64(m.ModTime))
+		i--
+		dAtA[i] = 0x30
 	}
-	if len(m.Linkname) > 0 {
-		dAtA[i] = 0x3a
-		i++
-		i = encodeVarintStat(dAtA, i, uint64(len(m.Linkname)))
-		i += copy(dAtA[i:], m.Linkname)
+	if m.Size_ != 0 {
+		i = encodeVarintStat(dAtA, i, uint64(m.Size_))
+		i--
+		dAtA[i] = 0x28
 	}
-	if m.Devmajor != 0 {
-		dAtA[i] = 0x40
-		i++
-		i = encodeVarintStat(dAtA, i, uint64(m.Devmajor))
+	if m.Gid != 0 {
+		i = encodeVarintStat(dAtA, i, uint64(m.Gid))
+		i--
+		dAtA[i] = 0x20
 	}
-	if m.Devminor != 0 {
-		dAtA[i] = 0x48
-		i++
-		i = encodeVarintStat(dAtA, i, uint64(m.Devminor))
+	if m.Uid != 0 {
+		i = encodeVarintStat(dAtA, i, uint64(m.Uid))
+		i--
+		dAtA[i] = 0x18
 	}
-	if len(m.Xattrs) > 0 {
-		for k, _ := range m.Xattrs {
-			dAtA[i] = 0x52
-			i++
-			v := m.Xattrs[k]
-			byteSize := 0
-			if len(v) > 0 {
-				byteSize = 1 + len(v) + sovStat(uint64(len(v)))
-			}
-			mapSize := 1 + len(k) + sovStat(uint64(len(k))) + byteSize
-			i = encodeVarintStat(dAtA, i, uint64(mapSize))
-			dAtA[i] = 0xa
-			i++
-			i = encodeVarintStat(dAtA, i, uint64(len(k)))
-			i += copy(dAtA[i:], k)
-			if len(v) > 0 {
-				dAtA[i] = 0x12
-				i++
-				i = encodeVarintStat(dAtA, i, uint64(len(v)))
-				i += copy(dAtA[i:], v)
-			}
-		}
+	if m.Mode != 0 {
+		i = encodeVarintStat(dAtA, i, uint64(m.Mode))
+		i--
+		dAtA[i] = 0x10
 	}
-	return i, nil
+	if len(m.Path) > 0 {
+		i -= len(m.Path)
+		copy(dAtA[i:], m.Path)
+		i = encodeVarintStat(dAtA, i, uint64(len(m.Path)))
+		i--
+		dAtA[i] = 0xa
+	}
+	return len(dAtA) - i, nil
 }
 
-func encodeFixed64Stat(dAtA []byte, offset int, v uint64) int {
-	dAtA[offset] = uint8(v)
-	dAtA[offset+1] = uint8(v >> 8)
-	dAtA[offset+2] = uint8(v >> 16)
-	dAtA[offset+3] = uint8(v >> 24)
-	dAtA[offset+4] = uint8(v >> 32)
-	dAtA[offset+5] = uint8(v >> 40)
-	dAtA[offset+6] = uint8(v >> 48)
-	dAtA[offset+7] = uint8(v >> 56)
-	return offset + 8
-}
-func encodeFixed32Stat(dAtA []byte, offset int, v uint32) int {
-	dAtA[offset] = uint8(v)
-	dAtA[offset+1] = uint8(v >> 8)
-	dAtA[offset+2] = uint8(v >> 16)
-	dAtA[offset+3] = uint8(v >> 24)
-	return offset + 4
-}
 func encodeVarintStat(dAtA []byte, offset int, v uint64) int {
+	offset -= sovStat(v)
+	base := offset
 	for v >= 1<<7 {
 		dAtA[offset] = uint8(v&0x7f | 0x80)
 		v >>= 7
 		offset++
 	}
 	dAtA[offset] = uint8(v)
-	return offset + 1
+	return base
 }
 func (m *Stat) Size() (n int) {
+	if m == nil {
+		return 0
+	}
 	var l int
 	_ = l
 	l = len(m.Path)
@@ -393,14 +422,7 @@ func (m *Stat) Size() (n int) {
 }
 
 func sovStat(x uint64) (n int) {
-	for {
-		n++
-		x >>= 7
-		if x == 0 {
-			break
-		}
-	}
-	return n
+	return (math_bits.Len64(x|1) + 6) / 7
 }
 func sozStat(x uint64) (n int) {
 	return sovStat(uint64((x << 1) ^ uint64((int64(x) >> 63))))
@@ -457,7 +479,7 @@ func (m *Stat) Unmarshal(dAtA []byte) error {
 			}
 			b := dAtA[iNdEx]
 			iNdEx++
-			wire |= (uint64(b) & 0x7F) << shift
+			wire |= uint64(b&0x7F) << shift
 			if b < 0x80 {
 				break
 			}
@@ -485,7 +507,7 @@ func (m *Stat) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				stringLen |= (uint64(b) & 0x7F) << shift
+				stringLen |= uint64(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
@@ -495,6 +517,9 @@ func (m *Stat) Unmarshal(dAtA []byte) error {
 				return ErrInvalidLengthStat
 			}
 			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthStat
+			}
 			if postIndex > l {
 				return io.ErrUnexpectedEOF
 			}
@@ -514,7 +539,7 @@ func (m *Stat) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Mode |= (uint32(b) & 0x7F) << shift
+				m.Mode |= uint32(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
@@ -533,7 +558,7 @@ func (m *Stat) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Uid |= (uint32(b) & 0x7F) << shift
+				m.Uid |= uint32(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
@@ -552,7 +577,7 @@ func (m *Stat) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Gid |= (uint32(b) & 0x7F) << shift
+				m.Gid |= uint32(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
@@ -571,7 +596,7 @@ func (m *Stat) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Size_ |= (int64(b) & 0x7F) << shift
+				m.Size_ |= int64(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
@@ -590,7 +615,7 @@ func (m *Stat) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.ModTime |= (int64(b) & 0x7F) << shift
+				m.ModTime |= int64(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
@@ -609,7 +634,7 @@ func (m *Stat) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				stringLen |= (uint64(b) & 0x7F) << shift
+				stringLen |= uint64(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
@@ -619,6 +644,9 @@ func (m *Stat) Unmarshal(dAtA []byte) error {
 				return ErrInvalidLengthStat
 			}
 			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthStat
+			}
 			if postIndex > l {
 				return io.ErrUnexpectedEOF
 			}
@@ -638,7 +666,7 @@ func (m *Stat) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Devmajor |= (int64(b) & 0x7F) << shift
+				m.Devmajor |= int64(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
@@ -657,7 +685,7 @@ func (m *Stat) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Devminor |= (int64(b) & 0x7F) << shift
+				m.Devminor |= int64(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
@@ -676,7 +704,7 @@ func (m *Stat) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				msglen |= (int(b) & 0x7F) << shift
+				msglen |= int(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
@@ -685,54 +713,20 @@ func (m *Stat) Unmarshal(dAtA []byte) error {
 				return ErrInvalidLengthStat
 			}
 			postIndex := iNdEx + msglen
-			if postIndex > l {
-				return io.ErrUnexpectedEOF
-			}
-			var keykey uint64
-			for shift := uint(0); ; shift += 7 {
-				if shift >= 64 {
-					return ErrIntOverflowStat
-				}
-				if iNdEx >= l {
-					return io.ErrUnexpectedEOF
-				}
-				b := dAtA[iNdEx]
-				iNdEx++
-				keykey |= (uint64(b) & 0x7F) << shift
-				if b < 0x80 {
-					break
-				}
-			}
-			var stringLenmapkey uint64
-			for shift := uint(0); ; shift += 7 {
-				if shift >= 64 {
-					return ErrIntOverflowStat
-				}
-				if iNdEx >= l {
-					return io.ErrUnexpectedEOF
-				}
-				b := dAtA[iNdEx]
-				iNdEx++
-				stringLenmapkey |= (uint64(b) & 0x7F) << shift
-				if b < 0x80 {
-					break
-				}
-			}
-			intStringLenmapkey := int(stringLenmapkey)
-			if intStringLenmapkey < 0 {
+			if postIndex < 0 {
 				return ErrInvalidLengthStat
 			}
-			postStringIndexmapkey := iNdEx + intStringLenmapkey
-			if postStringIndexmapkey > l {
+			if postIndex > l {
 				return io.ErrUnexpectedEOF
 			}
-			mapkey := string(dAtA[iNdEx:postStringIndexmapkey])
-			iNdEx = postStringIndexmapkey
 			if m.Xattrs == nil {
 				m.Xattrs = make(map[string][]byte)
 			}
-			if iNdEx < postIndex {
-				var valuekey uint64
+			var mapkey string
+			mapvalue := []byte{}
+			for iNdEx < postIndex {
+				entryPreIndex := iNdEx
+				var wire uint64
 				for shift := uint(0); ; shift += 7 {
 					if shift >= 64 {
 						return ErrIntOverflowStat
@@ -742,42 +736,87 @@ func (m *Stat) Unmarshal(dAtA []byte) error {
 					}
 					b := dAtA[iNdEx]
 					iNdEx++
-					valuekey |= (uint64(b) & 0x7F) << shift
+					wire |= uint64(b&0x7F) << shift
 					if b < 0x80 {
 						break
 					}
 				}
-				var mapbyteLen uint64
-				for shift := uint(0); ; shift += 7 {
-					if shift >= 64 {
-						return ErrIntOverflowStat
+				fieldNum := int32(wire >> 3)
+				if fieldNum == 1 {
+					var stringLenmapkey uint64
+					for shift := uint(0); ; shift += 7 {
+						if shift >= 64 {
+							return ErrIntOverflowStat
+						}
+						if iNdEx >= l {
+							return io.ErrUnexpectedEOF
+						}
+						b := dAtA[iNdEx]
+						iNdEx++
+						stringLenmapkey |= uint64(b&0x7F) << shift
+						if b < 0x80 {
+							break
+						}
 					}
-					if iNdEx >= l {
+					intStringLenmapkey := int(stringLenmapkey)
+					if intStringLenmapkey < 0 {
+						return ErrInvalidLengthStat
+					}
+					postStringIndexmapkey := iNdEx + intStringLenmapkey
+					if postStringIndexmapkey < 0 {
+						return ErrInvalidLengthStat
+					}
+					if postStringIndexmapkey > l {
 						return io.ErrUnexpectedEOF
 					}
-					b := dAtA[iNdEx]
-					iNdEx++
-					mapbyteLen |= (uint64(b) & 0x7F) << shift
-					if b < 0x80 {
-						break
+					mapkey = string(dAtA[iNdEx:postStringIndexmapkey])
+					iNdEx = postStringIndexmapkey
+				} else if fieldNum == 2 {
+					var mapbyteLen uint64
+					for shift := uint(0); ; shift += 7 {
+						if shift >= 64 {
+							return ErrIntOverflowStat
+						}
+						if iNdEx >= l {
+							return io.ErrUnexpectedEOF
+						}
+						b := dAtA[iNdEx]
+						iNdEx++
+						mapbyteLen |= uint64(b&0x7F) << shift
+						if b < 0x80 {
+							break
+						}
 					}
+					intMapbyteLen := int(mapbyteLen)
+					if intMapbyteLen < 0 {
+						return ErrInvalidLengthStat
+					}
+					postbytesIndex := iNdEx + intMapbyteLen
+					if postbytesIndex < 0 {
+						return ErrInvalidLengthStat
+					}
+					if postbytesIndex > l {
+						return io.ErrUnexpectedEOF
+					}
+					mapvalue = make([]byte, mapbyteLen)
+					copy(mapvalue, dAtA[iNdEx:postbytesIndex])
+					iNdEx = postbytesIndex
+				} else {
+					iNdEx = entryPreIndex
+					skippy, err := skipStat(dAtA[iNdEx:])
+					if err != nil {
+						return err
+					}
+					if (skippy < 0) || (iNdEx+skippy) < 0 {
+						return ErrInvalidLengthStat
+					}
+					if (iNdEx + skippy) > postIndex {
+						return io.ErrUnexpectedEOF
+					}
+					iNdEx += skippy
 				}
-				intMapbyteLen := int(mapbyteLen)
-				if intMapbyteLen < 0 {
-					return ErrInvalidLengthStat
-				}
-				postbytesIndex := iNdEx + intMapbyteLen
-				if postbytesIndex > l {
-					return io.ErrUnexpectedEOF
-				}
-				mapvalue := make([]byte, mapbyteLen)
-				copy(mapvalue, dAtA[iNdEx:postbytesIndex])
-				iNdEx = postbytesIndex
-				m.Xattrs[mapkey] = mapvalue
-			} else {
-				var mapvalue []byte
-				m.Xattrs[mapkey] = mapvalue
 			}
+			m.Xattrs[mapkey] = mapvalue
 			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
@@ -785,7 +824,7 @@ func (m *Stat) Unmarshal(dAtA []byte) error {
 			if err != nil {
 				return err
 			}
-			if skippy < 0 {
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
 				return ErrInvalidLengthStat
 			}
 			if (iNdEx + skippy) > l {
@@ -803,6 +842,7 @@ func (m *Stat) Unmarshal(dAtA []byte) error {
 func skipStat(dAtA []byte) (n int, err error) {
 	l := len(dAtA)
 	iNdEx := 0
+	depth := 0
 	for iNdEx < l {
 		var wire uint64
 		for shift := uint(0); ; shift += 7 {
@@ -834,10 +874,8 @@ func skipStat(dAtA []byte) (n int, err error) {
 					break
 				}
 			}
-			return iNdEx, nil
 		case 1:
 			iNdEx += 8
-			return iNdEx, nil
 		case 2:
 			var length int
 			for shift := uint(0); ; shift += 7 {
@@ -854,78 +892,34 @@ func skipStat(dAtA []byte) (n int, err error) {
 					break
 				}
 			}
-			iNdEx += length
 			if length < 0 {
 				return 0, ErrInvalidLengthStat
 			}
-			return iNdEx, nil
+			iNdEx += length
 		case 3:
-			for {
-				var innerWire uint64
-				var start int = iNdEx
-				for shift := uint(0); ; shift += 7 {
-					if shift >= 64 {
-						return 0, ErrIntOverflowStat
-					}
-					if iNdEx >= l {
-						return 0, io.ErrUnexpectedEOF
-					}
-					b := dAtA[iNdEx]
-					iNdEx++
-					innerWire |= (uint64(b) & 0x7F) << shift
-					if b < 0x80 {
-						break
-					}
-				}
-				innerWireType := int(innerWire & 0x7)
-				if innerWireType == 4 {
-					break
-				}
-				next, err := skipStat(dAtA[start:])
-				if err != nil {
-					return 0, err
-				}
-				iNdEx = start + next
-			}
-			return iNdEx, nil
+			depth++
 		case 4:
-			return iNdEx, nil
+			if depth == 0 {
+				return 0, ErrUnexpectedEndOfGroupStat
+			}
+			depth--
 		case 5:
 			iNdEx += 4
-			return iNdEx, nil
 		default:
 			return 0, fmt.Errorf("proto: illegal wireType %d", wireType)
 		}
+		if iNdEx < 0 {
+			return 0, ErrInvalidLengthStat
+		}
+		if depth == 0 {
+			return iNdEx, nil
+		}
 	}
-	panic("unreachable")
+	return 0, io.ErrUnexpectedEOF
 }
 
 var (
-	ErrInvalidLengthStat = fmt.Errorf("proto: negative length found during unmarshaling")
-	ErrIntOverflowStat   = fmt.Errorf("proto: integer overflow")
+	ErrInvalidLengthStat        = fmt.Errorf("proto: negative length found during unmarshaling")
+	ErrIntOverflowStat          = fmt.Errorf("proto: integer overflow")
+	ErrUnexpectedEndOfGroupStat = fmt.Errorf("proto: unexpected end of group")
 )
-
-func init() { proto.RegisterFile("stat.proto", fileDescriptorStat) }
-
-var fileDescriptorStat = []byte{
-	// 303 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x4c, 0x91, 0xb1, 0x4e, 0xf3, 0x30,
-	0x14, 0x85, 0x73, 0x9b, 0x36, 0x6d, 0xdd, 0xff, 0x97, 0x90, 0xc5, 0x70, 0xd5, 0xc1, 0x8a, 0x98,
-	0x32, 0xa0, 0x08, 0xc1, 0x02, 0x8c, 0x48, 0xbc, 0x40, 0x60, 0x60, 0x35, 0xb2, 0x29, 0xa6, 0x4d,
-	0x5c, 0x25, 0x4e, 0x45, 0x99, 0x78, 0x04, 0x1e, 0x83, 0xd7, 0x60, 0x63, 0xec, 0xc8, 0x48, 0xcc,
-	0xc2, 0xd8, 0x47, 0x40, 0x76, 0xda, 0xc2, 0x76, 0xce, 0x77, 0x7c, 0x65, 0x9d, 0x7b, 0x09, 0xa9,
-	0x0c, 0x37, 0xe9, 0xbc, 0xd4, 0x46, 0xd3, 0xe8, 0xae, 0xaa, 0x8d, 0x9a, 0x1d, 0xbc, 0x75, 0x48,
-	0xf7, 0xca, 0x70, 0x43, 0x29, 0xe9, 0xce, 0xb9, 0xb9, 0x47, 0x88, 0x21, 0x19, 0x66, 0x5e, 0x3b,
-	0x96, 0x6b, 0x21, 0xb1, 0x13, 0x43, 0xf2, 0x3f, 0xf3, 0x9a, 0xee, 0x91, 0xb0, 0x56, 0x02, 0x43,
-	0x8f, 0x9c, 0x74, 0x64, 0xa2, 0x04, 0x76, 0x5b, 0x32, 0x51, 0xc2, 0xcd, 0x55, 0xea, 0x49, 0x62,
-	0x2f, 0x86, 0x24, 0xcc, 0xbc, 0xa6, 0x48, 0xfa, 0xb9, 0x16, 0xd7, 0x2a, 0x97, 0x18, 0x79, 0xbc,
-	0xb5, 0x74, 0x4c, 0x06, 0x33, 0x55, 0x4c, 0x0b, 0x9e, 0x4b, 0xec, 0xfb, 0xdf, 0x77, 0xde, 0x65,
-	0x42, 0x2e, 0x72, 0xfe, 0xa0, 0x4b, 0x1c, 0xf8, 0xb1, 0x9d, 0xdf, 0x66, 0xaa, 0xd0, 0x25, 0x0e,
-	0x7f, 0x33, 0xe7, 0xe9, 0x11, 0x89, 0x1e, 0xb9, 0x31, 0x65, 0x85, 0x24, 0x0e, 0x93, 0xd1, 0x31,
-	0xa6, 0x6d, 0xdf, 0xd4, 0x75, 0x4d, 0x6f, 0x7c, 0x74, 0x59, 0x98, 0x72, 0x99, 0x6d, 0xde, 0x8d,
-	0xcf, 0xc8, 0xe8, 0x0f, 0x76, 0xa5, 0xa6, 0x72, 0xb9, 0xd9, 0x86, 0x93, 0x74, 0x9f, 0xf4, 0x16,
-	0x7c, 0x56, 0xb7, 0xdb, 0xf8, 0x97, 0xb5, 0xe6, 0xbc, 0x73, 0x0a, 0x17, 0x87, 0xab, 0x86, 0x05,
-	0x1f, 0x0d, 0x0b, 0xd6, 0x0d, 0x83, 0x67, 0xcb, 0xe0, 0xd5, 0x32, 0x78, 0xb7, 0x0c, 0x56, 0x96,
-	0xc1, 0xa7, 0x65, 0xf0, 0x6d, 0x59, 0xb0, 0xb6, 0x0c, 0x5e, 0xbe, 0x58, 0x70, 0x1b, 0xf9, 0x03,
-	0x9c, 0xfc, 0x04, 0x00, 0x00, 0xff, 0xff, 0x19, 0x97, 0x14, 0xf4, 0x8e, 0x01, 0x00, 0x00,
-}
@@ -0,0 +1,120 @@
+package fsutil
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TransferStats are the counters of a running transfer.
+type TransferStats struct {
+	// Started is the time the transfer started.
+	Started time.Time
+	// Bytes is the size of all packets sent or received so far.
+	Bytes int64
+	// Files is the number of file contents transferred. A file that was
+	// transferred again is counted again.
+	Files int64
+	// FilesPending is the number of files whose contents are being
+	// transferred.
+	FilesPending int64
+	// Retries is the number of files that were transferred again.
+	Retries int64
+	// Throughput is the number of bytes per second averaged over the last
+	// few seconds.
+	Throughput float64
+}
+
+// PublishStats publishes the stats returned by fn as an expvar variable, for
+// example PublishStats("sync", session.Stats).
+func PublishStats(name string, fn func() TransferStats) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return fn()
+	}))
+}
+
+type transferStats struct {
+	started time.Time
+	bytes   int64
+	files   int64
+	pending int64
+	retries int64
+	rate    *rateCounter
+}
+
+func newTransferStats() *transferStats {
+	return &transferStats{started: time.Now(), rate: newRateCounter(time.Now)}
+}
+
+func (s *transferStats) addBytes(n int) {
+	atomic.AddInt64(&s.bytes, int64(n))
+	s.rate.add(int64(n))
+}
+
+func (s *transferStats) snapshot() TransferStats {
+	return TransferStats{
+		Started:      s.started,
+		Bytes:        atomic.LoadInt64(&s.bytes),
+		Files:        atomic.LoadInt64(&s.files),
+		FilesPending: atomic.LoadInt64(&s.pending),
+		Retries:      atomic.LoadInt64(&s.retries),
+		Throughput:   s.rate.rate(),
+	}
+}
+
+// rateWindow is the number of seconds the throughput is averaged over.
+const rateWindow = 5
+
+// rateCounter counts bytes in buckets of a second.
+type rateCounter struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	start   time.Time
+	buckets [rateWindow + 1]int64
+	last    int64
+}
+
+func newRateCounter(now func() time.Time) *rateCounter {
+	return &rateCounter{now: now, start: now()}
+}
+
+// advance moves to the bucket of the current second, clearing the ones that
+// were skipped.
+func (c *rateCounter) advance() int64 {
+	sec := int64(c.now().Sub(c.start) / time.Second)
+	if sec-c.last > int64(len(c.buckets)) {
+		c.last = sec - int64(len(c.buckets))
+	}
+	for ; c.last < sec; c.last++ {
+		c.buckets[(c.last+1)%int64(len(c.buckets))] = 0
+	}
+	return sec
+}
+
+func (c *rateCounter) add(n int64) {
+	c.mu.Lock()
+	sec := c.advance()
+	c.buckets[sec%int64(len(c.buckets))] += n
+	c.mu.Unlock()
+}
+
+// rate returns the bytes per second of the last complete seconds. The
+// current second is left out as it is still being counted.
+func (c *rateCounter) rate() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sec := c.advance()
+	n := int64(rateWindow)
+	if sec < n {
+		n = sec
+	}
+	if n == 0 {
+		return 0
+	}
+	var total int64
+	for i := int64(1); i <= n; i++ {
+		total += c.buckets[(sec-i)%int64(len(c.buckets))]
+	}
+	return float64(total) / float64(n)
+}
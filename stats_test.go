@@ -0,0 +1,35 @@
+package fsutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateCounter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := newRateCounter(func() time.Time { return now })
+
+	c.add(100)
+	assert.Equal(t, float64(0), c.rate())
+
+	now = now.Add(time.Second)
+	c.add(300)
+	assert.Equal(t, float64(100), c.rate())
+
+	now = now.Add(time.Second)
+	assert.Equal(t, float64(200), c.rate())
+
+	now = now.Add(3 * time.Second)
+	assert.Equal(t, float64(80), c.rate())
+
+	now = now.Add(rateWindow * time.Second)
+	assert.Equal(t, float64(0), c.rate())
+
+	// a long pause clears all buckets
+	c.add(50)
+	now = now.Add(time.Hour)
+	c.add(10)
+	assert.Equal(t, float64(0), c.rate())
+}
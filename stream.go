@@ -0,0 +1,97 @@
+package fsutil
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+)
+
+// Change is a single entry of a ChangeStream.
+type Change struct {
+	Kind ChangeKind
+	Path string
+	// Stat is nil for deleted entries that have no known stat.
+	Stat *Stat
+	// Open returns the current contents of a regular file. It is nil for
+	// other entries and for deletes.
+	Open func() (io.ReadCloser, error)
+}
+
+// ChangeStream delivers changes over a channel. The producer blocks while the
+// channel is full, so a slow consumer slows down the walk or transfer instead
+// of changes being buffered without limit.
+type ChangeStream struct {
+	// C is closed when the producer has finished. Err returns its error
+	// afterwards.
+	C <-chan *Change
+
+	cancel func()
+	err    error
+}
+
+// Err returns the error that ended the stream. It must only be called after C
+// was closed.
+func (s *ChangeStream) Err() error {
+	return s.err
+}
+
+// Close stops the producer and waits for it to return. Changes that were not
+// consumed are discarded.
+func (s *ChangeStream) Close() {
+	s.cancel()
+	for range s.C {
+	}
+}
+
+// newChangeStream runs a producer calling a ChangeFunc and delivers the
+// changes on a channel. File contents are opened relative to root.
+func newChangeStream(ctx context.Context, root string, run func(context.Context, ChangeFunc) error) *ChangeStream {
+	ctx, cancel := context.WithCancel(ctx)
+	c := make(chan *Change, 128)
+	s := &ChangeStream{C: c, cancel: cancel}
+	go func() {
+		defer close(c)
+		s.err = run(ctx, func(kind ChangeKind, p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			ch := &Change{Kind: kind, Path: p}
+			if fi != nil {
+				ch.Stat, _ = fi.Sys().(*Stat)
+				if kind != ChangeKindDelete && fi.Mode().IsRegular() {
+					fp := filepath.Join(root, p)
+					ch.Open = func() (io.ReadCloser, error) {
+						return os.Open(fp)
+					}
+				}
+			}
+			select {
+			case c <- ch:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	return s
+}
+
+// WalkStream walks root like Walk and delivers every entry as a
+// ChangeKindAdd change.
+func WalkStream(ctx context.Context, root string, opt *WalkOpt) *ChangeStream {
+	return newChangeStream(ctx, root, func(ctx context.Context, changeFn ChangeFunc) error {
+		return Walk(ctx, root, opt, func(p string, fi os.FileInfo, err error) error {
+			return changeFn(ChangeKindAdd, p, fi, err)
+		})
+	})
+}
+
+// ChangeStream delivers the differences between the snapshot and the current
+// state of the directory at root.
+func (s *Snapshot) ChangeStream(ctx context.Context, root string, opt *WalkOpt) *ChangeStream {
+	return newChangeStream(ctx, root, func(ctx context.Context, changeFn ChangeFunc) error {
+		return s.Changes(ctx, root, opt, changeFn)
+	})
+}
@@ -0,0 +1,237 @@
+package fsutil
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// WriteTar walks root like Send does and writes the entries to w as a tar
+// archive. Hardlinks are written as links to the first path of the file
+// that was walked. Entries that can't be represented in a tar archive, like
+// sockets, fail the write unless they are left out with opt.Unsupported.
+func WriteTar(ctx context.Context, root string, opt *WalkOpt, w io.Writer) error {
+	return writeTar(ctx, NewFS(root, opt), w)
+}
+
+// writeTar writes the entries of fs to w as a tar archive.
+func writeTar(ctx context.Context, fs FS, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	err := fs.Walk(ctx, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		stat, ok := fi.Sys().(*Stat)
+		if !ok {
+			return errors.Errorf("invalid fileinfo without stat info: %s", p)
+		}
+		hdr, err := tarHeader(stat)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create tar header for %s", p)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "failed to write tar header for %s", p)
+		}
+		if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+			return nil
+		}
+		return copyTarFile(tw, fs, p, hdr.Size)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Untar reads a tar archive from r and calls fn with a ChangeKindAdd change
+// for every entry. Directories missing from the archive are added before the
+// entries under them. For regular files the file info also implements
+// io.Reader returning the contents, which can only be read until fn returns.
+// A DiskWriter created with NewDiskWriter reads them from there.
+func Untar(ctx context.Context, r io.Reader, fn HandleChangeFn) error {
+	tr := tar.NewReader(r)
+	dirs := map[string]struct{}{}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read tar header")
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		stat, err := tarStat(hdr)
+		if err != nil {
+			return err
+		}
+		if stat.Path == "" {
+			// the root of the archive, like "./"
+			continue
+		}
+		if err := addParentDirs(stat, dirs, fn); err != nil {
+			return err
+		}
+		var fi os.FileInfo = &StatInfo{stat}
+		switch {
+		case fi.IsDir():
+			dirs[stat.Path] = struct{}{}
+		case fi.Mode().IsRegular() && stat.Linkname == "":
+			fi = &readerFileInfo{StatInfo: &StatInfo{stat}, r: tr}
+		}
+		if err := fn(ChangeKindAdd, stat.Path, fi, nil); err != nil {
+			return err
+		}
+	}
+}
+
+// readerFileInfo is the file info of a regular file whose contents are read
+// from r, like the ones passed by Untar.
+type readerFileInfo struct {
+	*StatInfo
+	r io.Reader
+}
+
+func (fi *readerFileInfo) Read(p []byte) (int, error) {
+	return fi.r.Read(p)
+}
+
+// tarStat returns the stat of a tar entry.
+func tarStat(hdr *tar.Header) (*Stat, error) {
+	p, err := tarPath(hdr.Name)
+	if err != nil {
+		return nil, err
+	}
+	fi := hdr.FileInfo()
+	stat := &Stat{
+		Path:    p,
+		Mode:    uint32(fi.Mode()),
+		Uid:     uint32(hdr.Uid),
+		Gid:     uint32(hdr.Gid),
+		ModTime: hdr.ModTime.UnixNano(),
+	}
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		stat.Size_ = hdr.Size
+	case tar.TypeLink:
+		if stat.Linkname, err = tarPath(hdr.Linkname); err != nil {
+			return nil, err
+		}
+		if stat.Linkname == "" {
+			return nil, errors.Errorf("invalid link target %q for %s", hdr.Linkname, hdr.Name)
+		}
+	case tar.TypeSymlink:
+		stat.Linkname = hdr.Linkname
+	case tar.TypeChar, tar.TypeBlock:
+		stat.Devmajor = hdr.Devmajor
+		stat.Devminor = hdr.Devminor
+	case tar.TypeDir, tar.TypeFifo:
+	default:
+		return nil, errors.Errorf("unsupported tar entry type %q for %s", hdr.Typeflag, hdr.Name)
+	}
+	if len(hdr.Xattrs) > 0 {
+		stat.Xattrs = make(map[string][]byte, len(hdr.Xattrs))
+		for k, v := range hdr.Xattrs {
+			stat.Xattrs[k] = []byte(v)
+		}
+	}
+	return stat, nil
+}
+
+// tarPath returns the cleaned path of a tar entry relative to the root of
+// the archive. Paths pointing outside of the archive are rejected.
+func tarPath(name string) (string, error) {
+	p := strings.TrimLeft(path.Clean(name), "/")
+	if p == ".." || strings.HasPrefix(p, "../") {
+		return "", errors.Errorf("invalid path %q in tar archive", name)
+	}
+	if p == "" || p == "." {
+		return "", nil
+	}
+	return filepath.FromSlash(p), nil
+}
+
+// addParentDirs adds the directories leading to stat that were not in the
+// archive.
+func addParentDirs(stat *Stat, dirs map[string]struct{}, fn HandleChangeFn) error {
+	var missing []string
+	for dir := filepath.Dir(stat.Path); dir != "."; dir = filepath.Dir(dir) {
+		if _, ok := dirs[dir]; ok {
+			break
+		}
+		missing = append(missing, dir)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		dirs[missing[i]] = struct{}{}
+		st := &Stat{
+			Path:    missing[i],
+			Mode:    uint32(os.ModeDir | 0755),
+			ModTime: stat.ModTime,
+		}
+		if err := fn(ChangeKindAdd, st.Path, &StatInfo{st}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tarHeader returns the tar header of an entry with stat.
+func tarHeader(stat *Stat) (*tar.Header, error) {
+	fi := &StatInfo{stat}
+	hdr, err := tar.FileInfoHeader(fi, stat.Linkname)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Name = filepath.ToSlash(stat.Path)
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Uid = int(stat.Uid)
+	hdr.Gid = int(stat.Gid)
+	hdr.ModTime = time.Unix(0, stat.ModTime)
+	if stat.Linkname != "" && !isSymlink(stat) {
+		hdr.Typeflag = tar.TypeLink
+		hdr.Linkname = filepath.ToSlash(stat.Linkname)
+		hdr.Size = 0
+	}
+	if hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock {
+		hdr.Devmajor = stat.Devmajor
+		hdr.Devminor = stat.Devminor
+	}
+	if len(stat.Xattrs) > 0 {
+		hdr.Xattrs = make(map[string]string, len(stat.Xattrs))
+		for k, v := range stat.Xattrs {
+			hdr.Xattrs[k] = string(v)
+		}
+	}
+	return hdr, nil
+}
+
+func copyTarFile(w io.Writer, fs FS, p string, size int64) error {
+	f, err := fs.Open(p)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", p)
+	}
+	defer f.Close()
+	// a file that grew is cut at the size that was walked
+	if _, err := io.CopyN(w, f, size); err != nil {
+		if err == io.EOF {
+			return errors.Errorf("%s changed while it was written", p)
+		}
+		return errors.Wrapf(err, "failed to copy %s", p)
+	}
+	return nil
+}
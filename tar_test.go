@@ -0,0 +1,77 @@
+package fsutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestWriteTar(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar dir",
+		"ADD bar/baz file data1",
+		"ADD bar/link file >bar/baz",
+		"ADD foo symlink bar/baz",
+		"ADD skip file data2",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	buf := &bytes.Buffer{}
+	err = WriteTar(context.Background(), d, &WalkOpt{ExcludePatterns: []string{"skip"}}, buf)
+	assert.NoError(t, err)
+
+	var out []string
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		dt, err := ioutil.ReadAll(tr)
+		assert.NoError(t, err)
+		out = append(out, fmt.Sprintf("%c %s %s %s", hdr.Typeflag, hdr.Name, hdr.Linkname, dt))
+	}
+	assert.Equal(t, []string{
+		"5 bar/  ",
+		"0 bar/baz  data1",
+		"1 bar/link bar/baz ",
+		"2 foo bar/baz ",
+	}, out)
+}
+
+func TestWriteTarEpoch(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar dir",
+		"ADD bar/baz file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	epoch := time.Unix(1500000000, 0)
+	buf := &bytes.Buffer{}
+	err = WriteTar(context.Background(), d, &WalkOpt{Filter: WithEpoch(epoch)}, buf)
+	assert.NoError(t, err)
+
+	tr := tar.NewReader(buf)
+	n := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		assert.True(t, epoch.Equal(hdr.ModTime), hdr.Name)
+		n++
+	}
+	assert.Equal(t, 2, n)
+}
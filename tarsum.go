@@ -3,13 +3,16 @@ package fsutil
 import (
 	"archive/tar"
 	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"hash"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/docker/docker/builder"
@@ -23,21 +26,81 @@ type Tarsum struct {
 	root string
 	tree *iradix.Tree
 	txn  *iradix.Txn
+	alg  *HashAlgorithm
+
+	// files without a digest are hashed in the background
+	wg  sync.WaitGroup
+	sem chan struct{}
+	seq uint64
+	// pending maps the paths being hashed to the latest hash started for
+	// them
+	pending map[string]uint64
+	err     error
+}
+
+// TarsumOpt configures a Tarsum.
+type TarsumOpt struct {
+	// HashAlgorithm is the only algorithm the digests of the changes are
+	// accepted with, see NewTarsumWithHash.
+	HashAlgorithm *HashAlgorithm
+	// MaxConcurrentHashes limits the number of files hashed at the same
+	// time. Defaults to GOMAXPROCS.
+	MaxConcurrentHashes int
 }
 
+// HashAlgorithm is the hash the digests of files are computed with. Digests
+// made with it are prefixed with its name, for example "sha512:<hex>".
+type HashAlgorithm struct {
+	Name string
+	New  func() hash.Hash
+}
+
+// SHA256 is the algorithm of digests without a prefix.
+var SHA256 = HashAlgorithm{Name: "sha256", New: sha256.New}
+
 func NewTarsum(root string) *Tarsum {
-	ts := &Tarsum{
+	return NewTarsumWithOpt(root, TarsumOpt{})
+}
+
+// NewTarsumWithHash returns a Tarsum that only accepts files hashed with alg.
+// The DiskWriter producing the changes needs to use the same algorithm, see
+// DiskWriterOpt.HashAlgorithm.
+func NewTarsumWithHash(root string, alg HashAlgorithm) *Tarsum {
+	return NewTarsumWithOpt(root, TarsumOpt{HashAlgorithm: &alg})
+}
+
+// NewTarsumWithOpt returns a Tarsum configured with opt.
+func NewTarsumWithOpt(root string, opt TarsumOpt) *Tarsum {
+	n := opt.MaxConcurrentHashes
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	return &Tarsum{
 		tree: iradix.New(),
 		root: root,
+		alg:  opt.HashAlgorithm,
+		sem:  make(chan struct{}, n),
 	}
-	return ts
 }
 
+// Algorithm returns the algorithm set with NewTarsumWithHash or nil.
+func (ts *Tarsum) Algorithm() *HashAlgorithm {
+	return ts.alg
+}
+
+// HandleChange records a change of the entry at p. If fi doesn't implement
+// builder.Hashed, the entry is hashed from the file under root in the
+// background. Errors of hashing it are returned by a later call or by Sum.
 func (ts *Tarsum) HandleChange(kind ChangeKind, p string, fi os.FileInfo, err error) (retErr error) {
 	ts.mu.Lock()
+	if ts.err != nil {
+		ts.mu.Unlock()
+		return ts.err
+	}
 	if ts.txn == nil {
 		ts.txn = ts.tree.Txn()
 	}
+	delete(ts.pending, p)
 	if kind == ChangeKindDelete {
 		ts.txn.Delete([]byte(p))
 		ts.mu.Unlock()
@@ -46,8 +109,16 @@ func (ts *Tarsum) HandleChange(kind ChangeKind, p string, fi os.FileInfo, err er
 
 	h, ok := fi.(builder.Hashed)
 	if !ok {
+		if _, ok := fi.Sys().(*Stat); !ok {
+			ts.mu.Unlock()
+			return errors.Errorf("invalid fileinfo: %s", p)
+		}
+		ts.hash(p, fi)
+		return nil
+	}
+	if ts.alg != nil && !strings.HasPrefix(h.Hash(), ts.alg.Name+":") {
 		ts.mu.Unlock()
-		return errors.Errorf("invalid fileinfo: %p", p)
+		return errors.Errorf("digest %q of %s was not made with %s", h.Hash(), p, ts.alg.Name)
 	}
 
 	hfi := &fileInfo{
@@ -60,7 +131,85 @@ func (ts *Tarsum) HandleChange(kind ChangeKind, p string, fi os.FileInfo, err er
 	return nil
 }
 
+// hash starts hashing the entry at p. ts.mu needs to be held and is released
+// before waiting for a free worker.
+func (ts *Tarsum) hash(p string, fi os.FileInfo) {
+	if ts.pending == nil {
+		ts.pending = make(map[string]uint64)
+	}
+	ts.seq++
+	seq := ts.seq
+	ts.pending[p] = seq
+	ts.wg.Add(1)
+	ts.mu.Unlock()
+
+	ts.sem <- struct{}{}
+	go func() {
+		defer func() {
+			<-ts.sem
+			ts.wg.Done()
+		}()
+		alg, prefix := SHA256, ""
+		if ts.alg != nil {
+			alg, prefix = *ts.alg, ts.alg.Name+":"
+		}
+		dgst, err := hashContentsWithAlgorithm(fi, alg, func() (io.ReadCloser, error) {
+			return os.Open(filepath.Join(ts.root, p))
+		})
+
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		if err != nil {
+			if ts.err == nil {
+				ts.err = err
+			}
+			return
+		}
+		// the entry was changed again while it was hashed
+		if ts.pending[p] != seq {
+			return
+		}
+		delete(ts.pending, p)
+		if ts.txn == nil {
+			ts.txn = ts.tree.Txn()
+		}
+		ts.txn.Insert([]byte(p), &fileInfo{
+			FileInfo: fi,
+			Hashed:   &digestHash{dgst: prefix + dgst},
+			path:     p,
+		})
+	}()
+}
+
+// Sum waits for the entries that are still being hashed and returns the
+// digest of all entries. With the default hash it is the same as the
+// TreeDigest of the tree the changes were made to.
+func (ts *Tarsum) Sum() (string, error) {
+	n := ts.getRoot()
+	ts.mu.Lock()
+	err := ts.err
+	ts.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	var entries []*fileInfo
+	n.Walk(func(k []byte, v interface{}) bool {
+		entries = append(entries, v.(*fileInfo))
+		return false
+	})
+	// in the order of a walk, as TreeDigest
+	sort.Slice(entries, func(i, j int) bool {
+		return comparePath(entries[i].path, entries[j].path) < 0
+	})
+	h := sha256.New()
+	for _, e := range entries {
+		fmt.Fprintf(h, "%s\x00%s\n", e.path, e.Hash())
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 func (ts *Tarsum) getRoot() *iradix.Node {
+	ts.wg.Wait()
 	ts.mu.Lock()
 	if ts.txn != nil {
 		ts.tree = ts.txn.Commit()
@@ -71,7 +220,9 @@ func (ts *Tarsum) getRoot() *iradix.Node {
 	return t.Root()
 }
 
+// Close waits for the entries that are still being hashed.
 func (ts *Tarsum) Close() error {
+	ts.wg.Wait()
 	return nil
 }
 
@@ -126,18 +277,47 @@ func (c *Tarsum) Walk(root string, walkFn builder.WalkFunc) error {
 	return walkErr
 }
 
+// typeSocket is the type flag sockets are hashed with.
+const typeSocket = 's'
+
+// modeFileInfo overrides the mode of a FileInfo.
+type modeFileInfo struct {
+	os.FileInfo
+	mode os.FileMode
+}
+
+func (fi *modeFileInfo) Mode() os.FileMode {
+	return fi.mode
+}
+
 type tarsumHash struct {
 	hash.Hash
 	h *tar.Header
 }
 
 func NewTarsumHash(fi os.FileInfo) (hash.Hash, error) {
+	return NewTarsumHashWithAlgorithm(fi, SHA256)
+}
+
+// NewTarsumHashWithAlgorithm returns a hash of the tar header of fi and the
+// data written to it computed with alg.
+func NewTarsumHashWithAlgorithm(fi os.FileInfo, alg HashAlgorithm) (hash.Hash, error) {
 	stat, ok := fi.Sys().(*Stat)
 	link := ""
 	if ok {
 		link = stat.Linkname
 	}
-	h, err := tar.FileInfoHeader(fi, link)
+	var h *tar.Header
+	var err error
+	if fi.Mode()&os.ModeSocket != 0 {
+		// tar has no type for sockets
+		h, err = tar.FileInfoHeader(&modeFileInfo{FileInfo: fi, mode: fi.Mode() &^ os.ModeSocket}, link)
+		if err == nil {
+			h.Typeflag = typeSocket
+		}
+	} else {
+		h, err = tar.FileInfoHeader(fi, link)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -145,6 +325,10 @@ func NewTarsumHash(fi os.FileInfo) (hash.Hash, error) {
 		h.Uid = int(stat.Uid)
 		h.Gid = int(stat.Gid)
 		h.Linkname = stat.Linkname
+		if fi.Mode()&os.ModeDevice != 0 {
+			h.Devmajor = stat.Devmajor
+			h.Devminor = stat.Devminor
+		}
 		if stat.Xattrs != nil {
 			h.Xattrs = make(map[string]string)
 			for k, v := range stat.Xattrs {
@@ -152,7 +336,7 @@ func NewTarsumHash(fi os.FileInfo) (hash.Hash, error) {
 			}
 		}
 	}
-	tsh := &tarsumHash{h: h, Hash: sha256.New()}
+	tsh := &tarsumHash{h: h, Hash: alg.New()}
 	tsh.Reset()
 	return tsh, nil
 }
@@ -209,6 +393,19 @@ type fileInfo struct {
 	path string
 }
 
+// digestHash is the digest of an entry hashed by a Tarsum.
+type digestHash struct {
+	dgst string
+}
+
+func (h *digestHash) Hash() string {
+	return h.dgst
+}
+
+func (h *digestHash) SetHash(dgst string) {
+	h.dgst = dgst
+}
+
 func (fi *fileInfo) Path() string {
 	return fi.path
 }
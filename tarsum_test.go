@@ -0,0 +1,76 @@
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestTarsumSum(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD a dir",
+		"ADD a/b file data1",
+		"ADD a.b file data2",
+		"ADD bar dir",
+		"ADD bar/foo file data3",
+		"ADD bar/foo2 symlink ../a",
+		"ADD foo file data4",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	expected, err := TreeDigest(context.Background(), d, nil)
+	assert.NoError(t, err)
+
+	for _, n := range []int{1, 4} {
+		ts := NewTarsumWithOpt(d, TarsumOpt{MaxConcurrentHashes: n})
+		err = Walk(context.Background(), d, nil, func(p string, fi os.FileInfo, err error) error {
+			return ts.HandleChange(ChangeKindAdd, p, fi, err)
+		})
+		assert.NoError(t, err)
+		dgst, err := ts.Sum()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, dgst)
+
+		_, fi, err := ts.Stat("bar/foo")
+		assert.NoError(t, err)
+		assert.NotEmpty(t, fi.(*fileInfo).Hash())
+		assert.NoError(t, ts.Close())
+	}
+
+	// a change while the entry is hashed replaces it
+	ts := NewTarsum(d)
+	err = Walk(context.Background(), d, nil, func(p string, fi os.FileInfo, err error) error {
+		if err := ts.HandleChange(ChangeKindAdd, p, fi, err); err != nil {
+			return err
+		}
+		if p == "foo" {
+			return ts.HandleChange(ChangeKindDelete, p, nil, nil)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	dgst, err := ts.Sum()
+	assert.NoError(t, err)
+	expected, err = TreeDigest(context.Background(), d, &WalkOpt{ExcludePatterns: []string{"foo"}})
+	assert.NoError(t, err)
+	assert.Equal(t, expected, dgst)
+	_, _, err = ts.Stat("foo")
+	assert.True(t, os.IsNotExist(errors.Cause(err)))
+
+	// errors of hashing are returned by Sum
+	ts = NewTarsum(d)
+	err = Walk(context.Background(), d, nil, func(p string, fi os.FileInfo, err error) error {
+		if p == "foo" {
+			os.Remove(filepath.Join(d, "foo"))
+		}
+		return ts.HandleChange(ChangeKindAdd, p, fi, err)
+	})
+	assert.NoError(t, err)
+	_, err = ts.Sum()
+	assert.Error(t, err)
+}
@@ -0,0 +1,63 @@
+package fsutil
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// UnsupportedPolicy defines how entries that can't be handled by one side of
+// the transfer are treated. This includes sockets on the sending side and
+// device nodes that can't be created without privileges on the receiving
+// side.
+type UnsupportedPolicy struct {
+	// Skip makes unsupported entries be ignored. If it is not set, the
+	// operation fails with an *UnsupportedError listing all such paths after
+	// the other entries have been processed.
+	Skip bool
+	// Warn is called for every skipped entry.
+	Warn func(path string, err error)
+}
+
+// UnsupportedError is returned when unsupported entries were found and the
+// policy did not allow skipping them.
+type UnsupportedError struct {
+	Paths []string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("unsupported file types for paths: %s", strings.Join(e.Paths, ", "))
+}
+
+type unsupportedFiles struct {
+	policy *UnsupportedPolicy
+	paths  []string
+}
+
+func (u *unsupportedFiles) add(p string, err error) {
+	if u.policy.Skip {
+		if u.policy.Warn != nil {
+			u.policy.Warn(p, err)
+		}
+		return
+	}
+	u.paths = append(u.paths, p)
+}
+
+func (u *unsupportedFiles) err() error {
+	if len(u.paths) == 0 {
+		return nil
+	}
+	return &UnsupportedError{Paths: u.paths}
+}
+
+// isSupportedMode returns false for file types that can't be transferred.
+func isSupportedMode(m os.FileMode) bool {
+	return m&os.ModeSocket == 0
+}
+
+func errUnsupportedMode(m os.FileMode) error {
+	return errors.Errorf("unsupported file type %s", m&os.ModeType)
+}
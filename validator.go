@@ -1,6 +1,7 @@
 package fsutil
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"sort"
@@ -14,6 +15,9 @@ type parent struct {
 	last string
 }
 
+// Validator checks that changes come in walk order with clean paths under the
+// root, each following the directory it is in. Hardlinks need to point to a
+// path under the root as well.
 type Validator struct {
 	parentDirs []parent
 }
@@ -25,20 +29,21 @@ func (v *Validator) HandleChange(kind ChangeKind, p string, fi os.FileInfo, err
 	if v.parentDirs == nil {
 		v.parentDirs = make([]parent, 1, 10)
 	}
-	if p != filepath.Clean(p) {
-		return errors.Errorf("invalid unclean path %s", p)
+	if reason := checkPath(p); reason != "" {
+		return errors.WithStack(&ValidationError{Path: p, Reason: reason})
 	}
-	if filepath.IsAbs(p) {
-		return errors.Errorf("abolute path %s not allowed", p)
+	if kind != ChangeKindDelete && fi.Mode()&os.ModeSymlink == 0 {
+		if stat, ok := fi.Sys().(*Stat); ok && stat.Linkname != "" {
+			if reason := checkPath(stat.Linkname); reason != "" {
+				return errors.WithStack(&ValidationError{Path: p, Reason: "link to " + reason})
+			}
+		}
 	}
 	dir := filepath.Dir(p)
 	base := filepath.Base(p)
 	if dir == "." {
 		dir = ""
 	}
-	if dir == ".." || strings.HasPrefix(p, "../") {
-		return errors.Errorf("invalid path: %s", p)
-	}
 	i := sort.Search(len(v.parentDirs), func(i int) bool {
 		return v.parentDirs[len(v.parentDirs)-1-i].dir <= dir
 	})
@@ -48,7 +53,7 @@ func (v *Validator) HandleChange(kind ChangeKind, p string, fi os.FileInfo, err
 	}
 
 	if i == 0 && dir != "" || v.parentDirs[i].last >= base {
-		return errors.Errorf("changes out of order: %q %q", p, filepath.Join(v.parentDirs[i].dir, v.parentDirs[i].last))
+		return errors.WithStack(&ValidationError{Path: p, Reason: fmt.Sprintf("out of order after %q", filepath.Join(v.parentDirs[i].dir, v.parentDirs[i].last))})
 	}
 	v.parentDirs[i].last = base
 	if kind != ChangeKindDelete && fi.IsDir() {
@@ -60,3 +65,76 @@ func (v *Validator) HandleChange(kind ChangeKind, p string, fi os.FileInfo, err
 	// todo: validate invalid mode combinations
 	return err
 }
+
+// checkPath returns why p is not a valid path under a root or an empty
+// string.
+func checkPath(p string) string {
+	switch {
+	case p == "" || p == ".":
+		return "empty path"
+	case p != filepath.Clean(p):
+		return "unclean path"
+	case filepath.IsAbs(p) || filepath.VolumeName(p) != "" || strings.HasPrefix(p, string(filepath.Separator)):
+		return "absolute path not allowed"
+	case p == ".." || strings.HasPrefix(p, ".."+string(filepath.Separator)):
+		return "outside of the destination"
+	}
+	return ""
+}
+
+// destChecker rejects entries whose parent directories at the destination
+// are symlinks or other files, so a symlink created earlier can't make an
+// entry be written outside of the destination.
+type destChecker struct {
+	root string
+	// dirs are the checked directories
+	dirs map[string]struct{}
+}
+
+func newDestChecker(root string) *destChecker {
+	return &destChecker{root: root, dirs: make(map[string]struct{})}
+}
+
+func (c *destChecker) HandleChange(kind ChangeKind, p string, fi os.FileInfo, err error) error {
+	if err != nil {
+		return err
+	}
+	if kind != ChangeKindAdd {
+		// the directory may be replaced
+		if _, ok := c.dirs[p]; ok {
+			prefix := p + string(filepath.Separator)
+			for d := range c.dirs {
+				if d == p || strings.HasPrefix(d, prefix) {
+					delete(c.dirs, d)
+				}
+			}
+		}
+	}
+	return c.checkParents(p)
+}
+
+func (c *destChecker) checkParents(p string) error {
+	dir := filepath.Dir(p)
+	if dir == "." {
+		return nil
+	}
+	if _, ok := c.dirs[dir]; ok {
+		return nil
+	}
+	if err := c.checkParents(dir); err != nil {
+		return err
+	}
+	fi, err := os.Lstat(filepath.Join(c.root, dir))
+	if err != nil {
+		if isNotExist(err) {
+			// creating the entry fails
+			return nil
+		}
+		return errors.Wrapf(err, "failed to stat %s", dir)
+	}
+	if !fi.IsDir() {
+		return errors.WithStack(&ValidationError{Path: p, Reason: fmt.Sprintf("parent %s is not a directory", dir)})
+	}
+	c.dirs[dir] = struct{}{}
+	return nil
+}
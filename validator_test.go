@@ -3,9 +3,11 @@ package fsutil
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -136,6 +138,50 @@ func TestValidatorBigJump(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestValidatorErrorPath(t *testing.T) {
+	err := checkValid(changeStream([]string{
+		"ADD foo dir",
+		"ADD foo/bar file",
+		"ADD bar file",
+	}))
+	verr, ok := errors.Cause(err).(*ValidationError)
+	if assert.True(t, ok, "%v", err) {
+		assert.Equal(t, "bar", verr.Path)
+	}
+
+	err = checkValid(changeStream([]string{
+		"ADD ../foo file",
+	}))
+	verr, ok = errors.Cause(err).(*ValidationError)
+	if assert.True(t, ok, "%v", err) {
+		assert.Equal(t, "../foo", verr.Path)
+	}
+}
+
+func TestDestCheckerSymlinkParent(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD dir dir",
+		"ADD link symlink dir",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	c := newDestChecker(d)
+	assert.NoError(t, c.HandleChange(ChangeKindAdd, "dir/foo", nil, nil))
+	assert.NoError(t, c.HandleChange(ChangeKindAdd, "link", nil, nil))
+	err = c.HandleChange(ChangeKindAdd, "link/foo", nil, nil)
+	verr, ok := errors.Cause(err).(*ValidationError)
+	if assert.True(t, ok, "%v", err) {
+		assert.Equal(t, "link/foo", verr.Path)
+	}
+
+	// a directory replaced by a symlink is checked again
+	assert.NoError(t, os.RemoveAll(filepath.Join(d, "dir")))
+	assert.NoError(t, os.Symlink("link", filepath.Join(d, "dir")))
+	assert.NoError(t, c.HandleChange(ChangeKindModify, "dir", nil, nil))
+	assert.Error(t, c.HandleChange(ChangeKindAdd, "dir/foo", nil, nil))
+}
+
 func checkValid(inp []*change) error {
 	v := &Validator{}
 	for _, c := range inp {
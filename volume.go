@@ -0,0 +1,126 @@
+package fsutil
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// VolumeSnapshotter takes filesystem level snapshots of a destination
+// directory. When set in ReceiveOpt, a snapshot is taken before any change is
+// applied and the destination is rolled back to it if the transfer fails.
+type VolumeSnapshotter interface {
+	Snapshot(dest string) (VolumeSnapshot, error)
+}
+
+// VolumeSnapshot is a snapshot taken by a VolumeSnapshotter.
+type VolumeSnapshot interface {
+	// Rollback restores the destination to the state of the snapshot and
+	// removes the snapshot.
+	Rollback() error
+	// Release removes the snapshot keeping the current state.
+	Release() error
+}
+
+type commandFunc func(name string, args ...string) (string, error)
+
+func runCommand(name string, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "%s %s: %s", name, strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// BtrfsSnapshotter snapshots destinations that are btrfs subvolumes. The
+// snapshot is created next to the destination.
+type BtrfsSnapshotter struct {
+	run commandFunc
+}
+
+func (b *BtrfsSnapshotter) Snapshot(dest string) (VolumeSnapshot, error) {
+	run := b.run
+	if run == nil {
+		run = runCommand
+	}
+	dest = filepath.Clean(dest)
+	snap := filepath.Join(filepath.Dir(dest), ".snapshot-"+filepath.Base(dest)+"-"+nextSuffix())
+	if _, err := run("btrfs", "subvolume", "snapshot", dest, snap); err != nil {
+		return nil, err
+	}
+	return &btrfsSnapshot{run: run, dest: dest, snap: snap}, nil
+}
+
+type btrfsSnapshot struct {
+	run        commandFunc
+	dest, snap string
+}
+
+func (s *btrfsSnapshot) Rollback() error {
+	if _, err := s.run("btrfs", "subvolume", "delete", s.dest); err != nil {
+		return err
+	}
+	return errors.Wrapf(os.Rename(s.snap, s.dest), "failed to restore %s", s.dest)
+}
+
+func (s *btrfsSnapshot) Release() error {
+	_, err := s.run("btrfs", "subvolume", "delete", s.snap)
+	return err
+}
+
+// ZFSSnapshotter snapshots destinations that are the mountpoint of a ZFS
+// dataset. Other destinations are refused, as rolling back the dataset would
+// revert the files outside of them too.
+type ZFSSnapshotter struct {
+	run commandFunc
+}
+
+func (z *ZFSSnapshotter) Snapshot(dest string) (VolumeSnapshot, error) {
+	run := z.run
+	if run == nil {
+		run = runCommand
+	}
+	dest = filepath.Clean(dest)
+	out, err := run("zfs", "list", "-H", "-o", "name,mountpoint", dest)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Split(out, "\t")
+	if out == "" || len(fields) != 2 {
+		return nil, errors.Errorf("no zfs dataset for %s", dest)
+	}
+	dataset, mountpoint := fields[0], fields[1]
+	if filepath.Clean(mountpoint) != dest {
+		return nil, errors.Errorf("%s is not the mountpoint of zfs dataset %s mounted at %s", dest, dataset, mountpoint)
+	}
+	name := dataset + "@fsutil-" + nextSuffix()
+	if _, err := run("zfs", "snapshot", name); err != nil {
+		return nil, err
+	}
+	return &zfsSnapshot{run: run, name: name}, nil
+}
+
+type zfsSnapshot struct {
+	run  commandFunc
+	name string
+}
+
+func (s *zfsSnapshot) Rollback() error {
+	// without -r the rollback fails instead of destroying newer snapshots
+	if _, err := s.run("zfs", "rollback", s.name); err != nil {
+		return err
+	}
+	return s.Release()
+}
+
+func (s *zfsSnapshot) Release() error {
+	_, err := s.run("zfs", "destroy", s.name)
+	return err
+}
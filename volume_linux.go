@@ -0,0 +1,27 @@
+package fsutil
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	btrfsSuperMagic = 0x9123683e
+	zfsSuperMagic   = 0x2fc12fc1
+)
+
+// DetectVolumeSnapshotter returns a snapshotter for the filesystem dest is on.
+// It returns nil if the filesystem doesn't support snapshots.
+func DetectVolumeSnapshotter(dest string) (VolumeSnapshotter, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dest, &st); err != nil {
+		return nil, errors.Wrapf(err, "failed to stat filesystem of %s", dest)
+	}
+	switch uint32(st.Type) {
+	case btrfsSuperMagic:
+		return &BtrfsSnapshotter{}, nil
+	case zfsSuperMagic:
+		return &ZFSSnapshotter{}, nil
+	}
+	return nil, nil
+}
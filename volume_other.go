@@ -0,0 +1,9 @@
+// +build !linux
+
+package fsutil
+
+// DetectVolumeSnapshotter returns a snapshotter for the filesystem dest is on.
+// Filesystem snapshots are only detected on linux, elsewhere nil is returned.
+func DetectVolumeSnapshotter(dest string) (VolumeSnapshotter, error) {
+	return nil, nil
+}
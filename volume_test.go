@@ -0,0 +1,141 @@
+// +build linux
+
+package fsutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVolumeSnapshotCommands(t *testing.T) {
+	parent, err := ioutil.TempDir("", "volume")
+	assert.NoError(t, err)
+	defer os.RemoveAll(parent)
+	dest := filepath.Join(parent, "ctx")
+	assert.NoError(t, os.Mkdir(dest, 0700))
+
+	var cmds []string
+	run := func(name string, args ...string) (string, error) {
+		cmds = append(cmds, name+" "+strings.Join(args, " "))
+		switch {
+		case name == "btrfs" && args[1] == "snapshot":
+			return "", os.Mkdir(args[3], 0700)
+		case name == "btrfs" && args[1] == "delete":
+			return "", os.RemoveAll(args[2])
+		case name == "zfs" && args[0] == "list":
+			return "tank/ctx\t/data/ctx", nil
+		}
+		return "", nil
+	}
+
+	snap, err := (&BtrfsSnapshotter{run: run}).Snapshot(dest + "/")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(cmds))
+	assert.True(t, strings.HasPrefix(cmds[0], "btrfs subvolume snapshot "+dest+" "+filepath.Join(parent, ".snapshot-ctx-")))
+	snapPath := strings.Fields(cmds[0])[4]
+
+	assert.NoError(t, snap.Rollback())
+	assert.Equal(t, []string{"btrfs subvolume delete " + dest}, cmds[1:])
+	_, err = os.Stat(dest)
+	assert.NoError(t, err)
+	_, err = os.Stat(snapPath)
+	assert.True(t, os.IsNotExist(err))
+
+	cmds = nil
+	snap, err = (&ZFSSnapshotter{run: run}).Snapshot("/data/ctx")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(cmds))
+	assert.Equal(t, "zfs list -H -o name,mountpoint /data/ctx", cmds[0])
+	assert.True(t, strings.HasPrefix(cmds[1], "zfs snapshot tank/ctx@fsutil-"))
+	name := strings.Fields(cmds[1])[2]
+
+	assert.NoError(t, snap.Rollback())
+	assert.Equal(t, []string{"zfs rollback " + name, "zfs destroy " + name}, cmds[2:])
+}
+
+func TestZFSSnapshotDataset(t *testing.T) {
+	mountpoints := map[string]string{
+		"/data/ctx":     "tank/ctx\t/data/ctx",
+		"/data/ctx/sub": "tank/ctx\t/data/ctx",
+		"/data/other":   "",
+		"/data/legacy":  "tank/legacy\tlegacy",
+	}
+	var snapshots []string
+	run := func(name string, args ...string) (string, error) {
+		switch args[0] {
+		case "list":
+			return mountpoints[args[len(args)-1]], nil
+		case "snapshot":
+			snapshots = append(snapshots, strings.Split(args[1], "@")[0])
+		}
+		return "", nil
+	}
+
+	_, err := (&ZFSSnapshotter{run: run}).Snapshot("/data/ctx/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tank/ctx"}, snapshots)
+
+	// a subdirectory of the dataset is refused, rolling back would revert
+	// the rest of the dataset too
+	for _, dest := range []string{"/data/ctx/sub", "/data/other", "/data/legacy"} {
+		_, err = (&ZFSSnapshotter{run: run}).Snapshot(dest)
+		assert.Error(t, err, dest)
+	}
+	assert.Equal(t, []string{"tank/ctx"}, snapshots)
+}
+
+func TestReceiveVolumeSnapshot(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD foo file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dest, err := tmpDir(changeStream([]string{
+		"ADD bar file data2",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	vs := &fakeVolumeSnapshotter{}
+	receive := func(opt ReceiveOpt) error {
+		return syncDirs(d, dest, SendOpt{}, opt)
+	}
+
+	err = receive(ReceiveOpt{VolumeSnapshot: vs, DeleteLimit: &DeleteLimit{Percent: 1}})
+	assert.Error(t, err)
+	assert.Equal(t, []string{"snapshot " + dest, "rollback"}, vs.calls)
+
+	vs.calls = nil
+	err = receive(ReceiveOpt{VolumeSnapshot: vs})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"snapshot " + dest, "release"}, vs.calls)
+
+	dt, err := ioutil.ReadFile(dest + "/foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "data1", string(dt))
+}
+
+type fakeVolumeSnapshotter struct {
+	calls []string
+}
+
+func (vs *fakeVolumeSnapshotter) Snapshot(dest string) (VolumeSnapshot, error) {
+	vs.calls = append(vs.calls, "snapshot "+dest)
+	return vs, nil
+}
+
+func (vs *fakeVolumeSnapshotter) Rollback() error {
+	vs.calls = append(vs.calls, "rollback")
+	return nil
+}
+
+func (vs *fakeVolumeSnapshotter) Release() error {
+	vs.calls = append(vs.calls, "release")
+	return nil
+}
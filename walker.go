@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/docker/docker/pkg/fileutils"
@@ -12,8 +13,26 @@ import (
 )
 
 type WalkOpt struct {
-	IncludePaths    []string // todo: remove?
+	IncludePaths []string // todo: remove?
+	// IncludePatterns limits the walk to the entries matching one of the
+	// patterns and everything under them. The patterns use the same syntax
+	// as ExcludePatterns. Directories leading to an included entry are
+	// returned before it, directories that can't contain one are not
+	// entered.
+	IncludePatterns []string
 	ExcludePatterns []string
+	// FollowLinks resolves the symlinks along the IncludePatterns. The links
+	// and the entries they point to are included as well. Links pointing
+	// outside of the walked directory are resolved as if it was the
+	// filesystem root.
+	FollowLinks bool
+	// Unsupported defines how entries that can't be transferred, like
+	// sockets, are handled. If nil, they are returned like any other entry.
+	Unsupported *UnsupportedPolicy
+	// Filter selects and rewrites the walked entries after the patterns
+	// have been applied. The walk function is still called with the path of
+	// the entry under root while the stat has the mapped path.
+	Filter Filter
 }
 
 func Walk(ctx context.Context, p string, opt *WalkOpt, fn filepath.WalkFunc) error {
@@ -37,9 +56,42 @@ func Walk(ctx context.Context, p string, opt *WalkOpt, fn filepath.WalkFunc) err
 		}
 	}
 
-	seenFiles := make(map[uint64]string)
-	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+	var includes *includeMatcher
+	if opt != nil && opt.IncludePatterns != nil {
+		patterns := opt.IncludePatterns
+		if opt.FollowLinks {
+			patterns, err = followLinks(root, patterns)
+			if err != nil {
+				return err
+			}
+		}
+		includes, err = newIncludeMatcher(patterns)
+		if err != nil {
+			return errors.Wrapf(err, "invalid includepatterns %s", opt.IncludePatterns)
+		}
+	}
+
+	var unsupported *unsupportedFiles
+	if opt != nil && opt.Unsupported != nil {
+		unsupported = &unsupportedFiles{policy: opt.Unsupported}
+	}
+
+	var filter *statFilter
+	if opt != nil && opt.Filter != nil {
+		filter = newStatFilter(opt.Filter)
+	}
+
+	// parents holds the directories that were entered only because an
+	// included entry may be under them. They are returned once one is found.
+	var parents []*Stat
+
+	seenFiles := make(map[inode]string)
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
+			// entries removed while walking are skipped
+			if isNotExist(err) {
+				return nil
+			}
 			return err
 		}
 		origpath := path
@@ -52,6 +104,23 @@ func Walk(ctx context.Context, p string, opt *WalkOpt, fn filepath.WalkFunc) err
 			return nil
 		}
 
+		partial := false
+		if includes != nil {
+			m, err := includes.pm.Matches(path)
+			if err != nil {
+				return errors.Wrap(err, "failed to match includepatterns")
+			}
+			if !m {
+				if !fi.IsDir() {
+					return nil
+				}
+				if !includes.mayMatchBelow(path) {
+					return filepath.SkipDir
+				}
+				partial = true
+			}
+		}
+
 		if opt != nil {
 			if opt.IncludePaths != nil {
 				matched := false
@@ -97,6 +166,11 @@ func Walk(ctx context.Context, p string, opt *WalkOpt, fn filepath.WalkFunc) err
 		}
 
 	passedFilter:
+		if unsupported != nil && !isSupportedMode(fi.Mode()) {
+			unsupported.add(path, errUnsupportedMode(fi.Mode()))
+			return nil
+		}
+
 		stat := &Stat{
 			Path:    path,
 			Mode:    uint32(fi.Mode()),
@@ -110,25 +184,128 @@ func Walk(ctx context.Context, p string, opt *WalkOpt, fn filepath.WalkFunc) err
 			if fi.Mode()&os.ModeSymlink != 0 {
 				link, err := os.Readlink(origpath)
 				if err != nil {
+					if isNotExist(err) {
+						return nil
+					}
 					return errors.Wrapf(err, "failed to readlink %s", origpath)
 				}
 				stat.Linkname = link
 			}
 		}
 		if err := loadXattr(origpath, stat); err != nil {
+			if isNotExist(err) {
+				return nil
+			}
 			return errors.Wrapf(err, "failed to xattr %s", path)
 		}
 
+		if filter != nil {
+			ok, err := filter.filter(stat)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		if stat.Linkname != "" && !isSymlink(stat) {
+			// the contents are sent with the target of the hardlink
+			stat.Size_ = 0
+		}
+
+		for len(parents) > 0 && !strings.HasPrefix(path, parents[len(parents)-1].Path+string(filepath.Separator)) {
+			parents = parents[:len(parents)-1]
+		}
+		if partial {
+			parents = append(parents, stat)
+			return nil
+		}
+
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
+			for _, p := range parents {
+				if err := fn(p.Path, &StatInfo{p}, nil); err != nil {
+					return err
+				}
+			}
+			parents = parents[:0]
 			if err := fn(path, &StatInfo{stat}, nil); err != nil {
 				return err
 			}
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	if unsupported != nil {
+		return unsupported.err()
+	}
+	return nil
+}
+
+// includeMatcher matches paths against IncludePatterns.
+type includeMatcher struct {
+	pm   *fileutils.PatternMatcher
+	dirs [][]string
+}
+
+func newIncludeMatcher(patterns []string) (*includeMatcher, error) {
+	pm, err := fileutils.NewPatternMatcher(patterns)
+	if err != nil {
+		return nil, err
+	}
+	m := &includeMatcher{pm: pm}
+	for _, p := range pm.Patterns() {
+		if p.Exclusion() {
+			continue
+		}
+		m.dirs = append(m.dirs, strings.Split(filepath.ToSlash(p.String()), "/"))
+	}
+	return m, nil
+}
+
+// mayMatchBelow reports whether a pattern could match an entry under the
+// directory dir that does not match any pattern itself.
+func (m *includeMatcher) mayMatchBelow(dir string) bool {
+	parts := strings.Split(filepath.ToSlash(dir), "/")
+next:
+	for _, pat := range m.dirs {
+		for i, part := range parts {
+			if i >= len(pat) {
+				continue next
+			}
+			if pat[i] == "**" {
+				return true
+			}
+			if ok, _ := filepath.Match(pat[i], part); !ok {
+				continue next
+			}
+		}
+		if len(pat) > len(parts) {
+			return true
+		}
+	}
+	return false
+}
+
+func isNotExist(err error) bool {
+	err = errors.Cause(err)
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return os.IsNotExist(err) || err == syscall.ENOTDIR
+}
+
+// inode identifies a file by its device and inode number for detecting
+// hardlinks.
+type inode struct {
+	dev, ino uint64
 }
 
 type StatInfo struct {
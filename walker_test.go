@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"testing"
@@ -30,6 +31,90 @@ file foo2
 
 }
 
+func TestWalkerFilter(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar dir",
+		"ADD bar/a file abc",
+		"ADD bar/big file 0123456789",
+		"ADD bar/link file >bar/big",
+		"ADD bar/link2 file >bar/a",
+		"ADD bar/medium file 012345",
+		"ADD bar/small file x",
+		"ADD bar/tiny file >bar/small",
+		"ADD foo dir",
+		"ADD foo/x file abc",
+		"ADD y file >foo/x",
+		"ADD z file",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	filter := Chain(
+		MatchFunc(func(p string, st *Stat) (bool, error) {
+			return p != "foo" && p != "bar/a" && p != "bar/big", nil
+		}),
+		MaxSize(5),
+		MapFunc(func(p string, st *Stat) error {
+			if p == "z" {
+				st.Path = "zz"
+			}
+			return nil
+		}),
+	)
+
+	var out []string
+	err = Walk(context.Background(), d, &WalkOpt{Filter: filter}, func(p string, fi os.FileInfo, err error) error {
+		st := fi.Sys().(*Stat)
+		if !fi.IsDir() {
+			out = append(out, fmt.Sprintf("%s:%s>%s %d", p, st.Path, st.Linkname, st.Size_))
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	// the hardlinks to the dropped files, also to the ones in dropped
+	// directories, are sent as regular files with their size, the one to big
+	// is left out by its size
+	assert.Equal(t, []string{"bar/link2:bar/link2> 3", "bar/small:bar/small> 1", "bar/tiny:bar/tiny>bar/small 0", "y:y> 3", "z:zz> 0"}, out)
+}
+
+func TestWalkStream(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar dir",
+		"ADD bar/foo file data1",
+		"ADD foo2 file",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	s := WalkStream(context.Background(), d, nil)
+	var paths []string
+	for c := range s.C {
+		assert.Equal(t, ChangeKind(ChangeKindAdd), c.Kind)
+		assert.Equal(t, c.Path, c.Stat.Path)
+		paths = append(paths, c.Path)
+		if c.Path == "bar" {
+			assert.Nil(t, c.Open)
+		}
+		if c.Path == "bar/foo" {
+			r, err := c.Open()
+			assert.NoError(t, err)
+			dt, err := ioutil.ReadAll(r)
+			r.Close()
+			assert.NoError(t, err)
+			assert.Equal(t, "data1", string(dt))
+		}
+	}
+	assert.NoError(t, s.Err())
+	assert.Equal(t, []string{"bar", "bar/foo", "foo2"}, paths)
+
+	s = WalkStream(context.Background(), d, nil)
+	c := <-s.C
+	assert.Equal(t, "bar", c.Path)
+	s.Close()
+	_, ok := <-s.C
+	assert.False(t, ok)
+}
+
 func TestWalkerInclude(t *testing.T) {
 	d, err := tmpDir(changeStream([]string{
 		"ADD bar dir",
@@ -50,6 +135,97 @@ file bar/foo
 
 }
 
+func TestWalkerIncludePatterns(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD a dir",
+		"ADD a/b dir",
+		"ADD a/b/c file",
+		"ADD a/d file",
+		"ADD foo file",
+		"ADD node_modules dir",
+		"ADD node_modules/x file",
+		"ADD src dir",
+		"ADD src/empty dir",
+		"ADD src/main.go file",
+		"ADD src/main_test.go file",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), d, &WalkOpt{
+		IncludePatterns: []string{"a/b", "src/*.go", "foo"},
+		ExcludePatterns: []string{"src/*_test.go"},
+	}, bufWalk(b))
+	assert.NoError(t, err)
+
+	assert.Equal(t, `dir a
+dir a/b
+file a/b/c
+file foo
+dir src
+file src/main.go
+`, string(b.Bytes()))
+
+	m, err := newIncludeMatcher([]string{"a/b/c", "x/**/y", "!a"})
+	assert.NoError(t, err)
+	assert.True(t, m.mayMatchBelow("a"))
+	assert.True(t, m.mayMatchBelow("a/b"))
+	assert.False(t, m.mayMatchBelow("a/b/c"))
+	assert.False(t, m.mayMatchBelow("a/c"))
+	assert.True(t, m.mayMatchBelow("x/1/2/3"))
+	assert.False(t, m.mayMatchBelow("node_modules"))
+}
+
+func TestWalkerFollowLinks(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD app dir",
+		"ADD app/config symlink ../shared/config",
+		"ADD app/main file",
+		"ADD lib symlink /vendor/lib",
+		"ADD loop symlink loop2",
+		"ADD loop2 symlink loop",
+		"ADD shared dir",
+		"ADD shared/config dir",
+		"ADD shared/config/a file",
+		"ADD shared/other file",
+		"ADD vendor dir",
+		"ADD vendor/lib dir",
+		"ADD vendor/lib/x file",
+		"ADD vendor/y file",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), d, &WalkOpt{
+		IncludePatterns: []string{"app/config", "lib/*", "loop"},
+	}, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `dir app
+symlink:../shared/config app/config
+symlink:loop2 loop
+`, string(b.Bytes()))
+
+	b.Reset()
+	err = Walk(context.Background(), d, &WalkOpt{
+		IncludePatterns: []string{"app/config", "lib/*", "loop"},
+		FollowLinks:     true,
+	}, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `dir app
+symlink:../shared/config app/config
+symlink:/vendor/lib lib
+symlink:loop2 loop
+symlink:loop loop2
+dir shared
+dir shared/config
+file shared/config/a
+dir vendor
+dir vendor/lib
+file vendor/lib/x
+`, string(b.Bytes()))
+}
+
 func TestWalkerExclude(t *testing.T) {
 	d, err := tmpDir(changeStream([]string{
 		"ADD bar file",
@@ -72,6 +248,51 @@ file foo/bar2
 
 }
 
+func TestWalkerUnsupported(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file",
+		"ADD foo dir",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	l, err := net.Listen("unix", filepath.Join(d, "foo/sock"))
+	assert.NoError(t, err)
+	defer l.Close()
+
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), d, &WalkOpt{
+		Unsupported: &UnsupportedPolicy{},
+	}, bufWalk(b))
+	assert.Error(t, err)
+	uerr, ok := err.(*UnsupportedError)
+	assert.True(t, ok)
+	if ok {
+		assert.Equal(t, []string{"foo/sock"}, uerr.Paths)
+	}
+
+	assert.Equal(t, `file bar
+dir foo
+`, string(b.Bytes()))
+
+	var skipped []string
+	b = &bytes.Buffer{}
+	err = Walk(context.Background(), d, &WalkOpt{
+		Unsupported: &UnsupportedPolicy{
+			Skip: true,
+			Warn: func(p string, err error) {
+				skipped = append(skipped, p)
+			},
+		},
+	}, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"foo/sock"}, skipped)
+
+	assert.Equal(t, `file bar
+dir foo
+`, string(b.Bytes()))
+}
+
 func bufWalk(buf *bytes.Buffer) filepath.WalkFunc {
 	return func(path string, fi os.FileInfo, err error) error {
 		stat, ok := fi.Sys().(*Stat)
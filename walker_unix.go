@@ -10,6 +10,10 @@ import (
 	"github.com/stevvooe/continuity/sysx"
 )
 
+// xattrsSupported is true if extended attributes are read and written on
+// this platform.
+const xattrsSupported = true
+
 func loadXattr(origpath string, stat *Stat) error {
 	xattrs, err := sysx.LListxattr(origpath)
 	if err != nil {
@@ -28,7 +32,7 @@ func loadXattr(origpath string, stat *Stat) error {
 	return nil
 }
 
-func setUnixOpt(fi os.FileInfo, stat *Stat, path string, seenFiles map[uint64]string) {
+func setUnixOpt(fi os.FileInfo, stat *Stat, path string, seenFiles map[inode]string) {
 	s := fi.Sys().(*syscall.Stat_t)
 
 	stat.Uid = s.Uid
@@ -41,14 +45,18 @@ func setUnixOpt(fi os.FileInfo, stat *Stat, path string, seenFiles map[uint64]st
 			stat.Devminor = int64(minor(uint64(s.Rdev)))
 		}
 
-		ino := s.Ino
+		// files with more than one link are sent once, the other paths
+		// link to the first one that was walked. The size is kept until the
+		// filters ran, the link is sent as a regular file if its target was
+		// left out.
 		if s.Nlink > 1 {
+			ino := inode{dev: uint64(s.Dev), ino: uint64(s.Ino)}
 			if oldpath, ok := seenFiles[ino]; ok {
 				stat.Linkname = oldpath
-				stat.Size_ = 0
+			} else {
+				seenFiles[ino] = path
 			}
 		}
-		seenFiles[ino] = path
 	}
 }
 
@@ -6,9 +6,13 @@ import (
 	"os"
 )
 
+// xattrsSupported is true if extended attributes are read and written on
+// this platform.
+const xattrsSupported = false
+
 func loadXattr(_ string, _ *Stat) error {
 	return nil
 }
 
-func setUnixOpt(_ os.FileInfo, _ *Stat, _ string, _ map[uint64]string) {
+func setUnixOpt(_ os.FileInfo, _ *Stat, _ string, _ map[inode]string) {
 }
@@ -0,0 +1,316 @@
+package fsutil
+
+import (
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// DefaultWatchLatency is the time a watching sender waits for more changes
+// before sending them.
+const DefaultWatchLatency = 100 * time.Millisecond
+
+// SendWatchOpt keeps a send running after the initial transfer. Changes to
+// the source are sent to the receiver as they happen, which needs to receive
+// with ReceiveOpt.Watch. Filters that rename entries are not supported.
+type SendWatchOpt struct {
+	// Latency is the time to wait for more changes after one was noticed.
+	// Defaults to DefaultWatchLatency.
+	Latency time.Duration
+}
+
+// ReceiveWatchOpt keeps a receive running after the initial transfer to
+// apply the changes sent by a sender using SendOpt.Watch. Only a single
+// sender is supported. The receive ends when the sender's context is
+// canceled.
+type ReceiveWatchOpt struct {
+	// Synced is called after the initial transfer with nil and after every
+	// following transfer with the paths that were updated. An empty slice
+	// means the whole tree was compared again.
+	Synced func(paths []string)
+}
+
+// changeSet collects the paths changed under a watched root.
+type changeSet struct {
+	mu    sync.Mutex
+	paths map[string]struct{}
+	all   bool
+	err   error
+	// ch is signaled when a change is added
+	ch chan struct{}
+}
+
+func newChangeSet() *changeSet {
+	return &changeSet{paths: make(map[string]struct{}), ch: make(chan struct{}, 1)}
+}
+
+// add records a change of the path p relative to the root. An empty p means
+// changes may have been missed and the whole tree needs to be compared.
+func (cs *changeSet) add(p string) {
+	cs.mu.Lock()
+	if p == "" {
+		cs.all = true
+	} else {
+		cs.paths[p] = struct{}{}
+	}
+	cs.mu.Unlock()
+	cs.signal()
+}
+
+func (cs *changeSet) fail(err error) {
+	cs.mu.Lock()
+	if cs.err == nil {
+		cs.err = err
+	}
+	cs.mu.Unlock()
+	cs.signal()
+}
+
+func (cs *changeSet) signal() {
+	select {
+	case cs.ch <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the changes recorded so far and clears them. Paths under
+// another changed path are left out.
+func (cs *changeSet) take() ([]string, bool, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.err != nil {
+		return nil, false, cs.err
+	}
+	all := cs.all
+	paths := make([]string, 0, len(cs.paths))
+	for p := range cs.paths {
+		paths = append(paths, p)
+	}
+	cs.all = false
+	cs.paths = make(map[string]struct{})
+	if all {
+		return nil, true, nil
+	}
+	sort.Strings(paths)
+	out := paths[:0]
+	for _, p := range paths {
+		if len(out) > 0 && strings.HasPrefix(p, out[len(out)-1]+string(filepath.Separator)) {
+			continue
+		}
+		out = append(out, p)
+	}
+	return out, false, nil
+}
+
+// changedFilter keeps the entries at or under the changed paths and the
+// directories leading to them.
+type changedFilter []string
+
+func (f changedFilter) Match(p string, stat *Stat) (bool, error) {
+	for _, c := range f {
+		if p == c || strings.HasPrefix(p, c+string(filepath.Separator)) || strings.HasPrefix(c, p+string(filepath.Separator)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f changedFilter) Map(p string, stat *Stat) error {
+	return nil
+}
+
+func encodeWatchPaths(paths []string) []byte {
+	s := make([]string, len(paths))
+	for i, p := range paths {
+		s[i] = filepath.ToSlash(p)
+	}
+	return []byte(strings.Join(s, "\x00"))
+}
+
+func decodeWatchPaths(dt []byte) []string {
+	if len(dt) == 0 {
+		return nil
+	}
+	paths := strings.Split(string(dt), "\x00")
+	for i, p := range paths {
+		paths[i] = filepath.FromSlash(p)
+	}
+	return paths
+}
+
+// runWatch performs the initial transfer and then sends the changes noticed
+// under the root until ctx is canceled.
+func (ss *SendSession) runWatch(ctx context.Context) error {
+	root, err := filepath.EvalSymlinks(ss.root)
+	if err != nil {
+		return errors.Wrapf(err, "failed to resolve %s", ss.root)
+	}
+	cs := newChangeSet()
+	w, err := newWatcher(root, cs)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if err := ss.s.run(); err != nil {
+		return err
+	}
+
+	latency := ss.opt.Watch.Latency
+	if latency == 0 {
+		latency = DefaultWatchLatency
+	}
+	for {
+		select {
+		case <-cs.ch:
+		case <-ctx.Done():
+			ss.s.conn.SendMsg(&Packet{Type: PACKET_FIN})
+			return ctx.Err()
+		}
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			ss.s.conn.SendMsg(&Packet{Type: PACKET_FIN})
+			return ctx.Err()
+		}
+		paths, all, err := cs.take()
+		if err != nil {
+			ss.s.conn.SendMsg(&Packet{Type: PACKET_ERR, Data: []byte(err.Error())})
+			return err
+		}
+		if !all && len(paths) == 0 {
+			continue
+		}
+		if err := ss.s.conn.SendMsg(&Packet{Type: PACKET_WATCH, Data: encodeWatchPaths(paths)}); err != nil {
+			return err
+		}
+
+		opt := ss.opt
+		opt.TreeDigest = ""
+		if !all {
+			var wo WalkOpt
+			if opt.WalkOpt != nil {
+				wo = *opt.WalkOpt
+			}
+			if wo.Filter != nil {
+				wo.Filter = Chain(wo.Filter, changedFilter(paths))
+			} else {
+				wo.Filter = changedFilter(paths)
+			}
+			opt.WalkOpt = &wo
+		}
+		s := newSender(ss.s.conn, NewFS(ss.root, opt.WalkOpt), opt, ss.s.stats)
+		s.ctx = ss.s.ctx
+		s.cancel = ss.s.cancel
+		s.hs = ss.s.hs
+		if err := s.run(); err != nil {
+			return err
+		}
+	}
+}
+
+// watch applies the transfers started by a watching sender after the initial
+// one.
+func (rs *ReceiveSession) watch(ctx context.Context) error {
+	if rs.opt.Watch.Synced != nil {
+		rs.opt.Watch.Synced(nil)
+	}
+	for {
+		paths, ok, err := rs.r.nextRound(ctx)
+		if err != nil || !ok {
+			return err
+		}
+		if err := rs.r.run(ctx); err != nil {
+			return err
+		}
+		if rs.opt.Watch.Synced != nil {
+			if paths == nil {
+				paths = []string{}
+			}
+			rs.opt.Watch.Synced(paths)
+		}
+	}
+}
+
+// nextRound waits for the sender to start another transfer and prepares the
+// receiver for it. It returns false if the sender ended the session.
+func (r *receiver) nextRound(ctx context.Context) ([]string, bool, error) {
+	s := r.peers[0]
+	ch := make(chan error, 1)
+	var p Packet
+	go func() {
+		ch <- s.conn.RecvMsg(&p)
+	}()
+	select {
+	case err := <-ch:
+		if err != nil {
+			if err == io.EOF {
+				return nil, false, nil
+			}
+			return nil, false, err
+		}
+	case <-r.shutdown:
+		return nil, false, ErrShutdown
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+	r.updateProgress(p.Size(), false)
+
+	switch p.Type {
+	case PACKET_FIN:
+		return nil, false, nil
+	case PACKET_ERR:
+		return nil, false, errors.Errorf("error from sender: %s", p.Data)
+	case PACKET_WATCH:
+	default:
+		return nil, false, errors.Errorf("unexpected packet %s while watching", p.Type)
+	}
+
+	paths := decodeWatchPaths(p.Data)
+	r.watchPaths = paths
+	r.treeDigest = ""
+	r.digestChecked = nil
+	s.walkChan = make(chan *currentPath, 128)
+	s.mu.Lock()
+	s.files = make(map[string]uint32)
+	s.mu.Unlock()
+	if s.filter != nil {
+		s.filter = newStatFilter(s.filter.f)
+	}
+	if s.validator != nil {
+		s.validator = &Validator{}
+	}
+	return paths, true, nil
+}
+
+// destWalkerFn returns the walker for the entries of the destination that
+// are compared with the ones received.
+func (r *receiver) destWalkerFn() walkerFn {
+	root := r.compareRoot()
+	var filters []Filter
+	if r.watchPaths != nil {
+		filters = append(filters, changedFilter(r.watchPaths))
+	}
+	if r.protect != nil {
+		filters = append(filters, r.protect)
+	}
+	if len(filters) == 0 {
+		return GetWalkerFn(root)
+	}
+	return walkerFnWithOpt(root, &WalkOpt{Filter: Chain(filters...)})
+}
+
+// compareRoot returns the tree the received entries are compared with, the
+// parent of the layer written or the destination.
+func (r *receiver) compareRoot() string {
+	if r.diskWriterOpt != nil && r.diskWriterOpt.Layer != nil {
+		return r.diskWriterOpt.Layer.Parent
+	}
+	return r.dest
+}
@@ -0,0 +1,140 @@
+package fsutil
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const watchMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MODIFY | unix.IN_CLOSE_WRITE |
+	unix.IN_ATTRIB | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_ONLYDIR
+
+// inotifyWatcher records the changes under a directory in a changeSet using
+// inotify. Every directory of the tree is watched separately.
+type inotifyWatcher struct {
+	root string
+	cs   *changeSet
+	f    *os.File
+
+	mu  sync.Mutex
+	wds map[int]string
+}
+
+func newWatcher(root string, cs *changeSet) (io.Closer, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize inotify")
+	}
+	w := &inotifyWatcher{
+		root: root,
+		cs:   cs,
+		// the non-blocking descriptor makes reads interruptible by Close
+		f:   os.NewFile(uintptr(fd), "inotify"),
+		wds: make(map[int]string),
+	}
+	if err := w.addTree(""); err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// addTree watches the directory at the path p relative to the root and all
+// directories under it.
+func (w *inotifyWatcher) addTree(p string) error {
+	return filepath.Walk(filepath.Join(w.root, p), func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if isNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(w.root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			rel = ""
+		}
+		wd, err := unix.InotifyAddWatch(int(w.f.Fd()), path, watchMask)
+		if err != nil {
+			if err == unix.ENOENT || err == unix.ENOTDIR {
+				return nil
+			}
+			return errors.Wrapf(err, "failed to watch %s", path)
+		}
+		w.mu.Lock()
+		w.wds[wd] = rel
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) run() {
+	buf := make([]byte, 64*unix.SizeofInotifyEvent+64*unix.NAME_MAX)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			if errors.Cause(err) != os.ErrClosed && !isClosedFileErr(err) {
+				w.cs.fail(errors.Wrap(err, "failed to read inotify events"))
+			}
+			return
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(ev.Len)]
+			off += unix.SizeofInotifyEvent + int(ev.Len)
+			if err := w.handle(ev, string(bytes.TrimRight(name, "\x00"))); err != nil {
+				w.cs.fail(err)
+				return
+			}
+		}
+	}
+}
+
+func (w *inotifyWatcher) handle(ev *unix.InotifyEvent, name string) error {
+	if ev.Mask&unix.IN_Q_OVERFLOW != 0 {
+		w.cs.add("")
+		return nil
+	}
+	w.mu.Lock()
+	dir, ok := w.wds[int(ev.Wd)]
+	if ev.Mask&unix.IN_IGNORED != 0 {
+		delete(w.wds, int(ev.Wd))
+	}
+	w.mu.Unlock()
+	if !ok || name == "" {
+		// changes of the watched directories themselves are reported by
+		// their parents
+		return nil
+	}
+	p := filepath.Join(dir, name)
+	if ev.Mask&unix.IN_ISDIR != 0 && ev.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+		if err := w.addTree(p); err != nil {
+			return err
+		}
+	}
+	w.cs.add(p)
+	return nil
+}
+
+func isClosedFileErr(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err == os.ErrClosed
+	}
+	return false
+}
+
+func (w *inotifyWatcher) Close() error {
+	return w.f.Close()
+}
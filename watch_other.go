@@ -0,0 +1,13 @@
+// +build !linux
+
+package fsutil
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+func newWatcher(root string, cs *changeSet) (io.Closer, error) {
+	return nil, errors.New("watching is only supported on linux")
+}
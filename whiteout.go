@@ -0,0 +1,240 @@
+package fsutil
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// WhiteoutFormat defines how a DiskWriter writing a layer records deleted
+// entries and opaque directories.
+type WhiteoutFormat int
+
+const (
+	// WhiteoutOCI records a deleted entry as an empty file named .wh.<name>
+	// next to it and marks opaque directories with a .wh..wh..opq file, like
+	// the layers of OCI images.
+	WhiteoutOCI WhiteoutFormat = iota
+	// WhiteoutOverlay records a deleted entry as a character device with the
+	// device number 0/0 and marks opaque directories with the
+	// trusted.overlay.opaque xattr, so the layer can be mounted as an upper
+	// directory of overlayfs. Creating them needs CAP_MKNOD and
+	// CAP_SYS_ADMIN.
+	WhiteoutOverlay
+)
+
+const (
+	whiteoutPrefix    = ".wh."
+	whiteoutOpaqueDir = whiteoutPrefix + whiteoutPrefix + ".opq"
+	overlayOpaqueAttr = "trusted.overlay.opaque"
+)
+
+// LayerOpt makes a DiskWriter write the changes to the Parent tree into an
+// empty directory instead of applying them, so the directory can be mounted
+// on top of the parent as an image layer.
+type LayerOpt struct {
+	// Parent is the tree the changes were computed against. The unchanged
+	// directories of it that entries are added to or removed from are
+	// created in the layer with the same metadata. Receive compares the
+	// received tree with it instead of the destination.
+	Parent string
+	// Whiteouts is the format deleted entries are recorded in. A directory
+	// added at a path deleted earlier is marked opaque so the entries of
+	// the parent below it are hidden.
+	Whiteouts WhiteoutFormat
+}
+
+// prepareLayerEntry is called before the entry at p is written to the layer.
+// It creates the parent directories and removes a whiteout left for p. The
+// returned bool is true if a whiteout was removed.
+func (dw *DiskWriter) prepareLayerEntry(p string) (bool, error) {
+	if err := dw.layerParents(p); err != nil {
+		return false, err
+	}
+	destPath := filepath.Join(dw.dest, p)
+	switch dw.opt.Layer.Whiteouts {
+	case WhiteoutOCI:
+		wh := filepath.Join(filepath.Dir(destPath), whiteoutPrefix+filepath.Base(destPath))
+		if err := os.Remove(wh); err != nil {
+			if os.IsNotExist(err) {
+				return false, nil
+			}
+			return false, errors.Wrapf(err, "failed to remove whiteout %s", wh)
+		}
+		return true, nil
+	case WhiteoutOverlay:
+		fi, err := os.Lstat(destPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return false, nil
+			}
+			return false, errors.Wrapf(err, "failed to stat %s", destPath)
+		}
+		if !isOverlayWhiteout(fi) {
+			return false, nil
+		}
+		if err := os.Remove(destPath); err != nil {
+			return false, errors.Wrapf(err, "failed to remove whiteout %s", destPath)
+		}
+		return true, nil
+	}
+	return false, errors.Errorf("invalid whiteout format %d", dw.opt.Layer.Whiteouts)
+}
+
+// whiteout records the deletion of p in the layer, replacing the entry if it
+// was written before.
+func (dw *DiskWriter) whiteout(p string) error {
+	if _, err := dw.prepareLayerEntry(p); err != nil {
+		return err
+	}
+	destPath := filepath.Join(dw.dest, p)
+	if err := os.RemoveAll(destPath); err != nil {
+		return errors.Wrapf(err, "failed to remove: %s", destPath)
+	}
+	if dw.opt.Layer.Whiteouts == WhiteoutOverlay {
+		return errors.Wrapf(handleTarTypeBlockCharFifo(destPath, &Stat{Mode: uint32(os.ModeDevice | os.ModeCharDevice)}), "failed to create whiteout %s", destPath)
+	}
+	wh := filepath.Join(filepath.Dir(destPath), whiteoutPrefix+filepath.Base(destPath))
+	f, err := os.OpenFile(wh, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create whiteout %s", wh)
+	}
+	return errors.Wrapf(f.Close(), "failed to close %s", wh)
+}
+
+// markOpaque hides the entries of the parent below the directory p.
+func (dw *DiskWriter) markOpaque(p string) error {
+	destPath := filepath.Join(dw.dest, p)
+	if dw.opt.Layer.Whiteouts == WhiteoutOverlay {
+		return setOverlayOpaque(destPath)
+	}
+	opq := filepath.Join(destPath, whiteoutOpaqueDir)
+	f, err := os.OpenFile(opq, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %s", opq)
+	}
+	return errors.Wrapf(f.Close(), "failed to close %s", opq)
+}
+
+// layerParents creates the directories p is in that are missing from the
+// layer as copies of the ones in the parent.
+func (dw *DiskWriter) layerParents(p string) error {
+	dir := filepath.Dir(p)
+	if dir == "." {
+		return nil
+	}
+	fi, err := os.Lstat(filepath.Join(dw.dest, dir))
+	if err == nil {
+		if !fi.IsDir() {
+			return errors.WithStack(&ValidationError{Path: p, Reason: "parent " + dir + " is not a directory"})
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to stat %s", dir)
+	}
+	if err := dw.layerParents(dir); err != nil {
+		return err
+	}
+	stat, fi, err := dw.parentStat(dir)
+	if err != nil {
+		if isNotExist(err) {
+			// creating the entry fails
+			return nil
+		}
+		return err
+	}
+	if !fi.IsDir() {
+		return errors.WithStack(&ValidationError{Path: p, Reason: "parent " + dir + " is not a directory"})
+	}
+	destPath := filepath.Join(dw.dest, dir)
+	if err := os.Mkdir(destPath, fi.Mode()); err != nil {
+		return errors.Wrapf(err, "failed to create dir %s", destPath)
+	}
+	if err := rewriteMetadata(destPath, stat, nil); err != nil {
+		return errors.Wrapf(err, "error setting dir metadata for %s", destPath)
+	}
+	dw.setDirTime(destPath, stat.ModTime)
+	return nil
+}
+
+// copyUp copies the file at p from the parent into the layer so a hardlink
+// to it can be created.
+func (dw *DiskWriter) copyUp(p string) error {
+	if _, err := os.Lstat(filepath.Join(dw.dest, p)); !os.IsNotExist(err) {
+		return err
+	}
+	if err := dw.layerParents(p); err != nil {
+		return err
+	}
+	stat, fi, err := dw.parentStat(p)
+	if err != nil {
+		return err
+	}
+	src := filepath.Join(dw.opt.Layer.Parent, p)
+	destPath := filepath.Join(dw.dest, p)
+	if err := dw.keepDirTime(filepath.Dir(destPath)); err != nil {
+		return err
+	}
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		if err := os.Symlink(stat.Linkname, destPath); err != nil {
+			return errors.Wrapf(err, "failed to symlink %s", destPath)
+		}
+	case fi.Mode().IsRegular():
+		if err := copyFileContents(src, destPath, fi.Mode()); err != nil {
+			return err
+		}
+	default:
+		if err := handleTarTypeBlockCharFifo(destPath, stat); err != nil {
+			return errors.Wrapf(err, "failed to create device %s", destPath)
+		}
+	}
+	return errors.Wrapf(rewriteMetadata(destPath, stat, nil), "error setting metadata for %s", destPath)
+}
+
+// parentStat returns the stat of the entry at p in the parent.
+func (dw *DiskWriter) parentStat(p string) (*Stat, os.FileInfo, error) {
+	src := filepath.Join(dw.opt.Layer.Parent, p)
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to stat %s", src)
+	}
+	stat := &Stat{Path: p, Mode: uint32(fi.Mode()), ModTime: fi.ModTime().UnixNano()}
+	setUnixOpt(fi, stat, p, make(map[inode]string))
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if stat.Linkname, err = os.Readlink(src); err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to readlink %s", src)
+		}
+	}
+	if err := loadXattr(src, stat); err != nil {
+		return nil, nil, err
+	}
+	return stat, fi, nil
+}
+
+func copyFileContents(src, dest string, mode os.FileMode) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", src)
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_EXCL, mode)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %s", dest)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return errors.Wrapf(err, "failed to copy %s", src)
+	}
+	return errors.Wrapf(w.Close(), "failed to close %s", dest)
+}
+
+// isWhiteoutName returns true if the last element of p is reserved for the
+// OCI whiteouts.
+func isWhiteoutName(p string) bool {
+	return strings.HasPrefix(filepath.Base(p), whiteoutPrefix)
+}